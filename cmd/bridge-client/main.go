@@ -0,0 +1,73 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// bridge-client is a CNI plugin which forwards the request it receives
+// to a bridge plugin running as a daemon (`bridge -daemon <socket>`),
+// saving the cost of starting a new bridge process for every container.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+const defaultSocketPath = "/run/cni/bridge.sock"
+
+type NetConf struct {
+	types.NetConf
+	DaemonSocket string `json:"daemonSocket"`
+}
+
+func run() error {
+	req, err := skel.RequestFromEnv(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	n := &NetConf{DaemonSocket: defaultSocketPath}
+	if err = json.Unmarshal(req.StdinData, n); err != nil {
+		return fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	resp, err := skel.SendRequest(n.DaemonSocket, req)
+	if err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	if len(resp.Result) > 0 {
+		_, err = os.Stdout.Write(resp.Result)
+	}
+	return err
+}
+
+func main() {
+	if err := run(); err != nil {
+		e, ok := err.(*types.Error)
+		if !ok {
+			e = &types.Error{Code: 100, Msg: err.Error()}
+		}
+		if err := e.Print(); err != nil {
+			log.Print("Error writing error JSON to stdout: ", err)
+		}
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// cni-crd-sync keeps the CNI config directory of a node in sync with the
+// CNINetwork custom resources of its cluster: the spec of each resource
+// is written to the directory as a network config, and removed again when
+// the resource is deleted. Where the custom resource definition is not
+// installed it can fall back to the configs in a ConfigMap.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	EnvNetDir     = "NETCONFPATH"
+	DefaultNetDir = "/etc/cni/net.d"
+
+	networksPath = "/apis/cni.containernetworking.org/v1/cninetworks"
+)
+
+// network is a CNINetwork custom resource. Its spec is a network config,
+// with the same fields as the config files.
+type network struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec json.RawMessage `json:"spec"`
+}
+
+type networkList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []network `json:"items"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type configMap struct {
+	Data map[string]string `json:"data"`
+}
+
+// conf returns the network config of the resource, which is named after
+// the resource unless the spec sets a name
+func (n *network) conf() ([]byte, error) {
+	conf := map[string]interface{}{}
+	if err := json.Unmarshal(n.Spec, &conf); err != nil {
+		return nil, fmt.Errorf("invalid spec for %q: %v", n.Metadata.Name, err)
+	}
+	if _, ok := conf["name"]; !ok {
+		conf["name"] = n.Metadata.Name
+	}
+	return json.Marshal(conf)
+}
+
+type daemon struct {
+	client *client
+	syncer *syncer
+
+	// configMapFallback makes the daemon use the ConfigMap if the
+	// CNINetwork resource type does not exist
+	configMapFallback bool
+	configMapPath     string
+}
+
+// run lists the networks, writes their configs and then watches them for
+// changes until the watch ends
+func (d *daemon) run() error {
+	list := &networkList{}
+	err := d.client.getJSON(networksPath, list)
+	if err == errNotFound {
+		if !d.configMapFallback {
+			return fmt.Errorf("the CNINetwork resource type is not installed")
+		}
+		return d.syncConfigMap()
+	}
+	if err != nil {
+		return err
+	}
+
+	confs := make(map[string][]byte, len(list.Items))
+	for i := range list.Items {
+		n := &list.Items[i]
+		conf, err := n.conf()
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+		confs[n.Metadata.Name] = conf
+	}
+	if err = d.syncer.replace(confs); err != nil {
+		return err
+	}
+
+	return d.watch(list.Metadata.ResourceVersion)
+}
+
+// watch applies the changes to the networks after resourceVersion
+func (d *daemon) watch(resourceVersion string) error {
+	resp, err := d.client.get(networksPath + "?watch=true&resourceVersion=" + resourceVersion)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		ev := &watchEvent{}
+		if err := dec.Decode(ev); err != nil {
+			// the API server ends watches after a while
+			return nil
+		}
+
+		n := &network{}
+		if err := json.Unmarshal(ev.Object, n); err != nil {
+			log.Printf("failed to decode %s event: %v", ev.Type, err)
+			continue
+		}
+
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			conf, err := n.conf()
+			if err == nil {
+				err = d.syncer.write(n.Metadata.Name, conf)
+			}
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		case "DELETED":
+			if err := d.syncer.remove(n.Metadata.Name); err != nil {
+				log.Printf("%v", err)
+			}
+		case "ERROR":
+			// e.g. the resource version is too old, list again
+			return fmt.Errorf("watch failed: %s", ev.Object)
+		}
+	}
+}
+
+// syncConfigMap writes the configs of the ConfigMap, whose keys are the
+// network names, optionally with a .conf suffix
+func (d *daemon) syncConfigMap() error {
+	cm := &configMap{}
+	if err := d.client.getJSON(d.configMapPath, cm); err != nil {
+		return fmt.Errorf("failed to get the fallback ConfigMap: %v", err)
+	}
+
+	confs := make(map[string][]byte, len(cm.Data))
+	for key, conf := range cm.Data {
+		confs[strings.TrimSuffix(key, ".conf")] = []byte(conf)
+	}
+	return d.syncer.replace(confs)
+}
+
+func main() {
+	fallback := flag.Bool("configmap-fallback", false, "use the configs of a ConfigMap if the CNINetwork resource type is not installed")
+	cmNamespace := flag.String("configmap-namespace", "kube-system", "namespace of the fallback ConfigMap")
+	cmName := flag.String("configmap-name", "cni-networks", "name of the fallback ConfigMap")
+	resync := flag.Duration("resync", time.Minute, "interval between listing the networks again")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 0 {
+		usage()
+	}
+
+	netdir := os.Getenv(EnvNetDir)
+	if netdir == "" {
+		netdir = DefaultNetDir
+	}
+
+	c, err := newInClusterClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	d := &daemon{
+		client:            c,
+		syncer:            &syncer{dir: netdir},
+		configMapFallback: *fallback,
+		configMapPath:     fmt.Sprintf("/api/v1/namespaces/%s/configmaps/%s", *cmNamespace, *cmName),
+	}
+	for {
+		if err := d.run(); err != nil {
+			log.Printf("%v", err)
+		}
+		time.Sleep(*resync)
+	}
+}
+
+func usage() {
+	exe := filepath.Base(os.Args[0])
+
+	fmt.Fprintf(os.Stderr, "%s: Write the CNINetwork resources of the cluster to the CNI config directory\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s [-configmap-fallback] [-configmap-namespace <ns>] [-configmap-name <name>] [-resync <interval>]\n", exe)
+	os.Exit(1)
+}
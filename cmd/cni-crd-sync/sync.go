@@ -0,0 +1,110 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// filePrefix marks the config files written by cni-crd-sync, so that
+// files written by hand are never deleted
+const filePrefix = "crd-"
+
+// syncer writes network configs to the CNI config directory
+type syncer struct {
+	dir string
+}
+
+func (s *syncer) path(name string) string {
+	return filepath.Join(s.dir, filePrefix+name+".conf")
+}
+
+// write writes the config of the network name, if it is valid
+func (s *syncer) write(name string, conf []byte) error {
+	n := &types.NetConf{}
+	if err := json.Unmarshal(conf, n); err != nil {
+		return fmt.Errorf("invalid config for %q: %v", name, err)
+	}
+	if n.Name == "" || n.Type == "" {
+		return fmt.Errorf("invalid config for %q: name and type must be set", name)
+	}
+
+	// write to a temporary file first, so that runtimes never load a
+	// partial config
+	tmp, err := ioutil.TempFile(s.dir, ".crd-sync")
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary file in %q: %v", s.dir, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(conf)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write the config for %q: %v", name, err)
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), s.path(name)); err != nil {
+		return fmt.Errorf("failed to write the config for %q: %v", name, err)
+	}
+	return nil
+}
+
+// remove deletes the config of the network name, if there is one
+func (s *syncer) remove(name string) error {
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove the config for %q: %v", name, err)
+	}
+	return nil
+}
+
+// replace makes the configs written by cni-crd-sync those in confs,
+// keyed by network name. Errors for single networks are logged so that
+// one broken network does not hold up the others.
+func (s *syncer) replace(confs map[string][]byte) error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %v", s.dir, err)
+	}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, ".conf") {
+			continue
+		}
+		name = strings.TrimSuffix(strings.TrimPrefix(name, filePrefix), ".conf")
+		if _, ok := confs[name]; !ok {
+			if err := s.remove(name); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+	}
+
+	for name, conf := range confs {
+		if err := s.write(name, conf); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("syncer", func() {
+	var s *syncer
+
+	BeforeEach(func() {
+		dir, err := ioutil.TempDir("", "cni-crd-sync")
+		Expect(err).NotTo(HaveOccurred())
+		s = &syncer{dir: dir}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(s.dir)).To(Succeed())
+	})
+
+	files := func() []string {
+		infos, err := ioutil.ReadDir(s.dir)
+		Expect(err).NotTo(HaveOccurred())
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		return names
+	}
+
+	It("writes valid configs only", func() {
+		conf := []byte(`{"name": "mynet", "type": "bridge"}`)
+		Expect(s.write("mynet", conf)).To(Succeed())
+		Expect(ioutil.ReadFile(filepath.Join(s.dir, "crd-mynet.conf"))).To(Equal(conf))
+
+		Expect(s.write("broken", []byte(`{"name": "broken"}`))).To(MatchError(`invalid config for "broken": name and type must be set`))
+		Expect(s.write("broken", []byte(`{`))).To(HaveOccurred())
+		Expect(files()).To(ConsistOf("crd-mynet.conf"))
+	})
+
+	It("removes configs, tolerating missing ones", func() {
+		Expect(s.write("mynet", []byte(`{"name": "mynet", "type": "bridge"}`))).To(Succeed())
+		Expect(s.remove("mynet")).To(Succeed())
+		Expect(s.remove("mynet")).To(Succeed())
+		Expect(files()).To(BeEmpty())
+	})
+
+	It("replaces its own configs and leaves the others alone", func() {
+		Expect(ioutil.WriteFile(filepath.Join(s.dir, "10-manual.conf"), []byte(`{}`), 0644)).To(Succeed())
+		Expect(s.write("old", []byte(`{"name": "old", "type": "bridge"}`))).To(Succeed())
+		Expect(s.write("kept", []byte(`{"name": "kept", "type": "bridge"}`))).To(Succeed())
+
+		Expect(s.replace(map[string][]byte{
+			"kept":   []byte(`{"name": "kept", "type": "ptp"}`),
+			"new":    []byte(`{"name": "new", "type": "bridge"}`),
+			"broken": []byte(`{"name": "broken"}`),
+		})).To(Succeed())
+
+		Expect(files()).To(ConsistOf("10-manual.conf", "crd-kept.conf", "crd-new.conf"))
+		Expect(ioutil.ReadFile(filepath.Join(s.dir, "crd-kept.conf"))).To(MatchJSON(`{"name": "kept", "type": "ptp"}`))
+	})
+})
+
+var _ = Describe("network", func() {
+	It("names the config after the resource unless the spec does", func() {
+		n := &network{Spec: []byte(`{"type": "bridge"}`)}
+		n.Metadata.Name = "mynet"
+		Expect(n.conf()).To(MatchJSON(`{"name": "mynet", "type": "bridge"}`))
+
+		n.Spec = []byte(`{"name": "other", "type": "bridge"}`)
+		Expect(n.conf()).To(MatchJSON(`{"name": "other", "type": "bridge"}`))
+
+		n.Spec = []byte(`[]`)
+		_, err := n.conf()
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,374 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// cni-reconcile compares the allocations of a bridge network using
+// host-local IPAM with the veths and masquerade rules actually present
+// on the host, and optionally repairs the differences.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/utils"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	EnvCNIPath = "CNI_PATH"
+	EnvNetDir  = "NETCONFPATH"
+
+	DefaultNetDir = "/etc/cni/net.d"
+
+	defaultBrName = "cni0"
+)
+
+const (
+	// an IP is allocated but no container on the bridge has it
+	MissingVeth = "missingVeth"
+	// a container on the bridge has an IP of the network that is not
+	// allocated
+	ExtraVeth = "extraVeth"
+	// an IP is allocated but its masquerade chain is missing
+	MissingMasq = "missingMasquerade"
+)
+
+// divergenceKinds are the kinds of divergence -repair accepts
+var divergenceKinds = []string{MissingVeth, ExtraVeth, MissingMasq}
+
+// parseRepairKinds parses the comma separated kinds of divergence to
+// repair
+func parseRepairKinds(list string) (map[string]bool, error) {
+	kinds := make(map[string]bool)
+	if list == "" {
+		return kinds, nil
+	}
+	for _, kind := range strings.Split(list, ",") {
+		known := false
+		for _, k := range divergenceKinds {
+			if k == kind {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown divergence kind %q, must be one of %s", kind, strings.Join(divergenceKinds, ", "))
+		}
+		kinds[kind] = true
+	}
+	return kinds, nil
+}
+
+// Divergence is a difference between expected and actual state
+type Divergence struct {
+	Kind        string `json:"kind"`
+	ContainerID string `json:"containerID,omitempty"`
+	IP          string `json:"ip,omitempty"`
+	NetNS       string `json:"netns,omitempty"`
+	HostVeth    string `json:"hostVeth,omitempty"`
+	Repaired    bool   `json:"repaired"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Report is printed to stdout
+type Report struct {
+	Network     string       `json:"network"`
+	Bridge      string       `json:"bridge"`
+	Divergences []Divergence `json:"divergences"`
+}
+
+type netConf struct {
+	types.NetConf
+	BrName string `json:"bridge"`
+	IPMasq bool   `json:"ipMasq"`
+	IPAM   struct {
+		Type    string      `json:"type"`
+		Subnet  types.IPNet `json:"subnet"`
+		Ranges  []ipamRange `json:"ranges"`
+		DataDir string      `json:"dataDir"`
+	} `json:"ipam"`
+}
+
+// ipamRange is a range of the host-local config, of which only the
+// subnet matters here
+type ipamRange struct {
+	Subnet types.IPNet `json:"subnet"`
+}
+
+// loadNetConf parses the config of a bridge network using host-local,
+// with its subnet in either "subnet" or "ranges" as host-local accepts
+func loadNetConf(bytes []byte) (*netConf, error) {
+	n := &netConf{BrName: defaultBrName}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	if n.Type != "bridge" || n.IPAM.Type != "host-local" {
+		return nil, fmt.Errorf("only bridge networks using host-local IPAM can be reconciled")
+	}
+	if len(n.IPAM.Ranges) > 0 && n.IPAM.Subnet.IP != nil {
+		return nil, fmt.Errorf("ranges cannot be combined with subnet")
+	}
+	for i, r := range n.IPAM.Ranges {
+		if r.Subnet.IP == nil {
+			return nil, fmt.Errorf("missing field %q in range %d", "subnet", i)
+		}
+	}
+	return n, nil
+}
+
+// dataDir returns the directory host-local keeps the allocations of all
+// networks in
+func (n *netConf) dataDir() string {
+	if n.IPAM.DataDir != "" {
+		return n.IPAM.DataDir
+	}
+	return defaultDataDir
+}
+
+// contains reports whether addr is in a subnet of the network
+func (n *netConf) contains(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	_, err := n.subnetOf(ip)
+	return err == nil
+}
+
+// subnetOf returns the subnet of the network containing addr, from
+// "ranges" or "subnet"
+func (n *netConf) subnetOf(addr net.IP) (*net.IPNet, error) {
+	subnets := []types.IPNet{n.IPAM.Subnet}
+	if len(n.IPAM.Ranges) > 0 {
+		subnets = nil
+		for _, r := range n.IPAM.Ranges {
+			subnets = append(subnets, r.Subnet)
+		}
+	}
+	for _, s := range subnets {
+		ipn := net.IPNet(s)
+		if ipn.IP != nil && ipn.Contains(addr) {
+			return &net.IPNet{IP: addr, Mask: ipn.Mask}, nil
+		}
+	}
+	return nil, fmt.Errorf("no subnet of network %q contains %v", n.Name, addr)
+}
+
+func init() {
+	// namespace switching requires a single OS thread
+	runtime.LockOSThread()
+}
+
+func main() {
+	repair := flag.String("repair", "", "comma separated kinds of divergence to repair: "+strings.Join(divergenceKinds, ", "))
+	ifName := flag.String("ifname", "eth0", "container interface name of the network, for the DEL of a missing veth")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+	}
+
+	repairKinds, err := parseRepairKinds(*repair)
+	if err != nil {
+		exit(err)
+	}
+
+	netdir := os.Getenv(EnvNetDir)
+	if netdir == "" {
+		netdir = DefaultNetDir
+	}
+	netconf, err := libcni.LoadConf(netdir, flag.Arg(0))
+	if err != nil {
+		exit(err)
+	}
+
+	n, err := loadNetConf(netconf.Bytes)
+	if err != nil {
+		exit(err)
+	}
+
+	report, err := reconcile(n)
+	if err != nil {
+		exit(err)
+	}
+
+	if len(repairKinds) > 0 {
+		cninet := &libcni.CNIConfig{
+			Path: strings.Split(os.Getenv(EnvCNIPath), ":"),
+		}
+		for i := range report.Divergences {
+			d := &report.Divergences[i]
+			if !repairKinds[d.Kind] {
+				continue
+			}
+			if err := repairDivergence(cninet, netconf, n, *ifName, d); err != nil {
+				d.Error = err.Error()
+			} else {
+				d.Repaired = true
+			}
+		}
+	}
+
+	out, err := json.MarshalIndent(report, "", "    ")
+	if err != nil {
+		exit(err)
+	}
+	fmt.Println(string(out))
+}
+
+// reconcile lists the divergences between the allocations of the network
+// and the state of the host
+func reconcile(n *netConf) (*Report, error) {
+	allocated, err := allocations(n.dataDir(), n.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read allocations: %v", err)
+	}
+
+	ports, err := bridgePorts(n.BrName)
+	if err != nil {
+		return nil, err
+	}
+
+	hasMasq := func(string) bool { return true }
+	if n.IPMasq {
+		ipt, err := iptables.New()
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate iptables: %v", err)
+		}
+		hasMasq = func(id string) bool {
+			// listing fails if the chain does not exist
+			_, err := ipt.List("nat", utils.FormatChainName(n.Name, id))
+			return err == nil
+		}
+	}
+
+	return &Report{
+		Network:     n.Name,
+		Bridge:      n.BrName,
+		Divergences: classify(allocated, containerVeths(ports), n.contains, hasMasq),
+	}, nil
+}
+
+// classify compares the allocated IPs, mapped to the ID of the container
+// holding them, with the container veths found on the bridge. inNetwork
+// reports whether an IP is in a subnet of the network, hasMasq whether
+// the masquerade chain of a container exists.
+//
+// A veth is only extra when it has IPs of the network and none of them
+// is allocated: one without, e.g. while ADD configures it, with static
+// addresses or of another network sharing the bridge, is left alone.
+func classify(allocated map[string]string, veths []containerVeth, inNetwork func(addr string) bool, hasMasq func(containerID string) bool) []Divergence {
+	divergences := []Divergence{}
+
+	present := make(map[string]bool)
+	for _, cv := range veths {
+		var ours []string
+		owned := false
+		for _, addr := range cv.IPs {
+			present[addr] = true
+			if _, ok := allocated[addr]; ok {
+				owned = true
+			}
+			if inNetwork(addr) {
+				ours = append(ours, addr)
+			}
+		}
+		if !owned && len(ours) > 0 {
+			divergences = append(divergences, Divergence{
+				Kind:     ExtraVeth,
+				IP:       strings.Join(ours, ","),
+				NetNS:    cv.NetNS,
+				HostVeth: cv.HostVeth,
+			})
+		}
+	}
+
+	// in a stable order, as the report is meant to be compared
+	addrs := make([]string, 0, len(allocated))
+	for addr := range allocated {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	for _, addr := range addrs {
+		id := allocated[addr]
+		if !present[addr] {
+			divergences = append(divergences, Divergence{
+				Kind:        MissingVeth,
+				ContainerID: id,
+				IP:          addr,
+			})
+		} else if !hasMasq(id) {
+			divergences = append(divergences, Divergence{
+				Kind:        MissingMasq,
+				ContainerID: id,
+				IP:          addr,
+			})
+		}
+	}
+	return divergences
+}
+
+// repairDivergence brings the host back in line with the allocations
+func repairDivergence(cninet *libcni.CNIConfig, netconf *libcni.NetworkConfig, n *netConf, ifName string, d *Divergence) error {
+	switch d.Kind {
+	case MissingVeth:
+		// without a netns the plugin only releases the allocation
+		return cninet.DelNetwork(netconf, &libcni.RuntimeConf{ContainerID: d.ContainerID, IfName: ifName})
+	case ExtraVeth:
+		link, err := netlink.LinkByName(d.HostVeth)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", d.HostVeth, err)
+		}
+		return netlink.LinkDel(link)
+	case MissingMasq:
+		ipn, err := n.subnetOf(net.ParseIP(d.IP))
+		if err != nil {
+			return err
+		}
+		chain := utils.FormatChainName(n.Name, d.ContainerID)
+		comment := utils.FormatComment(n.Name, d.ContainerID)
+		return ip.SetupIPMasq(ip.Network(ipn), chain, comment)
+	}
+	return fmt.Errorf("unknown divergence %q", d.Kind)
+}
+
+func usage() {
+	exe := filepath.Base(os.Args[0])
+
+	fmt.Fprintf(os.Stderr, "%s: Report differences between allocated and configured container networking\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s [-repair <kind>[,<kind>...]] [-ifname <name>] <net>\n", exe)
+	fmt.Fprintf(os.Stderr, "Repairing %s releases the IPs of containers whose network namespace is not\n", MissingVeth)
+	fmt.Fprintf(os.Stderr, "found under /var/run/netns or held by a process, and %s deletes veths.\n", ExtraVeth)
+	os.Exit(1)
+}
+
+func exit(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
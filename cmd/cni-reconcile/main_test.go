@@ -0,0 +1,173 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("netConf", func() {
+	It("reads the host-local dataDir", func() {
+		n, err := loadNetConf([]byte(`{"name": "mynet", "type": "bridge", "ipam": {"type": "host-local", "subnet": "10.1.2.0/24"}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.dataDir()).To(Equal(defaultDataDir))
+		Expect(n.BrName).To(Equal(defaultBrName))
+
+		n, err = loadNetConf([]byte(`{"name": "mynet", "type": "bridge", "ipam": {"type": "host-local", "subnet": "10.1.2.0/24", "dataDir": "/run/cni"}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.dataDir()).To(Equal("/run/cni"))
+	})
+
+	It("only accepts bridge networks using host-local", func() {
+		_, err := loadNetConf([]byte(`{"name": "mynet", "type": "ptp", "ipam": {"type": "host-local", "subnet": "10.1.2.0/24"}}`))
+		Expect(err).To(HaveOccurred())
+		_, err = loadNetConf([]byte(`{"name": "mynet", "type": "bridge", "ipam": {"type": "dhcp"}}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("finds the subnet of an address in subnet or ranges", func() {
+		n, err := loadNetConf([]byte(`{"name": "mynet", "type": "bridge", "ipam": {"type": "host-local", "subnet": "10.1.2.0/24"}}`))
+		Expect(err).NotTo(HaveOccurred())
+		ipn, err := n.subnetOf(net.ParseIP("10.1.2.3"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipn.String()).To(Equal("10.1.2.3/24"))
+
+		n, err = loadNetConf([]byte(`{"name": "mynet", "type": "bridge", "ipam": {"type": "host-local",
+			"ranges": [{"subnet": "10.1.2.0/24"}, {"subnet": "10.1.4.0/22"}]}}`))
+		Expect(err).NotTo(HaveOccurred())
+		ipn, err = n.subnetOf(net.ParseIP("10.1.5.3"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipn.String()).To(Equal("10.1.5.3/22"))
+
+		_, err = n.subnetOf(net.ParseIP("10.1.3.3"))
+		Expect(err).To(MatchError(`no subnet of network "mynet" contains 10.1.3.3`))
+	})
+
+	It("rejects ranges combined with subnet", func() {
+		_, err := loadNetConf([]byte(`{"name": "mynet", "type": "bridge", "ipam": {"type": "host-local",
+			"subnet": "10.1.2.0/24", "ranges": [{"subnet": "10.1.4.0/24"}]}}`))
+		Expect(err).To(MatchError("ranges cannot be combined with subnet"))
+	})
+})
+
+var _ = Describe("classify", func() {
+	var inNetwork func(string) bool
+
+	BeforeEach(func() {
+		n, err := loadNetConf([]byte(`{"name": "mynet", "type": "bridge", "ipam": {"type": "host-local",
+			"ranges": [{"subnet": "10.1.2.0/24"}, {"subnet": "fd00:1::/64"}]}}`))
+		Expect(err).NotTo(HaveOccurred())
+		inNetwork = n.contains
+	})
+
+	hasMasq := func(ids ...string) func(string) bool {
+		return func(id string) bool {
+			for _, i := range ids {
+				if i == id {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	It("finds nothing when the host matches the allocations", func() {
+		divergences := classify(
+			map[string]string{"10.1.2.3": "c1"},
+			[]containerVeth{{NetNS: "/var/run/netns/c1", HostVeth: "veth1", IPs: []string{"10.1.2.3"}}},
+			inNetwork,
+			hasMasq("c1"),
+		)
+		Expect(divergences).To(BeEmpty())
+	})
+
+	It("classifies missing veths, extra veths and missing masquerade chains", func() {
+		divergences := classify(
+			map[string]string{
+				"10.1.2.3": "c1",
+				"10.1.2.4": "c2",
+				"10.1.2.5": "c3",
+			},
+			[]containerVeth{
+				{NetNS: "/var/run/netns/c1", HostVeth: "veth1", IPs: []string{"10.1.2.3"}},
+				{NetNS: "/var/run/netns/c3", HostVeth: "veth3", IPs: []string{"10.1.2.5"}},
+				{NetNS: "/var/run/netns/x", HostVeth: "veth9", IPs: []string{"10.1.2.9", "10.1.2.10"}},
+			},
+			inNetwork,
+			hasMasq("c1"),
+		)
+		Expect(divergences).To(Equal([]Divergence{
+			{Kind: ExtraVeth, IP: "10.1.2.9,10.1.2.10", NetNS: "/var/run/netns/x", HostVeth: "veth9"},
+			{Kind: MissingVeth, ContainerID: "c2", IP: "10.1.2.4"},
+			{Kind: MissingMasq, ContainerID: "c3", IP: "10.1.2.5"},
+		}))
+	})
+
+	It("does not report a veth holding any allocated IP as extra", func() {
+		divergences := classify(
+			map[string]string{"10.1.2.3": "c1"},
+			[]containerVeth{{HostVeth: "veth1", IPs: []string{"10.1.2.3", "10.1.2.99"}}},
+			inNetwork,
+			hasMasq("c1"),
+		)
+		Expect(divergences).To(BeEmpty())
+	})
+
+	It("matches IPv6 allocations", func() {
+		divergences := classify(
+			map[string]string{"fd00:1::3": "c1"},
+			[]containerVeth{{HostVeth: "veth1", IPs: []string{"fd00:1::3", "fe80::1"}}},
+			inNetwork,
+			hasMasq("c1"),
+		)
+		Expect(divergences).To(BeEmpty())
+	})
+
+	It("does not report a veth without IPs of the network as extra", func() {
+		divergences := classify(
+			map[string]string{},
+			[]containerVeth{
+				{HostVeth: "veth1"},
+				{HostVeth: "veth2", IPs: []string{"fe80::1"}},
+				{HostVeth: "veth3", IPs: []string{"192.168.0.3"}},
+			},
+			inNetwork,
+			hasMasq(),
+		)
+		Expect(divergences).To(BeEmpty())
+	})
+})
+
+var _ = Describe("parseRepairKinds", func() {
+	It("repairs nothing by default", func() {
+		kinds, err := parseRepairKinds("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kinds).To(BeEmpty())
+	})
+
+	It("parses a list of kinds", func() {
+		kinds, err := parseRepairKinds("missingMasquerade,extraVeth")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kinds).To(Equal(map[string]bool{MissingMasq: true, ExtraVeth: true}))
+	})
+
+	It("rejects an unknown kind", func() {
+		_, err := parseRepairKinds("all")
+		Expect(err).To(MatchError(`unknown divergence kind "all", must be one of missingVeth, extraVeth, missingMasquerade`))
+	})
+})
@@ -0,0 +1,161 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// defaultDataDir is where host-local keeps its allocations
+const defaultDataDir = "/var/lib/cni/networks"
+
+// allocations returns the IPs reserved by host-local for the network,
+// mapped to the ID of the container holding them
+func allocations(dataDir, network string) (map[string]string, error) {
+	dir := filepath.Join(dataDir, network)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]string{}, nil
+		}
+		return nil, err
+	}
+
+	res := make(map[string]string)
+	for _, f := range files {
+		if f.IsDir() || net.ParseIP(f.Name()) == nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		res[f.Name()] = strings.TrimSpace(string(data))
+	}
+	return res, nil
+}
+
+// containerVeth is the container end of a veth pair attached to the bridge
+type containerVeth struct {
+	NetNS    string
+	IfName   string
+	HostVeth string
+	IPs      []string
+}
+
+// bridgePorts returns the links attached to the bridge, keyed by index
+func bridgePorts(brName string) (map[int]netlink.Link, error) {
+	br, err := netlink.LinkByName(brName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", brName, err)
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+
+	ports := make(map[int]netlink.Link)
+	for _, l := range links {
+		if l.Attrs().MasterIndex == br.Attrs().Index {
+			ports[l.Attrs().Index] = l
+		}
+	}
+	return ports, nil
+}
+
+// netnsPaths returns one path for every network namespace in use, other
+// than the one of the calling process
+func netnsPaths() []string {
+	candidates, _ := filepath.Glob("/var/run/netns/*")
+	procs, _ := filepath.Glob("/proc/[0-9]*/ns/net")
+	candidates = append(candidates, procs...)
+
+	seen := make(map[uint64]bool)
+	var self syscall.Stat_t
+	if err := syscall.Stat("/proc/self/ns/net", &self); err == nil {
+		seen[self.Ino] = true
+	}
+
+	var paths []string
+	for _, p := range candidates {
+		var st syscall.Stat_t
+		if err := syscall.Stat(p, &st); err != nil || seen[st.Ino] {
+			continue
+		}
+		seen[st.Ino] = true
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// containerVeths finds the container ends of the veth pairs whose host
+// end is one of ports by looking into every network namespace, with
+// their IPv4 and IPv6 addresses. Ports whose peer is in no namespace
+// found are not returned.
+func containerVeths(ports map[int]netlink.Link) []containerVeth {
+	var res []containerVeth
+	for _, path := range netnsPaths() {
+		netns, err := ns.GetNS(path)
+		if err != nil {
+			continue
+		}
+
+		_ = netns.Do(func(_ ns.NetNS) error {
+			links, err := netlink.LinkList()
+			if err != nil {
+				return err
+			}
+			for _, l := range links {
+				if l.Type() != "veth" {
+					continue
+				}
+				// for a veth, the parent index is the ifindex of its peer
+				hostVeth, ok := ports[l.Attrs().ParentIndex]
+				if !ok {
+					continue
+				}
+
+				// a veth whose addresses cannot be read is left out
+				// rather than reported without any
+				addrs, err := netlink.AddrList(l, netlink.FAMILY_ALL)
+				if err != nil {
+					continue
+				}
+				cv := containerVeth{
+					NetNS:    path,
+					IfName:   l.Attrs().Name,
+					HostVeth: hostVeth.Attrs().Name,
+				}
+				for _, a := range addrs {
+					cv.IPs = append(cv.IPs, a.IP.String())
+				}
+				res = append(res, cv)
+			}
+			return nil
+		})
+		netns.Close()
+	}
+	return res
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("allocations", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "cni-reconcile")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("maps the IPs reserved by host-local to their container", func() {
+		dir := filepath.Join(dataDir, "mynet")
+		Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		for name, content := range map[string]string{
+			"10.1.2.3":         "container1\n",
+			"10.1.2.4":         "container2",
+			"last_reserved_ip": "10.1.2.4",
+			"lock":             "",
+		} {
+			Expect(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)).To(Succeed())
+		}
+
+		allocated, err := allocations(dataDir, "mynet")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(allocated).To(Equal(map[string]string{
+			"10.1.2.3": "container1",
+			"10.1.2.4": "container2",
+		}))
+	})
+
+	It("returns no allocations for a network without any", func() {
+		allocated, err := allocations(dataDir, "mynet")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(allocated).To(BeEmpty())
+	})
+})
@@ -15,6 +15,9 @@
 package libcni
 
 import (
+	"encoding/json"
+	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/containernetworking/cni/pkg/invoke"
@@ -40,6 +43,9 @@ type CNI interface {
 
 type CNIConfig struct {
 	Path []string
+	// CacheDir, if set, is where the results of AddNetwork are kept
+	// for ExportNetworkState
+	CacheDir string
 }
 
 func (c *CNIConfig) AddNetwork(net *NetworkConfig, rt *RuntimeConf) (*types.Result, error) {
@@ -48,7 +54,19 @@ func (c *CNIConfig) AddNetwork(net *NetworkConfig, rt *RuntimeConf) (*types.Resu
 		return nil, err
 	}
 
-	return invoke.ExecPluginWithResult(pluginPath, net.Bytes, c.args("ADD", rt))
+	if err := checkCapabilities(pluginPath, net.Network.Capabilities); err != nil {
+		return nil, err
+	}
+
+	result, err := invoke.ExecPluginWithResult(pluginPath, net.Bytes, c.args("ADD", rt))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.cacheResult(net, rt, result); err != nil {
+		return nil, fmt.Errorf("failed to cache result: %v", err)
+	}
+	return result, nil
 }
 
 func (c *CNIConfig) DelNetwork(net *NetworkConfig, rt *RuntimeConf) error {
@@ -57,17 +75,76 @@ func (c *CNIConfig) DelNetwork(net *NetworkConfig, rt *RuntimeConf) error {
 		return err
 	}
 
-	return invoke.ExecPluginWithoutResult(pluginPath, net.Bytes, c.args("DEL", rt))
+	if err := invoke.ExecPluginWithoutResult(pluginPath, net.Bytes, c.args("DEL", rt)); err != nil {
+		return err
+	}
+
+	return c.uncacheResult(net, rt)
+}
+
+// GetPluginCapabilities asks the plugin at pluginPath which capabilities
+// it supports, such as "portMappings", using the VERSION command
+func GetPluginCapabilities(pluginPath string) ([]string, error) {
+	args := &invoke.Args{Command: "VERSION"}
+	output, err := invoke.ExecPluginWithOutput(pluginPath, []byte("{}"), args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get version info of %s: %v", pluginPath, err)
+	}
+
+	info := struct {
+		Capabilities []string `json:"capabilities"`
+	}{}
+	if err := json.Unmarshal(output, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse version info of %s: %v", pluginPath, err)
+	}
+	return info.Capabilities, nil
+}
+
+// checkCapabilities fails if the plugin does not advertise every
+// capability enabled in required
+func checkCapabilities(pluginPath string, required map[string]bool) error {
+	var wanted []string
+	for capability, enabled := range required {
+		if enabled {
+			wanted = append(wanted, capability)
+		}
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+	sort.Strings(wanted)
+
+	supported, err := GetPluginCapabilities(pluginPath)
+	if err != nil {
+		return err
+	}
+
+	for _, capability := range wanted {
+		found := false
+		for _, s := range supported {
+			if s == capability {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("plugin %s does not support capability %q", pluginPath, capability)
+		}
+	}
+	return nil
 }
 
 // =====
+// args asks plugins for the 0.2.0 result format, which is what AddNetwork
+// returns
 func (c *CNIConfig) args(action string, rt *RuntimeConf) *invoke.Args {
 	return &invoke.Args{
-		Command:     action,
-		ContainerID: rt.ContainerID,
-		NetNS:       rt.NetNS,
-		PluginArgs:  rt.Args,
-		IfName:      rt.IfName,
-		Path:        strings.Join(c.Path, ":"),
+		Command:       action,
+		ContainerID:   rt.ContainerID,
+		NetNS:         rt.NetNS,
+		PluginArgs:    rt.Args,
+		IfName:        rt.IfName,
+		Path:          strings.Join(c.Path, ":"),
+		ResultVersion: "0.2.0",
 	}
 }
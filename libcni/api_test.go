@@ -0,0 +1,107 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package libcni_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/libcni"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// versionPlugin advertises the portMappings capability and records ADDs
+const versionPlugin = `#!/bin/sh
+if [ "$CNI_COMMAND" = "VERSION" ]; then
+	echo '{"cniVersion": "0.2.0", "capabilities": ["portMappings"]}'
+	exit 0
+fi
+touch "$(dirname "$0")/added"
+echo '{"ip4": {"ip": "10.1.2.3/24"}}'
+`
+
+var _ = Describe("plugin capabilities", func() {
+	var (
+		tmpDir string
+		cninet *libcni.CNIConfig
+		rt     *libcni.RuntimeConf
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "libcni")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(tmpDir, "stub"), []byte(versionPlugin), 0755)).To(Succeed())
+
+		cninet = &libcni.CNIConfig{Path: []string{tmpDir}}
+		rt = &libcni.RuntimeConf{
+			ContainerID: "some-container",
+			NetNS:       "/some/netns",
+			IfName:      "eth0",
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("reads the capabilities from the VERSION response", func() {
+		caps, err := libcni.GetPluginCapabilities(filepath.Join(tmpDir, "stub"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(caps).To(Equal([]string{"portMappings"}))
+	})
+
+	It("adds the network when the required capabilities are advertised", func() {
+		netConf, err := libcni.ConfFromBytes([]byte(`{"name": "test", "type": "stub", "capabilities": {"portMappings": true, "bandwidth": false}}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = cninet.AddNetwork(netConf, rt)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(filepath.Join(tmpDir, "added")).To(BeAnExistingFile())
+	})
+
+	It("refuses to add the network when a required capability is missing", func() {
+		netConf, err := libcni.ConfFromBytes([]byte(`{"name": "test", "type": "stub", "capabilities": {"bandwidth": true}}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = cninet.AddNetwork(netConf, rt)
+		Expect(err).To(MatchError(ContainSubstring(`does not support capability "bandwidth"`)))
+		Expect(filepath.Join(tmpDir, "added")).NotTo(BeAnExistingFile())
+	})
+})
+
+var _ = Describe("plugin capabilities of a skel based plugin", func() {
+	It("reads an empty capability list from the VERSION response", func() {
+		caps, err := libcni.GetPluginCapabilities(pathToLoPlugin)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(caps).To(BeEmpty())
+	})
+
+	It("refuses to add the network when a required capability is missing", func() {
+		netConf, err := libcni.ConfFromBytes([]byte(`{"name": "test", "type": "loopback", "capabilities": {"portMappings": true}}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		cninet := &libcni.CNIConfig{Path: []string{filepath.Dir(pathToLoPlugin)}}
+		_, err = cninet.AddNetwork(netConf, &libcni.RuntimeConf{
+			ContainerID: "some-container",
+			NetNS:       "/some/netns",
+			IfName:      "lo",
+		})
+		Expect(err).To(MatchError(ContainSubstring(`does not support capability "portMappings"`)))
+	})
+})
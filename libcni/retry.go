@@ -0,0 +1,76 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.7
+// +build go1.7
+
+package libcni
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// RetryPolicy controls how AddNetworkWithRetry retries a plugin that
+// fails with a transient error
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times the plugin is run;
+	// values below 1 mean a single attempt
+	MaxAttempts int
+	// BaseDelay is the wait before the first retry, doubled after
+	// every further attempt
+	BaseDelay time.Duration
+	// Jitter is the fraction, between 0 and 1, by which each delay is
+	// randomly shortened or lengthened
+	Jitter float64
+}
+
+// delay returns the wait after the given failed attempt, counted from 1
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.BaseDelay << uint(attempt-1)
+	if p.Jitter > 0 {
+		d += time.Duration(float64(d) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// isRetriable reports whether err is a plugin error with the "try again
+// later" code
+func isRetriable(err error) bool {
+	e, ok := err.(*types.Error)
+	return ok && e.Code == types.ErrTryAgainLater
+}
+
+// AddNetworkWithRetry is AddNetwork, but runs the plugin again following
+// policy as long as it fails with the "try again later" error code. It
+// gives up early when ctx is done.
+func (c *CNIConfig) AddNetworkWithRetry(ctx context.Context, net *NetworkConfig, rt *RuntimeConf, policy RetryPolicy) (*types.Result, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := c.AddNetwork(net, rt)
+		if err == nil || !isRetriable(err) || attempt >= policy.MaxAttempts {
+			return result, err
+		}
+
+		timer := time.NewTimer(policy.delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
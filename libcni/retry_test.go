@@ -0,0 +1,123 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.7
+// +build go1.7
+
+package libcni_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// flakyPlugin fails its first two runs with $FLAKY_CODE, then succeeds.
+// Every run appends a line to the "runs" file next to it.
+const flakyPlugin = `#!/bin/sh
+runs="$(dirname "$0")/runs"
+echo run >> "$runs"
+if [ "$(wc -l < "$runs")" -le 2 ]; then
+	echo '{"code": FLAKY_CODE, "msg": "not ready"}'
+	exit 1
+fi
+echo '{"ip4": {"ip": "10.1.2.3/24"}}'
+`
+
+var _ = Describe("AddNetworkWithRetry", func() {
+	var (
+		tmpDir  string
+		cninet  *libcni.CNIConfig
+		rt      *libcni.RuntimeConf
+		netConf *libcni.NetworkConfig
+		policy  libcni.RetryPolicy
+	)
+
+	writePlugin := func(code string) {
+		script := strings.Replace(flakyPlugin, "FLAKY_CODE", code, 1)
+		Expect(ioutil.WriteFile(filepath.Join(tmpDir, "flaky"), []byte(script), 0755)).To(Succeed())
+	}
+
+	runs := func() int {
+		data, err := ioutil.ReadFile(filepath.Join(tmpDir, "runs"))
+		Expect(err).NotTo(HaveOccurred())
+		return strings.Count(string(data), "\n")
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "libcni")
+		Expect(err).NotTo(HaveOccurred())
+
+		cninet = &libcni.CNIConfig{Path: []string{tmpDir}}
+		rt = &libcni.RuntimeConf{
+			ContainerID: "some-container",
+			NetNS:       "/some/netns",
+			IfName:      "eth0",
+		}
+		netConf, err = libcni.ConfFromBytes([]byte(`{"name": "test", "type": "flaky"}`))
+		Expect(err).NotTo(HaveOccurred())
+		policy = libcni.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, Jitter: 0.5}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("retries a plugin failing with a retriable error until it succeeds", func() {
+		writePlugin("11")
+
+		result, err := cninet.AddNetworkWithRetry(context.Background(), netConf, rt, policy)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IP4.IP.String()).To(Equal("10.1.2.3/24"))
+		Expect(runs()).To(Equal(3))
+	})
+
+	It("gives up after MaxAttempts", func() {
+		writePlugin("11")
+		policy.MaxAttempts = 2
+
+		_, err := cninet.AddNetworkWithRetry(context.Background(), netConf, rt, policy)
+		Expect(err).To(Equal(&types.Error{Code: types.ErrTryAgainLater, Msg: "not ready"}))
+		Expect(runs()).To(Equal(2))
+	})
+
+	It("does not retry other errors", func() {
+		writePlugin("100")
+
+		_, err := cninet.AddNetworkWithRetry(context.Background(), netConf, rt, policy)
+		Expect(err).To(Equal(&types.Error{Code: 100, Msg: "not ready"}))
+		Expect(runs()).To(Equal(1))
+	})
+
+	It("stops retrying when the context is done", func() {
+		writePlugin("11")
+		policy.BaseDelay = time.Hour
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := cninet.AddNetworkWithRetry(ctx, netConf, rt, policy)
+		Expect(err).To(Equal(context.DeadlineExceeded))
+		Expect(runs()).To(Equal(1))
+	})
+})
@@ -0,0 +1,157 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package libcni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// networkState is the exported state of one network of a container
+type networkState struct {
+	Config json.RawMessage `json:"config"`
+	NetNS  string          `json:"netns"`
+	IfName string          `json:"ifName"`
+	Args   [][2]string     `json:"args,omitempty"`
+	Result *types.Result   `json:"result,omitempty"`
+}
+
+// stateBundle is the portable form of the networks of a container
+type stateBundle struct {
+	ContainerID string         `json:"containerID"`
+	Networks    []networkState `json:"networks"`
+}
+
+func (c *CNIConfig) cachePath(net *NetworkConfig, containerID, ifName string) string {
+	return filepath.Join(c.CacheDir, fmt.Sprintf("%s-%s-%s", net.Network.Name, containerID, ifName))
+}
+
+func (c *CNIConfig) cacheResult(net *NetworkConfig, rt *RuntimeConf, result *types.Result) error {
+	if c.CacheDir == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.CacheDir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.cachePath(net, rt.ContainerID, rt.IfName), data, 0600)
+}
+
+func (c *CNIConfig) cachedResult(net *NetworkConfig, containerID, ifName string) (*types.Result, error) {
+	if c.CacheDir == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(c.cachePath(net, containerID, ifName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	result := &types.Result{}
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, fmt.Errorf("failed to parse cached result: %v", err)
+	}
+	return result, nil
+}
+
+func (c *CNIConfig) uncacheResult(net *NetworkConfig, rt *RuntimeConf) error {
+	if c.CacheDir == "" {
+		return nil
+	}
+
+	err := os.Remove(c.cachePath(net, rt.ContainerID, rt.IfName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ExportNetworkState serializes the configuration of the networks of a
+// container, along with the results cached when they were added, so that
+// they can be reproduced on another node with ImportNetworkState.
+func (c *CNIConfig) ExportNetworkState(containerID string, networks []*NetworkConfig, rt *RuntimeConf) ([]byte, error) {
+	bundle := stateBundle{ContainerID: containerID}
+	for _, net := range networks {
+		result, err := c.cachedResult(net, containerID, rt.IfName)
+		if err != nil {
+			return nil, err
+		}
+
+		bundle.Networks = append(bundle.Networks, networkState{
+			Config: net.Bytes,
+			NetNS:  rt.NetNS,
+			IfName: rt.IfName,
+			Args:   rt.Args,
+			Result: result,
+		})
+	}
+	return json.Marshal(bundle)
+}
+
+// ImportNetworkState adds the networks of a bundle created by
+// ExportNetworkState. Where the exported result has an IPv4 address it
+// is requested again through the "IP" argument, which plugins that do
+// not support it ignore.
+func (c *CNIConfig) ImportNetworkState(bundle []byte) error {
+	state := stateBundle{}
+	if err := json.Unmarshal(bundle, &state); err != nil {
+		return fmt.Errorf("error parsing network state: %v", err)
+	}
+
+	for _, ns := range state.Networks {
+		net, err := ConfFromBytes(ns.Config)
+		if err != nil {
+			return err
+		}
+
+		rt := &RuntimeConf{
+			ContainerID: state.ContainerID,
+			NetNS:       ns.NetNS,
+			IfName:      ns.IfName,
+			Args:        ns.Args,
+		}
+		if ns.Result != nil && ns.Result.IP4 != nil && !hasArg(rt.Args, "IP") {
+			rt.Args = append(rt.Args,
+				[2]string{"IgnoreUnknown", "1"},
+				[2]string{"IP", ns.Result.IP4.IP.IP.String()})
+		}
+
+		if _, err := c.AddNetwork(net, rt); err != nil {
+			return fmt.Errorf("failed to add network %q: %v", net.Network.Name, err)
+		}
+	}
+	return nil
+}
+
+func hasArg(args [][2]string, key string) bool {
+	for _, kv := range args {
+		if kv[0] == key {
+			return true
+		}
+	}
+	return false
+}
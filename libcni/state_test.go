@@ -0,0 +1,96 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package libcni_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/libcni"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// stubPlugin records the CNI_ARGS of every invocation in a log file
+// and returns a fixed IPv4 address on ADD
+const stubPlugin = `#!/bin/sh
+echo "$CNI_COMMAND $CNI_CONTAINERID $CNI_ARGS" >> %s
+if [ "$CNI_COMMAND" = "ADD" ]; then
+	echo '{"ip4": {"ip": "10.1.2.3/24"}}'
+fi
+`
+
+var _ = Describe("network state export", func() {
+	var (
+		tmpDir  string
+		logFile string
+		cninet  *libcni.CNIConfig
+		netConf *libcni.NetworkConfig
+		rt      *libcni.RuntimeConf
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "libcni")
+		Expect(err).NotTo(HaveOccurred())
+
+		logFile = filepath.Join(tmpDir, "log")
+		plugin := fmt.Sprintf(stubPlugin, logFile)
+		Expect(ioutil.WriteFile(filepath.Join(tmpDir, "stub"), []byte(plugin), 0755)).To(Succeed())
+
+		cninet = &libcni.CNIConfig{
+			Path:     []string{tmpDir},
+			CacheDir: filepath.Join(tmpDir, "cache"),
+		}
+		netConf, err = libcni.ConfFromBytes([]byte(`{"name": "test", "type": "stub"}`))
+		Expect(err).NotTo(HaveOccurred())
+		rt = &libcni.RuntimeConf{
+			ContainerID: "some-container",
+			NetNS:       "/some/netns",
+			IfName:      "eth0",
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("re-adds the networks requesting the exported addresses", func() {
+		_, err := cninet.AddNetwork(netConf, rt)
+		Expect(err).NotTo(HaveOccurred())
+
+		bundle, err := cninet.ExportNetworkState("some-container", []*libcni.NetworkConfig{netConf}, rt)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(cninet.ImportNetworkState(bundle)).To(Succeed())
+
+		log, err := ioutil.ReadFile(logFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(log)).To(Equal("ADD some-container \nADD some-container IgnoreUnknown=1;IP=10.1.2.3\n"))
+	})
+
+	It("drops the cached result when the network is deleted", func() {
+		_, err := cninet.AddNetwork(netConf, rt)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cninet.DelNetwork(netConf, rt)).To(Succeed())
+
+		bundle, err := cninet.ExportNetworkState("some-container", []*libcni.NetworkConfig{netConf}, rt)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(bundle)).NotTo(ContainSubstring("result"))
+	})
+})
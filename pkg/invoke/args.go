@@ -45,6 +45,9 @@ type Args struct {
 	PluginArgsStr string
 	IfName        string
 	Path          string
+	// ResultVersion is the CNI spec version of the result format to ask
+	// the plugin for, if not empty
+	ResultVersion string
 }
 
 func (args *Args) AsEnv() []string {
@@ -61,9 +64,26 @@ func (args *Args) AsEnv() []string {
 		"CNI_ARGS="+pluginArgsStr,
 		"CNI_IFNAME="+args.IfName,
 		"CNI_PATH="+args.Path)
+	if args.ResultVersion != "" {
+		env = append(env, "CNI_RESULT_VERSION="+args.ResultVersion)
+	}
 	return env
 }
 
+// delegateArgs are the arguments of this process, passed on to a delegated
+// plugin, asking for the 0.2.0 result format that DelegateAdd parses
+type delegateArgs struct{}
+
+func (_ *delegateArgs) AsEnv() []string {
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "CNI_RESULT_VERSION=") {
+			env = append(env, e)
+		}
+	}
+	return append(env, "CNI_RESULT_VERSION=0.2.0")
+}
+
 // taken from rkt/networking/net_plugin.go
 func stringify(pluginArgs [][2]string) string {
 	entries := make([]string, len(pluginArgs))
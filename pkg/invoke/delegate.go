@@ -34,7 +34,7 @@ func DelegateAdd(delegatePlugin string, netconf []byte) (*types.Result, error) {
 		return nil, err
 	}
 
-	return ExecPluginWithResult(pluginPath, netconf, ArgsFromEnv())
+	return ExecPluginWithResult(pluginPath, netconf, &delegateArgs{})
 }
 
 func DelegateDel(delegatePlugin string, netconf []byte) error {
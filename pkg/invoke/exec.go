@@ -30,11 +30,7 @@ func pluginErr(err error, output []byte) error {
 		if perr := json.Unmarshal(output, &emsg); perr != nil {
 			return fmt.Errorf("netplugin failed but error parsing its diagnostic message %q: %v", string(output), perr)
 		}
-		details := ""
-		if emsg.Details != "" {
-			details = fmt.Sprintf("; %v", emsg.Details)
-		}
-		return fmt.Errorf("%v%v", emsg.Msg, details)
+		return &emsg
 	}
 
 	return err
@@ -56,6 +52,12 @@ func ExecPluginWithoutResult(pluginPath string, netconf []byte, args CNIArgs) er
 	return err
 }
 
+// ExecPluginWithOutput runs the plugin and returns its raw output, for
+// commands that do not return a types.Result
+func ExecPluginWithOutput(pluginPath string, netconf []byte, args CNIArgs) ([]byte, error) {
+	return execPlugin(pluginPath, netconf, args)
+}
+
 func execPlugin(pluginPath string, netconf []byte, args CNIArgs) ([]byte, error) {
 	stdout := &bytes.Buffer{}
 
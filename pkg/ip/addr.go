@@ -0,0 +1,77 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// AddAddrWithScope adds the address ipn to the link with the given scope,
+// such as netlink.SCOPE_HOST; the vendored netlink package always adds
+// addresses with global scope.
+// Equivalent to: `ip addr add $ipn dev $link scope $scope`
+func AddAddrWithScope(link netlink.Link, ipn *net.IPNet, scope netlink.Scope) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	family := nl.GetIPFamily(ipn.IP)
+	msg := nl.NewIfAddrmsg(family)
+	msg.Index = uint32(link.Attrs().Index)
+	prefixLen, _ := ipn.Mask.Size()
+	msg.Prefixlen = uint8(prefixLen)
+	msg.Scope = uint8(scope)
+	req.AddData(msg)
+
+	addr := ipn.IP.To4()
+	if family != netlink.FAMILY_V4 {
+		addr = ipn.IP.To16()
+	}
+	req.AddData(nl.NewRtAttr(syscall.IFA_LOCAL, addr))
+	req.AddData(nl.NewRtAttr(syscall.IFA_ADDRESS, addr))
+
+	_, err := execute(req, syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// AddrScope returns the scope of the address ip of the link
+func AddrScope(link netlink.Link, ip net.IP) (netlink.Scope, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETADDR, syscall.NLM_F_DUMP)
+	req.AddData(nl.NewIfAddrmsg(nl.GetIPFamily(ip)))
+
+	msgs, err := execute(req, syscall.NETLINK_ROUTE, syscall.RTM_NEWADDR)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, m := range msgs {
+		msg := nl.DeserializeIfAddrmsg(m)
+		if int(msg.Index) != link.Attrs().Index {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return 0, err
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type == syscall.IFA_ADDRESS && net.IP(attr.Value).Equal(ip) {
+				return netlink.Scope(msg.Scope), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no address %v on %q", ip, link.Attrs().Name)
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Message types and attributes from linux/rtnetlink.h and
+// linux/if_addrlabel.h; the vendored netlink package has no support for
+// address labels.
+const (
+	rtmNewAddrLabel = 72
+	rtmDelAddrLabel = 73
+	rtmGetAddrLabel = 74
+
+	ifalAddress = 1
+	ifalLabel   = 2
+
+	sizeofIfAddrlblmsg = 12
+)
+
+// AddrLabel is an entry of the policy table of RFC 6724 source address
+// selection, as managed by "ip addrlabel". The kernel only applies the
+// table to IPv6 addresses.
+type AddrLabel struct {
+	Prefix *net.IPNet
+	Label  uint32
+}
+
+func (a AddrLabel) String() string {
+	return fmt.Sprintf("{Prefix: %s Label: %d}", a.Prefix, a.Label)
+}
+
+// ifAddrlblmsg is the header of address label messages, a struct
+// ifaddrlblmsg of which only the family and prefix length are used
+type ifAddrlblmsg struct {
+	prefixLen uint8
+}
+
+func (msg *ifAddrlblmsg) Len() int {
+	return sizeofIfAddrlblmsg
+}
+
+func (msg *ifAddrlblmsg) Serialize() []byte {
+	b := make([]byte, sizeofIfAddrlblmsg)
+	b[0] = syscall.AF_INET6
+	b[2] = msg.prefixLen
+	return b
+}
+
+// AddAddrLabel adds an address label.
+// Equivalent to: `ip addrlabel add prefix $prefix label $label`
+func AddAddrLabel(a *AddrLabel) error {
+	req := nl.NewNetlinkRequest(rtmNewAddrLabel, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	return addrLabelHandle(a, req)
+}
+
+// DelAddrLabel removes an address label.
+// Equivalent to: `ip addrlabel del prefix $prefix label $label`
+func DelAddrLabel(a *AddrLabel) error {
+	req := nl.NewNetlinkRequest(rtmDelAddrLabel, syscall.NLM_F_ACK)
+	return addrLabelHandle(a, req)
+}
+
+func addrLabelHandle(a *AddrLabel, req *nl.NetlinkRequest) error {
+	if a.Prefix.IP.To4() != nil {
+		return fmt.Errorf("address labels only apply to IPv6 prefixes, got %s", a.Prefix)
+	}
+
+	prefixLen, _ := a.Prefix.Mask.Size()
+	req.AddData(&ifAddrlblmsg{prefixLen: uint8(prefixLen)})
+	req.AddData(nl.NewRtAttr(ifalAddress, a.Prefix.IP.To16()))
+	req.AddData(nl.NewRtAttr(ifalLabel, nl.Uint32Attr(a.Label)))
+
+	_, err := execute(req, syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// AddrLabelList gets the address labels.
+// Equivalent to: `ip addrlabel list`
+func AddrLabelList() ([]AddrLabel, error) {
+	req := nl.NewNetlinkRequest(rtmGetAddrLabel, syscall.NLM_F_DUMP)
+	req.AddData(&ifAddrlblmsg{})
+
+	msgs, err := execute(req, syscall.NETLINK_ROUTE, rtmNewAddrLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	native := nl.NativeEndian()
+	var res []AddrLabel
+	for _, m := range msgs {
+		if len(m) < sizeofIfAddrlblmsg {
+			return nil, fmt.Errorf("got short address label message")
+		}
+		attrs, err := nl.ParseRouteAttr(m[sizeofIfAddrlblmsg:])
+		if err != nil {
+			return nil, err
+		}
+
+		a := AddrLabel{}
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case ifalAddress:
+				a.Prefix = &net.IPNet{
+					IP:   net.IP(attr.Value),
+					Mask: net.CIDRMask(int(m[2]), 8*len(attr.Value)),
+				}
+			case ifalLabel:
+				a.Label = native.Uint32(attr.Value[0:4])
+			}
+		}
+		res = append(res, a)
+	}
+	return res, nil
+}
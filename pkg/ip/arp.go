@@ -0,0 +1,160 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	ethHdrLen = 14
+	arpLen    = 28
+
+	arpOpRequest = 1
+	arpOpReply   = 2
+)
+
+// proxyARPPath is the proxy_arp sysctl of an interface
+var proxyARPPath = "/proc/sys/net/ipv4/conf/%s/proxy_arp"
+
+// SetArpProxy makes the kernel answer ARP requests received on ifName for
+// addresses it has a route to through another interface.
+// Equivalent to: `sysctl net.ipv4.conf.$ifName.proxy_arp=$enable`
+func SetArpProxy(ifName string, enable bool) error {
+	value := "0"
+	if enable {
+		value = "1"
+	}
+	if err := ioutil.WriteFile(fmt.Sprintf(proxyARPPath, ifName), []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to set proxy_arp of %q: %v", ifName, err)
+	}
+	return nil
+}
+
+// arpProbe builds an ARP probe (RFC 5227) from srcMAC for ip: a
+// broadcast request with a sender IP of 0.0.0.0
+func arpProbe(srcMAC net.HardwareAddr, ip net.IP) []byte {
+	frame := make([]byte, ethHdrLen+arpLen)
+
+	// ethernet header
+	copy(frame[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(frame[6:12], srcMAC)
+	binary.BigEndian.PutUint16(frame[12:14], syscall.ETH_P_ARP)
+
+	arp := frame[ethHdrLen:]
+	binary.BigEndian.PutUint16(arp[0:2], syscall.ARPHRD_ETHER)
+	binary.BigEndian.PutUint16(arp[2:4], syscall.ETH_P_IP)
+	arp[4] = 6 // hardware address length
+	arp[5] = 4 // protocol address length
+	binary.BigEndian.PutUint16(arp[6:8], arpOpRequest)
+	copy(arp[8:14], srcMAC)
+	// sender IP (arp[14:18]) and target MAC (arp[18:24]) are zero
+	copy(arp[24:28], ip.To4())
+
+	return frame
+}
+
+// arpConflict checks whether frame shows another host using ip: either
+// an ARP packet sent from ip, or a probe for ip from another host. It
+// returns the MAC address of that host.
+func arpConflict(frame []byte, ownMAC net.HardwareAddr, ip net.IP) net.HardwareAddr {
+	if len(frame) < ethHdrLen+arpLen || binary.BigEndian.Uint16(frame[12:14]) != syscall.ETH_P_ARP {
+		return nil
+	}
+
+	arp := frame[ethHdrLen:]
+	op := binary.BigEndian.Uint16(arp[6:8])
+	if op != arpOpRequest && op != arpOpReply {
+		return nil
+	}
+
+	sha := net.HardwareAddr(arp[8:14])
+	spa := net.IP(arp[14:18])
+	tpa := net.IP(arp[24:28])
+	if bytes.Equal(sha, ownMAC) {
+		return nil
+	}
+
+	if spa.Equal(ip) || (op == arpOpRequest && spa.Equal(net.IPv4zero) && tpa.Equal(ip)) {
+		return append(net.HardwareAddr(nil), sha...)
+	}
+	return nil
+}
+
+// ARPProbe performs IPv4 Address Conflict Detection (RFC 5227) on link:
+// it sends an ARP probe for ip and listens for an answer for timeout.
+// It returns the MAC address of the host already using ip, or nil if
+// none answered.
+func ARPProbe(link netlink.Link, ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("ARP probing needs an IPv4 address, not %v", ip)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open packet socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	sll := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  link.Attrs().Index,
+	}
+	if err = syscall.Bind(fd, sll); err != nil {
+		return nil, fmt.Errorf("failed to bind packet socket to %q: %v", link.Attrs().Name, err)
+	}
+
+	ownMAC := link.Attrs().HardwareAddr
+	if err = syscall.Sendto(fd, arpProbe(ownMAC, ip), 0, sll); err != nil {
+		return nil, fmt.Errorf("failed to send ARP probe: %v", err)
+	}
+
+	buf := make([]byte, 1500)
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return nil, nil
+		}
+		tv := syscall.NsecToTimeval(remaining.Nanoseconds())
+		if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			return nil, err
+		}
+
+		n, from, err := syscall.Recvfrom(fd, buf, 0)
+		switch {
+		case err == syscall.EAGAIN || err == syscall.EINTR:
+			continue
+		case err != nil:
+			return nil, fmt.Errorf("failed to receive ARP packets: %v", err)
+		}
+
+		// packet sockets also see the frames we send
+		if from, ok := from.(*syscall.SockaddrLinklayer); ok && from.Pkttype == syscall.PACKET_OUTGOING {
+			continue
+		}
+		if mac := arpConflict(buf[:n], ownMAC, ip); mac != nil {
+			return mac, nil
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ARP proxy", func() {
+	var saved, dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "proxy_arp")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Mkdir(filepath.Join(dir, "veth0"), 0755)).To(Succeed())
+
+		saved = proxyARPPath
+		proxyARPPath = filepath.Join(dir, "%s", "proxy_arp")
+	})
+
+	AfterEach(func() {
+		proxyARPPath = saved
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("enables and disables proxy_arp of the interface", func() {
+		path := filepath.Join(dir, "veth0", "proxy_arp")
+
+		Expect(SetArpProxy("veth0", true)).To(Succeed())
+		Expect(ioutil.ReadFile(path)).To(Equal([]byte("1")))
+
+		Expect(SetArpProxy("veth0", false)).To(Succeed())
+		Expect(ioutil.ReadFile(path)).To(Equal([]byte("0")))
+	})
+
+	It("fails for a missing interface", func() {
+		Expect(SetArpProxy("veth1", true)).To(MatchError(HavePrefix(`failed to set proxy_arp of "veth1"`)))
+	})
+})
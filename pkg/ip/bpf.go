@@ -0,0 +1,153 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Constants from linux/bpf.h and linux/pkt_cls.h
+const (
+	bpfObjGet = 7
+
+	tcaBPFFD          = 6
+	tcaBPFName        = 7
+	tcaBPFFlags       = 8
+	tcaBPFFlagActDir  = 1
+	bpfFilterPriority = 2
+)
+
+// LoadPinnedBPF returns a file descriptor for the eBPF program pinned at
+// path in a bpf filesystem. The caller must close it.
+func LoadPinnedBPF(path string) (int, error) {
+	pathname, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+
+	// union bpf_attr for BPF_OBJ_GET: pathname, bpf_fd, file_flags
+	attr := struct {
+		pathname uint64
+		bpfFD    uint32
+		flags    uint32
+	}{pathname: uint64(uintptr(unsafe.Pointer(pathname)))}
+
+	fd, _, errno := syscall.Syscall(sysBPF, bpfObjGet, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return -1, fmt.Errorf("failed to get eBPF program %s: %v", path, errno)
+	}
+	return int(fd), nil
+}
+
+// AttachBPFFilter attaches the eBPF program progFD, which must be of the
+// sched_cls type, in direct action mode to the ingress of the link, so
+// it can drop packets received on the link before the network stack
+// processes them.
+// Equivalent to: `tc filter add dev $link ingress bpf da fd $progFD name $name`
+func AttachBPFFilter(link netlink.Link, progFD int, name string) error {
+	if err := ensureIngressQdisc(link); err != nil {
+		return err
+	}
+
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWTFILTER, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(link.Attrs().Index),
+		Parent:  ingressParent,
+		Handle:  1,
+		Info:    netlink.MakeHandle(bpfFilterPriority, htons(syscall.ETH_P_ALL)),
+	})
+	req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("bpf")))
+
+	options := nl.NewRtAttr(nl.TCA_OPTIONS, nil)
+	nl.NewRtAttrChild(options, tcaBPFFD, nl.Uint32Attr(uint32(progFD)))
+	nl.NewRtAttrChild(options, tcaBPFName, nl.ZeroTerminated(name))
+	nl.NewRtAttrChild(options, tcaBPFFlags, nl.Uint32Attr(tcaBPFFlagActDir))
+	req.AddData(options)
+
+	if _, err := execute(req, syscall.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("failed to attach eBPF filter to %q: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// DetachBPFFilter undoes the effects of AttachBPFFilter
+func DetachBPFFilter(link netlink.Link) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_DELTFILTER, syscall.NLM_F_ACK)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(link.Attrs().Index),
+		Parent:  ingressParent,
+		Info:    netlink.MakeHandle(bpfFilterPriority, htons(syscall.ETH_P_ALL)),
+	})
+
+	if _, err := execute(req, syscall.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("failed to detach eBPF filter from %q: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// BPFFilterList returns the names of the eBPF programs attached to the
+// ingress of the link.
+// Equivalent to: `tc filter show dev $link ingress`
+func BPFFilterList(link netlink.Link) ([]string, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETTFILTER, syscall.NLM_F_DUMP)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(link.Attrs().Index),
+		Parent:  ingressParent,
+	})
+
+	msgs, err := execute(req, syscall.NETLINK_ROUTE, syscall.RTM_NEWTFILTER)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for _, m := range msgs {
+		msg := nl.DeserializeTcMsg(m)
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return nil, err
+		}
+
+		isBPF := false
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case nl.TCA_KIND:
+				isBPF = string(attr.Value[:len(attr.Value)-1]) == "bpf"
+			case nl.TCA_OPTIONS:
+				if !isBPF {
+					continue
+				}
+				opts, err := nl.ParseRouteAttr(attr.Value)
+				if err != nil {
+					return nil, err
+				}
+				for _, opt := range opts {
+					if opt.Attr.Type == tcaBPFName {
+						res = append(res, string(opt.Value[:len(opt.Value)-1]))
+					}
+				}
+			}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// IFLA_BR_* attributes from linux/if_link.h
+const (
+	iflaBrForwardDelay  = 1
+	iflaBrAgeingTime    = 4
+	iflaBrStpState      = 5
+	iflaBrMcastSnooping = 23
+	iflaBrFdbMaxLearned = 49
+)
+
+// bridgeGetAttr returns the value of a single IFLA_BR_* attribute of a
+// bridge, or nil if the kernel did not report it
+func bridgeGetAttr(br netlink.Link, attr int) ([]byte, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, 0)
+
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(br.Attrs().Index)
+	req.AddData(msg)
+
+	msgs, err := execute(req, syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, fmt.Errorf("no link found for %q", br.Attrs().Name)
+	}
+
+	attrs, err := nl.ParseRouteAttr(msgs[0][syscall.SizeofIfInfomsg:])
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range attrs {
+		if a.Attr.Type != syscall.IFLA_LINKINFO {
+			continue
+		}
+		infos, err := nl.ParseRouteAttr(a.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if info.Attr.Type != nl.IFLA_INFO_DATA {
+				continue
+			}
+			data, err := nl.ParseRouteAttr(info.Value)
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range data {
+				if int(d.Attr.Type) == attr {
+					return d.Value, nil
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// BridgeSetFDBMaxLearned limits the number of MAC addresses a bridge
+// learns into its forwarding database, 0 meaning unlimited. Needs
+// Linux 6.7 or later; older kernels ignore the setting.
+// Equivalent to: `ip link set $br type bridge fdb_max_learned $max`
+func BridgeSetFDBMaxLearned(br netlink.Link, max uint32) error {
+	return bridgeSetAttr(br, iflaBrFdbMaxLearned, nl.Uint32Attr(max))
+}
+
+// BridgeFDBMaxLearned returns the limit set by BridgeSetFDBMaxLearned
+func BridgeFDBMaxLearned(br netlink.Link) (uint32, error) {
+	value, err := bridgeGetAttr(br, iflaBrFdbMaxLearned)
+	if err != nil {
+		return 0, err
+	}
+	if len(value) < 4 {
+		return 0, fmt.Errorf("kernel does not support fdb_max_learned on %q", br.Attrs().Name)
+	}
+	return nl.NativeEndian().Uint32(value), nil
+}
+
+// BridgeSetSTPState turns the spanning tree protocol of a bridge on or
+// off. Outside of the initial network namespace the kernel runs STP
+// itself rather than calling out to a userspace daemon.
+// Equivalent to: `ip link set $br type bridge stp_state $on`
+func BridgeSetSTPState(br netlink.Link, on bool) error {
+	var state uint32
+	if on {
+		state = 1
+	}
+	return bridgeSetAttr(br, iflaBrStpState, nl.Uint32Attr(state))
+}
+
+// BridgeSTPState reports whether STP is enabled on a bridge
+func BridgeSTPState(br netlink.Link) (bool, error) {
+	value, err := bridgeGetAttr(br, iflaBrStpState)
+	if err != nil {
+		return false, err
+	}
+	if len(value) < 4 {
+		return false, fmt.Errorf("kernel did not report stp_state of %q", br.Attrs().Name)
+	}
+	return nl.NativeEndian().Uint32(value) != 0, nil
+}
+
+// userHZ is the unit of the bridge timers, which the kernel reports in
+// clock_t
+const userHZ = 100
+
+// bridgeGetUint32 returns the value of a 32 bits IFLA_BR_* attribute
+func bridgeGetUint32(br netlink.Link, attr int, name string) (uint32, error) {
+	value, err := bridgeGetAttr(br, attr)
+	if err != nil {
+		return 0, err
+	}
+	if len(value) < 4 {
+		return 0, fmt.Errorf("kernel did not report %s of %q", name, br.Attrs().Name)
+	}
+	return nl.NativeEndian().Uint32(value), nil
+}
+
+// BridgeSetForwardDelay sets the time a bridge port spends in each of
+// the listening and learning states when STP is enabled.
+// Equivalent to: `ip link set $br type bridge forward_delay $seconds*100`
+func BridgeSetForwardDelay(br netlink.Link, seconds int) error {
+	return bridgeSetAttr(br, iflaBrForwardDelay, nl.Uint32Attr(uint32(seconds*userHZ)))
+}
+
+// BridgeForwardDelay returns the forward delay of a bridge in seconds
+func BridgeForwardDelay(br netlink.Link) (int, error) {
+	v, err := bridgeGetUint32(br, iflaBrForwardDelay, "forward_delay")
+	return int(v / userHZ), err
+}
+
+// BridgeSetAgeingTime sets the time after which a bridge forgets the
+// MAC addresses it learned but has not seen since.
+// Equivalent to: `ip link set $br type bridge ageing_time $seconds*100`
+func BridgeSetAgeingTime(br netlink.Link, seconds int) error {
+	return bridgeSetAttr(br, iflaBrAgeingTime, nl.Uint32Attr(uint32(seconds*userHZ)))
+}
+
+// BridgeAgeingTime returns the ageing time of a bridge in seconds
+func BridgeAgeingTime(br netlink.Link) (int, error) {
+	v, err := bridgeGetUint32(br, iflaBrAgeingTime, "ageing_time")
+	return int(v / userHZ), err
+}
+
+// BridgeSetMulticastSnooping turns IGMP and MLD snooping of a bridge on
+// or off. Without snooping, multicast traffic is flooded to all ports.
+// Equivalent to: `ip link set $br type bridge mcast_snooping $on`
+func BridgeSetMulticastSnooping(br netlink.Link, on bool) error {
+	return bridgeSetAttr(br, iflaBrMcastSnooping, boolAttr(on))
+}
+
+// BridgeMulticastSnooping reports whether multicast snooping is enabled
+// on a bridge
+func BridgeMulticastSnooping(br netlink.Link) (bool, error) {
+	value, err := bridgeGetAttr(br, iflaBrMcastSnooping)
+	if err != nil {
+		return false, err
+	}
+	if len(value) < 1 {
+		return false, fmt.Errorf("kernel did not report mcast_snooping of %q", br.Attrs().Name)
+	}
+	return value[0] != 0, nil
+}
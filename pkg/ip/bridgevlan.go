@@ -0,0 +1,165 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Attributes and flags from linux/if_bridge.h and linux/rtnetlink.h; the
+// vendored netlink package cannot manage the bridge VLAN database.
+const (
+	iflaAfSpec  = 26
+	iflaExtMask = 29
+
+	iflaBridgeFlags    = 0
+	iflaBridgeVlanInfo = 2
+
+	bridgeFlagsMaster = 1
+	bridgeFlagsSelf   = 2
+
+	bridgeVlanInfoPvid     = 1 << 1
+	bridgeVlanInfoUntagged = 1 << 2
+
+	rtextFilterBrvlan = 1 << 1
+
+	iflaBrVlanFiltering = 7
+)
+
+// BridgeVlanInfo is an entry of the bridge VLAN database of a port
+type BridgeVlanInfo struct {
+	Vid      uint16
+	Pvid     bool
+	Untagged bool
+}
+
+// bridgeSetAttr changes a single IFLA_BR_* attribute of a bridge
+func bridgeSetAttr(br netlink.Link, attr int, value []byte) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(br.Attrs().Index)
+	req.AddData(msg)
+
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.NonZeroTerminated("bridge"))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+	nl.NewRtAttrChild(data, attr, value)
+	req.AddData(linkInfo)
+
+	_, err := execute(req, syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+func boolAttr(v bool) []byte {
+	if v {
+		return nl.Uint8Attr(1)
+	}
+	return nl.Uint8Attr(0)
+}
+
+// BridgeSetVlanFiltering turns VLAN filtering of a bridge on or off.
+// Equivalent to: `ip link set $br type bridge vlan_filtering $on`
+func BridgeSetVlanFiltering(br netlink.Link, on bool) error {
+	return bridgeSetAttr(br, iflaBrVlanFiltering, boolAttr(on))
+}
+
+// BridgeVlanAdd adds a VLAN to the VLAN filter of a bridge port.
+// Equivalent to: `bridge vlan add dev $link vid $vid [pvid] [untagged]`
+func BridgeVlanAdd(link netlink.Link, vid uint16, pvid, untagged bool) error {
+	return bridgeVlanModify(syscall.RTM_SETLINK, link, vid, pvid, untagged)
+}
+
+// BridgeVlanDel removes a VLAN from the VLAN filter of a bridge port.
+// Equivalent to: `bridge vlan del dev $link vid $vid`
+func BridgeVlanDel(link netlink.Link, vid uint16) error {
+	return bridgeVlanModify(syscall.RTM_DELLINK, link, vid, false, false)
+}
+
+func bridgeVlanModify(cmd int, link netlink.Link, vid uint16, pvid, untagged bool) error {
+	req := nl.NewNetlinkRequest(cmd, syscall.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(syscall.AF_BRIDGE)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+
+	spec := nl.NewRtAttr(iflaAfSpec, nil)
+	nl.NewRtAttrChild(spec, iflaBridgeFlags, nl.Uint16Attr(bridgeFlagsMaster))
+
+	var flags uint16
+	if pvid {
+		flags |= bridgeVlanInfoPvid
+	}
+	if untagged {
+		flags |= bridgeVlanInfoUntagged
+	}
+	info := make([]byte, 4)
+	native := nl.NativeEndian()
+	native.PutUint16(info[0:2], flags)
+	native.PutUint16(info[2:4], vid)
+	nl.NewRtAttrChild(spec, iflaBridgeVlanInfo, info)
+	req.AddData(spec)
+
+	_, err := execute(req, syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// BridgeVlanList returns the VLAN database of all bridge ports, keyed
+// by interface index.
+// Equivalent to: `bridge vlan show`
+func BridgeVlanList() (map[int32][]BridgeVlanInfo, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, syscall.NLM_F_DUMP)
+	req.AddData(nl.NewIfInfomsg(syscall.AF_BRIDGE))
+	req.AddData(nl.NewRtAttr(iflaExtMask, nl.Uint32Attr(rtextFilterBrvlan)))
+
+	msgs, err := execute(req, syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK)
+	if err != nil {
+		return nil, err
+	}
+
+	native := nl.NativeEndian()
+	res := make(map[int32][]BridgeVlanInfo)
+	for _, m := range msgs {
+		msg := nl.DeserializeIfInfomsg(m)
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return nil, err
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type != iflaAfSpec {
+				continue
+			}
+			children, err := nl.ParseRouteAttr(attr.Value)
+			if err != nil {
+				return nil, err
+			}
+			for _, child := range children {
+				if child.Attr.Type != iflaBridgeVlanInfo || len(child.Value) < 4 {
+					continue
+				}
+				flags := native.Uint16(child.Value[0:2])
+				res[msg.Index] = append(res[msg.Index], BridgeVlanInfo{
+					Vid:      native.Uint16(child.Value[2:4]),
+					Pvid:     flags&bridgeVlanInfoPvid != 0,
+					Untagged: flags&bridgeVlanInfoUntagged != 0,
+				})
+			}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Attributes from linux/rtnetlink.h, linux/lwtunnel.h and linux/if_tunnel.h;
+// the vendored netlink package supports neither lightweight tunnels nor
+// ipip devices.
+const (
+	rtaEncapType = 21
+	rtaEncap     = 22
+
+	lwtunnelEncapIP = 2
+	lwtunnelIPDst   = 2
+
+	iflaIptunCollectMetadata = 19
+)
+
+// EncapRoute is a route whose packets are encapsulated in IP by a flow
+// based tunnel device, as managed by "ip route ... encap ip dst $EncapDst"
+type EncapRoute struct {
+	Dst       *net.IPNet
+	LinkIndex int
+	EncapDst  net.IP
+}
+
+// AddIPIPDevice creates a flow based ("external") ipip device, which
+// takes the tunnel endpoints from the routes sending packets through it.
+// Equivalent to: `ip link add $name type ipip external`
+func AddIPIPDevice(name string) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	req.AddData(nl.NewIfInfomsg(syscall.AF_UNSPEC))
+	req.AddData(nl.NewRtAttr(syscall.IFLA_IFNAME, nl.ZeroTerminated(name)))
+
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.NonZeroTerminated("ipip"))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+	nl.NewRtAttrChild(data, iflaIptunCollectMetadata, nil)
+	req.AddData(linkInfo)
+
+	_, err := execute(req, syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// AddEncapRoute adds a route to dst through dev, a flow based ipip
+// device, encapsulating packets to the tunnel endpoint encapDst.
+// Equivalent to: `ip route add $dst encap ip dst $encapDst dev $dev`
+func AddEncapRoute(dst *net.IPNet, encapDst net.IP, dev netlink.Link) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	return encapRouteHandle(req, dst, encapDst, dev)
+}
+
+// DelEncapRoute removes a route added by AddEncapRoute
+func DelEncapRoute(dst *net.IPNet, encapDst net.IP, dev netlink.Link) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_DELROUTE, syscall.NLM_F_ACK)
+	return encapRouteHandle(req, dst, encapDst, dev)
+}
+
+func encapRouteHandle(req *nl.NetlinkRequest, dst *net.IPNet, encapDst net.IP, dev netlink.Link) error {
+	if dst.IP.To4() == nil || encapDst.To4() == nil {
+		return fmt.Errorf("IP in IP encapsulation needs IPv4 addresses")
+	}
+
+	dstLen, _ := dst.Mask.Size()
+	msg := nl.NewRtMsg()
+	msg.Family = syscall.AF_INET
+	msg.Dst_len = uint8(dstLen)
+	req.AddData(msg)
+	req.AddData(nl.NewRtAttr(syscall.RTA_DST, dst.IP.To4()))
+	req.AddData(nl.NewRtAttr(syscall.RTA_OIF, nl.Uint32Attr(uint32(dev.Attrs().Index))))
+	req.AddData(nl.NewRtAttr(rtaEncapType, nl.Uint16Attr(lwtunnelEncapIP)))
+	encap := nl.NewRtAttr(rtaEncap|syscall.NLA_F_NESTED, nil)
+	nl.NewRtAttrChild(encap, lwtunnelIPDst, encapDst.To4())
+	req.AddData(encap)
+
+	_, err := execute(req, syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// EncapRouteList returns the IPv4 routes of the main table which
+// encapsulate packets in IP
+func EncapRouteList() ([]EncapRoute, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETROUTE, syscall.NLM_F_DUMP)
+	msg := &nl.RtMsg{}
+	msg.Family = syscall.AF_INET
+	req.AddData(msg)
+
+	msgs, err := execute(req, syscall.NETLINK_ROUTE, syscall.RTM_NEWROUTE)
+	if err != nil {
+		return nil, err
+	}
+
+	native := nl.NativeEndian()
+	var res []EncapRoute
+	for _, m := range msgs {
+		msg := nl.DeserializeRtMsg(m)
+		if msg.Table != syscall.RT_TABLE_MAIN {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return nil, err
+		}
+
+		route := EncapRoute{Dst: &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(int(msg.Dst_len), 32)}}
+		isIP := false
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_DST:
+				route.Dst.IP = net.IP(attr.Value)
+			case syscall.RTA_OIF:
+				route.LinkIndex = int(native.Uint32(attr.Value[0:4]))
+			case rtaEncapType:
+				isIP = native.Uint16(attr.Value[0:2]) == lwtunnelEncapIP
+			case rtaEncap:
+				encap, err := nl.ParseRouteAttr(attr.Value)
+				if err != nil {
+					return nil, err
+				}
+				for _, e := range encap {
+					if e.Attr.Type == lwtunnelIPDst {
+						route.EncapDst = net.IP(e.Value)
+					}
+				}
+			}
+		}
+		if isIP {
+			res = append(res, route)
+		}
+	}
+	return res, nil
+}
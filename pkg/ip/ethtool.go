@@ -0,0 +1,181 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Commands and string sets from linux/ethtool.h; neither the standard
+// library nor the vendored netlink package speak ethtool.
+const (
+	siocEthtool = 0x8946
+
+	ethtoolGStrings  = 0x1b
+	ethtoolGSsetInfo = 0x37
+	ethtoolGFeatures = 0x3a
+	ethtoolSFeatures = 0x3b
+
+	ethSSFeatures = 4
+	ethGStringLen = 32
+)
+
+// ifreqData is a struct ifreq whose union holds a pointer to the
+// ethtool command
+type ifreqData struct {
+	name [syscall.IFNAMSIZ]byte
+	data uintptr
+	_    [16]byte
+}
+
+// ethtool runs the ethtool command in cmd on ifName. The kernel writes
+// its answer into cmd.
+func ethtool(ifName string, cmd []byte) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	ifr := ifreqData{data: uintptr(unsafe.Pointer(&cmd[0]))}
+	copy(ifr.name[:syscall.IFNAMSIZ-1], ifName)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), siocEthtool, uintptr(unsafe.Pointer(&ifr)))
+	// ifr only holds the address of cmd, which must outlive the call
+	runtime.KeepAlive(cmd)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// featureNames returns the names of the offload features of ifName, in
+// the order of their bits
+func featureNames(ifName string) ([]string, error) {
+	native := nl.NativeEndian()
+
+	// struct ethtool_sset_info with room for the size of one set
+	info := make([]byte, 20)
+	native.PutUint32(info[0:], ethtoolGSsetInfo)
+	native.PutUint64(info[8:], 1<<ethSSFeatures)
+	if err := ethtool(ifName, info); err != nil {
+		return nil, fmt.Errorf("failed to get the number of features of %q: %v", ifName, err)
+	}
+	count := int(native.Uint32(info[16:]))
+
+	// struct ethtool_gstrings
+	strs := make([]byte, 12+count*ethGStringLen)
+	native.PutUint32(strs[0:], ethtoolGStrings)
+	native.PutUint32(strs[4:], ethSSFeatures)
+	native.PutUint32(strs[8:], uint32(count))
+	if err := ethtool(ifName, strs); err != nil {
+		return nil, fmt.Errorf("failed to get the feature names of %q: %v", ifName, err)
+	}
+
+	names := make([]string, count)
+	for i := range names {
+		s := strs[12+i*ethGStringLen : 12+(i+1)*ethGStringLen]
+		names[i] = string(bytes.TrimRight(s, "\x00"))
+	}
+	return names, nil
+}
+
+// LinkFeatures returns the offload features ifName supports and whether
+// they are active, by name, e.g. "tx-udp-segmentation".
+// Equivalent to: `ethtool --show-features $ifName`
+func LinkFeatures(ifName string) (map[string]bool, error) {
+	names, err := featureNames(ifName)
+	if err != nil {
+		return nil, err
+	}
+
+	native := nl.NativeEndian()
+	blocks := (len(names) + 31) / 32
+
+	// struct ethtool_gfeatures, each block holds the available,
+	// requested, active and never_changed bits of 32 features
+	cmd := make([]byte, 8+blocks*16)
+	native.PutUint32(cmd[0:], ethtoolGFeatures)
+	native.PutUint32(cmd[4:], uint32(blocks))
+	if err := ethtool(ifName, cmd); err != nil {
+		return nil, fmt.Errorf("failed to get the features of %q: %v", ifName, err)
+	}
+
+	features := make(map[string]bool)
+	for i, name := range names {
+		block := cmd[8+i/32*16:]
+		bit := uint32(1) << uint(i%32)
+		if native.Uint32(block[0:])&bit == 0 {
+			continue
+		}
+		features[name] = native.Uint32(block[8:])&bit != 0
+	}
+	return features, nil
+}
+
+// SetLinkFeature turns an offload feature of ifName on or off. It fails
+// if the kernel or the driver of ifName does not support the feature.
+// Equivalent to: `ethtool --features $ifName $feature on|off`
+func SetLinkFeature(ifName string, feature string, on bool) error {
+	names, err := featureNames(ifName)
+	if err != nil {
+		return err
+	}
+
+	index := -1
+	for i, name := range names {
+		if name == feature {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("kernel does not know the %s feature", feature)
+	}
+
+	native := nl.NativeEndian()
+	blocks := (len(names) + 31) / 32
+
+	// struct ethtool_sfeatures, each block holds the valid and
+	// requested bits of 32 features
+	cmd := make([]byte, 8+blocks*8)
+	native.PutUint32(cmd[0:], ethtoolSFeatures)
+	native.PutUint32(cmd[4:], uint32(blocks))
+	block := cmd[8+index/32*8:]
+	bit := uint32(1) << uint(index%32)
+	native.PutUint32(block[0:], bit)
+	if on {
+		native.PutUint32(block[4:], bit)
+	}
+	// the kernel answers with a positive flag set when the request could
+	// not be fully applied, which the ioctl does not report as an error
+	if err := ethtool(ifName, cmd); err != nil {
+		return fmt.Errorf("failed to set %s of %q: %v", feature, ifName, err)
+	}
+
+	features, err := LinkFeatures(ifName)
+	if err != nil {
+		return err
+	}
+	if active, ok := features[feature]; !ok || active != on {
+		return fmt.Errorf("%q does not support changing %s", ifName, feature)
+	}
+	return nil
+}
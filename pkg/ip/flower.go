@@ -0,0 +1,190 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Attributes from linux/pkt_cls.h and linux/tc_act/tc_gact.h; the
+// vendored netlink package only knows about u32 filters.
+const (
+	tcaFlowerAct          = 3
+	tcaFlowerKeyEthSrc    = 6
+	tcaFlowerKeyEthSrcMsk = 7
+	tcaFlowerKeyEthType   = 8
+	tcaFlowerKeyIPv4Src   = 10
+	tcaFlowerKeyIPv4SrcMk = 11
+	tcaFlowerFlags        = 22
+
+	tcaClsFlagsInHW = 1 << 2
+
+	tcaActKind    = 1
+	tcaActOptions = 2
+	tcaActHWStats = 8
+
+	tcaActHWStatsAny = 3
+
+	tcaGactParms  = 2
+	sizeofTcGen   = 20
+	tcActOK       = 0
+	ingressParent = 0xffff0000
+)
+
+// FlowerFilter is a flower classifier matching the source of packets
+type FlowerFilter struct {
+	Priority uint16
+	SrcMAC   net.HardwareAddr
+	SrcIP    net.IP
+	// InHW is set if the kernel reports the filter as offloaded
+	InHW bool
+}
+
+func htons(v uint16) uint16 {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return nl.NativeEndian().Uint16(b)
+}
+
+// ensureIngressQdisc adds an ingress qdisc to the link, which filters
+// for packets received on the link are attached to
+func ensureIngressQdisc(link netlink.Link) error {
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err := netlink.QdiscAdd(ingress); err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("failed to add ingress qdisc to %q: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// SetupFlowerOffload adds an ingress flower classifier to the link which
+// passes IPv4 packets from srcMAC and srcIP. Neither skip_sw nor skip_hw
+// is set so the kernel offloads the filter to hardware where possible,
+// and hardware statistics are requested for its action.
+// An ingress qdisc is added to the link if it does not have one.
+// Equivalent to: `tc filter add dev $link ingress prio $prio protocol ip
+// flower src_mac $srcMAC src_ip $srcIP action pass hw_stats any`
+func SetupFlowerOffload(link netlink.Link, prio uint16, srcMAC net.HardwareAddr, srcIP net.IP) error {
+	if err := ensureIngressQdisc(link); err != nil {
+		return err
+	}
+
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWTFILTER, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(link.Attrs().Index),
+		Parent:  ingressParent,
+		Info:    netlink.MakeHandle(prio, htons(syscall.ETH_P_IP)),
+	})
+	req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("flower")))
+
+	options := nl.NewRtAttr(nl.TCA_OPTIONS, nil)
+	ethType := make([]byte, 2)
+	binary.BigEndian.PutUint16(ethType, syscall.ETH_P_IP)
+	nl.NewRtAttrChild(options, tcaFlowerKeyEthType, ethType)
+	nl.NewRtAttrChild(options, tcaFlowerKeyEthSrc, []byte(srcMAC))
+	nl.NewRtAttrChild(options, tcaFlowerKeyEthSrcMsk, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	nl.NewRtAttrChild(options, tcaFlowerKeyIPv4Src, []byte(srcIP.To4()))
+	nl.NewRtAttrChild(options, tcaFlowerKeyIPv4SrcMk, []byte(net.CIDRMask(32, 32)))
+	nl.NewRtAttrChild(options, tcaFlowerFlags, nl.Uint32Attr(0))
+
+	acts := nl.NewRtAttrChild(options, tcaFlowerAct, nil)
+	act := nl.NewRtAttrChild(acts, 1, nil)
+	nl.NewRtAttrChild(act, tcaActKind, nl.ZeroTerminated("gact"))
+	// struct nla_bitfield32 {value, selector}
+	hwStats := make([]byte, 8)
+	nl.NativeEndian().PutUint32(hwStats[0:], tcaActHWStatsAny)
+	nl.NativeEndian().PutUint32(hwStats[4:], tcaActHWStatsAny)
+	nl.NewRtAttrChild(act, tcaActHWStats, hwStats)
+	actOpts := nl.NewRtAttrChild(act, tcaActOptions, nil)
+	// struct tc_gact, only the action is set
+	parms := make([]byte, sizeofTcGen)
+	nl.NativeEndian().PutUint32(parms[8:], tcActOK)
+	nl.NewRtAttrChild(actOpts, tcaGactParms, parms)
+	req.AddData(options)
+
+	if _, err := execute(req, syscall.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("failed to add flower filter to %q: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// FlowerFilterList returns the ingress flower classifiers of the link.
+// Equivalent to: `tc filter show dev $link ingress`
+func FlowerFilterList(link netlink.Link) ([]FlowerFilter, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETTFILTER, syscall.NLM_F_DUMP)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(link.Attrs().Index),
+		Parent:  ingressParent,
+	})
+
+	msgs, err := execute(req, syscall.NETLINK_ROUTE, syscall.RTM_NEWTFILTER)
+	if err != nil {
+		return nil, err
+	}
+
+	native := nl.NativeEndian()
+	var res []FlowerFilter
+	for _, m := range msgs {
+		msg := nl.DeserializeTcMsg(m)
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return nil, err
+		}
+
+		prio, _ := netlink.MajorMinor(msg.Info)
+		filter := FlowerFilter{Priority: prio}
+		isFlower, hasOptions := false, false
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case nl.TCA_KIND:
+				isFlower = string(attr.Value[:len(attr.Value)-1]) == "flower"
+			case nl.TCA_OPTIONS:
+				hasOptions = true
+				opts, err := nl.ParseRouteAttr(attr.Value)
+				if err != nil {
+					return nil, err
+				}
+				for _, opt := range opts {
+					switch opt.Attr.Type {
+					case tcaFlowerKeyEthSrc:
+						filter.SrcMAC = net.HardwareAddr(opt.Value)
+					case tcaFlowerKeyIPv4Src:
+						filter.SrcIP = net.IP(opt.Value)
+					case tcaFlowerFlags:
+						filter.InHW = native.Uint32(opt.Value[0:4])&tcaClsFlagsInHW != 0
+					}
+				}
+			}
+		}
+		// the dump also contains a header entry per priority without options
+		if isFlower && hasOptions {
+			res = append(res, filter)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"syscall"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// natTable is the part of iptables.IPTables used to set up NAT, so the
+// same code can drive ip6tables
+type natTable interface {
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	NewChain(table, chain string) error
+	AppendUnique(table, chain string, rulespec ...string) error
+	Delete(table, chain string, rulespec ...string) error
+	ClearChain(table, chain string) error
+	DeleteChain(table, chain string) error
+}
+
+// newNATTable returns the iptables or ip6tables command matching the
+// address family of ipn
+func newNATTable(ipn *net.IPNet) (natTable, error) {
+	if ipn.IP.To4() == nil {
+		ipt, err := newIP6Tables()
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate ip6tables: %v", err)
+		}
+		return ipt, nil
+	}
+
+	ipt, err := iptables.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	return ipt, nil
+}
+
+// ip6tables runs the ip6tables command; the vendored go-iptables only
+// knows about iptables
+type ip6tables struct {
+	path string
+}
+
+// ip6tablesError is a failed ip6tables run and its standard error
+type ip6tablesError struct {
+	*exec.ExitError
+	msg string
+}
+
+func (e *ip6tablesError) ExitStatus() int {
+	return e.Sys().(syscall.WaitStatus).ExitStatus()
+}
+
+func (e *ip6tablesError) Error() string {
+	return fmt.Sprintf("exit status %v: %v", e.ExitStatus(), e.msg)
+}
+
+func newIP6Tables() (*ip6tables, error) {
+	path, err := exec.LookPath("ip6tables")
+	if err != nil {
+		return nil, err
+	}
+	return &ip6tables{path: path}, nil
+}
+
+func (ipt *ip6tables) run(args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(ipt.path, append(args, "--wait")...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			return &ip6tablesError{e, stderr.String()}
+		}
+		return err
+	}
+	return nil
+}
+
+func (ipt *ip6tables) NewChain(table, chain string) error {
+	return ipt.run("-t", table, "-N", chain)
+}
+
+func (ipt *ip6tables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	err := ipt.run(append([]string{"-t", table, "-C", chain}, rulespec...)...)
+	if e, ok := err.(*ip6tablesError); ok && e.ExitStatus() == 1 {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (ipt *ip6tables) AppendUnique(table, chain string, rulespec ...string) error {
+	exists, err := ipt.Exists(table, chain, rulespec...)
+	if err != nil || exists {
+		return err
+	}
+	return ipt.run(append([]string{"-t", table, "-A", chain}, rulespec...)...)
+}
+
+func (ipt *ip6tables) Delete(table, chain string, rulespec ...string) error {
+	return ipt.run(append([]string{"-t", table, "-D", chain}, rulespec...)...)
+}
+
+// ClearChain flushes chain, creating it if it does not exist
+func (ipt *ip6tables) ClearChain(table, chain string) error {
+	err := ipt.NewChain(table, chain)
+	if e, ok := err.(*ip6tablesError); ok && e.ExitStatus() == 1 {
+		return ipt.run("-t", table, "-F", chain)
+	}
+	return err
+}
+
+func (ipt *ip6tables) DeleteChain(table, chain string) error {
+	return ipt.run("-t", table, "-X", chain)
+}
@@ -17,41 +17,93 @@ package ip
 import (
 	"fmt"
 	"net"
-
-	"github.com/coreos/go-iptables/iptables"
+	"os/exec"
 )
 
 // SetupIPMasq installs iptables rules to masquerade traffic
-// coming from ipn and going outside of it
+// coming from ipn and going outside of it. ip6tables is used for an
+// IPv6 ipn.
 func SetupIPMasq(ipn *net.IPNet, chain string, comment string) error {
-	ipt, err := iptables.New()
+	return SetupIPMasqWithExclusions(ipn, nil, chain, comment)
+}
+
+// SetupIPMasqWithExclusions is like SetupIPMasq, except traffic going to
+// the exclude networks keeps its source address
+func SetupIPMasqWithExclusions(ipn *net.IPNet, exclude []*net.IPNet, chain string, comment string) error {
+	return setupNAT(ipn, IPMasqRules(ipn, exclude, comment), chain, comment)
+}
+
+// SetupSNAT installs iptables rules to rewrite the source address of
+// traffic coming from network and going outside of it to snatIP, rather
+// than to the address of the outgoing interface as SetupIPMasq does
+func SetupSNAT(network *net.IPNet, snatIP net.IP, chain string, comment string) error {
+	return SetupSNATWithExclusions(network, snatIP, nil, chain, comment)
+}
+
+// SetupSNATWithExclusions is like SetupSNAT, except traffic going to the
+// exclude networks keeps its source address
+func SetupSNATWithExclusions(network *net.IPNet, snatIP net.IP, exclude []*net.IPNet, chain string, comment string) error {
+	return setupNAT(network, snatRules(network, snatIP, exclude, comment), chain, comment)
+}
+
+// setupNAT fills chain with rules and jumps to it for traffic from ipn
+func setupNAT(ipn *net.IPNet, rules [][]string, chain string, comment string) error {
+	ipt, err := newNATTable(ipn)
 	if err != nil {
-		return fmt.Errorf("failed to locate iptables: %v", err)
+		return err
 	}
 
 	if err = ipt.NewChain("nat", chain); err != nil {
-		if err.(*iptables.Error).ExitStatus() != 1 {
+		if e, ok := err.(interface {
+			ExitStatus() int
+		}); !ok || e.ExitStatus() != 1 {
 			// TODO(eyakubovich): assumes exit status 1 implies chain exists
 			return err
 		}
 	}
 
-	if err = ipt.AppendUnique("nat", chain, "-d", ipn.String(), "-j", "ACCEPT", "-m", "comment", "--comment", comment); err != nil {
-		return err
-	}
-
-	if err = ipt.AppendUnique("nat", chain, "!", "-d", "224.0.0.0/4", "-j", "MASQUERADE", "-m", "comment", "--comment", comment); err != nil {
-		return err
+	for _, rule := range rules {
+		if err = ipt.AppendUnique("nat", chain, rule...); err != nil {
+			return err
+		}
 	}
 
 	return ipt.AppendUnique("nat", "POSTROUTING", "-s", ipn.String(), "-j", chain, "-m", "comment", "--comment", comment)
 }
 
-// TeardownIPMasq undoes the effects of SetupIPMasq
+// IPMasqRules returns the rules of the per-container chain of
+// SetupIPMasqWithExclusions, in order, as iptables arguments
+func IPMasqRules(ipn *net.IPNet, exclude []*net.IPNet, comment string) [][]string {
+	return natRules(ipn, exclude, []string{"MASQUERADE"}, comment)
+}
+
+// snatRules returns the rules of the per-container chain of SetupSNAT
+func snatRules(ipn *net.IPNet, snatIP net.IP, exclude []*net.IPNet, comment string) [][]string {
+	return natRules(ipn, exclude, []string{"SNAT", "--to-source", snatIP.String()}, comment)
+}
+
+// natRules accepts traffic within ipn, returns for the excluded networks
+// and sends the remaining unicast traffic to target
+func natRules(ipn *net.IPNet, exclude []*net.IPNet, target []string, comment string) [][]string {
+	rules := [][]string{
+		{"-d", ipn.String(), "-j", "ACCEPT", "-m", "comment", "--comment", comment},
+	}
+	for _, n := range exclude {
+		rules = append(rules, []string{"-d", n.String(), "-j", "RETURN", "-m", "comment", "--comment", comment})
+	}
+	multicast := "224.0.0.0/4"
+	if ipn.IP.To4() == nil {
+		multicast = "ff00::/8"
+	}
+	rule := append([]string{"!", "-d", multicast, "-j"}, target...)
+	return append(rules, append(rule, "-m", "comment", "--comment", comment))
+}
+
+// TeardownIPMasq undoes the effects of SetupIPMasq and SetupSNAT
 func TeardownIPMasq(ipn *net.IPNet, chain string, comment string) error {
-	ipt, err := iptables.New()
+	ipt, err := newNATTable(ipn)
 	if err != nil {
-		return fmt.Errorf("failed to locate iptables: %v", err)
+		return err
 	}
 
 	if err = ipt.Delete("nat", "POSTROUTING", "-s", ipn.String(), "-j", chain, "-m", "comment", "--comment", comment); err != nil {
@@ -64,3 +116,51 @@ func TeardownIPMasq(ipn *net.IPNet, chain string, comment string) error {
 
 	return ipt.DeleteChain("nat", chain)
 }
+
+// SetupIP6Masq installs ip6tables rules to masquerade traffic coming from
+// the IPv6 network ipn and going outside of it, with the same chain and
+// comment scheme as SetupIPMasq
+func SetupIP6Masq(ipn *net.IPNet, chain string, comment string) error {
+	if err := checkIP6Masq(ipn); err != nil {
+		return err
+	}
+	return SetupIPMasq(ipn, chain, comment)
+}
+
+// TeardownIP6Masq undoes the effects of SetupIP6Masq
+func TeardownIP6Masq(ipn *net.IPNet, chain string, comment string) error {
+	if err := checkIP6Masq(ipn); err != nil {
+		return err
+	}
+	return TeardownIPMasq(ipn, chain, comment)
+}
+
+// checkIP6Masq returns an error if ipn is not an IPv6 network or if
+// ip6tables is not installed
+func checkIP6Masq(ipn *net.IPNet) error {
+	if ipn.IP.To4() != nil {
+		return fmt.Errorf("%v is not an IPv6 network", ipn)
+	}
+	if _, err := exec.LookPath("ip6tables"); err != nil {
+		return fmt.Errorf("ip6tables is not available, cannot masquerade IPv6 traffic from %v", ipn)
+	}
+	return nil
+}
+
+// CheckIPMasq returns an error if the traffic from ipn no longer goes
+// through the chain installed by SetupIPMasq or SetupSNAT
+func CheckIPMasq(ipn *net.IPNet, chain string, comment string) error {
+	ipt, err := newNATTable(ipn)
+	if err != nil {
+		return err
+	}
+
+	exists, err := ipt.Exists("nat", "POSTROUTING", "-s", ipn.String(), "-j", chain, "-m", "comment", "--comment", comment)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("masquerade rule for %v is missing from POSTROUTING", ipn)
+	}
+	return nil
+}
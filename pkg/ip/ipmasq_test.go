@@ -0,0 +1,82 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IP masquerade rules", func() {
+	It("returns for the excluded networks before masquerading", func() {
+		ipn, err := types.ParseCIDR("10.1.2.0/24")
+		Expect(err).NotTo(HaveOccurred())
+		_, excl1, _ := net.ParseCIDR("10.100.0.0/16")
+		_, excl2, _ := net.ParseCIDR("192.168.0.0/16")
+
+		rules := IPMasqRules(ipn, []*net.IPNet{excl1, excl2}, "test")
+		Expect(rules).To(Equal([][]string{
+			{"-d", "10.1.2.0/24", "-j", "ACCEPT", "-m", "comment", "--comment", "test"},
+			{"-d", "10.100.0.0/16", "-j", "RETURN", "-m", "comment", "--comment", "test"},
+			{"-d", "192.168.0.0/16", "-j", "RETURN", "-m", "comment", "--comment", "test"},
+			{"!", "-d", "224.0.0.0/4", "-j", "MASQUERADE", "-m", "comment", "--comment", "test"},
+		}))
+	})
+
+	It("only masquerades without exclusions", func() {
+		ipn, err := types.ParseCIDR("10.1.2.0/24")
+		Expect(err).NotTo(HaveOccurred())
+
+		rules := IPMasqRules(ipn, nil, "test")
+		Expect(rules).To(HaveLen(2))
+		Expect(rules[1]).To(ContainElement("MASQUERADE"))
+	})
+
+	It("rewrites the source address to the SNAT IP", func() {
+		ipn, err := types.ParseCIDR("10.1.2.0/24")
+		Expect(err).NotTo(HaveOccurred())
+		_, excl, _ := net.ParseCIDR("10.100.0.0/16")
+
+		rules := snatRules(ipn, net.ParseIP("203.0.113.10"), []*net.IPNet{excl}, "test")
+		Expect(rules).To(Equal([][]string{
+			{"-d", "10.1.2.0/24", "-j", "ACCEPT", "-m", "comment", "--comment", "test"},
+			{"-d", "10.100.0.0/16", "-j", "RETURN", "-m", "comment", "--comment", "test"},
+			{"!", "-d", "224.0.0.0/4", "-j", "SNAT", "--to-source", "203.0.113.10", "-m", "comment", "--comment", "test"},
+		}))
+	})
+
+	It("does not masquerade IPv6 multicast", func() {
+		ipn, err := types.ParseCIDR("2001:db8:1::/64")
+		Expect(err).NotTo(HaveOccurred())
+
+		rules := IPMasqRules(ipn, nil, "test")
+		Expect(rules).To(Equal([][]string{
+			{"-d", "2001:db8:1::/64", "-j", "ACCEPT", "-m", "comment", "--comment", "test"},
+			{"!", "-d", "ff00::/8", "-j", "MASQUERADE", "-m", "comment", "--comment", "test"},
+		}))
+	})
+
+	It("only sets up IPv6 masquerading for IPv6 networks", func() {
+		ipn, err := types.ParseCIDR("10.1.2.0/24")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(SetupIP6Masq(ipn, "CNI-abc", "test")).To(MatchError("10.1.2.0/24 is not an IPv6 network"))
+		Expect(TeardownIP6Masq(ipn, "CNI-abc", "test")).To(MatchError("10.1.2.0/24 is not an IPv6 network"))
+	})
+})
@@ -16,12 +16,16 @@ package ip
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
 	"net"
 	"os"
+	"strings"
+	"syscall"
 
 	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
 )
 
 func makeVethPair(name, peer string, mtu int) (netlink.Link, error) {
@@ -78,16 +82,45 @@ func RandomVethName() (string, error) {
 	return fmt.Sprintf("veth%x", entropy), nil
 }
 
+// DeriveStableMAC returns a MAC address for the interface ifName of a
+// container which stays the same across restarts of the container, e.g.
+// for DHCP servers keying their leases on the MAC. It is the start of the
+// SHA-256 of containerID and ifName, made a locally administered unicast
+// address.
+func DeriveStableMAC(containerID, ifName string) net.HardwareAddr {
+	sum := sha256.Sum256([]byte(containerID + ifName))
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = mac[0]&^0x01 | 0x02
+	return mac
+}
+
 // SetupVeth sets up a virtual ethernet link.
 // Should be in container netns, and will switch back to hostNS to set the host
 // veth end up.
 func SetupVeth(contVethName string, mtu int, hostNS ns.NetNS) (hostVeth, contVeth netlink.Link, err error) {
+	return SetupVethWithMAC(contVethName, mtu, nil, hostNS)
+}
+
+// SetupVethWithMAC is SetupVeth giving the container veth end the MAC
+// address mac, or a random one if mac is nil.
+func SetupVethWithMAC(contVethName string, mtu int, mac net.HardwareAddr, hostNS ns.NetNS) (hostVeth, contVeth netlink.Link, err error) {
 	var hostVethName string
 	hostVethName, contVeth, err = makeVeth(contVethName, mtu)
 	if err != nil {
 		return
 	}
 
+	if mac != nil {
+		if err = netlink.LinkSetHardwareAddr(contVeth, mac); err != nil {
+			err = fmt.Errorf("failed to set the MAC of %q to %v: %v", contVethName, mac, err)
+			return
+		}
+		if contVeth, err = netlink.LinkByName(contVethName); err != nil {
+			err = fmt.Errorf("failed to lookup %q: %v", contVethName, err)
+			return
+		}
+	}
+
 	if err = netlink.LinkSetUp(contVeth); err != nil {
 		err = fmt.Errorf("failed to set %q up: %v", contVethName, err)
 		return
@@ -151,3 +184,82 @@ func DelLinkByNameAddr(ifName string, family int) (*net.IPNet, error) {
 
 	return addrs[0].IPNet, nil
 }
+
+// LinkSetPromisc turns promiscuous mode of the link on or off; the
+// vendored netlink package cannot set it.
+// Equivalent to: `ip link set $link promisc on|off`
+func LinkSetPromisc(link netlink.Link, on bool) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	msg.Change = syscall.IFF_PROMISC
+	if on {
+		msg.Flags = syscall.IFF_PROMISC
+	}
+	req.AddData(msg)
+
+	if _, err := execute(req, syscall.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("failed to set promiscuous mode of %q: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// LinkPromisc returns whether promiscuous mode of the link was turned on
+func LinkPromisc(link netlink.Link) (bool, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, 0)
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+
+	msgs, err := execute(req, syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK)
+	if err != nil {
+		return false, err
+	}
+	if len(msgs) == 0 {
+		return false, fmt.Errorf("no link found for %q", link.Attrs().Name)
+	}
+	return nl.DeserializeIfInfomsg(msgs[0]).Flags&syscall.IFF_PROMISC != 0, nil
+}
+
+// LinkSetAlias sets the alias of the link, which is kept when the link
+// moves to another netns; the vendored netlink package cannot set it.
+// Equivalent to: `ip link set $link alias $alias`
+func LinkSetAlias(link netlink.Link, alias string) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+	req.AddData(nl.NewRtAttr(syscall.IFLA_IFALIAS, []byte(alias)))
+
+	if _, err := execute(req, syscall.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("failed to set alias of %q: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// LinkAlias returns the alias of the link, or "" if it has none
+func LinkAlias(link netlink.Link) (string, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, 0)
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+
+	msgs, err := execute(req, syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK)
+	if err != nil {
+		return "", err
+	}
+	if len(msgs) == 0 {
+		return "", fmt.Errorf("no link found for %q", link.Attrs().Name)
+	}
+
+	attrs, err := nl.ParseRouteAttr(msgs[0][syscall.SizeofIfInfomsg:])
+	if err != nil {
+		return "", err
+	}
+	for _, attr := range attrs {
+		if attr.Attr.Type == syscall.IFLA_IFALIAS {
+			return strings.TrimRight(string(attr.Value), "\x00"), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"net"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("stable MAC addresses", func() {
+	It("derives the same locally administered unicast MAC for a container interface", func() {
+		mac := DeriveStableMAC("container1", "eth0")
+		Expect(mac).To(HaveLen(6))
+		Expect(mac).To(Equal(DeriveStableMAC("container1", "eth0")))
+		Expect(mac[0] & 0x01).To(BeZero())
+		Expect(mac[0] & 0x02).NotTo(BeZero())
+	})
+
+	It("derives different MACs for different interfaces", func() {
+		Expect(DeriveStableMAC("container1", "eth0")).NotTo(Equal(DeriveStableMAC("container1", "eth1")))
+		Expect(DeriveStableMAC("container1", "eth0")).NotTo(Equal(DeriveStableMAC("container2", "eth0")))
+	})
+})
+
+var _ = Describe("link aliases", func() {
+	var testNS ns.NetNS
+
+	BeforeEach(func() {
+		var err error
+		testNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(testNS.Close()).To(Succeed())
+	})
+
+	It("sets and returns the alias of a link", func() {
+		err := testNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := makeVethPair("veth0", "veth1", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(LinkAlias(link)).To(Equal(""))
+
+			Expect(LinkSetAlias(link, "eth3")).To(Succeed())
+			Expect(LinkAlias(link)).To(Equal("eth3"))
+
+			peer, err := netlink.LinkByName("veth1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(LinkAlias(peer)).To(Equal(""))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("veth setup", func() {
+	var hostNS, contNS ns.NetNS
+
+	BeforeEach(func() {
+		var err error
+		hostNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		contNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(hostNS.Close()).To(Succeed())
+		Expect(contNS.Close()).To(Succeed())
+	})
+
+	It("gives the container end the requested MAC", func() {
+		mac, err := net.ParseMAC("02:42:ac:11:00:02")
+		Expect(err).NotTo(HaveOccurred())
+
+		err = contNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, contVeth, err := SetupVethWithMAC("eth0", 1500, mac, hostNS)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contVeth.Attrs().HardwareAddr).To(Equal(mac))
+
+			link, err := netlink.LinkByName("eth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().HardwareAddr).To(Equal(mac))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("keeps a random MAC without one", func() {
+		err := contNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := SetupVethWithMAC("eth0", 1500, nil, hostNS)
+			Expect(err).NotTo(HaveOccurred())
+
+			link, err := netlink.LinkByName("eth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().HardwareAddr).To(HaveLen(6))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
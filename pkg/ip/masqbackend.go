@@ -0,0 +1,118 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// iptablesPath is the iptables binary whose presence selects the iptables
+// masquerade backend
+const iptablesPath = "/sbin/iptables"
+
+// MasqBackend installs, checks and removes the rules that masquerade the
+// traffic of a container, see SetupIPMasq
+type MasqBackend interface {
+	SetupIPMasq(ipn *net.IPNet, chain string, comment string) error
+	SetupIPMasqWithExclusions(ipn *net.IPNet, exclude []*net.IPNet, chain string, comment string) error
+	SetupSNATWithExclusions(ipn *net.IPNet, snatIP net.IP, exclude []*net.IPNet, chain string, comment string) error
+	CheckIPMasq(ipn *net.IPNet, chain string, comment string) error
+	TeardownIPMasq(ipn *net.IPNet, chain string, comment string) error
+}
+
+// NewMasqBackend returns the iptables backend if iptables is installed
+// and the nftables one otherwise, for hosts that only ship nft
+func NewMasqBackend() MasqBackend {
+	if _, err := os.Stat(iptablesPath); err == nil {
+		return &IPTablesBackend{}
+	}
+	return &NFTablesBackend{}
+}
+
+// installedMasqBackends returns the backends whose command is installed,
+// in the order NewMasqBackend prefers them
+func installedMasqBackends() []MasqBackend {
+	var backends []MasqBackend
+	if _, err := os.Stat(iptablesPath); err == nil {
+		backends = append(backends, &IPTablesBackend{})
+	}
+	if _, err := exec.LookPath("nft"); err == nil {
+		backends = append(backends, &NFTablesBackend{})
+	}
+	return backends
+}
+
+// TeardownMasq removes the masquerading of ipn set up by any backend.
+// NewMasqBackend picks the backend from the commands installed when it is
+// called, so DEL may not get the backend ADD used; TeardownMasq tries
+// every installed backend and succeeds once one of them removes the rules.
+func TeardownMasq(ipn *net.IPNet, chain string, comment string) error {
+	return anyMasqBackend(ipn, func(b MasqBackend) error {
+		return b.TeardownIPMasq(ipn, chain, comment)
+	})
+}
+
+// CheckMasq returns an error if no installed backend masquerades the
+// traffic of ipn through chain, see TeardownMasq
+func CheckMasq(ipn *net.IPNet, chain string, comment string) error {
+	return anyMasqBackend(ipn, func(b MasqBackend) error {
+		return b.CheckIPMasq(ipn, chain, comment)
+	})
+}
+
+// anyMasqBackend calls f with each installed backend until one succeeds
+func anyMasqBackend(ipn *net.IPNet, f func(MasqBackend) error) error {
+	backends := installedMasqBackends()
+	if len(backends) == 0 {
+		return fmt.Errorf("neither iptables nor nft is installed, cannot handle the masquerading of %v", ipn)
+	}
+
+	var errs []string
+	for _, b := range backends {
+		err := f(b)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// IPTablesBackend masquerades with iptables, or ip6tables for IPv6
+type IPTablesBackend struct{}
+
+func (*IPTablesBackend) SetupIPMasq(ipn *net.IPNet, chain string, comment string) error {
+	return SetupIPMasq(ipn, chain, comment)
+}
+
+func (*IPTablesBackend) SetupIPMasqWithExclusions(ipn *net.IPNet, exclude []*net.IPNet, chain string, comment string) error {
+	return SetupIPMasqWithExclusions(ipn, exclude, chain, comment)
+}
+
+func (*IPTablesBackend) SetupSNATWithExclusions(ipn *net.IPNet, snatIP net.IP, exclude []*net.IPNet, chain string, comment string) error {
+	return SetupSNATWithExclusions(ipn, snatIP, exclude, chain, comment)
+}
+
+func (*IPTablesBackend) CheckIPMasq(ipn *net.IPNet, chain string, comment string) error {
+	return CheckIPMasq(ipn, chain, comment)
+}
+
+func (*IPTablesBackend) TeardownIPMasq(ipn *net.IPNet, chain string, comment string) error {
+	return TeardownIPMasq(ipn, chain, comment)
+}
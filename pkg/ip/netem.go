@@ -0,0 +1,150 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	netemDefaultLimit = 1000
+	netemMaxProb      = 0xffffffff
+	sizeofNetemQopt   = 24
+)
+
+// Netem holds network emulation parameters, see tc-netem(8).
+// Delay and Jitter are in microseconds, Loss and Duplicate are
+// probabilities between 0.0 and 1.0.
+type Netem struct {
+	Delay     uint32
+	Jitter    uint32
+	Loss      float64
+	Duplicate float64
+	Limit     uint32
+}
+
+func probToNetem(p float64) uint32 {
+	return uint32(p * netemMaxProb)
+}
+
+func netemToProb(v uint32) float64 {
+	return float64(v) / netemMaxProb
+}
+
+// SetupNetem adds a netem root qdisc to the link.
+// Equivalent to: `tc qdisc add dev $link root netem ...`
+func SetupNetem(link netlink.Link, netem *Netem) error {
+	limit := netem.Limit
+	if limit == 0 {
+		limit = netemDefaultLimit
+	}
+
+	// struct tc_netem_qopt, time values are in scheduler ticks
+	native := nl.NativeEndian()
+	opt := make([]byte, sizeofNetemQopt)
+	native.PutUint32(opt[0:], uint32(float64(netem.Delay)*netlink.TickInUsec()))
+	native.PutUint32(opt[4:], limit)
+	native.PutUint32(opt[8:], probToNetem(netem.Loss))
+	native.PutUint32(opt[16:], probToNetem(netem.Duplicate))
+	native.PutUint32(opt[20:], uint32(float64(netem.Jitter)*netlink.TickInUsec()))
+
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWQDISC, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(link.Attrs().Index),
+		Parent:  netlink.HANDLE_ROOT,
+	})
+	req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("netem")))
+	req.AddData(nl.NewRtAttr(nl.TCA_OPTIONS, opt))
+
+	if _, err := execute(req, syscall.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("failed to add netem qdisc to %q: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// TeardownNetem removes the root qdisc added by SetupNetem
+func TeardownNetem(link netlink.Link) error {
+	netem, err := GetNetem(link)
+	if err != nil {
+		return err
+	}
+	if netem == nil {
+		return nil
+	}
+
+	return netlink.QdiscDel(&netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		QdiscType: "netem",
+	})
+}
+
+// GetNetem returns the parameters of the netem root qdisc of the link,
+// or nil if the link has none.
+func GetNetem(link netlink.Link) (*Netem, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETQDISC, syscall.NLM_F_DUMP)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(link.Attrs().Index),
+	})
+
+	msgs, err := execute(req, syscall.NETLINK_ROUTE, syscall.RTM_NEWQDISC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list qdiscs of %q: %v", link.Attrs().Name, err)
+	}
+
+	native := nl.NativeEndian()
+	for _, m := range msgs {
+		msg := nl.DeserializeTcMsg(m)
+		if int(msg.Ifindex) != link.Attrs().Index || msg.Parent != netlink.HANDLE_ROOT {
+			continue
+		}
+
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return nil, err
+		}
+
+		var kind string
+		var opt []byte
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case nl.TCA_KIND:
+				kind = string(attr.Value[:len(attr.Value)-1])
+			case nl.TCA_OPTIONS:
+				opt = attr.Value
+			}
+		}
+		if kind != "netem" || len(opt) < sizeofNetemQopt {
+			continue
+		}
+
+		return &Netem{
+			Delay:     uint32(float64(native.Uint32(opt[0:])) / netlink.TickInUsec()),
+			Limit:     native.Uint32(opt[4:]),
+			Loss:      netemToProb(native.Uint32(opt[8:])),
+			Duplicate: netemToProb(native.Uint32(opt[16:])),
+			Jitter:    uint32(float64(native.Uint32(opt[20:])) / netlink.TickInUsec()),
+		}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// netlinkRecvBuf is the receive buffer size of the netlink sockets
+// opened by this package. Dumps on busy nodes overflow the default
+// buffer and fail with ENOBUFS.
+var netlinkRecvBuf = 8 << 20
+
+// SetNetlinkRecvBuf sets the receive buffer size, in bytes, of the
+// netlink sockets subsequently opened by this package
+func SetNetlinkRecvBuf(size int) error {
+	if size <= 0 {
+		return fmt.Errorf("invalid netlink receive buffer size %d", size)
+	}
+	netlinkRecvBuf = size
+	return nil
+}
+
+// netlinkSocket opens and binds a netlink socket of the given protocol
+// with a receive buffer of netlinkRecvBuf bytes
+func netlinkSocket(protocol int) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, protocol)
+	if err != nil {
+		return -1, err
+	}
+
+	// SO_RCVBUFFORCE may exceed net.core.rmem_max but needs CAP_NET_ADMIN
+	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, netlinkRecvBuf)
+	if err == syscall.EPERM {
+		err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, netlinkRecvBuf)
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("failed to set netlink receive buffer size: %v", err)
+	}
+
+	if err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// execute is nl.NetlinkRequest.Execute on a socket from netlinkSocket
+func execute(req *nl.NetlinkRequest, sockType int, resType uint16) ([][]byte, error) {
+	fd, err := netlinkSocket(sockType)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+
+	if err = syscall.Sendto(fd, req.Serialize(), 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return nil, err
+	}
+	pid := sa.(*syscall.SockaddrNetlink).Pid
+
+	var res [][]byte
+	for {
+		// the returned messages point into buf, so it cannot be reused
+		buf := make([]byte, syscall.Getpagesize())
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		if n < syscall.NLMSG_HDRLEN {
+			return nil, fmt.Errorf("got short netlink response")
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != req.Seq {
+				return nil, fmt.Errorf("wrong netlink seq nr %d, expected %d", m.Header.Seq, req.Seq)
+			}
+			if m.Header.Pid != pid {
+				return nil, fmt.Errorf("wrong netlink pid %d, expected %d", m.Header.Pid, pid)
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return res, nil
+			case syscall.NLMSG_ERROR:
+				errno := int32(nl.NativeEndian().Uint32(m.Data[0:4]))
+				if errno == 0 {
+					return res, nil
+				}
+				return nil, syscall.Errno(-errno)
+			}
+			if resType != 0 && m.Header.Type != resType {
+				continue
+			}
+			res = append(res, m.Data)
+			if m.Header.Flags&syscall.NLM_F_MULTI == 0 {
+				return res, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"syscall"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("netlink sockets", func() {
+	var saved int
+
+	BeforeEach(func() {
+		saved = netlinkRecvBuf
+	})
+
+	AfterEach(func() {
+		netlinkRecvBuf = saved
+	})
+
+	It("opens sockets with the configured receive buffer size", func() {
+		Expect(SetNetlinkRecvBuf(4 << 20)).To(Succeed())
+
+		fd, err := netlinkSocket(syscall.NETLINK_ROUTE)
+		Expect(err).NotTo(HaveOccurred())
+		defer syscall.Close(fd)
+
+		// the kernel doubles the requested size for bookkeeping overhead
+		size, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(size).To(BeNumerically(">=", 4<<20))
+	})
+
+	It("rejects a non-positive size", func() {
+		Expect(SetNetlinkRecvBuf(0)).NotTo(Succeed())
+		Expect(netlinkRecvBuf).To(Equal(saved))
+	})
+
+	It("executes requests on its own sockets", func() {
+		rules, err := RuleList(syscall.AF_INET)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rules).NotTo(BeEmpty())
+	})
+})
@@ -0,0 +1,209 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// nftMasqTable is the table of the rules of NFTablesBackend, one per
+// address family, holding the postrouting base chain and a chain per
+// container like the iptables nat table does
+const (
+	nftMasqTable       = "cni_masq"
+	nftPostroutingHook = "postrouting"
+)
+
+// NFTablesBackend masquerades with nftables. It runs the nft command; no
+// nftables library is vendored.
+type NFTablesBackend struct{}
+
+func (b *NFTablesBackend) SetupIPMasq(ipn *net.IPNet, chain string, comment string) error {
+	return b.SetupIPMasqWithExclusions(ipn, nil, chain, comment)
+}
+
+func (*NFTablesBackend) SetupIPMasqWithExclusions(ipn *net.IPNet, exclude []*net.IPNet, chain string, comment string) error {
+	return nftSetupNAT(ipn, exclude, "masquerade", chain, comment)
+}
+
+func (*NFTablesBackend) SetupSNATWithExclusions(ipn *net.IPNet, snatIP net.IP, exclude []*net.IPNet, chain string, comment string) error {
+	return nftSetupNAT(ipn, exclude, "snat to "+snatIP.String(), chain, comment)
+}
+
+// CheckIPMasq returns an error if the postrouting chain no longer jumps
+// to chain for the traffic from ipn
+func (*NFTablesBackend) CheckIPMasq(ipn *net.IPNet, chain string, comment string) error {
+	nft, err := newNFT()
+	if err != nil {
+		return err
+	}
+
+	handles, err := nft.jumpRuleHandles(nftFamily(ipn), chain, comment)
+	if err != nil {
+		return err
+	}
+	if len(handles) == 0 {
+		return fmt.Errorf("masquerade rule for %v is missing from the %s chain", ipn, nftPostroutingHook)
+	}
+	return nil
+}
+
+// nftSetupNAT fills chain with the rules of nftMasqScript ending in action
+// and jumps to it for traffic from ipn
+func nftSetupNAT(ipn *net.IPNet, exclude []*net.IPNet, action string, chain string, comment string) error {
+	nft, err := newNFT()
+	if err != nil {
+		return err
+	}
+
+	ipn = Network(ipn)
+	if _, err = nft.run(nftMasqScript(ipn, exclude, action, chain, comment), "-f", "-"); err != nil {
+		return fmt.Errorf("failed to set up masquerading of %v: %v", ipn, err)
+	}
+
+	handles, err := nft.jumpRuleHandles(nftFamily(ipn), chain, comment)
+	if err != nil || len(handles) > 0 {
+		return err
+	}
+	_, err = nft.run("", "add", "rule", nftFamily(ipn), nftMasqTable, nftPostroutingHook, nftJumpRule(ipn, chain, comment))
+	return err
+}
+
+// TeardownIPMasq removes the jump to chain from the postrouting chain and
+// chain itself, leaving rules of other containers and plugins alone
+func (*NFTablesBackend) TeardownIPMasq(ipn *net.IPNet, chain string, comment string) error {
+	nft, err := newNFT()
+	if err != nil {
+		return err
+	}
+
+	family := nftFamily(ipn)
+	handles, err := nft.jumpRuleHandles(family, chain, comment)
+	if err != nil {
+		return err
+	}
+
+	var script bytes.Buffer
+	for _, h := range handles {
+		fmt.Fprintf(&script, "delete rule %s %s %s handle %s\n", family, nftMasqTable, nftPostroutingHook, h)
+	}
+	fmt.Fprintf(&script, "flush chain %s %s %s\n", family, nftMasqTable, chain)
+	fmt.Fprintf(&script, "delete chain %s %s %s\n", family, nftMasqTable, chain)
+	if _, err = nft.run(script.String(), "-f", "-"); err != nil {
+		return fmt.Errorf("failed to tear down masquerading of %v: %v", ipn, err)
+	}
+	return nil
+}
+
+// nftFamily returns the nftables address family of ipn
+func nftFamily(ipn *net.IPNet) string {
+	if ipn.IP.To4() == nil {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// nftMasqScript returns the nft script that creates the table, its
+// postrouting base chain and chain, and fills chain with the rules of
+// IPMasqRules: accept traffic within ipn, return for the exclude networks
+// and apply action, masquerade or snat, to the rest but multicast. The
+// script is applied atomically.
+func nftMasqScript(ipn *net.IPNet, exclude []*net.IPNet, action string, chain string, comment string) string {
+	family := nftFamily(ipn)
+	multicast := "224.0.0.0/4"
+	if family == "ip6" {
+		multicast = "ff00::/8"
+	}
+
+	var script bytes.Buffer
+	fmt.Fprintf(&script, "add table %s %s\n", family, nftMasqTable)
+	fmt.Fprintf(&script, "add chain %s %s %s { type nat hook postrouting priority 100 ; }\n", family, nftMasqTable, nftPostroutingHook)
+	fmt.Fprintf(&script, "add chain %s %s %s\n", family, nftMasqTable, chain)
+	fmt.Fprintf(&script, "flush chain %s %s %s\n", family, nftMasqTable, chain)
+	fmt.Fprintf(&script, "add rule %s %s %s %s daddr %s accept comment %s\n", family, nftMasqTable, chain, family, ipn, nftQuote(comment))
+	for _, n := range exclude {
+		fmt.Fprintf(&script, "add rule %s %s %s %s daddr %s return comment %s\n", family, nftMasqTable, chain, family, n, nftQuote(comment))
+	}
+	fmt.Fprintf(&script, "add rule %s %s %s %s daddr != %s %s comment %s\n", family, nftMasqTable, chain, family, multicast, action, nftQuote(comment))
+	return script.String()
+}
+
+// nftJumpRule returns the rule of the postrouting chain sending the
+// traffic from ipn to chain
+func nftJumpRule(ipn *net.IPNet, chain string, comment string) string {
+	return fmt.Sprintf("%s saddr %s jump %s comment %s", nftFamily(ipn), ipn, chain, nftQuote(comment))
+}
+
+// nftQuote quotes s as an nft string; comments made by FormatComment
+// contain quotes themselves
+func nftQuote(s string) string {
+	return `"` + strings.Replace(s, `"`, `'`, -1) + `"`
+}
+
+// nft runs the nft command
+type nft struct {
+	path string
+}
+
+func newNFT() (*nft, error) {
+	path, err := exec.LookPath("nft")
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate nft: %v", err)
+	}
+	return &nft{path: path}, nil
+}
+
+func (n *nft) run(stdin string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(n.path, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// jumpRuleHandles returns the handles of the rules of the postrouting
+// chain that jump to chain with comment
+func (n *nft) jumpRuleHandles(family string, chain string, comment string) ([]string, error) {
+	out, err := n.run("", "-a", "list", "chain", family, nftMasqTable, nftPostroutingHook)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the %s chain: %v", nftPostroutingHook, err)
+	}
+	return parseJumpRuleHandles(out, chain, comment), nil
+}
+
+// parseJumpRuleHandles returns the handles of the rules jumping to chain
+// with comment in the output of `nft -a list chain`
+func parseJumpRuleHandles(out string, chain string, comment string) []string {
+	var handles []string
+	for _, line := range strings.Split(out, "\n") {
+		i := strings.LastIndex(line, "# handle ")
+		if i < 0 {
+			continue
+		}
+		rule := line[:i]
+		if strings.Contains(rule, "jump "+chain+" ") && strings.Contains(rule, "comment "+nftQuote(comment)) {
+			handles = append(handles, strings.TrimSpace(line[i+len("# handle "):]))
+		}
+	}
+	return handles
+}
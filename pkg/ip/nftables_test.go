@@ -0,0 +1,76 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("nftables masquerade rules", func() {
+	It("creates the table and fills the chain of the container", func() {
+		ipn, err := types.ParseCIDR("10.1.2.0/24")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(nftMasqScript(ipn, nil, "masquerade", "CNI-abc", `name: "mynet" id: "dummy"`)).To(Equal(`add table ip cni_masq
+add chain ip cni_masq postrouting { type nat hook postrouting priority 100 ; }
+add chain ip cni_masq CNI-abc
+flush chain ip cni_masq CNI-abc
+add rule ip cni_masq CNI-abc ip daddr 10.1.2.0/24 accept comment "name: 'mynet' id: 'dummy'"
+add rule ip cni_masq CNI-abc ip daddr != 224.0.0.0/4 masquerade comment "name: 'mynet' id: 'dummy'"
+`))
+		Expect(nftJumpRule(ipn, "CNI-abc", "test")).To(Equal(`ip saddr 10.1.2.0/24 jump CNI-abc comment "test"`))
+	})
+
+	It("uses the ip6 family for IPv6", func() {
+		ipn, err := types.ParseCIDR("2001:db8:1::/64")
+		Expect(err).NotTo(HaveOccurred())
+
+		script := nftMasqScript(ipn, nil, "masquerade", "CNI-abc", "test")
+		Expect(script).To(ContainSubstring("add table ip6 cni_masq\n"))
+		Expect(script).To(ContainSubstring(`add rule ip6 cni_masq CNI-abc ip6 daddr != ff00::/8 masquerade comment "test"`))
+	})
+
+	It("returns for the excluded networks before snat", func() {
+		ipn, err := types.ParseCIDR("10.1.2.0/24")
+		Expect(err).NotTo(HaveOccurred())
+		exclude, err := types.ParseCIDR("10.0.0.0/8")
+		Expect(err).NotTo(HaveOccurred())
+
+		script := nftMasqScript(ipn, []*net.IPNet{exclude}, "snat to 192.0.2.10", "CNI-abc", "test")
+		Expect(script).To(HaveSuffix(`add rule ip cni_masq CNI-abc ip daddr 10.1.2.0/24 accept comment "test"
+add rule ip cni_masq CNI-abc ip daddr 10.0.0.0/8 return comment "test"
+add rule ip cni_masq CNI-abc ip daddr != 224.0.0.0/4 snat to 192.0.2.10 comment "test"
+`))
+	})
+
+	It("finds the jump rules of the container only", func() {
+		out := `table ip cni_masq {
+	chain postrouting { # handle 1
+		type nat hook postrouting priority srcnat; policy accept;
+		ip saddr 10.1.2.0/24 jump CNI-abc comment "name: 'mynet' id: 'dummy'" # handle 4
+		ip saddr 10.1.3.0/24 jump CNI-abcd comment "name: 'mynet' id: 'other'" # handle 7
+		ip saddr 10.1.2.0/24 jump CNI-abc comment "name: 'mynet' id: 'dummy'" # handle 9
+	}
+}
+`
+		Expect(parseJumpRuleHandles(out, "CNI-abc", `name: "mynet" id: "dummy"`)).To(Equal([]string{"4", "9"}))
+		Expect(parseJumpRuleHandles(out, "CNI-xyz", "test")).To(BeEmpty())
+	})
+})
@@ -0,0 +1,188 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Attributes from linux/tc_act/tc_skbedit.h; the vendored netlink package
+// has no support for skbedit actions.
+const (
+	tcaSkbeditParms    = 2
+	tcaSkbeditPriority = 3
+)
+
+// dscpMask selects the DSCP bits of the first word of the IPv4 header
+const dscpMask = 0x00fc0000
+
+func htonl(v uint32) uint32 {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return nl.NativeEndian().Uint32(b)
+}
+
+// SetupDSCPPriorityMap adds an ingress u32 classifier to the link for
+// each entry of prioMap, which sets the priority of IPv4 packets with the
+// DSCP of the key to the value. VLAN devices map the priority to the PCP
+// bits of the 802.1Q header through their egress-qos-map, NICs to their
+// traffic classes. The actions continue classification, so filters with
+// a higher prio still see the packets.
+// An ingress qdisc is added to the link if it does not have one.
+// Equivalent to: `tc filter add dev $link ingress prio $prio protocol ip
+// u32 match ip dsfield $dscp<<2 0xfc action skbedit priority $pcp continue`
+func SetupDSCPPriorityMap(link netlink.Link, prio uint16, prioMap map[int]int) error {
+	if err := ensureIngressQdisc(link); err != nil {
+		return err
+	}
+
+	for dscp, pcp := range prioMap {
+		req := nl.NewNetlinkRequest(syscall.RTM_NEWTFILTER, syscall.NLM_F_CREATE|syscall.NLM_F_ACK)
+		req.AddData(&nl.TcMsg{
+			Family:  nl.FAMILY_ALL,
+			Ifindex: int32(link.Attrs().Index),
+			Parent:  ingressParent,
+			Info:    netlink.MakeHandle(prio, htons(syscall.ETH_P_IP)),
+		})
+		req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("u32")))
+
+		options := nl.NewRtAttr(nl.TCA_OPTIONS, nil)
+		sel := nl.TcU32Sel{
+			Flags: nl.TC_U32_TERMINAL,
+			Nkeys: 1,
+			Keys: []nl.TcU32Key{{
+				Mask: htonl(dscpMask),
+				Val:  htonl(uint32(dscp) << 18),
+			}},
+		}
+		nl.NewRtAttrChild(options, nl.TCA_U32_SEL, sel.Serialize())
+
+		acts := nl.NewRtAttrChild(options, nl.TCA_U32_ACT, nil)
+		act := nl.NewRtAttrChild(acts, 1, nil)
+		nl.NewRtAttrChild(act, tcaActKind, nl.ZeroTerminated("skbedit"))
+		actOpts := nl.NewRtAttrChild(act, tcaActOptions, nil)
+		// struct tc_skbedit, only the action is set, to continue
+		action := nl.TC_ACT_UNSPEC
+		parms := make([]byte, sizeofTcGen)
+		nl.NativeEndian().PutUint32(parms[8:], uint32(action))
+		nl.NewRtAttrChild(actOpts, tcaSkbeditParms, parms)
+		nl.NewRtAttrChild(actOpts, tcaSkbeditPriority, nl.Uint32Attr(uint32(pcp)))
+		req.AddData(options)
+
+		if _, err := execute(req, syscall.NETLINK_ROUTE, 0); err != nil {
+			return fmt.Errorf("failed to add filter mapping DSCP %d to priority %d to %q: %v", dscp, pcp, link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// DSCPPriorityMap returns the DSCP to priority map set up on the link by
+// SetupDSCPPriorityMap with the given prio.
+// Equivalent to: `tc filter show dev $link ingress prio $prio`
+func DSCPPriorityMap(link netlink.Link, prio uint16) (map[int]int, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETTFILTER, syscall.NLM_F_DUMP)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(link.Attrs().Index),
+		Parent:  ingressParent,
+	})
+
+	msgs, err := execute(req, syscall.NETLINK_ROUTE, syscall.RTM_NEWTFILTER)
+	if err != nil {
+		return nil, err
+	}
+
+	res := map[int]int{}
+	for _, m := range msgs {
+		msg := nl.DeserializeTcMsg(m)
+		if p, _ := netlink.MajorMinor(msg.Info); p != prio {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return nil, err
+		}
+
+		dscp, pcp := -1, -1
+		for _, attr := range attrs {
+			if attr.Attr.Type != nl.TCA_OPTIONS {
+				continue
+			}
+			opts, err := nl.ParseRouteAttr(attr.Value)
+			if err != nil {
+				return nil, err
+			}
+			for _, opt := range opts {
+				switch opt.Attr.Type {
+				case nl.TCA_U32_SEL:
+					sel := nl.DeserializeTcU32Sel(opt.Value)
+					if sel.Nkeys == 1 && sel.Keys[0].Mask == htonl(dscpMask) {
+						dscp = int(htonl(sel.Keys[0].Val) >> 18)
+					}
+				case nl.TCA_U32_ACT:
+					if pcp, err = skbeditPriority(opt.Value); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		// the dump also contains header entries without a selector
+		if dscp >= 0 && pcp >= 0 {
+			res[dscp] = pcp
+		}
+	}
+	return res, nil
+}
+
+// skbeditPriority returns the priority set by the first skbedit action
+// in the list of actions, or -1 if there is none
+func skbeditPriority(b []byte) (int, error) {
+	acts, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return -1, err
+	}
+	for _, act := range acts {
+		attrs, err := nl.ParseRouteAttr(act.Value)
+		if err != nil {
+			return -1, err
+		}
+		isSkbedit := false
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case tcaActKind:
+				isSkbedit = string(attr.Value[:len(attr.Value)-1]) == "skbedit"
+			case tcaActOptions:
+				if !isSkbedit {
+					continue
+				}
+				opts, err := nl.ParseRouteAttr(attr.Value)
+				if err != nil {
+					return -1, err
+				}
+				for _, opt := range opts {
+					if opt.Attr.Type == tcaSkbeditPriority {
+						return int(nl.NativeEndian().Uint32(opt.Value)), nil
+					}
+				}
+			}
+		}
+	}
+	return -1, nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const qosHandleMajor = 1
+
+// qosIfbName returns the name of the ifb device shaping the traffic
+// received on hostVethName
+func qosIfbName(hostVethName string) string {
+	name := "ifb" + strings.TrimPrefix(hostVethName, "veth")
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	return name
+}
+
+// addHTB adds an htb root qdisc to the link whose default class limits
+// all the traffic sent by the link to kbps.
+// Equivalent to: `tc qdisc add dev $link root handle 1: htb default 1`
+// and `tc class add dev $link parent 1: classid 1:1 htb rate ${kbps}kbit`
+func addHTB(link netlink.Link, kbps uint64) error {
+	qdisc := netlink.NewHtb(netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    netlink.MakeHandle(qosHandleMajor, 0),
+		Parent:    netlink.HANDLE_ROOT,
+	})
+	qdisc.Defcls = 1
+	if err := netlink.QdiscAdd(qdisc); err != nil {
+		return fmt.Errorf("failed to add htb qdisc to %q: %v", link.Attrs().Name, err)
+	}
+
+	class := netlink.NewHtbClass(netlink.ClassAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    netlink.MakeHandle(qosHandleMajor, 1),
+		Parent:    netlink.MakeHandle(qosHandleMajor, 0),
+	}, netlink.HtbClassAttrs{
+		Rate: kbps * 1000,
+	})
+	if err := netlink.ClassAdd(class); err != nil {
+		return fmt.Errorf("failed to add htb class to %q: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// SetupQoS shapes the traffic of a container on the host end of its veth.
+// ingressKbps limits the traffic the host sends to the container, with an
+// htb root qdisc on the veth. egressKbps limits the traffic the container
+// sends, which is received on the veth: it is redirected to an ifb device
+// with an htb root qdisc. A zero rate means no shaping.
+func SetupQoS(hostVethName string, egressKbps, ingressKbps uint64) error {
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+
+	if ingressKbps > 0 {
+		if err = addHTB(hostVeth, ingressKbps); err != nil {
+			return err
+		}
+	}
+
+	if egressKbps == 0 {
+		return nil
+	}
+
+	ifbName := qosIfbName(hostVethName)
+	ifb := &netlink.Ifb{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: ifbName,
+			MTU:  hostVeth.Attrs().MTU,
+		},
+	}
+	if err = netlink.LinkAdd(ifb); err != nil {
+		return fmt.Errorf("failed to add ifb device %q: %v", ifbName, err)
+	}
+	ifbLink, err := netlink.LinkByName(ifbName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifbName, err)
+	}
+	if err = netlink.LinkSetUp(ifbLink); err != nil {
+		return fmt.Errorf("failed to set %q up: %v", ifbName, err)
+	}
+	if err = addHTB(ifbLink, egressKbps); err != nil {
+		return err
+	}
+
+	// redirect everything the container sends to the ifb device, after
+	// any filters classifying the packets
+	if err = ensureIngressQdisc(hostVeth); err != nil {
+		return err
+	}
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: hostVeth.Attrs().Index,
+			Parent:    netlink.MakeHandle(0xffff, 0),
+			Priority:  2,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		RedirIndex: ifbLink.Attrs().Index,
+	}
+	if err = netlink.FilterAdd(filter); err != nil {
+		return fmt.Errorf("failed to redirect the traffic of %q to %q: %v", hostVethName, ifbName, err)
+	}
+	return nil
+}
+
+// TeardownQoS undoes the effects of SetupQoS. The qdiscs of the veth go
+// away with it, so it may already have been deleted.
+func TeardownQoS(hostVethName string) error {
+	if hostVeth, err := netlink.LinkByName(hostVethName); err == nil {
+		qdisc := &netlink.GenericQdisc{
+			QdiscAttrs: netlink.QdiscAttrs{
+				LinkIndex: hostVeth.Attrs().Index,
+				Parent:    netlink.HANDLE_ROOT,
+			},
+			QdiscType: "htb",
+		}
+		if err = netlink.QdiscDel(qdisc); err != nil && err != syscall.ENOENT && err != syscall.EINVAL {
+			return fmt.Errorf("failed to delete htb qdisc of %q: %v", hostVethName, err)
+		}
+	}
+
+	ifbName := qosIfbName(hostVethName)
+	ifb, err := netlink.LinkByName(ifbName)
+	if err != nil {
+		// no egress shaping
+		return nil
+	}
+	if err = netlink.LinkDel(ifb); err != nil {
+		return fmt.Errorf("failed to delete %q: %v", ifbName, err)
+	}
+	return nil
+}
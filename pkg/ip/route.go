@@ -15,9 +15,29 @@
 package ip
 
 import (
+	"fmt"
 	"net"
+	"syscall"
 
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// RTA_PREF and its values from linux/rtnetlink.h and linux/icmpv6.h; the
+// vendored netlink package has no support for route preferences.
+const (
+	rtaPref = 20
+
+	icmpv6RouterPrefMedium = 0x0
+	icmpv6RouterPrefHigh   = 0x1
+	icmpv6RouterPrefLow    = 0x3
+)
+
+// Router preferences of RFC 4191, as used by types.Route
+const (
+	RouterPrefLow    = -1
+	RouterPrefMedium = 0
+	RouterPrefHigh   = 1
 )
 
 // AddDefaultRoute sets the default route on the given gateway.
@@ -36,6 +56,167 @@ func AddRoute(ipn *net.IPNet, gw net.IP, dev netlink.Link) error {
 	})
 }
 
+// RouteOptions are the attributes of a route that the vendored netlink
+// package cannot set
+type RouteOptions struct {
+	// Metric is the priority of the route; lower is preferred and 0
+	// leaves the kernel default
+	Metric int
+	// RouterPreference is the RFC 4191 preference of the router of an
+	// IPv6 route, one of RouterPrefLow, RouterPrefMedium and RouterPrefHigh
+	RouterPreference int
+}
+
+// AddRouteWithPreference adds a universally-scoped IPv6 route to a device
+// with the router preference pref, one of RouterPrefLow, RouterPrefMedium
+// and RouterPrefHigh.
+// Equivalent to: `ip -6 route add $ipn via $gw dev $dev pref $pref`
+func AddRouteWithPreference(ipn *net.IPNet, gw net.IP, dev netlink.Link, pref int) error {
+	if pref < RouterPrefLow || pref > RouterPrefHigh {
+		return fmt.Errorf("invalid router preference %d", pref)
+	}
+	if ipn.IP.To4() != nil {
+		return fmt.Errorf("router preferences apply to IPv6 routes only")
+	}
+	return AddRouteWithOptions(ipn, gw, dev, RouteOptions{RouterPreference: pref})
+}
+
+// AddRouteWithOptions adds a universally-scoped route to a device with the
+// metric and router preference of opts.
+// Equivalent to: `ip route add $ipn via $gw dev $dev metric $metric pref $pref`
+func AddRouteWithOptions(ipn *net.IPNet, gw net.IP, dev netlink.Link, opts RouteOptions) error {
+	var rtaPrefValue uint8
+	switch opts.RouterPreference {
+	case RouterPrefLow:
+		rtaPrefValue = icmpv6RouterPrefLow
+	case RouterPrefMedium:
+		rtaPrefValue = icmpv6RouterPrefMedium
+	case RouterPrefHigh:
+		rtaPrefValue = icmpv6RouterPrefHigh
+	default:
+		return fmt.Errorf("invalid router preference %d", opts.RouterPreference)
+	}
+	if opts.Metric < 0 {
+		return fmt.Errorf("invalid route metric %d", opts.Metric)
+	}
+
+	family, dstIP, gwIP := syscall.AF_INET6, ipn.IP.To16(), gw.To16()
+	if ipn.IP.To4() != nil {
+		if opts.RouterPreference != RouterPrefMedium {
+			return fmt.Errorf("router preferences apply to IPv6 routes only")
+		}
+		family, dstIP, gwIP = syscall.AF_INET, ipn.IP.To4(), gw.To4()
+	}
+
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	msg := nl.NewRtMsg()
+	msg.Family = uint8(family)
+	dstLen, _ := ipn.Mask.Size()
+	msg.Dst_len = uint8(dstLen)
+	req.AddData(msg)
+
+	req.AddData(nl.NewRtAttr(syscall.RTA_DST, dstIP))
+	if gw != nil {
+		req.AddData(nl.NewRtAttr(syscall.RTA_GATEWAY, gwIP))
+	}
+	req.AddData(nl.NewRtAttr(syscall.RTA_OIF, nl.Uint32Attr(uint32(dev.Attrs().Index))))
+	if opts.Metric != 0 {
+		req.AddData(nl.NewRtAttr(syscall.RTA_PRIORITY, nl.Uint32Attr(uint32(opts.Metric))))
+	}
+	if family == syscall.AF_INET6 {
+		req.AddData(nl.NewRtAttr(rtaPref, []byte{rtaPrefValue}))
+	}
+
+	_, err := execute(req, syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// RoutePreference returns the router preference of the IPv6 route to dst
+// through dev
+func RoutePreference(dst *net.IPNet, dev netlink.Link) (int, error) {
+	attrs, err := routeAttrs(dst, dev)
+	if err != nil {
+		return 0, err
+	}
+
+	pref := RouterPrefMedium
+	for _, attr := range attrs {
+		if attr.Attr.Type != rtaPref {
+			continue
+		}
+		switch attr.Value[0] {
+		case icmpv6RouterPrefLow:
+			pref = RouterPrefLow
+		case icmpv6RouterPrefHigh:
+			pref = RouterPrefHigh
+		}
+	}
+	return pref, nil
+}
+
+// RouteMetric returns the metric of the route to dst through dev
+func RouteMetric(dst *net.IPNet, dev netlink.Link) (int, error) {
+	attrs, err := routeAttrs(dst, dev)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, attr := range attrs {
+		if attr.Attr.Type == syscall.RTA_PRIORITY {
+			return int(nl.NativeEndian().Uint32(attr.Value[0:4])), nil
+		}
+	}
+	return 0, nil
+}
+
+// routeAttrs returns the attributes of the first route to dst through dev
+// of the main table
+func routeAttrs(dst *net.IPNet, dev netlink.Link) ([]syscall.NetlinkRouteAttr, error) {
+	family, zero := syscall.AF_INET6, net.IPv6zero
+	if dst.IP.To4() != nil {
+		family, zero = syscall.AF_INET, net.IPv4zero
+	}
+
+	req := nl.NewNetlinkRequest(syscall.RTM_GETROUTE, syscall.NLM_F_DUMP)
+	msg := nl.NewRtMsg()
+	msg.Family = uint8(family)
+	req.AddData(msg)
+
+	msgs, err := execute(req, syscall.NETLINK_ROUTE, syscall.RTM_NEWROUTE)
+	if err != nil {
+		return nil, err
+	}
+
+	dstLen, _ := dst.Mask.Size()
+	for _, m := range msgs {
+		rt := nl.DeserializeRtMsg(m)
+		if int(rt.Dst_len) != dstLen || rt.Table != syscall.RT_TABLE_MAIN {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[rt.Len():])
+		if err != nil {
+			return nil, err
+		}
+
+		routeDst, oif := net.IP(nil), -1
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_DST:
+				routeDst = net.IP(attr.Value)
+			case syscall.RTA_OIF:
+				oif = int(nl.NativeEndian().Uint32(attr.Value[0:4]))
+			}
+		}
+		if dstLen == 0 && routeDst == nil {
+			routeDst = zero
+		}
+		if oif == dev.Attrs().Index && routeDst.Equal(dst.IP) {
+			return attrs, nil
+		}
+	}
+	return nil, fmt.Errorf("no route to %v through %q", dst, dev.Attrs().Name)
+}
+
 // AddHostRoute adds a host-scoped route to a device.
 func AddHostRoute(ipn *net.IPNet, gw net.IP, dev netlink.Link) error {
 	return netlink.RouteAdd(&netlink.Route{
@@ -45,3 +226,25 @@ func AddHostRoute(ipn *net.IPNet, gw net.IP, dev netlink.Link) error {
 		Gw:        gw,
 	})
 }
+
+// DetectMTU returns the MTU of the interface of the default route of the
+// host, preferring IPv4, or an error if there is no default route.
+func DetectMTU() (int, error) {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteList(nil, family)
+		if err != nil {
+			return 0, fmt.Errorf("failed to list routes: %v", err)
+		}
+		for _, route := range routes {
+			if route.Dst != nil || route.LinkIndex == 0 {
+				continue
+			}
+			link, err := netlink.LinkByIndex(route.LinkIndex)
+			if err != nil {
+				return 0, fmt.Errorf("failed to lookup the link of the default route: %v", err)
+			}
+			return link.Attrs().MTU, nil
+		}
+	}
+	return 0, fmt.Errorf("no default route")
+}
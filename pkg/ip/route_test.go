@@ -0,0 +1,93 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"net"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("routes", func() {
+	var testNS ns.NetNS
+
+	BeforeEach(func() {
+		var err error
+		testNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(testNS.Close()).To(Succeed())
+	})
+
+	It("adds IPv6 routes with a router preference", func() {
+		err := testNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := makeVethPair("veth0", "veth1", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+
+			for dst, pref := range map[string]int{
+				"2001:db8:1::/64": RouterPrefHigh,
+				"2001:db8:2::/64": RouterPrefLow,
+				"2001:db8:3::/64": RouterPrefMedium,
+			} {
+				_, ipn, err := net.ParseCIDR(dst)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(AddRouteWithPreference(ipn, nil, link, pref)).To(Succeed())
+				Expect(RoutePreference(ipn, link)).To(Equal(pref))
+			}
+
+			_, ipn, _ := net.ParseCIDR("10.0.0.0/8")
+			Expect(AddRouteWithPreference(ipn, nil, link, RouterPrefHigh)).To(MatchError("router preferences apply to IPv6 routes only"))
+			Expect(AddRouteWithPreference(ipn, nil, link, 2)).To(MatchError("invalid router preference 2"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("adds routes with a metric", func() {
+		err := testNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := makeVethPair("veth0", "veth1", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+			addr, err := netlink.ParseAddr("10.1.2.3/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(link, addr)).To(Succeed())
+
+			_, ipn, _ := net.ParseCIDR("0.0.0.0/0")
+			Expect(AddRouteWithOptions(ipn, net.ParseIP("10.1.2.1"), link, RouteOptions{Metric: 100})).To(Succeed())
+			Expect(RouteMetric(ipn, link)).To(Equal(100))
+
+			_, ipn, _ = net.ParseCIDR("2001:db8:1::/64")
+			opts := RouteOptions{Metric: 200, RouterPreference: RouterPrefHigh}
+			Expect(AddRouteWithOptions(ipn, nil, link, opts)).To(Succeed())
+			Expect(RouteMetric(ipn, link)).To(Equal(200))
+			Expect(RoutePreference(ipn, link)).To(Equal(RouterPrefHigh))
+
+			Expect(AddRouteWithOptions(ipn, nil, link, RouteOptions{Metric: -1})).To(MatchError("invalid route metric -1"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
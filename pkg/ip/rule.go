@@ -0,0 +1,156 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Attributes and actions from linux/fib_rules.h; the vendored netlink
+// package has no support for policy routing rules.
+const (
+	fraSrc      = 2
+	fraPriority = 6
+	fraFwmark   = 10
+	fraTable    = 15
+	fraFwmask   = 16
+
+	frActToTbl = 1
+)
+
+// Rule is a policy routing rule, as managed by "ip rule".
+// Zero values mean the selector is not used.
+type Rule struct {
+	Family   int
+	Priority int
+	Table    int
+	Mark     uint32
+	Mask     uint32
+	Src      *net.IPNet
+}
+
+func (r Rule) String() string {
+	return fmt.Sprintf("{Priority: %d Table: %d Mark: %#x/%#x Src: %s}", r.Priority, r.Table, r.Mark, r.Mask, r.Src)
+}
+
+// AddRule adds a policy routing rule.
+// Equivalent to: `ip rule add $rule`
+func AddRule(rule *Rule) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWRULE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	return ruleHandle(rule, req)
+}
+
+// DelRule removes a policy routing rule.
+// Equivalent to: `ip rule del $rule`
+func DelRule(rule *Rule) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_DELRULE, syscall.NLM_F_ACK)
+	return ruleHandle(rule, req)
+}
+
+func ruleFamily(rule *Rule) int {
+	switch {
+	case rule.Src != nil:
+		return nl.GetIPFamily(rule.Src.IP)
+	case rule.Family != 0:
+		return rule.Family
+	}
+	return netlink.FAMILY_V4
+}
+
+func ruleHandle(rule *Rule, req *nl.NetlinkRequest) error {
+	// fib_rule_hdr has the same layout as rtmsg
+	msg := &nl.RtMsg{}
+	msg.Family = uint8(ruleFamily(rule))
+	msg.Type = frActToTbl
+	if rule.Table > 0 && rule.Table < 256 {
+		msg.Table = uint8(rule.Table)
+	}
+	req.AddData(msg)
+
+	if rule.Src != nil {
+		srcLen, _ := rule.Src.Mask.Size()
+		msg.Src_len = uint8(srcLen)
+		srcData := rule.Src.IP.To4()
+		if msg.Family != netlink.FAMILY_V4 {
+			srcData = rule.Src.IP.To16()
+		}
+		req.AddData(nl.NewRtAttr(fraSrc, srcData))
+	}
+	if rule.Table > 0 {
+		req.AddData(nl.NewRtAttr(fraTable, nl.Uint32Attr(uint32(rule.Table))))
+	}
+	if rule.Priority > 0 {
+		req.AddData(nl.NewRtAttr(fraPriority, nl.Uint32Attr(uint32(rule.Priority))))
+	}
+	if rule.Mark != 0 {
+		req.AddData(nl.NewRtAttr(fraFwmark, nl.Uint32Attr(rule.Mark)))
+		if rule.Mask != 0 {
+			req.AddData(nl.NewRtAttr(fraFwmask, nl.Uint32Attr(rule.Mask)))
+		}
+	}
+
+	_, err := execute(req, syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// RuleList gets a list of policy routing rules of the given family.
+// Equivalent to: `ip rule show`
+func RuleList(family int) ([]Rule, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETRULE, syscall.NLM_F_DUMP)
+	msg := &nl.RtMsg{}
+	msg.Family = uint8(family)
+	req.AddData(msg)
+
+	msgs, err := execute(req, syscall.NETLINK_ROUTE, syscall.RTM_NEWRULE)
+	if err != nil {
+		return nil, err
+	}
+
+	native := nl.NativeEndian()
+	var res []Rule
+	for _, m := range msgs {
+		msg := nl.DeserializeRtMsg(m)
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return nil, err
+		}
+
+		rule := Rule{Family: int(msg.Family), Table: int(msg.Table)}
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case fraSrc:
+				rule.Src = &net.IPNet{
+					IP:   attr.Value,
+					Mask: net.CIDRMask(int(msg.Src_len), 8*len(attr.Value)),
+				}
+			case fraTable:
+				rule.Table = int(native.Uint32(attr.Value[0:4]))
+			case fraPriority:
+				rule.Priority = int(native.Uint32(attr.Value[0:4]))
+			case fraFwmark:
+				rule.Mark = native.Uint32(attr.Value[0:4])
+			case fraFwmask:
+				rule.Mask = native.Uint32(attr.Value[0:4])
+			}
+		}
+		res = append(res, rule)
+	}
+	return res, nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Constants from linux/bpf.h and linux/if_link.h; the vendored netlink
+// package does not support XDP
+const (
+	bpfProgLoad    = 5
+	bpfProgTypeXDP = 6
+	xdpPass        = 2
+
+	iflaNumRxQueues = 32
+	iflaXDP         = 43
+	iflaXDPFD       = 1
+	iflaXDPAttached = 2
+	iflaXDPFlags    = 3
+	iflaXDPProgID   = 4
+
+	// XDPFlagsDrvMode attaches an XDP program in native (driver) mode
+	XDPFlagsDrvMode = 1 << 2
+
+	// XDPAttachedDrv is the XDPAttached mode of a program attached in
+	// native mode
+	XDPAttachedDrv = 1
+)
+
+// bpfInsn is a struct bpf_insn
+type bpfInsn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+// LoadXDPPass loads an XDP program passing all packets on to the network
+// stack, for links that need an XDP program attached to run in native
+// XDP mode. The caller must close the returned file descriptor.
+func LoadXDPPass() (int, error) {
+	insns := []bpfInsn{
+		{code: 0xb7, imm: xdpPass}, // r0 = XDP_PASS
+		{code: 0x95},               // exit
+	}
+	license, err := syscall.BytePtrFromString("GPL")
+	if err != nil {
+		return -1, err
+	}
+
+	// union bpf_attr for BPF_PROG_LOAD, up to kern_version
+	attr := struct {
+		progType    uint32
+		insnCnt     uint32
+		insns       uint64
+		license     uint64
+		logLevel    uint32
+		logSize     uint32
+		logBuf      uint64
+		kernVersion uint32
+		progFlags   uint32
+	}{
+		progType: bpfProgTypeXDP,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(license))),
+	}
+
+	fd, _, errno := syscall.Syscall(sysBPF, bpfProgLoad, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return -1, fmt.Errorf("failed to load XDP program: %v", errno)
+	}
+	return int(fd), nil
+}
+
+// LinkSetXDP attaches the XDP program progFD to the link, or detaches
+// the current one if progFD is -1. flags are XDP_FLAGS_* values, such
+// as XDPFlagsDrvMode.
+// Equivalent to: `ip link set $link xdpdrv fd $progFD`
+func LinkSetXDP(link netlink.Link, progFD int, flags uint32) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_SETLINK, syscall.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+
+	xdp := nl.NewRtAttr(iflaXDP|syscall.NLA_F_NESTED, nil)
+	nl.NewRtAttrChild(xdp, iflaXDPFD, nl.Uint32Attr(uint32(int32(progFD))))
+	nl.NewRtAttrChild(xdp, iflaXDPFlags, nl.Uint32Attr(flags))
+	req.AddData(xdp)
+
+	if _, err := execute(req, syscall.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("failed to set XDP program of %q: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// XDPInfo describes the XDP program attached to a link
+type XDPInfo struct {
+	// Attached is the XDP_ATTACHED_* mode, 0 if no program is attached
+	Attached uint8
+	ProgID   uint32
+}
+
+// LinkXDP returns the XDP program attached to the link
+func LinkXDP(link netlink.Link) (*XDPInfo, error) {
+	value, err := linkAttr(link, iflaXDP)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &XDPInfo{}
+	attrs, err := nl.ParseRouteAttr(value)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range attrs {
+		switch a.Attr.Type {
+		case iflaXDPAttached:
+			info.Attached = a.Value[0]
+		case iflaXDPProgID:
+			info.ProgID = nl.NativeEndian().Uint32(a.Value[0:4])
+		}
+	}
+	return info, nil
+}
+
+// LinkNumRxQueues returns the number of receive queues of the link
+func LinkNumRxQueues(link netlink.Link) (int, error) {
+	value, err := linkAttr(link, iflaNumRxQueues)
+	if err != nil {
+		return 0, err
+	}
+	if len(value) < 4 {
+		return 0, fmt.Errorf("kernel did not report the receive queues of %q", link.Attrs().Name)
+	}
+	return int(nl.NativeEndian().Uint32(value[0:4])), nil
+}
+
+// linkAttr returns the value of a single IFLA_* attribute of a link, or
+// nil if the kernel did not report it
+func linkAttr(link netlink.Link, attr int) ([]byte, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, 0)
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+
+	msgs, err := execute(req, syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, fmt.Errorf("no link found for %q", link.Attrs().Name)
+	}
+
+	attrs, err := nl.ParseRouteAttr(msgs[0][syscall.SizeofIfInfomsg:])
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range attrs {
+		if int(a.Attr.Type) == attr {
+			return a.Value, nil
+		}
+	}
+	return nil, nil
+}
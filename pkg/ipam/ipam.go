@@ -16,6 +16,7 @@ package ipam
 
 import (
 	"fmt"
+	"net"
 	"os"
 
 	"github.com/Sirupsen/logrus"
@@ -34,21 +35,84 @@ func ExecDel(plugin string, netconf []byte) error {
 	return invoke.DelegateDel(plugin, netconf)
 }
 
+// Options controls how ConfigureIfaceWithOptions applies an IPAM result
+type Options struct {
+	// SkipConflictCheck allows routes to be added even if they clash
+	// with an existing route through another interface
+	SkipConflictCheck bool
+	// AddressScope is the scope of the addresses, as in
+	// types.NetConf.AddressScope
+	AddressScope string
+}
+
+// addressScope returns the netlink scope named by scope
+func addressScope(scope string) (netlink.Scope, error) {
+	switch scope {
+	case "", "global":
+		return netlink.SCOPE_UNIVERSE, nil
+	case "link":
+		return netlink.SCOPE_LINK, nil
+	case "host":
+		return netlink.SCOPE_HOST, nil
+	}
+	return 0, fmt.Errorf("invalid addressScope %q, must be one of global, link or host", scope)
+}
+
 // ConfigureIface takes the result of IPAM plugin and
 // applies to the ifName interface
 func ConfigureIface(ifName string, res *types.Result) error {
+	return ConfigureIfaceWithOptions(ifName, res, Options{})
+}
+
+// ConfigureIfaceWithOptions is like ConfigureIface. Unless
+// opts.SkipConflictCheck is set, it fails without changing the
+// interface if any route in the result would overwrite an existing
+// route through a different interface.
+func ConfigureIfaceWithOptions(ifName string, res *types.Result, opts Options) error {
+	scope, err := addressScope(opts.AddressScope)
+	if err != nil {
+		return err
+	}
+
 	link, err := netlink.LinkByName(ifName)
 	if err != nil {
 		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
 	}
 
+	ipcs := res.IPConfigs()
+
+	if !opts.SkipConflictCheck {
+		for _, ipc := range ipcs {
+			if err := checkRouteConflicts(link, ipc); err != nil {
+				return err
+			}
+		}
+	}
+
 	if err := netlink.LinkSetUp(link); err != nil {
 		return fmt.Errorf("failed to set %q UP: %v", ifName, err)
 	}
 
-	// TODO(eyakubovich): IPv6
-	addr := &netlink.Addr{IPNet: &res.IP4.IP, Label: ""}
-	if err = netlink.AddrAdd(link, addr); err != nil {
+	for _, ipc := range ipcs {
+		if err := configureIP(link, ifName, ipc, scope); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// configureIP adds the address of ipc with the given scope and its routes
+// to link
+func configureIP(link netlink.Link, ifName string, ipc *types.IPConfig, scope netlink.Scope) error {
+	addr := &netlink.Addr{IPNet: &ipc.IP, Label: ""}
+	var err error
+	if scope != netlink.SCOPE_UNIVERSE {
+		err = ip.AddAddrWithScope(link, &ipc.IP, scope)
+	} else {
+		err = netlink.AddrAdd(link, addr)
+	}
+	if err != nil {
 		if err.Error() == "file exists" {
 			logrus.Infof("Interface %q already has IP address: %v, no worries", ifName, addr)
 		} else {
@@ -56,12 +120,21 @@ func ConfigureIface(ifName string, res *types.Result) error {
 		}
 	}
 
-	for _, r := range res.IP4.Routes {
+	for _, r := range ipc.Routes {
 		gw := r.GW
 		if gw == nil {
-			gw = res.IP4.Gateway
+			gw = ipc.Gateway
+		}
+		var err error
+		if r.Metric != 0 || r.RouterPreference != ip.RouterPrefMedium {
+			err = ip.AddRouteWithOptions(&r.Dst, gw, link, ip.RouteOptions{
+				Metric:           r.Metric,
+				RouterPreference: r.RouterPreference,
+			})
+		} else {
+			err = ip.AddRoute(&r.Dst, gw, link)
 		}
-		if err = ip.AddRoute(&r.Dst, gw, link); err != nil {
+		if err != nil {
 			// we skip over duplicate routes as we assume the first one wins
 			if !os.IsExist(err) {
 				return fmt.Errorf("failed to add route '%v via %v dev %v': %v", r.Dst, gw, ifName, err)
@@ -71,3 +144,70 @@ func ConfigureIface(ifName string, res *types.Result) error {
 
 	return nil
 }
+
+func routeDst(dst *net.IPNet, family int) string {
+	if dst == nil {
+		if family == netlink.FAMILY_V6 {
+			return "::/0"
+		}
+		return "0.0.0.0/0"
+	}
+	return ip.Network(dst).String()
+}
+
+// checkRouteConflicts returns an error if a route of ipc has the same
+// destination and metric as an existing route through a link other than
+// link. The kernel would refuse to add such a route, while one with
+// another metric, e.g. the default route of a standby interface, can sit
+// next to it. Both are in the main table, the only one routes are added
+// to and listed from.
+func checkRouteConflicts(link netlink.Link, ipc *types.IPConfig) error {
+	family := netlink.FAMILY_V4
+	if ipc.IP.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+
+	existing, err := netlink.RouteList(nil, family)
+	if err != nil {
+		return fmt.Errorf("failed to list routes: %v", err)
+	}
+
+	for _, r := range ipc.Routes {
+		dst := routeDst(&r.Dst, family)
+		metric := routeMetric(r.Metric, family)
+		for _, e := range existing {
+			if e.LinkIndex == link.Attrs().Index || routeDst(e.Dst, family) != dst {
+				continue
+			}
+			dev, err := netlink.LinkByIndex(e.LinkIndex)
+			if err != nil {
+				continue
+			}
+			_, eDst, _ := net.ParseCIDR(dst)
+			eMetric, err := ip.RouteMetric(eDst, dev)
+			if err != nil {
+				return fmt.Errorf("failed to read the metric of the route to %v through %q: %v", dst, dev.Attrs().Name, err)
+			}
+			if eMetric != metric {
+				continue
+			}
+
+			gw := r.GW
+			if gw == nil {
+				gw = ipc.Gateway
+			}
+			return fmt.Errorf("route '%v via %v dev %v metric %v' conflicts with existing route '%v via %v dev %v metric %v'",
+				dst, gw, link.Attrs().Name, metric, dst, e.Gw, dev.Attrs().Name, eMetric)
+		}
+	}
+	return nil
+}
+
+// routeMetric returns the metric the kernel gives a route added with
+// metric: IPv6 routes without one get 1024
+func routeMetric(metric int, family int) int {
+	if metric == 0 && family == netlink.FAMILY_V6 {
+		return 1024
+	}
+	return metric
+}
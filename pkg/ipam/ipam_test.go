@@ -0,0 +1,168 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam_test
+
+import (
+	"net"
+
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/ipam"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ConfigureIface", func() {
+	var testNS ns.NetNS
+
+	BeforeEach(func() {
+		var err error
+		testNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testNS.Do(func(ns.NetNS) error {
+			return netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "eth0"},
+				PeerName:  "eth1",
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(testNS.Close()).To(Succeed())
+	})
+
+	configure := func(scope string) (netlink.Scope, error) {
+		var addrScope netlink.Scope
+		err := testNS.Do(func(ns.NetNS) error {
+			ipn, err := types.ParseCIDR("10.1.2.3/24")
+			Expect(err).NotTo(HaveOccurred())
+			res := &types.Result{IP4: &types.IPConfig{IP: *ipn}}
+			if err := ipam.ConfigureIfaceWithOptions("eth0", res, ipam.Options{AddressScope: scope}); err != nil {
+				return err
+			}
+
+			link, err := netlink.LinkByName("eth0")
+			Expect(err).NotTo(HaveOccurred())
+			addrScope, err = ip.AddrScope(link, ipn.IP)
+			return err
+		})
+		return addrScope, err
+	}
+
+	It("adds addresses with global scope by default", func() {
+		Expect(configure("")).To(Equal(netlink.SCOPE_UNIVERSE))
+	})
+
+	It("adds addresses with the configured scope", func() {
+		Expect(configure("host")).To(Equal(netlink.SCOPE_HOST))
+	})
+
+	It("adds addresses with link scope", func() {
+		Expect(configure("link")).To(Equal(netlink.SCOPE_LINK))
+	})
+
+	It("rejects an unknown scope", func() {
+		_, err := configure("site")
+		Expect(err).To(MatchError(`invalid addressScope "site", must be one of global, link or host`))
+	})
+
+	It("adds routes with their metric", func() {
+		err := testNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName("eth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+
+			ipn, err := types.ParseCIDR("10.1.2.3/24")
+			Expect(err).NotTo(HaveOccurred())
+			dst, err := types.ParseCIDR("0.0.0.0/0")
+			Expect(err).NotTo(HaveOccurred())
+			res := &types.Result{IP4: &types.IPConfig{
+				IP: *ipn,
+				Routes: []types.Route{
+					{Dst: *dst, GW: net.ParseIP("10.1.2.1"), Metric: 100},
+					{Dst: *dst, GW: net.ParseIP("10.1.2.2"), Metric: 200},
+				},
+			}}
+			Expect(ipam.ConfigureIface("eth0", res)).To(Succeed())
+
+			routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			var gws []string
+			for _, r := range routes {
+				if r.Dst == nil {
+					gws = append(gws, r.Gw.String())
+				}
+			}
+			Expect(gws).To(ConsistOf("10.1.2.1", "10.1.2.2"))
+			Expect(ip.RouteMetric(dst, link)).To(Equal(100))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Context("with a default route through another interface", func() {
+		addDefaultRoute := func(metric int) error {
+			var err error
+			nsErr := testNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				ipn, e := types.ParseCIDR("10.1.2.3/24")
+				Expect(e).NotTo(HaveOccurred())
+				dst, e := types.ParseCIDR("0.0.0.0/0")
+				Expect(e).NotTo(HaveOccurred())
+				res := &types.Result{IP4: &types.IPConfig{
+					IP:     *ipn,
+					Routes: []types.Route{{Dst: *dst, GW: net.ParseIP("10.1.2.1"), Metric: metric}},
+				}}
+				err = ipam.ConfigureIface("eth0", res)
+				return nil
+			})
+			Expect(nsErr).NotTo(HaveOccurred())
+			return err
+		}
+
+		BeforeEach(func() {
+			err := testNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				ipn, err := types.ParseCIDR("10.1.3.3/24")
+				Expect(err).NotTo(HaveOccurred())
+				dst, err := types.ParseCIDR("0.0.0.0/0")
+				Expect(err).NotTo(HaveOccurred())
+				res := &types.Result{IP4: &types.IPConfig{
+					IP:     *ipn,
+					Routes: []types.Route{{Dst: *dst, GW: net.ParseIP("10.1.3.1"), Metric: 100}},
+				}}
+				return ipam.ConfigureIface("eth1", res)
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("adds a default route with another metric", func() {
+			Expect(addDefaultRoute(200)).To(Succeed())
+		})
+
+		It("rejects a default route with the same metric", func() {
+			Expect(addDefaultRoute(100)).To(MatchError("route '0.0.0.0/0 via 10.1.2.1 dev eth0 metric 100' conflicts with existing route '0.0.0.0/0 via 10.1.3.1 dev eth1 metric 100'"))
+		})
+	})
+})
@@ -0,0 +1,114 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package modprobe makes sure the kernel modules a plugin relies on are
+// loaded before it uses them.
+package modprobe
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Swapped out by tests
+var (
+	procModules = "/proc/modules"
+	sysModule   = "/sys/module"
+
+	modulesBuiltin = func() (string, error) {
+		release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join("/lib/modules", strings.TrimSpace(string(release)), "modules.builtin"), nil
+	}
+
+	modprobe = func(name string) error {
+		out, err := exec.Command("modprobe", name).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+)
+
+// EnsureModule loads the kernel module name with modprobe unless it is
+// already loaded or built into the kernel
+func EnsureModule(name string) error {
+	name = strings.Replace(name, "-", "_", -1)
+
+	loaded, err := isLoaded(name)
+	if err != nil || loaded {
+		return err
+	}
+
+	// built in modules are missing from /proc/modules. Those with
+	// parameters show up in /sys/module, the rest only in modules.builtin
+	if _, err := os.Stat(filepath.Join(sysModule, name)); err == nil {
+		return nil
+	}
+	if isBuiltin(name) {
+		return nil
+	}
+
+	if err := modprobe(name); err != nil {
+		return fmt.Errorf("failed to load kernel module %q: %v", name, err)
+	}
+	return nil
+}
+
+// isLoaded reports whether the module is listed in /proc/modules. A
+// kernel without /proc/modules has no loadable modules, everything it
+// supports is built in.
+func isLoaded(name string) (bool, error) {
+	data, err := ioutil.ReadFile(procModules)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %v", procModules, err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isBuiltin reports whether the module is listed in the modules.builtin
+// file of the running kernel. A missing file means we cannot tell.
+func isBuiltin(name string) bool {
+	path, err := modulesBuiltin()
+	if err != nil {
+		return false
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		module := strings.TrimSuffix(filepath.Base(strings.TrimSpace(line)), ".ko")
+		if strings.Replace(module, "-", "_", -1) == name {
+			return true
+		}
+	}
+	return false
+}
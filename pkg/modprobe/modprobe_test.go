@@ -0,0 +1,104 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modprobe
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EnsureModule", func() {
+	var (
+		tmpDir string
+		loaded []string
+
+		origProcModules, origSysModule string
+		origModprobe                   func(string) error
+		origModulesBuiltin             func() (string, error)
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "modprobe")
+		Expect(err).NotTo(HaveOccurred())
+
+		origProcModules, origSysModule, origModprobe = procModules, sysModule, modprobe
+		origModulesBuiltin = modulesBuiltin
+		procModules = filepath.Join(tmpDir, "modules")
+		sysModule = filepath.Join(tmpDir, "module")
+		modulesBuiltin = func() (string, error) {
+			return filepath.Join(tmpDir, "modules.builtin"), nil
+		}
+		Expect(os.Mkdir(sysModule, 0755)).To(Succeed())
+
+		loaded = nil
+		modprobe = func(name string) error {
+			loaded = append(loaded, name)
+			return nil
+		}
+
+		modules := "bridge 126976 0 - Live 0x0000000000000000\n" +
+			"nf_conntrack 172032 1 bridge, Live 0x0000000000000000\n"
+		Expect(ioutil.WriteFile(procModules, []byte(modules), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		procModules, sysModule, modprobe = origProcModules, origSysModule, origModprobe
+		modulesBuiltin = origModulesBuiltin
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("does nothing for a loaded module", func() {
+		Expect(EnsureModule("nf_conntrack")).To(Succeed())
+		Expect(EnsureModule("nf-conntrack")).To(Succeed())
+		Expect(loaded).To(BeEmpty())
+	})
+
+	It("does not mistake a dependency for a loaded module", func() {
+		Expect(EnsureModule("veth")).To(Succeed())
+		Expect(loaded).To(Equal([]string{"veth"}))
+	})
+
+	It("does nothing for a built in module", func() {
+		Expect(os.Mkdir(filepath.Join(sysModule, "veth"), 0755)).To(Succeed())
+		Expect(EnsureModule("veth")).To(Succeed())
+		Expect(loaded).To(BeEmpty())
+	})
+
+	It("does nothing for a built in module without parameters", func() {
+		builtin := "kernel/net/bridge/bridge.ko\nkernel/drivers/net/veth.ko\n"
+		Expect(ioutil.WriteFile(filepath.Join(tmpDir, "modules.builtin"), []byte(builtin), 0644)).To(Succeed())
+		Expect(EnsureModule("veth")).To(Succeed())
+		Expect(loaded).To(BeEmpty())
+	})
+
+	It("does nothing without loadable module support", func() {
+		Expect(os.Remove(procModules)).To(Succeed())
+		Expect(EnsureModule("veth")).To(Succeed())
+		Expect(loaded).To(BeEmpty())
+	})
+
+	It("reports a module that cannot be loaded", func() {
+		modprobe = func(string) error {
+			return errors.New("exit status 1: modprobe: FATAL: Module veth not found")
+		}
+		Expect(EnsureModule("veth")).To(MatchError(`failed to load kernel module "veth": exit status 1: modprobe: FATAL: Module veth not found`))
+	})
+})
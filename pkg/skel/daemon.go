@@ -0,0 +1,258 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// Request is a CNI invocation sent to a plugin running as a daemon.
+// It carries what a one-shot plugin receives via env vars and stdin.
+type Request struct {
+	Command     string `json:"command"`
+	ContainerID string `json:"containerID,omitempty"`
+	Netns       string `json:"netns,omitempty"`
+	IfName      string `json:"ifName,omitempty"`
+	Args        string `json:"args,omitempty"`
+	Path        string `json:"path,omitempty"`
+	StdinData   []byte `json:"stdinData"`
+	// ResultVersion is CNI_RESULT_VERSION of the caller
+	ResultVersion string `json:"resultVersion,omitempty"`
+}
+
+// Response is the reply of a plugin running as a daemon. Exactly one of
+// Result and Error is set.
+type Response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *types.Error    `json:"error,omitempty"`
+}
+
+// RequestFromEnv builds a Request from the CNI env vars and the
+// network configuration read from stdin
+func RequestFromEnv(stdin io.Reader) (*Request, error) {
+	stdinData, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return nil, fmt.Errorf("error reading from stdin: %v", err)
+	}
+
+	return &Request{
+		Command:       os.Getenv("CNI_COMMAND"),
+		ContainerID:   os.Getenv("CNI_CONTAINERID"),
+		Netns:         os.Getenv("CNI_NETNS"),
+		IfName:        os.Getenv("CNI_IFNAME"),
+		Args:          os.Getenv("CNI_ARGS"),
+		Path:          os.Getenv("CNI_PATH"),
+		StdinData:     stdinData,
+		ResultVersion: os.Getenv("CNI_RESULT_VERSION"),
+	}, nil
+}
+
+// SendRequest passes req to the plugin daemon listening on socketPath
+// and waits for its response
+func SendRequest(socketPath string, req *Request) (*Response, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %q: %v", socketPath, err)
+	}
+	defer conn.Close()
+
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	resp := &Response{}
+	if err = json.NewDecoder(conn).Decode(resp); err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	return resp, nil
+}
+
+// PluginServe is the "main" for a plugin running as a daemon. It listens
+// on socketPath and runs the callback for the command of each Request
+// received. cmdCheck may be nil if the plugin does not implement CHECK.
+// The cniVersion of each request is checked against supportedVersions
+// and its result version negotiated as PluginMainWithVersion does.
+//
+// Requests are handled one at a time on the calling goroutine, so a
+// plugin which locked its main thread for namespace operations can keep
+// relying on it.
+func PluginServe(socketPath string, cmdAdd, cmdDel, cmdCheck func(_ *CmdArgs) error, supportedVersions ...string) error {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket %q: %v", socketPath, err)
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %q: %v", socketPath, err)
+	}
+	defer l.Close()
+
+	return serve(l, cmdAdd, cmdDel, cmdCheck, supportedVersions)
+}
+
+func serve(l net.Listener, cmdAdd, cmdDel, cmdCheck func(_ *CmdArgs) error, supportedVersions []string) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		if err = serveConn(conn, cmdAdd, cmdDel, cmdCheck, supportedVersions); err != nil {
+			log.Printf("Error serving request: %v", err)
+		}
+		conn.Close()
+	}
+}
+
+func serveConn(conn net.Conn, cmdAdd, cmdDel, cmdCheck func(_ *CmdArgs) error, supportedVersions []string) error {
+	req := &Request{}
+	if err := json.NewDecoder(conn).Decode(req); err != nil {
+		return fmt.Errorf("failed to read request: %v", err)
+	}
+
+	var resp *Response
+	switch req.Command {
+	case "ADD":
+		resp = handleRequest(req, cmdAdd, supportedVersions)
+	case "DEL":
+		resp = handleRequest(req, cmdDel, supportedVersions)
+	case "CHECK":
+		resp = handleRequest(req, cmdCheck, supportedVersions)
+	default:
+		resp = errorResponse(fmt.Errorf("unknown CNI_COMMAND: %v", req.Command))
+	}
+
+	return json.NewEncoder(conn).Encode(resp)
+}
+
+// handleRequest runs cmd for req. The result a plugin prints to stdout
+// is captured and returned in the Response.
+func handleRequest(req *Request, cmd func(_ *CmdArgs) error, supportedVersions []string) *Response {
+	if cmd == nil {
+		return errorResponse(fmt.Errorf("%s is not supported by this plugin", req.Command))
+	}
+
+	required := map[string]string{"CNI_IFNAME": req.IfName, "CNI_PATH": req.Path}
+	if req.Command == "ADD" {
+		required["CNI_NETNS"] = req.Netns
+	}
+	for name, val := range required {
+		if val == "" {
+			return errorResponse(fmt.Errorf("%v missing from request", name))
+		}
+	}
+
+	// delegated plugins, e.g. IPAM, take their arguments from the env
+	// inherited from the plugin
+	defer setEnv(req)()
+
+	if e := checkVersion(req.StdinData, supportedVersions); e != nil {
+		return &Response{Error: e}
+	}
+	resultVersion, e := negotiateResultVersion(req.StdinData)
+	if e != nil {
+		return &Response{Error: e}
+	}
+
+	cmdArgs := &CmdArgs{
+		ContainerID:   req.ContainerID,
+		Netns:         req.Netns,
+		IfName:        req.IfName,
+		Args:          req.Args,
+		Path:          req.Path,
+		StdinData:     req.StdinData,
+		ResultVersion: resultVersion,
+	}
+
+	out, err := captureStdout(func() error { return cmd(cmdArgs) })
+	if err != nil {
+		resp := errorResponse(err)
+		resp.Error = types.ConvertError(resp.Error, resultVersion)
+		return resp
+	}
+
+	resp := &Response{}
+	if len(bytes.TrimSpace(out)) > 0 {
+		resp.Result = json.RawMessage(out)
+	}
+	return resp
+}
+
+// setEnv exports the CNI env vars of req and returns a func restoring
+// the previous values
+func setEnv(req *Request) func() {
+	vars := map[string]string{
+		"CNI_COMMAND":        req.Command,
+		"CNI_CONTAINERID":    req.ContainerID,
+		"CNI_NETNS":          req.Netns,
+		"CNI_IFNAME":         req.IfName,
+		"CNI_ARGS":           req.Args,
+		"CNI_PATH":           req.Path,
+		"CNI_RESULT_VERSION": req.ResultVersion,
+	}
+
+	saved := map[string]string{}
+	for name, val := range vars {
+		saved[name] = os.Getenv(name)
+		os.Setenv(name, val)
+	}
+
+	return func() {
+		for name, val := range saved {
+			os.Setenv(name, val)
+		}
+	}
+}
+
+func errorResponse(err error) *Response {
+	if e, ok := err.(*types.Error); ok {
+		// don't wrap Error in Error
+		return &Response{Error: e}
+	}
+	return &Response{Error: types.NewError(types.ErrInternal, err.Error(), "")}
+}
+
+// captureStdout runs f with os.Stdout redirected to a pipe and returns
+// what it wrote
+func captureStdout(f func() error) ([]byte, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pipe: %v", err)
+	}
+	defer r.Close()
+
+	outc := make(chan []byte)
+	go func() {
+		out, _ := ioutil.ReadAll(r)
+		outc <- out
+	}()
+
+	stdout := os.Stdout
+	os.Stdout = w
+	err = f()
+	os.Stdout = stdout
+	w.Close()
+
+	return <-outc, err
+}
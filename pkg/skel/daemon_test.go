@@ -0,0 +1,171 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skel
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Daemon", func() {
+	var (
+		dir        string
+		socketPath string
+		listener   net.Listener
+		added      *CmdArgs
+		addedEnv   string
+		checkEnv   string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "skel-daemon")
+		Expect(err).NotTo(HaveOccurred())
+		socketPath = filepath.Join(dir, "plugin.sock")
+		listener, err = net.Listen("unix", socketPath)
+		Expect(err).NotTo(HaveOccurred())
+
+		added = nil
+		fAdd := func(args *CmdArgs) error {
+			added = args
+			addedEnv = os.Getenv("CNI_COMMAND")
+			fmt.Println(`{"ip4": {"ip": "10.1.2.3/24"}}`)
+			return nil
+		}
+		fDel := func(_ *CmdArgs) error {
+			return &types.Error{Code: 7, Msg: "dummy"}
+		}
+		go serve(listener, fAdd, fDel, nil, nil)
+	})
+
+	AfterEach(func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("returns the result printed by the ADD callback", func() {
+		resp, err := SendRequest(socketPath, &Request{
+			Command:     "ADD",
+			ContainerID: "dummy",
+			Netns:       "/var/run/netns/dummy",
+			IfName:      "eth0",
+			Path:        "/opt/cni/bin",
+			StdinData:   []byte(`{"name": "test"}`),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Error).To(BeNil())
+		Expect(resp.Result).To(MatchJSON(`{"ip4": {"ip": "10.1.2.3/24"}}`))
+
+		Expect(added).To(Equal(&CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/var/run/netns/dummy",
+			IfName:      "eth0",
+			Path:        "/opt/cni/bin",
+			StdinData:   []byte(`{"name": "test"}`),
+		}))
+		Expect(addedEnv).To(Equal("ADD"))
+	})
+
+	It("returns the error of the DEL callback", func() {
+		resp, err := SendRequest(socketPath, &Request{Command: "DEL", IfName: "eth0", Path: "/opt/cni/bin"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Result).To(BeNil())
+		Expect(resp.Error).To(Equal(&types.Error{Code: 7, Msg: "dummy"}))
+	})
+
+	It("rejects a request with missing arguments", func() {
+		resp, err := SendRequest(socketPath, &Request{Command: "ADD", IfName: "eth0", Path: "/opt/cni/bin"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Error.Msg).To(Equal("CNI_NETNS missing from request"))
+		Expect(added).To(BeNil())
+	})
+
+	It("rejects CHECK when the plugin does not implement it", func() {
+		resp, err := SendRequest(socketPath, &Request{Command: "CHECK", IfName: "eth0", Path: "/opt/cni/bin"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Error.Msg).To(Equal("CHECK is not supported by this plugin"))
+	})
+
+	Context("with a CHECK callback printing a result", func() {
+		var checkListener net.Listener
+
+		BeforeEach(func() {
+			var err error
+			checkListener, err = net.Listen("unix", filepath.Join(dir, "check.sock"))
+			Expect(err).NotTo(HaveOccurred())
+
+			fCheck := func(args *CmdArgs) error {
+				checkEnv = os.Getenv("CNI_RESULT_VERSION")
+				ip4, err := types.ParseCIDR("10.1.2.3/24")
+				if err != nil {
+					return err
+				}
+				return args.PrintResult(&types.Result{IP4: &types.IPConfig{IP: *ip4}})
+			}
+			go serve(checkListener, nil, nil, fCheck, []string{"0.2.0", "0.3.1"})
+			socketPath = filepath.Join(dir, "check.sock")
+		})
+
+		AfterEach(func() {
+			checkListener.Close()
+		})
+
+		It("prints the result in the version of the request", func() {
+			resp, err := SendRequest(socketPath, &Request{
+				Command:       "CHECK",
+				Netns:         "/var/run/netns/dummy",
+				IfName:        "eth0",
+				Path:          "/opt/cni/bin",
+				StdinData:     []byte(`{"name": "test"}`),
+				ResultVersion: "0.3.1",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Error).To(BeNil())
+			Expect(resp.Result).To(MatchJSON(`{"cniVersion": "0.3.1", "ips": [{"version": "4", "address": "10.1.2.3/24"}], "dns": {}}`))
+			Expect(checkEnv).To(Equal("0.3.1"))
+		})
+
+		It("prints the result in the cniVersion of the configuration", func() {
+			resp, err := SendRequest(socketPath, &Request{
+				Command:   "CHECK",
+				IfName:    "eth0",
+				Path:      "/opt/cni/bin",
+				StdinData: []byte(`{"cniVersion": "0.3.1", "name": "test"}`),
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Error).To(BeNil())
+			Expect(resp.Result).To(MatchJSON(`{"cniVersion": "0.3.1", "ips": [{"version": "4", "address": "10.1.2.3/24"}], "dns": {}}`))
+		})
+
+		It("rejects an unsupported cniVersion", func() {
+			resp, err := SendRequest(socketPath, &Request{
+				Command:   "CHECK",
+				IfName:    "eth0",
+				Path:      "/opt/cni/bin",
+				StdinData: []byte(`{"cniVersion": "0.1.0", "name": "test"}`),
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Error.Code).To(Equal(uint(types.ErrIncompatibleCNIVersion)))
+		})
+	})
+})
@@ -17,6 +17,7 @@
 package skel
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -34,6 +35,18 @@ type CmdArgs struct {
 	Args        string
 	Path        string
 	StdinData   []byte
+	// ResultVersion is the CNI spec version of the result format the
+	// caller asked for, see PrintResult
+	ResultVersion string
+}
+
+// PrintResult prints result in the format of ResultVersion
+func (args *CmdArgs) PrintResult(result *types.Result) error {
+	res, err := types.ConvertResult(result, args.ResultVersion)
+	if err != nil {
+		return err
+	}
+	return res.Print()
 }
 
 type reqForCmdEntry map[string]bool
@@ -41,6 +54,27 @@ type reqForCmdEntry map[string]bool
 // PluginMain is the "main" for a plugin. It accepts
 // two callback functions for add and del commands.
 func PluginMain(cmdAdd, cmdDel func(_ *CmdArgs) error) {
+	PluginMainWithCheck(cmdAdd, cmdDel, nil)
+}
+
+// PluginMainWithCheck is PluginMain for a plugin that also implements
+// the CHECK command. cmdCheck may be nil.
+func PluginMainWithCheck(cmdAdd, cmdDel, cmdCheck func(_ *CmdArgs) error) {
+	PluginMainWithVersion(cmdAdd, cmdDel, cmdCheck)
+}
+
+// PluginMainWithVersion is PluginMainWithCheck for a plugin that only
+// supports the listed CNI spec versions. Requests whose network
+// configuration has another cniVersion fail with an incompatible version
+// error. Without supportedVersions, all versions are accepted.
+func PluginMainWithVersion(cmdAdd, cmdDel, cmdCheck func(_ *CmdArgs) error, supportedVersions ...string) {
+	PluginMainWithCapabilities(cmdAdd, cmdDel, cmdCheck, nil, supportedVersions...)
+}
+
+// PluginMainWithCapabilities is PluginMainWithVersion for a plugin that
+// advertises capabilities, such as "portMappings", in its response to
+// the VERSION command
+func PluginMainWithCapabilities(cmdAdd, cmdDel, cmdCheck func(_ *CmdArgs) error, capabilities []string, supportedVersions ...string) {
 	var cmd, contID, netns, ifName, args, path string
 
 	vars := []struct {
@@ -52,48 +86,54 @@ func PluginMain(cmdAdd, cmdDel func(_ *CmdArgs) error) {
 			"CNI_COMMAND",
 			&cmd,
 			reqForCmdEntry{
-				"ADD": true,
-				"DEL": true,
+				"ADD":   true,
+				"DEL":   true,
+				"CHECK": true,
 			},
 		},
 		{
 			"CNI_CONTAINERID",
 			&contID,
 			reqForCmdEntry{
-				"ADD": false,
-				"DEL": false,
+				"ADD":   false,
+				"DEL":   false,
+				"CHECK": false,
 			},
 		},
 		{
 			"CNI_NETNS",
 			&netns,
 			reqForCmdEntry{
-				"ADD": true,
-				"DEL": false,
+				"ADD":   true,
+				"DEL":   false,
+				"CHECK": true,
 			},
 		},
 		{
 			"CNI_IFNAME",
 			&ifName,
 			reqForCmdEntry{
-				"ADD": true,
-				"DEL": true,
+				"ADD":   true,
+				"DEL":   true,
+				"CHECK": true,
 			},
 		},
 		{
 			"CNI_ARGS",
 			&args,
 			reqForCmdEntry{
-				"ADD": false,
-				"DEL": false,
+				"ADD":   false,
+				"DEL":   false,
+				"CHECK": false,
 			},
 		},
 		{
 			"CNI_PATH",
 			&path,
 			reqForCmdEntry{
-				"ADD": true,
-				"DEL": true,
+				"ADD":   true,
+				"DEL":   true,
+				"CHECK": true,
 			},
 		},
 	}
@@ -116,13 +156,30 @@ func PluginMain(cmdAdd, cmdDel func(_ *CmdArgs) error) {
 		dieMsg("error reading from stdin: %v", err)
 	}
 
+	if cmd == "VERSION" {
+		if err := json.NewEncoder(os.Stdout).Encode(newVersionInfo(supportedVersions, capabilities)); err != nil {
+			dieMsg("failed to print version info: %v", err)
+		}
+		return
+	}
+
+	if e := checkVersion(stdinData, supportedVersions); e != nil {
+		dieErr(e)
+	}
+
+	resultVersion, e := negotiateResultVersion(stdinData)
+	if e != nil {
+		dieErr(e)
+	}
+
 	cmdArgs := &CmdArgs{
-		ContainerID: contID,
-		Netns:       netns,
-		IfName:      ifName,
-		Args:        args,
-		Path:        path,
-		StdinData:   stdinData,
+		ContainerID:   contID,
+		Netns:         netns,
+		IfName:        ifName,
+		Args:          args,
+		Path:          path,
+		StdinData:     stdinData,
+		ResultVersion: resultVersion,
 	}
 
 	switch cmd {
@@ -132,6 +189,12 @@ func PluginMain(cmdAdd, cmdDel func(_ *CmdArgs) error) {
 	case "DEL":
 		err = cmdDel(cmdArgs)
 
+	case "CHECK":
+		if cmdCheck == nil {
+			dieMsg("CHECK is not supported by this plugin")
+		}
+		err = cmdCheck(cmdArgs)
+
 	default:
 		dieMsg("unknown CNI_COMMAND: %v", cmd)
 	}
@@ -139,15 +202,93 @@ func PluginMain(cmdAdd, cmdDel func(_ *CmdArgs) error) {
 	if err != nil {
 		if e, ok := err.(*types.Error); ok {
 			// don't wrap Error in Error
-			dieErr(e)
+			dieErr(types.ConvertError(e, resultVersion))
+		}
+		dieErr(types.ConvertError(&types.Error{Code: types.ErrInternal, Msg: err.Error()}, resultVersion))
+	}
+}
+
+// versionInfo is the response to the VERSION command
+type versionInfo struct {
+	CNIVersion        string   `json:"cniVersion"`
+	SupportedVersions []string `json:"supportedVersions"`
+	Capabilities      []string `json:"capabilities,omitempty"`
+}
+
+// newVersionInfo returns the VERSION response of a plugin. Without
+// supportedVersions the plugin supports every result format.
+func newVersionInfo(supportedVersions, capabilities []string) *versionInfo {
+	if len(supportedVersions) == 0 {
+		supportedVersions = types.ResultVersions()
+	}
+	return &versionInfo{
+		CNIVersion:        supportedVersions[len(supportedVersions)-1],
+		SupportedVersions: supportedVersions,
+		Capabilities:      capabilities,
+	}
+}
+
+// negotiateResultVersion returns the CNI spec version of the result format
+// to print: CNI_RESULT_VERSION if set, or else the cniVersion of the
+// network configuration in stdinData if ConvertResult supports it. Without
+// either the result is printed in the format that predates versioning.
+func negotiateResultVersion(stdinData []byte) (string, *types.Error) {
+	if v := os.Getenv("CNI_RESULT_VERSION"); v != "" {
+		if !types.ResultVersionSupported(v) {
+			return "", &types.Error{
+				Code:    types.ErrIncompatibleCNIVersion,
+				Msg:     "incompatible CNI versions",
+				Details: fmt.Sprintf("result version %q is not supported", v),
+			}
 		}
-		dieMsg(err.Error())
+		return v, nil
+	}
+
+	conf := struct {
+		CNIVersion string `json:"cniVersion"`
+	}{}
+	if err := json.Unmarshal(stdinData, &conf); err != nil || !types.ResultVersionSupported(conf.CNIVersion) {
+		return "", nil
+	}
+	return conf.CNIVersion, nil
+}
+
+// checkVersion returns an error if the cniVersion of the network
+// configuration in stdinData is not one of supportedVersions. A
+// configuration without cniVersion predates versioning and is accepted.
+func checkVersion(stdinData []byte, supportedVersions []string) *types.Error {
+	if len(supportedVersions) == 0 {
+		return nil
+	}
+
+	conf := struct {
+		CNIVersion string `json:"cniVersion"`
+	}{}
+	if err := json.Unmarshal(stdinData, &conf); err != nil {
+		return &types.Error{
+			Code: types.ErrInternal,
+			Msg:  fmt.Sprintf("failed to decode network configuration: %v", err),
+		}
+	}
+	if conf.CNIVersion == "" {
+		return nil
+	}
+
+	for _, v := range supportedVersions {
+		if v == conf.CNIVersion {
+			return nil
+		}
+	}
+	return &types.Error{
+		Code:    types.ErrIncompatibleCNIVersion,
+		Msg:     "incompatible CNI versions",
+		Details: fmt.Sprintf("config is %q, plugin supports %q", conf.CNIVersion, supportedVersions),
 	}
 }
 
 func dieMsg(f string, args ...interface{}) {
 	e := &types.Error{
-		Code: 100,
+		Code: types.ErrInternal,
 		Msg:  fmt.Sprintf(f, args...),
 	}
 	dieErr(e)
@@ -15,8 +15,13 @@
 package skel
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
 	"os"
 
+	"github.com/containernetworking/cni/pkg/types"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -72,6 +77,12 @@ var _ = Describe("Skel", func() {
 		// 	PluginMain(fErr, nil)
 		// })
 
+		It("should not fail with CHECK and noop callback", func() {
+			err := os.Setenv("CNI_COMMAND", "CHECK")
+			Expect(err).NotTo(HaveOccurred())
+			PluginMainWithCheck(nil, nil, fNoop)
+		})
+
 		It("should not fail with DEL and no NETNS and noop callback", func() {
 			err := os.Setenv("CNI_COMMAND", "DEL")
 			Expect(err).NotTo(HaveOccurred())
@@ -81,4 +92,137 @@ var _ = Describe("Skel", func() {
 		})
 
 	})
+
+	Context("When the plugin declares its supported versions", func() {
+		supported := []string{"0.2.0", "0.3.1"}
+
+		It("accepts a supported cniVersion", func() {
+			Expect(checkVersion([]byte(`{"cniVersion": "0.3.1"}`), supported)).To(BeNil())
+		})
+
+		It("accepts a configuration without cniVersion", func() {
+			Expect(checkVersion([]byte(`{"name": "test"}`), supported)).To(BeNil())
+		})
+
+		It("accepts any cniVersion without supported versions", func() {
+			Expect(checkVersion([]byte(`{"cniVersion": "0.4.0"}`), nil)).To(BeNil())
+		})
+
+		It("rejects an unsupported cniVersion with an incompatible version error", func() {
+			e := checkVersion([]byte(`{"cniVersion": "0.4.0"}`), supported)
+			Expect(e).To(Equal(&types.Error{
+				Code:    types.ErrIncompatibleCNIVersion,
+				Msg:     "incompatible CNI versions",
+				Details: `config is "0.4.0", plugin supports ["0.2.0" "0.3.1"]`,
+			}))
+		})
+	})
+
+	Context("When negotiating the result version", func() {
+		AfterEach(func() {
+			Expect(os.Unsetenv("CNI_RESULT_VERSION")).To(Succeed())
+		})
+
+		It("uses CNI_RESULT_VERSION", func() {
+			Expect(os.Setenv("CNI_RESULT_VERSION", "0.3.1")).To(Succeed())
+			v, e := negotiateResultVersion([]byte(`{"cniVersion": "0.2.0"}`))
+			Expect(e).To(BeNil())
+			Expect(v).To(Equal("0.3.1"))
+		})
+
+		It("falls back to the cniVersion of the configuration", func() {
+			v, e := negotiateResultVersion([]byte(`{"cniVersion": "0.4.0"}`))
+			Expect(e).To(BeNil())
+			Expect(v).To(Equal("0.4.0"))
+		})
+
+		It("ignores an unknown cniVersion of the configuration", func() {
+			v, e := negotiateResultVersion([]byte(`{"cniVersion": "0.1"}`))
+			Expect(e).To(BeNil())
+			Expect(v).To(BeEmpty())
+		})
+
+		It("prints a 0.3.1 result in the spec format for a 0.3.1 configuration", func() {
+			v, e := negotiateResultVersion([]byte(`{"cniVersion": "0.3.1"}`))
+			Expect(e).To(BeNil())
+
+			ip4, err := types.ParseCIDR("10.1.2.3/24")
+			Expect(err).NotTo(HaveOccurred())
+			dst, err := types.ParseCIDR("0.0.0.0/0")
+			Expect(err).NotTo(HaveOccurred())
+			result := &types.Result{
+				IP4: &types.IPConfig{
+					IP:      *ip4,
+					Gateway: net.ParseIP("10.1.2.1"),
+					Routes:  []types.Route{{Dst: *dst, GW: net.ParseIP("10.1.2.1")}},
+				},
+				Interfaces: []types.Interface{{Name: "eth0", Sandbox: "/var/run/netns/test"}},
+			}
+
+			// capture what a runtime would read from the plugin
+			r, w, err := os.Pipe()
+			Expect(err).NotTo(HaveOccurred())
+			stdout := os.Stdout
+			os.Stdout = w
+			err = (&CmdArgs{ResultVersion: v}).PrintResult(result)
+			os.Stdout = stdout
+			Expect(w.Close()).To(Succeed())
+			Expect(err).NotTo(HaveOccurred())
+			out, err := ioutil.ReadAll(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			// decoded without the types package, as the spec describes it
+			printed := struct {
+				CNIVersion string `json:"cniVersion"`
+				IPs        []struct {
+					Version   string `json:"version"`
+					Address   string `json:"address"`
+					Gateway   string `json:"gateway"`
+					Interface *int   `json:"interface"`
+				} `json:"ips"`
+				Routes []struct {
+					Dst string `json:"dst"`
+					GW  string `json:"gw"`
+				} `json:"routes"`
+			}{}
+			Expect(json.Unmarshal(out, &printed)).To(Succeed())
+
+			Expect(printed.CNIVersion).To(Equal("0.3.1"))
+			Expect(printed.IPs).To(HaveLen(1))
+			Expect(printed.IPs[0].Version).To(Equal("4"))
+			Expect(printed.IPs[0].Address).To(Equal("10.1.2.3/24"))
+			Expect(printed.IPs[0].Gateway).To(Equal("10.1.2.1"))
+			Expect(printed.IPs[0].Interface).NotTo(BeNil())
+			Expect(*printed.IPs[0].Interface).To(Equal(0))
+			Expect(printed.Routes).To(HaveLen(1))
+			Expect(printed.Routes[0].Dst).To(Equal("0.0.0.0/0"))
+			Expect(printed.Routes[0].GW).To(Equal("10.1.2.1"))
+		})
+
+		It("answers VERSION with the supported versions and capabilities", func() {
+			info := newVersionInfo([]string{"0.2.0", "0.3.1"}, []string{"portMappings"})
+			Expect(info).To(Equal(&versionInfo{
+				CNIVersion:        "0.3.1",
+				SupportedVersions: []string{"0.2.0", "0.3.1"},
+				Capabilities:      []string{"portMappings"},
+			}))
+		})
+
+		It("answers VERSION with every result version without supported versions", func() {
+			info := newVersionInfo(nil, nil)
+			Expect(info.SupportedVersions).To(Equal(types.ResultVersions()))
+			Expect(info.CNIVersion).To(Equal("0.4.0"))
+			Expect(info.Capabilities).To(BeNil())
+		})
+
+		It("rejects an unsupported CNI_RESULT_VERSION", func() {
+			Expect(os.Setenv("CNI_RESULT_VERSION", "9.9.9")).To(Succeed())
+			_, e := negotiateResultVersion([]byte(`{}`))
+			Expect(e).To(Equal(&types.Error{
+				Code:    types.ErrIncompatibleCNIVersion,
+				Msg:     "incompatible CNI versions",
+				Details: `result version "9.9.9" is not supported`,
+			}))
+		})
+	})
 })
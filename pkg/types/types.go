@@ -57,12 +57,19 @@ func (n *IPNet) UnmarshalJSON(data []byte) error {
 
 // NetConf describes a network.
 type NetConf struct {
+	CNIVersion string `json:"cniVersion,omitempty"`
+
 	Name string `json:"name,omitempty"`
 	Type string `json:"type,omitempty"`
 	IPAM struct {
-		Type string `json:"type,omitempty"`
+		Type              string `json:"type,omitempty"`
+		SkipConflictCheck bool   `json:"skipConflictCheck,omitempty"`
 	} `json:"ipam,omitempty"`
-	DNS DNS `json:"dns"`
+	DNS          DNS             `json:"dns"`
+	Capabilities map[string]bool `json:"capabilities,omitempty"`
+	// AddressScope is the scope of the addresses of the container
+	// interface: "global" (the default), "link" or "host"
+	AddressScope string `json:"addressScope,omitempty"`
 }
 
 // Result is what gets returned from the plugin (via stdout) to the caller
@@ -70,6 +77,20 @@ type Result struct {
 	IP4 *IPConfig `json:"ip4,omitempty"`
 	IP6 *IPConfig `json:"ip6,omitempty"`
 	DNS DNS       `json:"dns,omitempty"`
+
+	// Addresses lists any number of addresses of both families, for
+	// results which do not fit IP4 and IP6. They are only used if IP4
+	// and IP6 are nil, together with Routes.
+	Addresses []AddressConfig `json:"addresses,omitempty"`
+	Routes    []Route         `json:"routes,omitempty"`
+
+	// Interfaces are the interfaces created by the plugin, as listed by
+	// results from CNI spec 0.3.0 on
+	Interfaces []Interface `json:"interfaces,omitempty"`
+
+	// Annotations are passed by the runtime to the orchestrator, e.g.
+	// to be set on a Kubernetes pod
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
 func (r *Result) Print() error {
@@ -90,6 +111,205 @@ func (r *Result) String() string {
 	return fmt.Sprintf("%sDNS:%+v", str, r.DNS)
 }
 
+// ToCurrentSpec returns r with its IP4 and IP6 addresses moved to
+// Addresses and their routes to Routes. Routes without a gateway get the
+// gateway of their address, as they would have used it before.
+func (r *Result) ToCurrentSpec() *Result {
+	res := &Result{
+		DNS:         r.DNS,
+		Addresses:   r.Addresses,
+		Routes:      r.Routes,
+		Interfaces:  r.Interfaces,
+		Annotations: r.Annotations,
+	}
+	for _, ipc := range []struct {
+		version string
+		conf    *IPConfig
+	}{{"4", r.IP4}, {"6", r.IP6}} {
+		if ipc.conf == nil {
+			continue
+		}
+		res.Addresses = append(res.Addresses, AddressConfig{
+			Version: ipc.version,
+			Address: ipc.conf.IP,
+			Gateway: ipc.conf.Gateway,
+		})
+		for _, route := range ipc.conf.Routes {
+			if route.GW == nil {
+				route.GW = ipc.conf.Gateway
+			}
+			res.Routes = append(res.Routes, route)
+		}
+	}
+	return res
+}
+
+// IPConfigs returns the addresses of r with their routes, from IP4 and IP6
+// or, if both are nil, from Addresses. Each route of Routes goes with the
+// first address of its family.
+func (r *Result) IPConfigs() []*IPConfig {
+	var ipcs []*IPConfig
+	if r.IP4 != nil || r.IP6 != nil {
+		for _, ipc := range []*IPConfig{r.IP4, r.IP6} {
+			if ipc != nil {
+				ipcs = append(ipcs, ipc)
+			}
+		}
+		return ipcs
+	}
+
+	first := map[bool]*IPConfig{}
+	for _, a := range r.Addresses {
+		ipc := &IPConfig{IP: a.Address, Gateway: a.Gateway}
+		isV4 := a.Address.IP.To4() != nil
+		if first[isV4] == nil {
+			first[isV4] = ipc
+		}
+		ipcs = append(ipcs, ipc)
+	}
+	for _, route := range r.Routes {
+		if ipc := first[route.Dst.IP.To4() != nil]; ipc != nil {
+			ipc.Routes = append(ipc.Routes, route)
+		}
+	}
+	return ipcs
+}
+
+// CNI030Result is the result format of CNI spec 0.3.0, which lists the
+// addresses of both families in IPs and their routes in Routes instead of
+// the IP4 and IP6 fields
+type CNI030Result struct {
+	CNIVersion string          `json:"cniVersion,omitempty"`
+	Interfaces []Interface     `json:"interfaces,omitempty"`
+	IPs        []AddressConfig `json:"ips,omitempty"`
+	Routes     []Route         `json:"routes,omitempty"`
+	DNS        DNS             `json:"dns,omitempty"`
+
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// FromCNI020Result converts r to the 0.3.0 result format, listing the
+// IPv4 address before the IPv6 one. The addresses refer to the first
+// interface in a sandbox, if any.
+func FromCNI020Result(r *Result) *CNI030Result {
+	res := &CNI030Result{
+		CNIVersion:  "0.3.0",
+		Interfaces:  r.Interfaces,
+		DNS:         r.DNS,
+		Annotations: r.Annotations,
+	}
+
+	var iface *int
+	for i := range r.Interfaces {
+		if r.Interfaces[i].Sandbox != "" {
+			idx := i
+			iface = &idx
+			break
+		}
+	}
+
+	for _, ipc := range r.IPConfigs() {
+		version := "6"
+		if ipc.IP.IP.To4() != nil {
+			version = "4"
+		}
+		res.IPs = append(res.IPs, AddressConfig{
+			Version:   version,
+			Address:   ipc.IP,
+			Gateway:   ipc.Gateway,
+			Interface: iface,
+		})
+		res.Routes = append(res.Routes, ipc.Routes...)
+	}
+	return res
+}
+
+// ToCNI020Result converts r to the 0.2.0 result format, which has room
+// for the first address of each family only. Each route goes with the
+// first address of its family.
+func (r *CNI030Result) ToCNI020Result() *Result {
+	res := &Result{
+		DNS:         r.DNS,
+		Interfaces:  r.Interfaces,
+		Annotations: r.Annotations,
+	}
+	for _, ipc := range (&Result{Addresses: r.IPs, Routes: r.Routes}).IPConfigs() {
+		if ipc.IP.IP.To4() != nil {
+			if res.IP4 == nil {
+				res.IP4 = ipc
+			}
+		} else if res.IP6 == nil {
+			res.IP6 = ipc
+		}
+	}
+	return res
+}
+
+func (r *CNI030Result) Print() error {
+	return prettyPrint(r)
+}
+
+// Interface is an interface created by a plugin. Sandbox is the path of
+// the network namespace of a container interface and empty on the host.
+type Interface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+// VersionedResult is a result in the format of a CNI spec version
+type VersionedResult interface {
+	Print() error
+}
+
+// resultVersions are the CNI spec versions ConvertResult converts to
+var resultVersions = []string{"0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0"}
+
+// ResultVersionSupported returns whether ConvertResult converts to the
+// CNI spec version version
+func ResultVersionSupported(version string) bool {
+	for _, v := range resultVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// ResultVersions returns the CNI spec versions ConvertResult converts to,
+// oldest first
+func ResultVersions() []string {
+	return append([]string{}, resultVersions...)
+}
+
+// ConvertResult converts from to the result format of the CNI spec version
+// toVersion. The 0.1.0 and 0.2.0 formats are from itself, as is an empty
+// toVersion, which predates versioning. From 0.3.0 on addresses are listed
+// in "ips"; 0.4.0 results are 0.3.1 ones, only errors differ.
+func ConvertResult(from *Result, toVersion string) (VersionedResult, error) {
+	switch toVersion {
+	case "", "0.1.0", "0.2.0":
+		return from, nil
+	case "0.3.0", "0.3.1", "0.4.0":
+		res := FromCNI020Result(from)
+		res.CNIVersion = toVersion
+		return res, nil
+	}
+	return nil, NewError(ErrIncompatibleCNIVersion, "incompatible CNI versions",
+		fmt.Sprintf("result version %q is not supported", toVersion))
+}
+
+// ConvertError converts e to the error format of the CNI spec version
+// toVersion: from 0.4.0 on errors carry their cniVersion
+func ConvertError(e *Error, toVersion string) *Error {
+	if toVersion != "0.4.0" {
+		return e
+	}
+	res := *e
+	res.CNIVersion = toVersion
+	return &res
+}
+
 // IPConfig contains values necessary to configure an interface
 type IPConfig struct {
 	IP      net.IPNet
@@ -97,6 +317,16 @@ type IPConfig struct {
 	Routes  []Route
 }
 
+// AddressConfig is an address of an interface; Version is "4" or "6".
+// Interface is the index of the interface in the interfaces of the
+// result, if known.
+type AddressConfig struct {
+	Version   string
+	Address   net.IPNet
+	Gateway   net.IP
+	Interface *int
+}
+
 // DNS contains values interesting for DNS resolvers
 type DNS struct {
 	Nameservers []string `json:"nameservers,omitempty"`
@@ -108,15 +338,59 @@ type DNS struct {
 type Route struct {
 	Dst net.IPNet
 	GW  net.IP
+	// RouterPreference is the preference of the router of an IPv6 route
+	// as in RFC 4191: -1 for low, 0 for medium and 1 for high
+	RouterPreference int
+	// Metric is the priority of the route, lower is preferred; 0 leaves
+	// the kernel default
+	Metric int
 }
 
 type Error struct {
+	CNIVersion string `json:"cniVersion,omitempty"`
+
 	Code    uint   `json:"code"`
 	Msg     string `json:"msg"`
 	Details string `json:"details,omitempty"`
 }
 
+// ErrIncompatibleCNIVersion is the well-known error code of a request
+// in a CNI version the plugin does not support
+const ErrIncompatibleCNIVersion uint = 1
+
+// ErrUnsupportedField is the well-known error code of a network
+// configuration with a field the plugin does not support
+const ErrUnsupportedField uint = 2
+
+// ErrUnknownContainer is the well-known error code of a request for a
+// container the plugin does not know about
+const ErrUnknownContainer uint = 3
+
+// ErrInvalidNetworkConfig is the well-known error code of a network
+// configuration that fails to validate
+const ErrInvalidNetworkConfig uint = 7
+
+// ErrTryAgainLater is the well-known error code of a transient failure;
+// the same operation may succeed if retried later
+const ErrTryAgainLater uint = 11
+
+// ErrInternal is the code of errors without a well-known code, such as
+// plain errors returned by a plugin
+const ErrInternal uint = 100
+
+// NewError returns an Error with the given code, message and details
+func NewError(code uint, msg, details string) *Error {
+	return &Error{
+		Code:    code,
+		Msg:     msg,
+		Details: details,
+	}
+}
+
 func (e *Error) Error() string {
+	if e.Details != "" {
+		return fmt.Sprintf("%v; %v", e.Msg, e.Details)
+	}
 	return e.Msg
 }
 
@@ -134,9 +408,18 @@ type ipConfig struct {
 	Routes  []Route `json:"routes,omitempty"`
 }
 
+type addressConfig struct {
+	Version   string `json:"version"`
+	Address   IPNet  `json:"address"`
+	Gateway   net.IP `json:"gateway,omitempty"`
+	Interface *int   `json:"interface,omitempty"`
+}
+
 type route struct {
-	Dst IPNet  `json:"dst"`
-	GW  net.IP `json:"gw,omitempty"`
+	Dst              IPNet  `json:"dst"`
+	GW               net.IP `json:"gw,omitempty"`
+	RouterPreference int    `json:"routerPreference,omitempty"`
+	Metric           int    `json:"metric,omitempty"`
 }
 
 func (c *IPConfig) MarshalJSON() ([]byte, error) {
@@ -161,6 +444,31 @@ func (c *IPConfig) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+func (a *AddressConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(addressConfig{
+		Version:   a.Version,
+		Address:   IPNet(a.Address),
+		Gateway:   a.Gateway,
+		Interface: a.Interface,
+	})
+}
+
+func (a *AddressConfig) UnmarshalJSON(data []byte) error {
+	ac := addressConfig{}
+	if err := json.Unmarshal(data, &ac); err != nil {
+		return err
+	}
+
+	if ac.Version != "4" && ac.Version != "6" {
+		return fmt.Errorf("invalid address version %q", ac.Version)
+	}
+	a.Version = ac.Version
+	a.Address = net.IPNet(ac.Address)
+	a.Gateway = ac.Gateway
+	a.Interface = ac.Interface
+	return nil
+}
+
 func (r *Route) UnmarshalJSON(data []byte) error {
 	rt := route{}
 	if err := json.Unmarshal(data, &rt); err != nil {
@@ -169,13 +477,17 @@ func (r *Route) UnmarshalJSON(data []byte) error {
 
 	r.Dst = net.IPNet(rt.Dst)
 	r.GW = rt.GW
+	r.RouterPreference = rt.RouterPreference
+	r.Metric = rt.Metric
 	return nil
 }
 
 func (r *Route) MarshalJSON() ([]byte, error) {
 	rt := route{
-		Dst: IPNet(r.Dst),
-		GW:  r.GW,
+		Dst:              IPNet(r.Dst),
+		GW:               r.GW,
+		RouterPreference: r.RouterPreference,
+		Metric:           r.Metric,
 	}
 
 	return json.Marshal(rt)
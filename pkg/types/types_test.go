@@ -0,0 +1,218 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types_test
+
+import (
+	"encoding/json"
+	"net"
+
+	. "github.com/containernetworking/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Result", func() {
+	It("round trips the annotations through JSON", func() {
+		ipn, err := ParseCIDR("10.1.2.3/24")
+		Expect(err).NotTo(HaveOccurred())
+		res := &Result{
+			IP4:         &IPConfig{IP: *ipn},
+			Annotations: map[string]string{"k8s.v1.cni.cncf.io/interface-mac": "0a:58:0a:01:02:03"},
+		}
+
+		data, err := json.Marshal(res)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{
+			"ip4": {"ip": "10.1.2.3/24"},
+			"dns": {},
+			"annotations": {"k8s.v1.cni.cncf.io/interface-mac": "0a:58:0a:01:02:03"}
+		}`))
+
+		parsed := &Result{}
+		Expect(json.Unmarshal(data, parsed)).To(Succeed())
+		Expect(parsed.Annotations).To(Equal(res.Annotations))
+	})
+
+	It("round trips between the 0.2.0 and 0.3.0 formats", func() {
+		ip4, err := ParseCIDR("10.1.2.3/24")
+		Expect(err).NotTo(HaveOccurred())
+		ip6, err := ParseCIDR("2001:db8::3/64")
+		Expect(err).NotTo(HaveOccurred())
+		dst4, err := ParseCIDR("0.0.0.0/0")
+		Expect(err).NotTo(HaveOccurred())
+		dst6, err := ParseCIDR("2001:db8:1::/48")
+		Expect(err).NotTo(HaveOccurred())
+		res := &Result{
+			IP4: &IPConfig{IP: *ip4, Gateway: net.ParseIP("10.1.2.1"), Routes: []Route{{Dst: *dst4}}},
+			IP6: &IPConfig{IP: *ip6, Routes: []Route{{Dst: *dst6, GW: net.ParseIP("2001:db8::1")}}},
+			DNS: DNS{Nameservers: []string{"10.1.2.1"}},
+		}
+
+		converted := FromCNI020Result(res)
+		data, err := json.Marshal(converted)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{
+			"cniVersion": "0.3.0",
+			"ips": [
+				{"version": "4", "address": "10.1.2.3/24", "gateway": "10.1.2.1"},
+				{"version": "6", "address": "2001:db8::3/64"}
+			],
+			"routes": [
+				{"dst": "0.0.0.0/0"},
+				{"dst": "2001:db8:1::/48", "gw": "2001:db8::1"}
+			],
+			"dns": {"nameservers": ["10.1.2.1"]}
+		}`))
+
+		parsed := &CNI030Result{}
+		Expect(json.Unmarshal(data, parsed)).To(Succeed())
+		Expect(parsed.ToCNI020Result()).To(Equal(res))
+	})
+
+	It("lists the interfaces in the 0.3.0 format", func() {
+		ip4, err := ParseCIDR("10.1.2.3/24")
+		Expect(err).NotTo(HaveOccurred())
+		res := &Result{
+			IP4: &IPConfig{IP: *ip4},
+			Interfaces: []Interface{
+				{Name: "veth1234", Mac: "0a:58:0a:01:02:01"},
+				{Name: "eth0", Mac: "0a:58:0a:01:02:03", Sandbox: "/var/run/netns/test"},
+			},
+		}
+
+		data, err := json.Marshal(FromCNI020Result(res))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{
+			"cniVersion": "0.3.0",
+			"interfaces": [
+				{"name": "veth1234", "mac": "0a:58:0a:01:02:01"},
+				{"name": "eth0", "mac": "0a:58:0a:01:02:03", "sandbox": "/var/run/netns/test"}
+			],
+			"ips": [{"version": "4", "address": "10.1.2.3/24", "interface": 1}],
+			"dns": {}
+		}`))
+
+		parsed := &CNI030Result{}
+		Expect(json.Unmarshal(data, parsed)).To(Succeed())
+		Expect(parsed.ToCNI020Result()).To(Equal(res))
+	})
+
+	It("keeps the first address of each family in the 0.2.0 format", func() {
+		first, err := ParseCIDR("2001:db8::3/64")
+		Expect(err).NotTo(HaveOccurred())
+		second, err := ParseCIDR("2001:db8::4/64")
+		Expect(err).NotTo(HaveOccurred())
+
+		res := (&CNI030Result{IPs: []AddressConfig{{Version: "6", Address: *first}, {Version: "6", Address: *second}}}).ToCNI020Result()
+		Expect(res.IP4).To(BeNil())
+		Expect(res.IP6.IP.String()).To(Equal("2001:db8::3/64"))
+	})
+
+	It("converts results to the requested version", func() {
+		ip4, err := ParseCIDR("10.1.2.3/24")
+		Expect(err).NotTo(HaveOccurred())
+		res := &Result{IP4: &IPConfig{IP: *ip4}}
+
+		for _, v := range []string{"", "0.1.0", "0.2.0"} {
+			Expect(ConvertResult(res, v)).To(Equal(res))
+		}
+
+		converted, err := ConvertResult(res, "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+		data, err := json.Marshal(converted)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{"cniVersion": "0.4.0", "ips": [{"version": "4", "address": "10.1.2.3/24"}], "dns": {}}`))
+
+		_, err = ConvertResult(res, "1.0.0")
+		Expect(err).To(MatchError(`incompatible CNI versions; result version "1.0.0" is not supported`))
+	})
+
+	It("returns errors with a well-known code", func() {
+		e := NewError(ErrUnknownContainer, "unknown container", "dummy")
+		Expect(e.Error()).To(Equal("unknown container; dummy"))
+
+		data, err := json.Marshal(e)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{"code": 3, "msg": "unknown container", "details": "dummy"}`))
+	})
+
+	It("adds the cniVersion to errors from 0.4.0 on", func() {
+		e := &Error{Code: 100, Msg: "failed"}
+		Expect(ConvertError(e, "0.3.1")).To(Equal(e))
+
+		data, err := json.Marshal(ConvertError(e, "0.4.0"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{"cniVersion": "0.4.0", "code": 100, "msg": "failed"}`))
+		Expect(e.CNIVersion).To(BeEmpty())
+	})
+
+	It("round trips the router preference of routes", func() {
+		data := []byte(`{"dst": "::/0", "gw": "2001:db8::1", "routerPreference": 1}`)
+		r := &Route{}
+		Expect(json.Unmarshal(data, r)).To(Succeed())
+		Expect(r.RouterPreference).To(Equal(1))
+
+		out, err := json.Marshal(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out).To(MatchJSON(data))
+	})
+
+	It("round trips the metric of routes", func() {
+		data := []byte(`{"dst": "0.0.0.0/0", "gw": "10.1.2.1", "metric": 100}`)
+		r := &Route{}
+		Expect(json.Unmarshal(data, r)).To(Succeed())
+		Expect(r.Metric).To(Equal(100))
+
+		out, err := json.Marshal(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out).To(MatchJSON(data))
+	})
+
+	It("moves the IP4 and IP6 addresses to Addresses", func() {
+		ip4, err := ParseCIDR("10.1.2.3/24")
+		Expect(err).NotTo(HaveOccurred())
+		ip6, err := ParseCIDR("fd00::3/64")
+		Expect(err).NotTo(HaveOccurred())
+		dst, err := ParseCIDR("0.0.0.0/0")
+		Expect(err).NotTo(HaveOccurred())
+		res := &Result{
+			IP4: &IPConfig{IP: *ip4, Gateway: net.ParseIP("10.1.2.1"), Routes: []Route{{Dst: *dst}}},
+			IP6: &IPConfig{IP: *ip6},
+		}
+
+		data, err := json.Marshal(res.ToCurrentSpec())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{
+			"dns": {},
+			"addresses": [
+				{"version": "4", "address": "10.1.2.3/24", "gateway": "10.1.2.1"},
+				{"version": "6", "address": "fd00::3/64"}
+			],
+			"routes": [{"dst": "0.0.0.0/0", "gw": "10.1.2.1"}]
+		}`))
+
+		parsed := &Result{}
+		Expect(json.Unmarshal(data, parsed)).To(Succeed())
+		Expect(parsed.IP4).To(BeNil())
+		Expect(parsed.Addresses).To(HaveLen(2))
+		Expect(parsed.Addresses[1].Address.String()).To(Equal("fd00::3/64"))
+	})
+
+	It("rejects addresses with an unknown version", func() {
+		a := &AddressConfig{}
+		Expect(json.Unmarshal([]byte(`{"version": "5", "address": "10.1.2.3/24"}`), a)).NotTo(Succeed())
+	})
+})
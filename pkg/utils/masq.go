@@ -0,0 +1,111 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/ip"
+)
+
+// MasqEntry is the masquerading of the traffic from Network through
+// Chain, as ip.SetupIPMasq sets it up
+type MasqEntry struct {
+	Network *net.IPNet
+	Chain   string
+	Comment string
+}
+
+// BulkSetupIPMasq sets up the masquerading of entries like ip.SetupIPMasq,
+// but with one iptables-restore (or ip6tables-restore) run per address
+// family instead of one iptables run per rule, so that the xtables lock is
+// taken once per batch. The chains of the entries are flushed and filled
+// again; their jumps are appended to POSTROUTING, so the entries must not
+// be set up already.
+func BulkSetupIPMasq(entries []MasqEntry) error {
+	var v4, v6 []MasqEntry
+	for _, e := range entries {
+		if e.Network.IP.To4() != nil {
+			v4 = append(v4, e)
+		} else {
+			v6 = append(v6, e)
+		}
+	}
+
+	for _, batch := range []struct {
+		command string
+		entries []MasqEntry
+	}{{"iptables-restore", v4}, {"ip6tables-restore", v6}} {
+		if len(batch.entries) == 0 {
+			continue
+		}
+		if err := restore(batch.command, masqRestoreScript(batch.entries)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// masqRestoreScript returns the iptables-restore input that sets up the
+// nat table for entries, in a single transaction
+func masqRestoreScript(entries []MasqEntry) string {
+	var script bytes.Buffer
+	script.WriteString("*nat\n")
+	for _, e := range entries {
+		fmt.Fprintf(&script, ":%s - [0:0]\n", e.Chain)
+	}
+	for _, e := range entries {
+		for _, rule := range ip.IPMasqRules(e.Network, nil, e.Comment) {
+			writeRule(&script, e.Chain, rule)
+		}
+		writeRule(&script, "POSTROUTING", []string{"-s", e.Network.String(), "-j", e.Chain, "-m", "comment", "--comment", e.Comment})
+	}
+	script.WriteString("COMMIT\n")
+	return script.String()
+}
+
+// writeRule writes the rule appending rulespec to chain, quoting the
+// arguments iptables-restore would otherwise split
+func writeRule(script *bytes.Buffer, chain string, rulespec []string) {
+	script.WriteString("-A " + chain)
+	for _, arg := range rulespec {
+		if strings.ContainsAny(arg, " \t\"\\") {
+			arg = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+		}
+		script.WriteString(" " + arg)
+	}
+	script.WriteString("\n")
+}
+
+// restore feeds script to command, keeping the rules already in place
+func restore(command string, script string) error {
+	path, err := exec.LookPath(command)
+	if err != nil {
+		return fmt.Errorf("failed to locate %s: %v", command, err)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(path, "--noflush", "--wait")
+	cmd.Stdin = strings.NewReader(script)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
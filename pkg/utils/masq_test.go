@@ -0,0 +1,47 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"github.com/containernetworking/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BulkSetupIPMasq", func() {
+	It("writes one restore transaction for all entries", func() {
+		first, err := types.ParseCIDR("10.1.2.0/24")
+		Expect(err).NotTo(HaveOccurred())
+		second, err := types.ParseCIDR("10.1.3.0/24")
+		Expect(err).NotTo(HaveOccurred())
+
+		script := masqRestoreScript([]MasqEntry{
+			{Network: first, Chain: "CNI-first", Comment: FormatComment("mynet", "first")},
+			{Network: second, Chain: "CNI-second", Comment: "second"},
+		})
+		Expect(script).To(Equal(`*nat
+:CNI-first - [0:0]
+:CNI-second - [0:0]
+-A CNI-first -d 10.1.2.0/24 -j ACCEPT -m comment --comment "name: \"mynet\" id: \"first\""
+-A CNI-first ! -d 224.0.0.0/4 -j MASQUERADE -m comment --comment "name: \"mynet\" id: \"first\""
+-A POSTROUTING -s 10.1.2.0/24 -j CNI-first -m comment --comment "name: \"mynet\" id: \"first\""
+-A CNI-second -d 10.1.3.0/24 -j ACCEPT -m comment --comment second
+-A CNI-second ! -d 224.0.0.0/4 -j MASQUERADE -m comment --comment second
+-A POSTROUTING -s 10.1.3.0/24 -j CNI-second -m comment --comment second
+COMMIT
+`))
+	})
+})
@@ -27,7 +27,9 @@ const (
 
 // Generates a chain name to be used with iptables.
 // Ensures that the generated chain name is exactly
-// maxChainLength chars in length
+// maxChainLength chars in length. The name is the SHA-512 of the full
+// network name and ID rather than a truncation of them, so long network
+// names sharing a prefix still get distinct chains.
 func FormatChainName(name string, id string) string {
 	chainBytes := sha512.Sum512([]byte(name + id))
 	chain := fmt.Sprintf("%s%x", chainPrefix, chainBytes)
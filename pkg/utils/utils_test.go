@@ -48,4 +48,28 @@ var _ = Describe("Utils", func() {
 		Expect(chain1).To(Equal("CNI-374f33fe84ab0ed84dcdebe3"))
 		Expect(chain1).NotTo(Equal(chain2))
 	})
+
+	It("does not collide for real-world network names", func() {
+		names := []string{
+			"mynet", "cni0", "bridge", "podman", "k8s-pod-network",
+			"kubernetes-pod-network-default", "kubernetes-pod-network-default-v6",
+			"default/macvlan-conf", "default/macvlan-conf-2", "kube-system/multus-network",
+			"openshift-sdn", "weave", "cbr0", "flannel.1", "calico-k8s-network",
+		}
+		ids := []string{
+			"1", "12", "1234", "dummy",
+			"4a3e2a5e4e0b", "4a3e2a5e4e0c",
+			"4a3e2a5e4e0b9c5b6d1b0e3f4f8b7f3c2e1d0c9b8a7f6e5d4c3b2a1f0e9d8c7b",
+		}
+
+		seen := map[string]string{}
+		for _, name := range names {
+			for _, id := range ids {
+				chain := FormatChainName(name, id)
+				Expect(len(chain)).To(Equal(maxChainLength))
+				Expect(seen).NotTo(HaveKey(chain), "%s/%s collides with %s", name, id, seen[chain])
+				seen[chain] = name + "/" + id
+			}
+		}
+	})
 })
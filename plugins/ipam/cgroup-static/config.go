@@ -0,0 +1,138 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// IPAMConfig represents the IP related network configuration.
+type IPAMConfig struct {
+	Type       string        `json:"type"`
+	Subnet     types.IPNet   `json:"subnet"`
+	RangeStart net.IP        `json:"rangeStart"`
+	RangeEnd   net.IP        `json:"rangeEnd"`
+	Gateway    net.IP        `json:"gateway"`
+	Routes     []types.Route `json:"routes"`
+	Args       *IPAMArgs     `json:"-"`
+}
+
+// IPAMArgs are the CNI_ARGS understood by the plugin
+type IPAMArgs struct {
+	types.CommonArgs
+	CGROUPPath types.UnmarshallableString `json:"cgroupPath,omitempty"`
+}
+
+type Net struct {
+	Name string      `json:"name"`
+	IPAM *IPAMConfig `json:"ipam"`
+}
+
+// LoadIPAMConfig reads the IPAM configuration and CNI_ARGS
+func LoadIPAMConfig(bytes []byte, args string) (*IPAMConfig, error) {
+	n := Net{}
+	if err := json.Unmarshal(bytes, &n); err != nil {
+		return nil, err
+	}
+	if n.IPAM == nil {
+		return nil, fmt.Errorf("IPAM config missing 'ipam' key")
+	}
+
+	n.IPAM.Args = &IPAMArgs{}
+	if err := types.LoadArgs(args, n.IPAM.Args); err != nil {
+		return nil, err
+	}
+	return n.IPAM, nil
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(i uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, i)
+	return ip
+}
+
+// addressRange returns the first and last address, inclusive, handed out
+// from the subnet: rangeStart and rangeEnd if set, else all addresses
+// but the network and broadcast ones
+func (c *IPAMConfig) addressRange() (uint32, uint32, error) {
+	subnet := (*net.IPNet)(&c.Subnet)
+	if subnet.IP == nil {
+		return 0, 0, fmt.Errorf("missing field %q in IPAM configuration", "subnet")
+	}
+	if subnet.IP.To4() == nil || len(subnet.Mask) != net.IPv4len {
+		return 0, 0, fmt.Errorf("subnet %v is not an IPv4 subnet", subnet)
+	}
+
+	network := ipToUint32(subnet.IP) & ipToUint32(net.IP(subnet.Mask))
+	start := network + 1
+	end := (network | ^ipToUint32(net.IP(subnet.Mask))) - 1
+
+	if c.RangeStart != nil {
+		if !subnet.Contains(c.RangeStart) {
+			return 0, 0, fmt.Errorf("%s not in network: %s", c.RangeStart, subnet)
+		}
+		start = ipToUint32(c.RangeStart)
+	}
+	if c.RangeEnd != nil {
+		if !subnet.Contains(c.RangeEnd) {
+			return 0, 0, fmt.Errorf("%s not in network: %s", c.RangeEnd, subnet)
+		}
+		end = ipToUint32(c.RangeEnd)
+	}
+	if start > end {
+		return 0, 0, fmt.Errorf("empty address range from %s to %s", uint32ToIP(start), uint32ToIP(end))
+	}
+	return start, end, nil
+}
+
+// DeriveIP maps cgroupPath to an address of the range with a FNV-1a hash,
+// so the same cgroup always gets the same address. The gateway is never
+// returned. Different cgroups may get the same address.
+func (c *IPAMConfig) DeriveIP(cgroupPath string) (net.IP, error) {
+	start, end, err := c.addressRange()
+	if err != nil {
+		return nil, err
+	}
+
+	var gw uint32
+	hasGW := c.Gateway != nil && c.Gateway.To4() != nil &&
+		ipToUint32(c.Gateway) >= start && ipToUint32(c.Gateway) <= end
+	size := uint64(end-start) + 1
+	if hasGW {
+		gw = ipToUint32(c.Gateway)
+		size--
+	}
+	if size == 0 {
+		return nil, fmt.Errorf("no address left in the range besides the gateway")
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(cgroupPath))
+	ip := start + uint32(h.Sum64()%size)
+	if hasGW && ip >= gw {
+		ip++
+	}
+	return uint32ToIP(ip), nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("cgroup-static address derivation", func() {
+	loadConf := func(ipam string) *IPAMConfig {
+		conf, err := LoadIPAMConfig([]byte(`{"name": "test", "ipam": `+ipam+`}`), "IgnoreUnknown=1;CGROUPPath=/kubepods/pod1/abc")
+		Expect(err).NotTo(HaveOccurred())
+		return conf
+	}
+
+	It("reads the cgroup path from CNI_ARGS", func() {
+		conf := loadConf(`{"type": "cgroup-static", "subnet": "10.1.2.0/24"}`)
+		Expect(string(conf.Args.CGROUPPath)).To(Equal("/kubepods/pod1/abc"))
+	})
+
+	It("always derives the same address within the subnet for a cgroup", func() {
+		conf := loadConf(`{"type": "cgroup-static", "subnet": "10.1.2.0/24"}`)
+		_, subnet, _ := net.ParseCIDR("10.1.2.0/24")
+
+		for i := 0; i < 100; i++ {
+			path := fmt.Sprintf("/kubepods/pod%d", i)
+			ip, err := conf.DeriveIP(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(subnet.Contains(ip)).To(BeTrue())
+			Expect(ip.String()).NotTo(Equal("10.1.2.0"))
+			Expect(ip.String()).NotTo(Equal("10.1.2.255"))
+
+			again, err := conf.DeriveIP(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(again).To(Equal(ip))
+		}
+	})
+
+	It("stays within rangeStart and rangeEnd and skips the gateway", func() {
+		conf := loadConf(`{"type": "cgroup-static", "subnet": "10.1.2.0/24", "rangeStart": "10.1.2.10", "rangeEnd": "10.1.2.12", "gateway": "10.1.2.11"}`)
+
+		seen := map[string]bool{}
+		for i := 0; i < 50; i++ {
+			ip, err := conf.DeriveIP(fmt.Sprintf("/kubepods/pod%d", i))
+			Expect(err).NotTo(HaveOccurred())
+			seen[ip.String()] = true
+		}
+		Expect(seen).To(Equal(map[string]bool{"10.1.2.10": true, "10.1.2.12": true}))
+	})
+
+	It("rejects an IPv6 subnet", func() {
+		conf := loadConf(`{"type": "cgroup-static", "subnet": "2001:db8::/64"}`)
+		_, err := conf.DeriveIP("/kubepods/pod1")
+		Expect(err).To(MatchError("subnet 2001:db8::/64 is not an IPv4 subnet"))
+	})
+})
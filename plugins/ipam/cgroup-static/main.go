@@ -0,0 +1,58 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdDel)
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	ipamConf, err := LoadIPAMConfig(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+
+	cgroupPath := string(ipamConf.Args.CGROUPPath)
+	if cgroupPath == "" {
+		return fmt.Errorf("CGROUPPath missing from CNI_ARGS")
+	}
+
+	ip, err := ipamConf.DeriveIP(cgroupPath)
+	if err != nil {
+		return err
+	}
+
+	r := &types.Result{
+		IP4: &types.IPConfig{
+			IP:      net.IPNet{IP: ip, Mask: ipamConf.Subnet.Mask},
+			Gateway: ipamConf.Gateway,
+			Routes:  ipamConf.Routes,
+		},
+	}
+	return args.PrintResult(r)
+}
+
+// cmdDel has nothing to release: addresses are derived, not allocated
+func cmdDel(args *skel.CmdArgs) error {
+	return nil
+}
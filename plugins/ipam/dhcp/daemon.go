@@ -68,13 +68,14 @@ func (d *DHCP) Allocate(args *skel.CmdArgs, result *types.Result) error {
 		return err
 	}
 
-	d.setLease(args.ContainerID, conf.Name, l)
+	d.setLease(args.ContainerID, args.IfName, l)
 
 	result.IP4 = &types.IPConfig{
 		IP:      *ipn,
 		Gateway: l.Gateway(),
 		Routes:  l.Routes(),
 	}
+	result.DNS = l.DNS()
 
 	return nil
 }
@@ -87,32 +88,39 @@ func (d *DHCP) Release(args *skel.CmdArgs, reply *struct{}) error {
 		return fmt.Errorf("error parsing netconf: %v", err)
 	}
 
-	if l := d.getLease(args.ContainerID, conf.Name); l != nil {
+	if l := d.takeLease(args.ContainerID, args.IfName); l != nil {
 		l.Stop()
 		return nil
 	}
 
-	return fmt.Errorf("lease not found: %v/%v", args.ContainerID, conf.Name)
+	return fmt.Errorf("lease not found: %v:%v", args.ContainerID, args.IfName)
 }
 
-func (d *DHCP) getLease(contID, netName string) *DHCPLease {
+// leaseKey identifies the lease of an interface of a container; a
+// container cannot have two interfaces with the same name
+func leaseKey(contID, ifName string) string {
+	return contID + ":" + ifName
+}
+
+// takeLease removes the lease of the interface from the cache and
+// returns it
+func (d *DHCP) takeLease(contID, ifName string) *DHCPLease {
 	d.mux.Lock()
 	defer d.mux.Unlock()
 
-	// TODO(eyakubovich): hash it to avoid collisions
-	l, ok := d.leases[contID+netName]
+	l, ok := d.leases[leaseKey(contID, ifName)]
 	if !ok {
 		return nil
 	}
+	delete(d.leases, leaseKey(contID, ifName))
 	return l
 }
 
-func (d *DHCP) setLease(contID, netName string, l *DHCPLease) {
+func (d *DHCP) setLease(contID, ifName string, l *DHCPLease) {
 	d.mux.Lock()
 	defer d.mux.Unlock()
 
-	// TODO(eyakubovich): hash it to avoid collisions
-	d.leases[contID+netName] = l
+	d.leases[leaseKey(contID, ifName)] = l
 }
 
 func getListener() (net.Listener, error) {
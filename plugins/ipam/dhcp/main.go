@@ -27,7 +27,7 @@ import (
 const socketPath = "/run/cni/dhcp.sock"
 
 func main() {
-	if len(os.Args) > 1 && os.Args[1] == "daemon" {
+	if len(os.Args) > 1 && (os.Args[1] == "daemon" || os.Args[1] == "--daemon") {
 		runDaemon()
 	} else {
 		skel.PluginMain(cmdAdd, cmdDel)
@@ -39,7 +39,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if err := rpcCall("DHCP.Allocate", args, &result); err != nil {
 		return err
 	}
-	return result.Print()
+	return args.PrintResult(&result)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
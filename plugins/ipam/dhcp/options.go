@@ -33,6 +33,21 @@ func parseRouter(opts dhcp4.Options) net.IP {
 	return nil
 }
 
+// parseDNS returns the name servers and domain name offered by the server
+func parseDNS(opts dhcp4.Options) types.DNS {
+	dns := types.DNS{}
+	if servers, ok := opts[dhcp4.OptionDomainNameServer]; ok {
+		for len(servers) >= 4 {
+			dns.Nameservers = append(dns.Nameservers, net.IP(servers[:4]).String())
+			servers = servers[4:]
+		}
+	}
+	if domain, ok := opts[dhcp4.OptionDomainName]; ok {
+		dns.Domain = string(domain)
+	}
+	return dns
+}
+
 func classfulSubnet(sn net.IP) net.IPNet {
 	return net.IPNet{
 		IP:   sn,
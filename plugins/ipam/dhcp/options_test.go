@@ -73,3 +73,17 @@ func TestParseCIDRRoutes(t *testing.T) {
 
 	validateRoutes(t, routes)
 }
+
+func TestParseDNS(t *testing.T) {
+	opts := make(dhcp4.Options)
+	opts[dhcp4.OptionDomainNameServer] = []byte{10, 1, 2, 3, 10, 1, 2, 4}
+	opts[dhcp4.OptionDomainName] = []byte("example.com")
+	dns := parseDNS(opts)
+
+	if len(dns.Nameservers) != 2 || dns.Nameservers[0] != "10.1.2.3" || dns.Nameservers[1] != "10.1.2.4" {
+		t.Errorf("nameservers mismatch: expected [10.1.2.3 10.1.2.4], got %v", dns.Nameservers)
+	}
+	if dns.Domain != "example.com" {
+		t.Errorf("domain mismatch: expected example.com, got %v", dns.Domain)
+	}
+}
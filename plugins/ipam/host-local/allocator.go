@@ -37,6 +37,13 @@ func NewIPAllocator(conf *IPAMConfig, store backend.Store) (*IPAllocator, error)
 		end   net.IP
 		err   error
 	)
+	if conf.DelegatedPrefix.IP != nil {
+		if err := validateDelegatedPrefix(conf); err != nil {
+			return nil, err
+		}
+		return &IPAllocator{conf: conf, store: store}, nil
+	}
+
 	start, end, err = networkRange((*net.IPNet)(&conf.Subnet))
 	if err != nil {
 		return nil, err
@@ -73,6 +80,10 @@ func (a *IPAllocator) Get(id string) (*types.IPConfig, error) {
 	a.store.Lock()
 	defer a.store.Unlock()
 
+	if a.conf.DelegatedPrefix.IP != nil {
+		return a.getPrefix(id)
+	}
+
 	gw := a.conf.Gateway
 	if gw == nil {
 		gw = ip.NextIP(a.conf.Subnet.IP)
@@ -131,7 +142,50 @@ func (a *IPAllocator) Get(id string) (*types.IPConfig, error) {
 			}, nil
 		}
 	}
-	return nil, fmt.Errorf("no IP addresses available in network: %s", a.conf.Name)
+	return nil, exhaustedError(a.conf.Name)
+}
+
+// NewIPAllocators returns an allocator for each range of the network
+func NewIPAllocators(conf *IPAMConfig, store backend.Store) ([]*IPAllocator, error) {
+	var allocs []*IPAllocator
+	for _, rc := range conf.rangeConfigs() {
+		alloc, err := NewIPAllocator(rc, store)
+		if err != nil {
+			return nil, err
+		}
+		allocs = append(allocs, alloc)
+	}
+	return allocs, nil
+}
+
+// GetFromRanges allocates an IP from the first of allocs with a free
+// one, or the requested IP from the range containing it
+func GetFromRanges(allocs []*IPAllocator, id string) (*types.IPConfig, error) {
+	if len(allocs) == 1 {
+		return allocs[0].Get(id)
+	}
+
+	conf := allocs[0].conf
+	if conf.Args != nil && conf.Args.IP != nil {
+		for _, a := range allocs {
+			subnet := net.IPNet(a.conf.Subnet)
+			if subnet.Contains(conf.Args.IP) {
+				return a.Get(id)
+			}
+		}
+		return nil, fmt.Errorf("requested IP address %q is not in any range of network: %s", conf.Args.IP, conf.Name)
+	}
+
+	for _, a := range allocs {
+		ipConf, err := a.Get(id)
+		if err == nil {
+			return ipConf, nil
+		}
+		if _, ok := err.(exhaustedError); !ok {
+			return nil, err
+		}
+	}
+	return nil, exhaustedError(conf.Name)
 }
 
 // Releases all IPs allocated for the container with given ID
@@ -200,3 +254,11 @@ func (a *IPAllocator) getSearchRange() (net.IP, net.IP) {
 	}
 	return startIP, endIP
 }
+
+// exhaustedError is returned when all IPs of the network named by it are
+// allocated
+type exhaustedError string
+
+func (e exhaustedError) Error() string {
+	return "no IP addresses available in network: " + string(e)
+}
@@ -15,7 +15,13 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/plugins/ipam/host-local/backend/disk"
 	fakestore "github.com/containernetworking/cni/plugins/ipam/host-local/backend/testing"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -134,3 +140,149 @@ var _ = Describe("host-local ip allocator", func() {
 		})
 	})
 })
+
+var _ = Describe("host-local range allocator", func() {
+	newAllocators := func(ipmap map[string]string) ([]*IPAllocator, error) {
+		conf, err := LoadIPAMConfig([]byte(`{
+	"name": "test",
+	"ipam": {
+		"type": "host-local",
+		"ranges": [
+			{"subnet": "10.0.0.0/30"},
+			{"subnet": "10.1.0.0/24", "rangeStart": "10.1.0.10", "gateway": "10.1.0.254"}
+		]
+	}
+}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		return NewIPAllocators(conf, fakestore.NewFakeStore(ipmap, nil))
+	}
+
+	It("allocates from the first range with a free IP", func() {
+		allocs, err := newAllocators(map[string]string{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(allocs).To(HaveLen(2))
+
+		res, err := GetFromRanges(allocs, "ID")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.IP.String()).To(Equal("10.0.0.2/30"))
+		Expect(res.Gateway.String()).To(Equal("10.0.0.1"))
+
+		allocs, err = newAllocators(map[string]string{"10.0.0.2": "id", "10.0.0.3": "id"})
+		Expect(err).NotTo(HaveOccurred())
+		res, err = GetFromRanges(allocs, "ID")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.IP.String()).To(Equal("10.1.0.10/24"))
+		Expect(res.Gateway.String()).To(Equal("10.1.0.254"))
+	})
+
+	It("rejects ranges combined with a subnet", func() {
+		_, err := LoadIPAMConfig([]byte(`{
+	"name": "test",
+	"ipam": {
+		"type": "host-local",
+		"subnet": "10.0.0.0/24",
+		"ranges": [{"subnet": "10.1.0.0/24"}]
+	}
+}`), "")
+		Expect(err).To(MatchError("ranges cannot be combined with subnet or delegatedPrefix"))
+	})
+})
+
+var _ = Describe("host-local disk store", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host-local")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("never allocates the same IP to concurrent containers", func() {
+		subnet, err := types.ParseCIDR("10.0.0.0/24")
+		Expect(err).NotTo(HaveOccurred())
+		conf := &IPAMConfig{Name: "test", Subnet: types.IPNet(*subnet), DataDir: dataDir}
+
+		const n = 20
+		var wg sync.WaitGroup
+		ips := make([]string, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				store, err := disk.New(conf.Name, conf.DataDir)
+				Expect(err).NotTo(HaveOccurred())
+				defer store.Close()
+
+				alloc, err := NewIPAllocator(conf, store)
+				Expect(err).NotTo(HaveOccurred())
+				res, err := alloc.Get(fmt.Sprintf("ID%d", i))
+				Expect(err).NotTo(HaveOccurred())
+				ips[i] = res.IP.IP.String()
+			}(i)
+		}
+		wg.Wait()
+
+		seen := map[string]bool{}
+		for _, ip := range ips {
+			Expect(seen).NotTo(HaveKey(ip))
+			seen[ip] = true
+		}
+	})
+})
+
+var _ = Describe("host-local prefix allocator", func() {
+	newAllocator := func(ipmap map[string]string) (*IPAllocator, error) {
+		delegated, err := types.ParseCIDR("2001:db8:1200::/56")
+		Expect(err).NotTo(HaveOccurred())
+		conf := IPAMConfig{
+			Name:               "test",
+			Type:               "host-local",
+			DelegatedPrefix:    types.IPNet(*delegated),
+			ContainerPrefixLen: 64,
+		}
+		return NewIPAllocator(&conf, fakestore.NewFakeStore(ipmap, nil))
+	}
+
+	It("allocates the first free prefix of the delegated block", func() {
+		alloc, err := newAllocator(map[string]string{
+			"2001:db8:1200::":   "id",
+			"2001:db8:1200:1::": "id",
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		res, err := alloc.Get("ID")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.IP.String()).To(Equal("2001:db8:1200:2::1/64"))
+		Expect(res.Gateway).To(BeNil())
+	})
+
+	It("returns a meaningful error when the delegated block is exhausted", func() {
+		ipmap := map[string]string{}
+		for i := 0; i < 256; i++ {
+			ipmap[net.ParseIP(fmt.Sprintf("2001:db8:1200:%x::", i)).String()] = "id"
+		}
+		alloc, err := newAllocator(ipmap)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = alloc.Get("ID")
+		Expect(err).To(MatchError("no prefixes available in network: test"))
+	})
+
+	It("rejects a container prefix larger than the delegated prefix", func() {
+		delegated, err := types.ParseCIDR("2001:db8:1200::/56")
+		Expect(err).NotTo(HaveOccurred())
+		conf := IPAMConfig{
+			Name:               "test",
+			DelegatedPrefix:    types.IPNet(*delegated),
+			ContainerPrefixLen: 48,
+		}
+		_, err = NewIPAllocator(&conf, fakestore.NewFakeStore(map[string]string{}, nil))
+		Expect(err).To(MatchError("containerPrefixLen must be between 57 and 128, got 48"))
+	})
+})
@@ -31,8 +31,13 @@ type Store struct {
 	dataDir string
 }
 
-func New(network string) (*Store, error) {
-	dir := filepath.Join(defaultDataDir, network)
+// New returns the store of network under dataDir, or under
+// /var/lib/cni/networks if dataDir is empty
+func New(network, dataDir string) (*Store, error) {
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	dir := filepath.Join(dataDir, network)
 	if err := os.MkdirAll(dir, 0644); err != nil {
 		return nil, err
 	}
@@ -24,14 +24,28 @@ import (
 
 // IPAMConfig represents the IP related network configuration.
 type IPAMConfig struct {
-	Name       string
-	Type       string        `json:"type"`
-	RangeStart net.IP        `json:"rangeStart"`
-	RangeEnd   net.IP        `json:"rangeEnd"`
-	Subnet     types.IPNet   `json:"subnet"`
-	Gateway    net.IP        `json:"gateway"`
-	Routes     []types.Route `json:"routes"`
-	Args       *IPAMArgs     `json:"-"`
+	Name               string
+	Type               string        `json:"type"`
+	RangeStart         net.IP        `json:"rangeStart"`
+	RangeEnd           net.IP        `json:"rangeEnd"`
+	Subnet             types.IPNet   `json:"subnet"`
+	Gateway            net.IP        `json:"gateway"`
+	Routes             []types.Route `json:"routes"`
+	DelegatedPrefix    types.IPNet   `json:"delegatedPrefix"`
+	ContainerPrefixLen int           `json:"containerPrefixLen"`
+	Ranges             []Range       `json:"ranges"`
+	DataDir            string        `json:"dataDir"`
+	Args               *IPAMArgs     `json:"-"`
+}
+
+// Range is one of several address ranges of a network, which are used in
+// order: addresses are allocated from a range once the ones before it are
+// exhausted.
+type Range struct {
+	Subnet     types.IPNet `json:"subnet"`
+	RangeStart net.IP      `json:"rangeStart"`
+	RangeEnd   net.IP      `json:"rangeEnd"`
+	Gateway    net.IP      `json:"gateway"`
 }
 
 type IPAMArgs struct {
@@ -63,8 +77,39 @@ func LoadIPAMConfig(bytes []byte, args string) (*IPAMConfig, error) {
 		return nil, fmt.Errorf("IPAM config missing 'ipam' key")
 	}
 
+	if len(n.IPAM.Ranges) > 0 {
+		if n.IPAM.Subnet.IP != nil || n.IPAM.DelegatedPrefix.IP != nil {
+			return nil, fmt.Errorf("ranges cannot be combined with subnet or delegatedPrefix")
+		}
+		for i, r := range n.IPAM.Ranges {
+			if r.Subnet.IP == nil {
+				return nil, fmt.Errorf("missing field %q in range %d", "subnet", i)
+			}
+		}
+	}
+
 	// Copy net name into IPAM so not to drag Net struct around
 	n.IPAM.Name = n.Name
 
 	return n.IPAM, nil
 }
+
+// rangeConfigs returns a config for each range of the network, with the
+// range as its subnet, or the config itself if it has no ranges
+func (c *IPAMConfig) rangeConfigs() []*IPAMConfig {
+	if len(c.Ranges) == 0 {
+		return []*IPAMConfig{c}
+	}
+
+	confs := make([]*IPAMConfig, 0, len(c.Ranges))
+	for _, r := range c.Ranges {
+		rc := *c
+		rc.Ranges = nil
+		rc.Subnet = r.Subnet
+		rc.RangeStart = r.RangeStart
+		rc.RangeEnd = r.RangeEnd
+		rc.Gateway = r.Gateway
+		confs = append(confs, &rc)
+	}
+	return confs
+}
@@ -31,26 +31,29 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
-	store, err := disk.New(ipamConf.Name)
+	store, err := disk.New(ipamConf.Name, ipamConf.DataDir)
 	if err != nil {
 		return err
 	}
 	defer store.Close()
 
-	allocator, err := NewIPAllocator(ipamConf, store)
+	allocators, err := NewIPAllocators(ipamConf, store)
 	if err != nil {
 		return err
 	}
 
-	ipConf, err := allocator.Get(args.ContainerID)
+	ipConf, err := GetFromRanges(allocators, args.ContainerID)
 	if err != nil {
 		return err
 	}
 
-	r := &types.Result{
-		IP4: ipConf,
+	r := &types.Result{}
+	if ipamConf.DelegatedPrefix.IP != nil {
+		r.IP6 = ipConf
+	} else {
+		r.IP4 = ipConf
 	}
-	return r.Print()
+	return args.PrintResult(r)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -59,7 +62,7 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
-	store, err := disk.New(ipamConf.Name)
+	store, err := disk.New(ipamConf.Name, ipamConf.DataDir)
 	if err != nil {
 		return err
 	}
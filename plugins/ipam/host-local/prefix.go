@@ -0,0 +1,73 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func validateDelegatedPrefix(conf *IPAMConfig) error {
+	if conf.DelegatedPrefix.IP.To4() != nil {
+		return fmt.Errorf("delegatedPrefix %s is not an IPv6 prefix", &conf.DelegatedPrefix)
+	}
+	ones, _ := conf.DelegatedPrefix.Mask.Size()
+	if conf.ContainerPrefixLen <= ones || conf.ContainerPrefixLen > 128 {
+		return fmt.Errorf("containerPrefixLen must be between %d and 128, got %d", ones+1, conf.ContainerPrefixLen)
+	}
+	return nil
+}
+
+// getPrefix reserves the first free /containerPrefixLen block of the
+// delegated prefix. Blocks are recorded in the store by their network
+// address; the container is given the first host address of its block.
+func (a *IPAllocator) getPrefix(id string) (*types.IPConfig, error) {
+	delegated := ip.Network((*net.IPNet)(&a.conf.DelegatedPrefix))
+	ones, bits := delegated.Mask.Size()
+	mask := net.CIDRMask(a.conf.ContainerPrefixLen, bits)
+
+	step := big.NewInt(1)
+	step.Lsh(step, uint(bits-a.conf.ContainerPrefixLen))
+	cur := big.NewInt(0).SetBytes(delegated.IP.To16())
+
+	count := big.NewInt(1)
+	count.Lsh(count, uint(a.conf.ContainerPrefixLen-ones))
+	for i := big.NewInt(0); i.Cmp(count) < 0; i.Add(i, big.NewInt(1)) {
+		prefix := net.IP(make([]byte, net.IPv6len))
+		b := cur.Bytes()
+		copy(prefix[net.IPv6len-len(b):], b)
+
+		reserved, err := a.store.Reserve(id, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if reserved {
+			addr := prefix
+			if a.conf.ContainerPrefixLen < bits {
+				addr = ip.NextIP(prefix)
+			}
+			return &types.IPConfig{
+				IP:     net.IPNet{IP: addr, Mask: mask},
+				Routes: a.conf.Routes,
+			}, nil
+		}
+		cur.Add(cur, step)
+	}
+	return nil, fmt.Errorf("no prefixes available in network: %s", a.conf.Name)
+}
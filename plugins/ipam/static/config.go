@@ -0,0 +1,96 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// IPAMConfig represents the IP related network configuration.
+type IPAMConfig struct {
+	Type      string          `json:"type"`
+	Addresses []AddressConfig `json:"addresses"`
+	Routes    []types.Route   `json:"routes"`
+	DNS       types.DNS       `json:"dns"`
+}
+
+// AddressConfig is an address of the container, in CIDR notation, and
+// its optional gateway
+type AddressConfig struct {
+	Address types.IPNet `json:"address"`
+	Gateway net.IP      `json:"gateway"`
+}
+
+type Net struct {
+	Name string      `json:"name"`
+	IPAM *IPAMConfig `json:"ipam"`
+}
+
+// LoadIPAMConfig reads the IPAM configuration
+func LoadIPAMConfig(bytes []byte) (*IPAMConfig, error) {
+	n := Net{}
+	if err := json.Unmarshal(bytes, &n); err != nil {
+		return nil, err
+	}
+	if n.IPAM == nil {
+		return nil, fmt.Errorf("IPAM config missing 'ipam' key")
+	}
+	return n.IPAM, nil
+}
+
+// Result returns the configured addresses, routes and DNS settings. A
+// result holds at most one IPv4 and one IPv6 address, and each route
+// goes with the address of its family.
+func (c *IPAMConfig) Result() (*types.Result, error) {
+	if len(c.Addresses) == 0 {
+		return nil, fmt.Errorf("missing field %q in IPAM configuration", "addresses")
+	}
+
+	r := &types.Result{DNS: c.DNS}
+	for _, a := range c.Addresses {
+		ipc := &types.IPConfig{
+			IP:      net.IPNet(a.Address),
+			Gateway: a.Gateway,
+		}
+		if a.Gateway != nil && !ipc.IP.Contains(a.Gateway) {
+			return nil, fmt.Errorf("gateway %s not in network %s", a.Gateway, ipc.IP.String())
+		}
+
+		slot, family := &r.IP4, "IPv4"
+		if ipc.IP.IP.To4() == nil {
+			slot, family = &r.IP6, "IPv6"
+		}
+		if *slot != nil {
+			return nil, fmt.Errorf("more than one %s address in IPAM configuration", family)
+		}
+		*slot = ipc
+	}
+
+	for _, route := range c.Routes {
+		ipc := r.IP4
+		if route.Dst.IP.To4() == nil {
+			ipc = r.IP6
+		}
+		if ipc == nil {
+			return nil, fmt.Errorf("route to %s has no address of its family", route.Dst.String())
+		}
+		ipc.Routes = append(ipc.Routes, route)
+	}
+	return r, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("static IPAM configuration", func() {
+	result := func(ipam string) (*types.Result, error) {
+		conf, err := LoadIPAMConfig([]byte(`{"name": "test", "ipam": ` + ipam + `}`))
+		Expect(err).NotTo(HaveOccurred())
+		return conf.Result()
+	}
+
+	It("returns the configured addresses, routes and DNS", func() {
+		r, err := result(`{
+			"type": "static",
+			"addresses": [
+				{"address": "10.10.0.5/24", "gateway": "10.10.0.1"},
+				{"address": "2001:db8::5/64"}
+			],
+			"routes": [
+				{"dst": "0.0.0.0/0"},
+				{"dst": "2001:db8:1::/48", "gw": "2001:db8::1"}
+			],
+			"dns": {"nameservers": ["10.10.0.1"]}
+		}`)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(r.IP4.IP.String()).To(Equal("10.10.0.5/24"))
+		Expect(r.IP4.Gateway).To(Equal(net.ParseIP("10.10.0.1")))
+		Expect(r.IP4.Routes).To(HaveLen(1))
+		Expect(r.IP4.Routes[0].Dst.String()).To(Equal("0.0.0.0/0"))
+
+		Expect(r.IP6.IP.String()).To(Equal("2001:db8::5/64"))
+		Expect(r.IP6.Gateway).To(BeNil())
+		Expect(r.IP6.Routes).To(HaveLen(1))
+		Expect(r.IP6.Routes[0].GW).To(Equal(net.ParseIP("2001:db8::1")))
+
+		Expect(r.DNS.Nameservers).To(Equal([]string{"10.10.0.1"}))
+	})
+
+	It("rejects a gateway outside of the address network", func() {
+		_, err := result(`{"type": "static", "addresses": [{"address": "10.10.0.5/24", "gateway": "10.20.0.1"}]}`)
+		Expect(err).To(MatchError("gateway 10.20.0.1 not in network 10.10.0.5/24"))
+	})
+
+	It("rejects a second address of the same family", func() {
+		_, err := result(`{"type": "static", "addresses": [{"address": "10.10.0.5/24"}, {"address": "10.10.0.6/24"}]}`)
+		Expect(err).To(MatchError("more than one IPv4 address in IPAM configuration"))
+	})
+
+	It("rejects a route without an address of its family", func() {
+		_, err := result(`{"type": "static", "addresses": [{"address": "10.10.0.5/24"}], "routes": [{"dst": "::/0"}]}`)
+		Expect(err).To(MatchError("route to ::/0 has no address of its family"))
+	})
+
+	It("requires an address", func() {
+		_, err := result(`{"type": "static"}`)
+		Expect(err).To(MatchError(`missing field "addresses" in IPAM configuration`))
+	})
+})
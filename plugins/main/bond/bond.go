@@ -0,0 +1,339 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/ipam"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// bond attributes from linux/if_link.h; the vendored netlink package
+// does not know about bond links.
+const (
+	iflaBondMode           = 1
+	iflaBondMiimon         = 3
+	iflaBondXmitHashPolicy = 14
+	iflaBondAdLacpRate     = 21
+)
+
+var bondModes = map[string]uint8{
+	"balance-rr":    0,
+	"active-backup": 1,
+	"balance-xor":   2,
+	"broadcast":     3,
+	"802.3ad":       4,
+	"balance-tlb":   5,
+	"balance-alb":   6,
+}
+
+var xmitHashPolicies = map[string]uint8{
+	"layer2":   0,
+	"layer3+4": 1,
+	"layer2+3": 2,
+	"encap2+3": 3,
+	"encap3+4": 4,
+}
+
+var lacpRates = map[string]uint8{
+	"slow": 0,
+	"fast": 1,
+}
+
+type NetConf struct {
+	types.NetConf
+	// Links are the host interfaces to enslave to the bond
+	Links          []string `json:"links"`
+	Mode           string   `json:"mode"`
+	Miimon         int      `json:"miimon"`
+	LacpRate       string   `json:"lacpRate"`
+	XmitHashPolicy string   `json:"xmitHashPolicy"`
+	MTU            int      `json:"mtu"`
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadConf(bytes []byte) (*NetConf, error) {
+	n := &NetConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	if len(n.Links) == 0 {
+		return nil, errors.New(`"links" field is required. It specifies the interfaces to enslave`)
+	}
+	seen := map[string]bool{}
+	for _, l := range n.Links {
+		if seen[l] {
+			return nil, fmt.Errorf("link %q is listed twice", l)
+		}
+		seen[l] = true
+	}
+
+	if n.Mode == "" {
+		n.Mode = "balance-rr"
+	}
+	if _, ok := bondModes[n.Mode]; !ok {
+		return nil, fmt.Errorf("unknown bond mode %q", n.Mode)
+	}
+	if n.Miimon < 0 {
+		return nil, fmt.Errorf("invalid miimon %d", n.Miimon)
+	}
+	if n.LacpRate != "" {
+		if _, ok := lacpRates[n.LacpRate]; !ok {
+			return nil, fmt.Errorf("unknown lacpRate %q, must be slow or fast", n.LacpRate)
+		}
+		if n.Mode != "802.3ad" {
+			return nil, fmt.Errorf("lacpRate requires mode 802.3ad, not %s", n.Mode)
+		}
+	}
+	if n.XmitHashPolicy != "" {
+		if _, ok := xmitHashPolicies[n.XmitHashPolicy]; !ok {
+			return nil, fmt.Errorf("unknown xmitHashPolicy %q", n.XmitHashPolicy)
+		}
+		if n.Mode != "802.3ad" && n.Mode != "balance-xor" && n.Mode != "balance-tlb" {
+			return nil, fmt.Errorf("xmitHashPolicy requires mode 802.3ad, balance-xor or balance-tlb, not %s", n.Mode)
+		}
+	}
+	return n, nil
+}
+
+// addBond creates a bond link named name in the current netns
+func addBond(conf *NetConf, name string) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	req.AddData(nl.NewIfInfomsg(syscall.AF_UNSPEC))
+	req.AddData(nl.NewRtAttr(syscall.IFLA_IFNAME, nl.ZeroTerminated(name)))
+	if conf.MTU > 0 {
+		req.AddData(nl.NewRtAttr(syscall.IFLA_MTU, nl.Uint32Attr(uint32(conf.MTU))))
+	}
+
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.NonZeroTerminated("bond"))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+	nl.NewRtAttrChild(data, iflaBondMode, nl.Uint8Attr(bondModes[conf.Mode]))
+	if conf.Miimon > 0 {
+		nl.NewRtAttrChild(data, iflaBondMiimon, nl.Uint32Attr(uint32(conf.Miimon)))
+	}
+	if conf.LacpRate != "" {
+		nl.NewRtAttrChild(data, iflaBondAdLacpRate, nl.Uint8Attr(lacpRates[conf.LacpRate]))
+	}
+	if conf.XmitHashPolicy != "" {
+		nl.NewRtAttrChild(data, iflaBondXmitHashPolicy, nl.Uint8Attr(xmitHashPolicies[conf.XmitHashPolicy]))
+	}
+	req.AddData(linkInfo)
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// lookupSlaves returns the links to enslave, which must all exist in
+// the current netns
+func lookupSlaves(names []string) ([]netlink.Link, error) {
+	var slaves []netlink.Link
+	for _, name := range names {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup link %q: %v", name, err)
+		}
+		if link.Attrs().MasterIndex != 0 {
+			return nil, fmt.Errorf("link %q is already enslaved", name)
+		}
+		slaves = append(slaves, link)
+	}
+	return slaves, nil
+}
+
+// moveSlaves moves the named links of the current netns to the netns of fd
+func moveSlaves(names []string, fd int) error {
+	for _, name := range names {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to lookup link %q: %v", name, err)
+		}
+		if err = netlink.LinkSetNsFd(link, fd); err != nil {
+			return fmt.Errorf("failed to move link %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// createBond creates the bond ifName in the current netns and enslaves
+// the links of conf, which must already be in it. The bond is deleted
+// again on failure.
+func createBond(conf *NetConf, ifName string) (_ netlink.Link, err error) {
+	if err = addBond(conf, ifName); err != nil {
+		return nil, fmt.Errorf("failed to create bond: %v", err)
+	}
+
+	bond, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = netlink.LinkDel(bond)
+		}
+	}()
+
+	for _, name := range conf.Links {
+		slave, err := netlink.LinkByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup link %q: %v", name, err)
+		}
+		// the bond driver refuses slaves which are up
+		if err = netlink.LinkSetDown(slave); err != nil {
+			return nil, fmt.Errorf("failed to set %q down: %v", name, err)
+		}
+		if err = netlink.LinkSetMasterByIndex(slave, bond.Attrs().Index); err != nil {
+			return nil, fmt.Errorf("failed to enslave %q to %q: %v", name, ifName, err)
+		}
+	}
+
+	if err = netlink.LinkSetUp(bond); err != nil {
+		return nil, fmt.Errorf("failed to set %q up: %v", ifName, err)
+	}
+	return netlink.LinkByName(ifName)
+}
+
+// releaseBond releases the slaves of the bond ifName in the current
+// netns, moves them to the netns of hostFd and deletes the bond
+func releaseBond(conf *NetConf, ifName string, hostFd int) error {
+	for _, name := range conf.Links {
+		slave, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to lookup link %q: %v", name, err)
+		}
+		if err = netlink.LinkSetMasterByIndex(slave, 0); err != nil {
+			return fmt.Errorf("failed to release %q: %v", name, err)
+		}
+	}
+
+	if err := moveSlaves(conf.Links, hostFd); err != nil {
+		return err
+	}
+
+	bond, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	if err = netlink.LinkDel(bond); err != nil {
+		return fmt.Errorf("failed to delete %q: %v", ifName, err)
+	}
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	if _, err = lookupSlaves(n.Links); err != nil {
+		return err
+	}
+
+	// the kernel does not let a bond change netns, so the slaves move
+	// to the container and the bond is created there
+	if err = moveSlaves(n.Links, int(netns.Fd())); err != nil {
+		return err
+	}
+
+	var bond netlink.Link
+	err = netns.Do(func(hostNS ns.NetNS) error {
+		var err error
+		if bond, err = createBond(n, args.IfName); err != nil {
+			// give the slaves back rather than strand them in the container
+			_ = moveSlaves(n.Links, int(hostNS.Fd()))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// run the IPAM plugin and get back the config to apply
+	result, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+	if err != nil {
+		return err
+	}
+	if result.IP4 == nil {
+		return errors.New("IPAM plugin returned missing IPv4 config")
+	}
+
+	err = netns.Do(func(_ ns.NetNS) error {
+		return ipam.ConfigureIfaceWithOptions(args.IfName, result, ipam.Options{SkipConflictCheck: n.IPAM.SkipConflictCheck, AddressScope: n.AddressScope})
+	})
+	if err != nil {
+		return err
+	}
+
+	result.Interfaces = []types.Interface{{
+		Name:    args.IfName,
+		Mac:     bond.Attrs().HardwareAddr.String(),
+		Sandbox: args.Netns,
+	}}
+	result.DNS = n.DNS
+	return args.PrintResult(result)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	err = ipam.ExecDel(n.IPAM.Type, args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	hostNS, err := ns.GetCurrentNS()
+	if err != nil {
+		return fmt.Errorf("failed to open the host netns: %v", err)
+	}
+	defer hostNS.Close()
+
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return releaseBond(n, args.IfName, int(hostNS.Fd()))
+	})
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdDel)
+}
@@ -0,0 +1,138 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/containernetworking/cni/pkg/ns"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("bond Operations", func() {
+	var originalNS, targetNS ns.NetNS
+
+	BeforeEach(func() {
+		// Create a new NetNS so we don't modify the host
+		var err error
+		originalNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		targetNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for _, name := range []string{"slave0", "slave1"} {
+				err := netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: name},
+					PeerName:  "peer-" + name,
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(targetNS.Close()).To(Succeed())
+	})
+
+	It("requires links", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "bond"}`))
+		Expect(err).To(HaveOccurred())
+
+		_, err = loadConf([]byte(`{"name": "mynet", "type": "bond", "links": ["slave0", "slave0"]}`))
+		Expect(err).To(MatchError(`link "slave0" is listed twice`))
+	})
+
+	It("defaults to balance-rr and rejects unknown modes", func() {
+		conf, err := loadConf([]byte(`{"name": "mynet", "type": "bond", "links": ["slave0"]}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Mode).To(Equal("balance-rr"))
+
+		_, err = loadConf([]byte(`{"name": "mynet", "type": "bond", "links": ["slave0"], "mode": "foo"}`))
+		Expect(err).To(MatchError(`unknown bond mode "foo"`))
+	})
+
+	It("accepts LACP options with mode 802.3ad only", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "bond", "links": ["slave0"], "mode": "802.3ad", "lacpRate": "fast", "xmitHashPolicy": "layer3+4"}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = loadConf([]byte(`{"name": "mynet", "type": "bond", "links": ["slave0"], "mode": "active-backup", "lacpRate": "fast"}`))
+		Expect(err).To(MatchError("lacpRate requires mode 802.3ad, not active-backup"))
+
+		_, err = loadConf([]byte(`{"name": "mynet", "type": "bond", "links": ["slave0"], "mode": "802.3ad", "lacpRate": "medium"}`))
+		Expect(err).To(HaveOccurred())
+
+		_, err = loadConf([]byte(`{"name": "mynet", "type": "bond", "links": ["slave0"], "mode": "802.3ad", "xmitHashPolicy": "layer4"}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("requires the links to exist on the host", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			_, err := lookupSlaves([]string{"slave0", "missing0"})
+			return err
+		})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("creates a bond of the links in the container and releases them", func() {
+		conf, err := loadConf([]byte(`{"name": "mynet", "type": "bond", "links": ["slave0", "slave1"], "mode": "active-backup", "miimon": 100}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			return moveSlaves(conf.Links, int(targetNS.Fd()))
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			bond, err := createBond(conf, "bond0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bond.Type()).To(Equal("bond"))
+
+			for _, name := range conf.Links {
+				slave, err := netlink.LinkByName(name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(slave.Attrs().MasterIndex).To(Equal(bond.Attrs().Index))
+			}
+
+			return releaseBond(conf, "bond0", int(originalNS.Fd()))
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			slaves, err := lookupSlaves(conf.Links)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(slaves).To(HaveLen(2))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			_, err := netlink.LinkByName("bond0")
+			return err
+		})
+		Expect(err).To(HaveOccurred())
+	})
+})
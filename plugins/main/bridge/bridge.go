@@ -18,36 +18,173 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/containernetworking/cni/pkg/ip"
 	"github.com/containernetworking/cni/pkg/ipam"
+	"github.com/containernetworking/cni/pkg/modprobe"
 	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/utils"
+	"github.com/coreos/go-iptables/iptables"
 	"github.com/vishvananda/netlink"
 )
 
 const defaultBrName = "cni0"
 
+// rpFilterPath is the global IPv4 reverse path filter setting
+const rpFilterPath = "/proc/sys/net/ipv4/conf/all/rp_filter"
+
+// conntrackTCPLoosePath controls whether conntrack picks up TCP
+// connections it did not see the start of
+const conntrackTCPLoosePath = "/proc/sys/net/netfilter/nf_conntrack_tcp_loose"
+
+// annotationInterfaceMAC is the result annotation holding the MAC
+// address of the container interface
+const annotationInterfaceMAC = "k8s.v1.cni.cncf.io/interface-mac"
+
+// ipipDevName is the flow based ipip device used for the routes to
+// remote subnets
+const ipipDevName = "cni-ipip0"
+
+// acdTimeout is how long to wait for a host to answer the ARP probe
+// for the container's IP
+const acdTimeout = 100 * time.Millisecond
+
+// arptablesPath controls whether ARP traffic crossing a bridge is
+// passed to arptables
+const arptablesPath = "/proc/sys/net/bridge/bridge-nf-call-arptables"
+
+// sendRedirectsPath is the ICMP redirects setting of an interface, or of
+// all of them with "all"
+const sendRedirectsPath = "/proc/sys/net/ipv4/conf/%s/send_redirects"
+
+// acceptRedirectsPath controls whether ICMP redirects change the routes
+// of the network namespace
+const acceptRedirectsPath = "/proc/sys/net/ipv4/conf/all/accept_redirects"
+
+// ecmpHashSeedPath is the seed of the hash choosing the next hop of
+// multipath routes
+const ecmpHashSeedPath = "/proc/sys/net/ipv4/fib_multipath_hash_seed"
+
+// arpAnnouncePath selects the source address of the ARP requests sent
+// from an interface
+const arpAnnouncePath = "/proc/sys/net/ipv4/conf/%s/arp_announce"
+
+// hopLimitPath is the hop limit of the IPv6 packets sent from an interface
+const hopLimitPath = "/proc/sys/net/ipv6/conf/%s/hop_limit"
+
+// containerARPAnnounce makes the container use the best local address,
+// one in the subnet of the target, in its ARP requests
+const containerARPAnnounce = 2
+
+// tcpCongestionControlPath is the congestion control algorithm of new TCP
+// connections of the network namespace
+const tcpCongestionControlPath = "/proc/sys/net/ipv4/tcp_congestion_control"
+
+// tcpAvailableCongestionControlPath lists the congestion control
+// algorithms built in or loaded as modules
+const tcpAvailableCongestionControlPath = "/proc/sys/net/ipv4/tcp_available_congestion_control"
+
+// ipv6ExtHeaderLimitPaths limit the number of options in the IPv6
+// destination options and hop-by-hop extension headers
+var ipv6ExtHeaderLimitPaths = []string{
+	"/proc/sys/net/ipv6/max_dst_opts_number",
+	"/proc/sys/net/ipv6/max_hbh_opts_number",
+}
+
 // NetConf is used to hold the config of the network
 type NetConf struct {
 	types.NetConf
-	BrName          string `json:"bridge"`
-	BrSubnet        string `json:"bridgeSubnet"`
-	BrIP            string `json:"bridgeIP"`
-	LogToFile       string `json:"logToFile"`
-	IsGW            bool   `json:"isGateway"`
-	IsDefaultGW     bool   `json:"isDefaultGateway"`
-	IPMasq          bool   `json:"ipMasq"`
-	MTU             int    `json:"mtu"`
-	LinkMTUOverhead int    `json:"linkMTUOverhead"`
-	HairpinMode     bool   `json:"hairpinMode"`
+	BrName             string      `json:"bridge"`
+	BrSubnet           string      `json:"bridgeSubnet"`
+	BrIP               string      `json:"bridgeIP"`
+	LogToFile          string      `json:"logToFile"`
+	IsGW               bool        `json:"isGateway"`
+	IsDefaultGW        bool        `json:"isDefaultGateway"`
+	IPMasq             bool        `json:"ipMasq"`
+	MTU                int         `json:"mtu"`
+	LinkMTUOverhead    int         `json:"linkMTUOverhead"`
+	HairpinMode        bool        `json:"hairpinMode"`
+	MarkBased          []MarkRoute `json:"markBased"`
+	GlobalRPFilter     *int        `json:"globalRPFilter"`
+	NFLOGGroup         uint16      `json:"nflogGroup"`
+	NFLOGPrefix        string      `json:"nflogPrefix"`
+	TrunkPort          bool        `json:"trunkPort"`
+	AllowedVLANs       []int       `json:"allowedVLANs"`
+	ResolvConfPath     string      `json:"resolvConfPath"`
+	CleanupDNS         bool        `json:"cleanupDNS"`
+	AutoDetectGW       bool        `json:"autoDetectGateway"`
+	HWOffloadHints     bool        `json:"hwOffloadHints"`
+	ConntrackTCPLoose  bool        `json:"conntrackTCPLoose"`
+	HostVethNS         string      `json:"hostVethNetns"`
+	BPFFilterPath      string      `json:"bpfFilterPath"`
+	AdditionalIPs      []string    `json:"additionalIPs"`
+	DSCPRewrite        *bool       `json:"dscpRewrite"`
+	EnableARPTables    bool        `json:"enableARPTables"`
+	IPMasqExcludeCIDRs []string    `json:"ipMasqExcludeCIDRs"`
+	ACDEnabled         bool        `json:"acdEnabled"`
+	ContainerQdisc     string      `json:"containerQdisc"`
+	MaxPorts           int         `json:"maxPorts"`
+	MACTableMax        int         `json:"macTableMax"`
+	RemoteSubnet       string      `json:"remoteSubnet"`
+	RemoteEncapGW      string      `json:"remoteEncapGateway"`
+	BridgeUplink       string      `json:"bridgeUplink"`
+	SNATToIP           string      `json:"snatToIP"`
+	ConnmarkMark       uint32      `json:"connmarkMark"`
+	ConnmarkTable      int         `json:"connmarkTable"`
+	BPDUGuard          bool        `json:"bpduGuard"`
+	WireGuardIface     string      `json:"wireGuardInterface"`
+	WireGuardMasq      bool        `json:"wireGuardMasq"`
+	ByteQuota          uint64      `json:"byteQuota"`
+	ECMPFlowHashSeed   uint32      `json:"ecmpFlowHashSeed"`
+	AFXDPEnabled       bool        `json:"afXDPEnabled"`
+	AFXDPQueueID       int         `json:"afXDPQueueID"`
+	IPv6MaxExtHeaders  int         `json:"ipv6MaxExtHeaders"`
+	TCPCongestionCtl   string      `json:"tcpCongestionControl"`
+	ARPAnnounce        *int        `json:"arpAnnounce"`
+	IPVSVirtualService string      `json:"ipvsVirtualService"`
+	IPVSWeight         int         `json:"ipvsWeight"`
+	NFTablesExpireTTL  int         `json:"nftablesAutoExpireTTL"`
+	ICMPv4RateLimitPPS int         `json:"icmpv4RateLimitPPS"`
+	VLANTag            int         `json:"vlan"`
+	VLANFiltering      bool        `json:"vlanFiltering"`
+	RouteMark          uint32      `json:"routeMark"`
+	RouteMarkMask      uint32      `json:"routeMarkMask"`
+	RouteMarkTable     int         `json:"routeMarkTable"`
+	EgressKbps         uint64      `json:"egressBandwidthKbps"`
+	IngressKbps        uint64      `json:"ingressBandwidthKbps"`
+	STPEnabled         bool        `json:"stp"`
+	ForceBridgeIP      bool        `json:"forceUpdateBridgeIP"`
+	ForwardDelay       int         `json:"forwardDelay"`
+	AgeingTime         int         `json:"ageingTime"`
+	CTHelpers          []string    `json:"ctHelpers"`
+	MulticastSnooping  *bool       `json:"multicastSnooping"`
+	ArpProxy           bool        `json:"arpProxy"`
+	IPv6HopLimit       int         `json:"ipv6HopLimit"`
+	StableMAC          bool        `json:"stableMAC"`
+	ContainerMAC       string      `json:"containerMAC"`
+	VLANPriorityMap    map[int]int `json:"vlanPriorityMap"`
+	PromiscMode        bool        `json:"promiscMode"`
+	BridgePromiscMode  bool        `json:"bridgePromiscMode"`
+}
+
+// MarkRoute selects a routing table for traffic coming from the
+// container by marking it as it enters the host
+type MarkRoute struct {
+	Mark    uint32 `json:"mark"`
+	Mask    uint32 `json:"mask"`
+	TableID int    `json:"table"`
 }
 
 func init() {
@@ -57,6 +194,15 @@ func init() {
 	runtime.LockOSThread()
 }
 
+// resolvConfPath returns the path inside the container that the DNS
+// settings are written to
+func (n *NetConf) resolvConfPath() string {
+	if n.ResolvConfPath != "" {
+		return n.ResolvConfPath
+	}
+	return defaultResolvConfPath
+}
+
 func loadNetConf(bytes []byte) (*NetConf, error) {
 	n := &NetConf{
 		BrName: defaultBrName,
@@ -64,15 +210,303 @@ func loadNetConf(bytes []byte) (*NetConf, error) {
 	if err := json.Unmarshal(bytes, n); err != nil {
 		return nil, fmt.Errorf("failed to load netconf: %v", err)
 	}
+	if n.GlobalRPFilter != nil && (*n.GlobalRPFilter < 0 || *n.GlobalRPFilter > 2) {
+		return nil, fmt.Errorf("invalid globalRPFilter %d, must be 0, 1 or 2", *n.GlobalRPFilter)
+	}
+	if len(n.NFLOGPrefix) > maxNFLOGPrefixLen {
+		return nil, fmt.Errorf("nflogPrefix %q is longer than %d characters", n.NFLOGPrefix, maxNFLOGPrefixLen)
+	}
+	if n.TrunkPort && len(n.AllowedVLANs) == 0 {
+		return nil, fmt.Errorf("trunkPort requires at least one VLAN in allowedVLANs")
+	}
+	for _, cidr := range n.AdditionalIPs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("invalid additional IP %q: %v", cidr, err)
+		}
+	}
+	if (n.RemoteSubnet == "") != (n.RemoteEncapGW == "") {
+		return nil, fmt.Errorf("remoteSubnet and remoteEncapGateway must be set together")
+	}
+	if n.RemoteSubnet != "" {
+		if _, _, err := net.ParseCIDR(n.RemoteSubnet); err != nil {
+			return nil, fmt.Errorf("invalid remoteSubnet %q: %v", n.RemoteSubnet, err)
+		}
+		if gw := net.ParseIP(n.RemoteEncapGW); gw == nil || gw.To4() == nil {
+			return nil, fmt.Errorf("invalid remoteEncapGateway %q: must be an IPv4 address", n.RemoteEncapGW)
+		}
+	}
+	if n.SNATToIP != "" {
+		if snatIP := net.ParseIP(n.SNATToIP); snatIP == nil || snatIP.To4() == nil {
+			return nil, fmt.Errorf("invalid snatToIP %q: must be an IPv4 address", n.SNATToIP)
+		}
+	}
+	if n.WireGuardMasq && n.WireGuardIface == "" {
+		return nil, fmt.Errorf("wireGuardMasq requires wireGuardInterface")
+	}
+	if (n.ConnmarkMark == 0) != (n.ConnmarkTable == 0) {
+		return nil, fmt.Errorf("connmarkMark and connmarkTable must be set together")
+	}
+	if n.ConnmarkTable < 0 {
+		return nil, fmt.Errorf("invalid connmarkTable %d", n.ConnmarkTable)
+	}
+	if (n.RouteMark == 0) != (n.RouteMarkTable == 0) {
+		return nil, fmt.Errorf("routeMark and routeMarkTable must be set together")
+	}
+	if n.RouteMarkMask != 0 && n.RouteMark == 0 {
+		return nil, fmt.Errorf("routeMarkMask requires routeMark")
+	}
+	if n.RouteMarkTable < 0 {
+		return nil, fmt.Errorf("invalid routeMarkTable %d", n.RouteMarkTable)
+	}
+	if n.ARPAnnounce != nil && (*n.ARPAnnounce < 0 || *n.ARPAnnounce > 2) {
+		return nil, fmt.Errorf("invalid arpAnnounce %d, must be 0, 1 or 2", *n.ARPAnnounce)
+	}
+	if n.IPVSVirtualService != "" {
+		host, port, err := net.SplitHostPort(n.IPVSVirtualService)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ipvsVirtualService %q: %v", n.IPVSVirtualService, err)
+		}
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid ipvsVirtualService %q: %q is not an IP address", n.IPVSVirtualService, host)
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("invalid ipvsVirtualService %q: invalid port %q", n.IPVSVirtualService, port)
+		}
+	}
+	if n.IPVSWeight < 0 {
+		return nil, fmt.Errorf("invalid ipvsWeight %d", n.IPVSWeight)
+	}
+	if n.ICMPv4RateLimitPPS < 0 {
+		return nil, fmt.Errorf("invalid icmpv4RateLimitPPS %d", n.ICMPv4RateLimitPPS)
+	}
+	if n.NFTablesExpireTTL < 0 {
+		return nil, fmt.Errorf("invalid nftablesAutoExpireTTL %d", n.NFTablesExpireTTL)
+	}
+	for _, name := range n.CTHelpers {
+		if _, ok := ctHelpers[name]; !ok {
+			return nil, fmt.Errorf("unknown conntrack helper %q in ctHelpers", name)
+		}
+	}
+	if n.IPv6HopLimit < 0 || n.IPv6HopLimit > 255 {
+		return nil, fmt.Errorf("invalid ipv6HopLimit %d, must be between 1 and 255", n.IPv6HopLimit)
+	}
+	if n.ContainerMAC != "" {
+		mac, err := net.ParseMAC(n.ContainerMAC)
+		if err != nil || len(mac) != 6 || mac[0]&0x01 != 0 {
+			return nil, fmt.Errorf("invalid containerMAC %q, must be a unicast Ethernet address", n.ContainerMAC)
+		}
+		if n.StableMAC {
+			return nil, errors.New("containerMAC and stableMAC are mutually exclusive")
+		}
+	}
+	for dscp, pcp := range n.VLANPriorityMap {
+		if dscp < 0 || dscp > 63 {
+			return nil, fmt.Errorf("invalid DSCP %d in vlanPriorityMap, must be between 0 and 63", dscp)
+		}
+		if pcp < 0 || pcp > 7 {
+			return nil, fmt.Errorf("invalid priority %d for DSCP %d in vlanPriorityMap, must be between 0 and 7", pcp, dscp)
+		}
+	}
+	if n.ForwardDelay < 0 {
+		return nil, fmt.Errorf("invalid forwardDelay %d", n.ForwardDelay)
+	}
+	if n.AgeingTime < 0 {
+		return nil, fmt.Errorf("invalid ageingTime %d", n.AgeingTime)
+	}
+	if n.AFXDPQueueID < 0 {
+		return nil, fmt.Errorf("invalid afXDPQueueID %d", n.AFXDPQueueID)
+	}
+	if n.MACTableMax < 0 {
+		return nil, fmt.Errorf("invalid macTableMax %d", n.MACTableMax)
+	}
+	switch n.ContainerQdisc {
+	case "", "fq", "fq_codel", "pfifo_fast":
+	default:
+		return nil, fmt.Errorf("invalid containerQdisc %q: must be one of fq, fq_codel or pfifo_fast", n.ContainerQdisc)
+	}
+	for _, cidr := range n.IPMasqExcludeCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("invalid ipMasqExcludeCIDRs entry %q: %v", cidr, err)
+		}
+	}
+	for _, vid := range n.AllowedVLANs {
+		if vid < 1 || vid > 4094 {
+			return nil, fmt.Errorf("invalid VLAN ID %d in allowedVLANs, must be between 1 and 4094", vid)
+		}
+	}
+	if n.VLANTag != 0 && (n.VLANTag < 1 || n.VLANTag > 4094) {
+		return nil, fmt.Errorf("invalid vlan %d, must be between 1 and 4094", n.VLANTag)
+	}
 	return n, nil
 }
 
+// dscpClearEnabled reports whether the DSCP bits of the container's
+// traffic should be zeroed, which is only the case when dscpRewrite is
+// explicitly false
+func (n *NetConf) dscpClearEnabled() bool {
+	return n.DSCPRewrite != nil && !*n.DSCPRewrite
+}
+
+// nflogEnabled reports whether forwarded traffic should be copied to NFLOG
+func (n *NetConf) nflogEnabled() bool {
+	return n.NFLOGGroup != 0 || n.NFLOGPrefix != ""
+}
+
+// rpFilterStrictness orders rp_filter modes: disabled, loose, strict
+func rpFilterStrictness(mode int) int {
+	switch mode {
+	case 0:
+		return 0
+	case 2:
+		return 1
+	}
+	return 2
+}
+
+// relaxRPFilter writes mode to the rp_filter file at path, but only if
+// that is less strict than the current setting. A node that already
+// relaxed reverse path filtering is never tightened again.
+func relaxRPFilter(path string, mode int) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	cur, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	if rpFilterStrictness(mode) >= rpFilterStrictness(cur) {
+		return nil
+	}
+
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(mode)), 0644)
+}
+
+// enableSysctl turns on the boolean setting at path unless it is
+// already on, so the file is not rewritten for every container
+func enableSysctl(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	if strings.TrimSpace(string(data)) != "0" {
+		return nil
+	}
+
+	return ioutil.WriteFile(path, []byte("1"), 0644)
+}
+
+// disableSysctl turns off the boolean setting at path unless it is
+// already off
+func disableSysctl(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	if strings.TrimSpace(string(data)) == "0" {
+		return nil
+	}
+
+	return ioutil.WriteFile(path, []byte("0"), 0644)
+}
+
+// disableSendRedirects stops the host from sending ICMP redirects out of
+// the bridge: the containers route through it on purpose. The setting
+// of an interface is ORed with "all", so both are turned off.
+func disableSendRedirects(brName string) error {
+	for _, name := range []string{"all", brName} {
+		if err := disableSysctl(fmt.Sprintf(sendRedirectsPath, name)); err != nil {
+			return fmt.Errorf("failed to disable ICMP redirects: %v", err)
+		}
+	}
+	return nil
+}
+
+// setSysctlValue writes value to the setting at path unless it already
+// has that value
+func setSysctlValue(path string, value string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	if strings.TrimSpace(string(data)) == value {
+		return nil
+	}
+
+	return ioutil.WriteFile(path, []byte(value), 0644)
+}
+
+// setARPAnnounce sets the arp_announce mode of the interface ifName in
+// the current network namespace
+func setARPAnnounce(ifName string, mode int) error {
+	if err := setSysctlValue(fmt.Sprintf(arpAnnouncePath, ifName), strconv.Itoa(mode)); err != nil {
+		return fmt.Errorf("failed to set arp_announce of %q: %v", ifName, err)
+	}
+	return nil
+}
+
+// setHopLimit sets the hop limit of the IPv6 packets sent from ifName
+func setHopLimit(ifName string, limit int) error {
+	if err := setSysctlValue(fmt.Sprintf(hopLimitPath, ifName), strconv.Itoa(limit)); err != nil {
+		return fmt.Errorf("failed to set hop_limit of %q: %v", ifName, err)
+	}
+	return nil
+}
+
+// setStableMAC gives the container interface ifName the MAC derived from
+// the container ID, so that it keeps its MAC across restarts
+func setStableMAC(ifName, containerID string) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	mac := ip.DeriveStableMAC(containerID, ifName)
+	if err = netlink.LinkSetHardwareAddr(link, mac); err != nil {
+		return fmt.Errorf("failed to set the MAC of %q to %v: %v", ifName, mac, err)
+	}
+	return nil
+}
+
+// setTCPCongestionControl makes name the congestion control algorithm of
+// the current network namespace. The kernel loads the tcp_$name module
+// if the algorithm is not available yet.
+func setTCPCongestionControl(name string) error {
+	if err := setSysctlValue(tcpCongestionControlPath, name); err != nil {
+		data, _ := ioutil.ReadFile(tcpAvailableCongestionControlPath)
+		for _, available := range strings.Fields(string(data)) {
+			if available == name {
+				return fmt.Errorf("failed to set TCP congestion control %q: %v", name, err)
+			}
+		}
+		return fmt.Errorf("TCP congestion control %q is not available, is the tcp_%s kernel module installed?", name, name)
+	}
+	return nil
+}
+
 func ensureBridgeAddr(br *netlink.Bridge, ipn *net.IPNet) error {
-	addrs, err := netlink.AddrList(br, syscall.AF_INET)
+	family := syscall.AF_INET
+	if ipn.IP.To4() == nil {
+		family = syscall.AF_INET6
+	}
+	all, err := netlink.AddrList(br, family)
 	if err != nil && err != syscall.ENOENT {
 		return fmt.Errorf("could not get list of IP addresses: %v", err)
 	}
 
+	// the kernel adds an IPv6 link-local address by itself
+	var addrs []netlink.Addr
+	for _, a := range all {
+		if !a.IP.IsLinkLocalUnicast() {
+			addrs = append(addrs, a)
+		}
+	}
+
 	// if there're no addresses on the bridge, it's ok -- we'll add one
 	if len(addrs) > 0 {
 		ipnStr := ipn.String()
@@ -136,325 +570,1705 @@ func ensureBridge(brName string, mtu int) (*netlink.Bridge, error) {
 	return br, nil
 }
 
-func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairpinMode bool) error {
-	var hostVethName string
+// bridgePorts returns the number of links attached to br
+func bridgePorts(br netlink.Link) (int, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list links: %v", err)
+	}
 
-	err := netns.Do(func(hostNS ns.NetNS) error {
-		// create the veth pair in the container and move host end into host netns
-		hostVeth, _, err := ip.SetupVeth(ifName, mtu, hostNS)
-		if err != nil {
-			return err
+	var ports int
+	for _, link := range links {
+		if link.Attrs().MasterIndex == br.Attrs().Index {
+			ports++
 		}
+	}
+	return ports, nil
+}
 
-		hostVethName = hostVeth.Attrs().Name
-		return nil
-	})
+// checkMaxPorts fails if br already has max ports attached
+func checkMaxPorts(br *netlink.Bridge, max int) error {
+	ports, err := bridgePorts(br)
 	if err != nil {
 		return err
 	}
+	if ports >= max {
+		return fmt.Errorf("bridge %q already has %d ports, the maximum allowed by maxPorts", br.Attrs().Name, ports)
+	}
+	return nil
+}
 
-	// need to lookup hostVeth again as its index has changed during ns move
-	hostVeth, err := netlink.LinkByName(hostVethName)
+// setupRemoteRoute routes the remote subnet through the flow based ipip
+// device, encapsulating packets to the remote gateway. The route is
+// shared by all containers of the network.
+func setupRemoteRoute(n *NetConf) error {
+	dev, err := netlink.LinkByName(ipipDevName)
 	if err != nil {
-		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+		if err = ip.AddIPIPDevice(ipipDevName); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to create %q: %v", ipipDevName, err)
+		}
+		if dev, err = netlink.LinkByName(ipipDevName); err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ipipDevName, err)
+		}
 	}
-
-	// connect host veth end to the bridge
-	if err = netlink.LinkSetMaster(hostVeth, br); err != nil {
-		return fmt.Errorf("failed to connect %q to bridge %v: %v", hostVethName, br.Attrs().Name, err)
+	if err = netlink.LinkSetUp(dev); err != nil {
+		return fmt.Errorf("failed to set %q up: %v", ipipDevName, err)
 	}
 
-	// set hairpin mode
-	if err = netlink.LinkSetHairpin(hostVeth, hairpinMode); err != nil {
-		return fmt.Errorf("failed to setup hairpin mode for %v: %v", hostVethName, err)
+	_, dst, _ := net.ParseCIDR(n.RemoteSubnet)
+	err = ip.AddEncapRoute(dst, net.ParseIP(n.RemoteEncapGW), dev)
+	if err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("failed to add route to %v via %v: %v", dst, n.RemoteEncapGW, err)
 	}
-
 	return nil
 }
 
-func calcGatewayIP(ipn *net.IPNet) net.IP {
-	nid := ipn.IP.Mask(ipn.Mask)
-	return ip.NextIP(nid)
-}
-
-func calculateBridgeIP(n *NetConf) (*net.IPNet, error) {
-	var (
-		ip          net.IP
-		bridgeIPNet *net.IPNet
-		err         error
-	)
-
-	if n.BrSubnet == "" {
-		return nil, fmt.Errorf("mandatory bridgeSubnet not specified in config")
+// teardownRemoteRoute removes the route added by setupRemoteRoute once
+// the last container has left the bridge. The ipip device may be used by
+// other networks and is kept.
+func teardownRemoteRoute(n *NetConf) error {
+	br, err := netlink.LinkByName(n.BrName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", n.BrName, err)
+	}
+	ports, err := bridgePorts(br)
+	if err != nil || ports > 0 {
+		return err
 	}
 
-	_, brNetworkIPNet, err := net.ParseCIDR(n.BrSubnet)
+	dev, err := netlink.LinkByName(ipipDevName)
 	if err != nil {
-		return nil, fmt.Errorf("Invalid bridgeSubnet specified got error: %v", err)
+		return nil
 	}
 
-	if n.BrIP != "" {
-		ip = net.ParseIP(n.BrIP)
-		if ip == nil {
-			// Check if we can parse as a CIDR
-			ip, _, err = net.ParseCIDR(n.BrIP)
-			if err != nil {
-				return nil, fmt.Errorf("invalid bridgeIP specified in config")
-			}
-		}
-
-		if !brNetworkIPNet.Contains(ip) {
-			return nil, fmt.Errorf("bridgeIP is not in bridgeSubnet")
-		}
-		bridgeIPNet = &net.IPNet{IP: ip, Mask: brNetworkIPNet.Mask}
-	} else {
-		// Use the first IP of the subnet for the bridge
-		brNetworkIPTo4 := brNetworkIPNet.IP.To4()
-
-		ip = net.IPv4(
-			brNetworkIPTo4[0],
-			brNetworkIPTo4[1],
-			brNetworkIPTo4[2],
-			brNetworkIPTo4[3]+1,
-		)
-		bridgeIPNet = &net.IPNet{IP: ip, Mask: brNetworkIPNet.Mask}
+	_, dst, _ := net.ParseCIDR(n.RemoteSubnet)
+	err = ip.DelEncapRoute(dst, net.ParseIP(n.RemoteEncapGW), dev)
+	if err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("failed to delete route to %v: %v", dst, err)
 	}
-
-	return bridgeIPNet, nil
+	return nil
 }
 
-func setBridgeIP(n *NetConf) error {
-
-	if n.BrSubnet == "" {
-		return fmt.Errorf("mandatory bridgeSubnet not specified in config")
-	}
-
-	link, err := netlink.LinkByName(n.BrName)
+// attachUplink makes the interface uplink a port of br, moving its IPv4
+// addresses to br so that the host stays reachable through the bridge
+func attachUplink(br *netlink.Bridge, uplink string) error {
+	link, err := netlink.LinkByName(uplink)
 	if err != nil {
-		return fmt.Errorf("failed to lookup %q: %v", n.BrName, err)
+		return fmt.Errorf("failed to lookup uplink %q: %v", uplink, err)
 	}
-
-	bridgeIPNet, err := calculateBridgeIP(n)
-	if err != nil {
-		return fmt.Errorf("failed to calculate bridge IP: %v", err)
+	if link.Attrs().MasterIndex == br.Attrs().Index {
+		return nil
 	}
 
 	addrs, err := netlink.AddrList(link, syscall.AF_INET)
-	if err != nil && err != syscall.ENOENT {
-		return fmt.Errorf("could not get list of IP addresses: %v", err)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of %q: %v", uplink, err)
 	}
-	if len(addrs) > 0 {
-		bridgeIPStr := bridgeIPNet.String()
-		for _, a := range addrs {
-			if a.IPNet.String() == bridgeIPStr {
-				// Bridge IP already set, nothing to do
-				return nil
-			}
+	for _, addr := range addrs {
+		if err = netlink.AddrDel(link, &addr); err != nil {
+			return fmt.Errorf("failed to remove %v from %q: %v", addr.IPNet, uplink, err)
+		}
+		// labels must start with the name of the interface
+		err = netlink.AddrAdd(br, &netlink.Addr{IPNet: addr.IPNet})
+		if err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to move %v to %q: %v", addr.IPNet, br.Attrs().Name, err)
 		}
 	}
 
-	addr := &netlink.Addr{IPNet: bridgeIPNet, Label: ""}
-	if err = netlink.AddrAdd(link, addr); err != nil {
-		return fmt.Errorf("failed to add IP addr to %q: %v", n.BrName, err)
+	if err = netlink.LinkSetMaster(link, br); err != nil {
+		return fmt.Errorf("failed to attach %q to %q: %v", uplink, br.Attrs().Name, err)
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to set %q up: %v", uplink, err)
 	}
-
 	return nil
 }
 
-func setupBridge(n *NetConf) (*netlink.Bridge, error) {
-	// create bridge if necessary
-	br, err := ensureBridge(n.BrName, n.MTU)
+// detachUplink removes the uplink from the bridge once the last container
+// has left it. The addresses moved by attachUplink stay on the bridge.
+func detachUplink(n *NetConf) error {
+	br, err := netlink.LinkByName(n.BrName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create bridge %q: %v", n.BrName, err)
+		return fmt.Errorf("failed to lookup %q: %v", n.BrName, err)
 	}
-
-	// Set the bridge IP address
-	err = setBridgeIP(n)
+	link, err := netlink.LinkByName(n.BridgeUplink)
 	if err != nil {
-		return nil, fmt.Errorf("failed to set bridge IP: %v", err)
+		return fmt.Errorf("failed to lookup uplink %q: %v", n.BridgeUplink, err)
+	}
+	if link.Attrs().MasterIndex != br.Attrs().Index {
+		return nil
 	}
 
-	return br, nil
-}
+	// the uplink itself is one of the ports
+	ports, err := bridgePorts(br)
+	if err != nil || ports > 1 {
+		return err
+	}
+
+	if err = netlink.LinkSetMasterByIndex(link, 0); err != nil {
+		return fmt.Errorf("failed to detach %q from %q: %v", n.BridgeUplink, n.BrName, err)
+	}
+	return nil
+}
+
+func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, mac net.HardwareAddr, hairpinMode bool, trunkVLANs []int) (netlink.Link, error) {
+	var hostVethName string
+
+	err := netns.Do(func(hostNS ns.NetNS) error {
+		// create the veth pair in the container and move host end into host netns
+		hostVeth, _, err := ip.SetupVethWithMAC(ifName, mtu, mac, hostNS)
+		if err != nil {
+			return err
+		}
+
+		hostVethName = hostVeth.Attrs().Name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// need to lookup hostVeth again as its index has changed during ns move
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+
+	// connect host veth end to the bridge
+	if err = netlink.LinkSetMaster(hostVeth, br); err != nil {
+		return nil, fmt.Errorf("failed to connect %q to bridge %v: %v", hostVethName, br.Attrs().Name, err)
+	}
+
+	// set hairpin mode
+	if err = netlink.LinkSetHairpin(hostVeth, hairpinMode); err != nil {
+		return nil, fmt.Errorf("failed to setup hairpin mode for %v: %v", hostVethName, err)
+	}
+
+	// pass the trunk VLANs to the container tagged
+	for _, vid := range trunkVLANs {
+		if err = ip.BridgeVlanAdd(hostVeth, uint16(vid), false, false); err != nil {
+			return nil, fmt.Errorf("failed to add VLAN %d to %v: %v", vid, hostVethName, err)
+		}
+	}
+
+	return hostVeth, nil
+}
+
+// setupAccessVLAN makes hostVeth an access port of VLAN vid: untagged
+// frames from the container are classified into vid, and frames of vid
+// leave towards the container untagged.
+func setupAccessVLAN(hostVeth netlink.Link, vid int) error {
+	if err := ip.BridgeVlanAdd(hostVeth, uint16(vid), true, true); err != nil {
+		return fmt.Errorf("failed to add VLAN %d to %v: %v", vid, hostVeth.Attrs().Name, err)
+	}
+	return nil
+}
+
+// teardownAccessVLAN removes the access VLAN from the host end of the
+// container's veth, before the veth itself is deleted.
+func teardownAccessVLAN(hostNS ns.NetNS, hostVethName string, vid int) error {
+	return hostNS.Do(func(_ ns.NetNS) error {
+		hostVeth, err := netlink.LinkByName(hostVethName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+		}
+		if err = ip.BridgeVlanDel(hostVeth, uint16(vid)); err != nil {
+			return fmt.Errorf("failed to remove VLAN %d from %v: %v", vid, hostVethName, err)
+		}
+		return nil
+	})
+}
+
+// setupBPDUGuard makes the bridge disable hostVeth when the container
+// sends STP BPDUs, so that containers cannot take part in the spanning
+// tree of the host. Equivalent to writing 1 to brif/$hostVeth/bpdu_guard.
+func setupBPDUGuard(hostVeth netlink.Link) error {
+	if err := netlink.LinkSetGuard(hostVeth, true); err != nil {
+		return fmt.Errorf("failed to enable BPDU guard on %q: %v", hostVeth.Attrs().Name, err)
+	}
+	return nil
+}
+
+// setupAFXDP puts hostVeth in native XDP mode by attaching a program
+// passing all packets, as veth only runs XDP in its driver, and with it
+// AF_XDP sockets in driver mode, with a program attached. The socket of
+// the application then binds to queueID, which must exist. veth cannot
+// do zero-copy, so sockets copy packets, without going through an skb.
+func setupAFXDP(hostVeth netlink.Link, queueID int) error {
+	queues, err := ip.LinkNumRxQueues(hostVeth)
+	if err != nil {
+		return err
+	}
+	if queueID >= queues {
+		return fmt.Errorf("afXDPQueueID %d does not exist, %q has %d receive queues", queueID, hostVeth.Attrs().Name, queues)
+	}
+
+	fd, err := ip.LoadXDPPass()
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	return ip.LinkSetXDP(hostVeth, fd, ip.XDPFlagsDrvMode)
+}
+
+// Priorities of the ingress filters on the host veth. The DSCP priority
+// map comes first as its filters continue classification, the QoS
+// redirect takes priority 2.
+const (
+	vlanPriorityFilterPrio = 1
+	hwOffloadFilterPrio    = 3
+)
+
+// setupHWOffload adds a flower classifier for the container's traffic to
+// the host veth, so that NICs which support it can offload the datapath.
+// The filter goes away with the veth.
+func setupHWOffload(netns ns.NetNS, ifName, hostVethName string, contIP net.IP) error {
+	var contMAC net.HardwareAddr
+	err := netns.Do(func(_ ns.NetNS) error {
+		contVeth, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		contMAC = contVeth.Attrs().HardwareAddr
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+	return ip.SetupFlowerOffload(hostVeth, hwOffloadFilterPrio, contMAC, contIP)
+}
+
+// checkAddressConflict fails if another host answers an ARP probe for
+// addr sent from ifName. Must be called in the container netns.
+func checkAddressConflict(ifName string, addr net.IP) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	mac, err := ip.ARPProbe(link, addr, acdTimeout)
+	if err != nil {
+		return err
+	}
+	if mac != nil {
+		return fmt.Errorf("IP address %v is already in use by %v", addr, mac)
+	}
+	return nil
+}
+
+func containerQdisc(link netlink.Link, kind string) netlink.Qdisc {
+	return &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		QdiscType: kind,
+	}
+}
+
+// setupContainerQdisc replaces the root qdisc of ifName with one of the
+// given kind, using its default parameters. Must be called in the
+// container netns.
+func setupContainerQdisc(ifName, kind string) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	if err = netlink.QdiscAdd(containerQdisc(link, kind)); err != nil {
+		return fmt.Errorf("failed to add %s qdisc to %q: %v", kind, ifName, err)
+	}
+	return nil
+}
+
+// teardownContainerQdisc undoes the effects of setupContainerQdisc
+func teardownContainerQdisc(ifName, kind string) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	err = netlink.QdiscDel(containerQdisc(link, kind))
+	if err != nil && err != syscall.ENOENT {
+		return fmt.Errorf("failed to remove %s qdisc from %q: %v", kind, ifName, err)
+	}
+	return nil
+}
+
+// additionalAddr returns the address for the i-th additional IP of
+// ifName, labelled as an alias of the interface
+func additionalAddr(ifName string, i int, cidr string) (*netlink.Addr, error) {
+	ipn, err := types.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	return &netlink.Addr{IPNet: ipn, Label: fmt.Sprintf("%s:%d", ifName, i)}, nil
+}
+
+// addAdditionalIPs adds secondary addresses to ifName. Must be called
+// in the container netns.
+func addAdditionalIPs(ifName string, cidrs []string) error {
+	if len(cidrs) == 0 {
+		return nil
+	}
+
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	for i, cidr := range cidrs {
+		addr, err := additionalAddr(ifName, i, cidr)
+		if err != nil {
+			return err
+		}
+		if err = netlink.AddrAdd(link, addr); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to add IP addr %v to %q: %v", addr.IPNet, ifName, err)
+		}
+	}
+	return nil
+}
+
+// delAdditionalIPs undoes the effects of addAdditionalIPs
+func delAdditionalIPs(ifName string, cidrs []string) error {
+	if len(cidrs) == 0 {
+		return nil
+	}
+
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	for i, cidr := range cidrs {
+		addr, err := additionalAddr(ifName, i, cidr)
+		if err != nil {
+			return err
+		}
+		if err = netlink.AddrDel(link, addr); err != nil && err != syscall.EADDRNOTAVAIL {
+			return fmt.Errorf("failed to remove IP addr %v from %q: %v", addr.IPNet, ifName, err)
+		}
+	}
+	return nil
+}
+
+// attachBPFFilter attaches the eBPF program pinned at path to the host
+// veth, where it sees all packets sent by the container
+func attachBPFFilter(hostVeth netlink.Link, path string) error {
+	fd, err := ip.LoadPinnedBPF(path)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	return ip.AttachBPFFilter(hostVeth, fd, filepath.Base(path))
+}
+
+// detachBPFFilter undoes the effects of attachBPFFilter. Must be called
+// in the container netns.
+func detachBPFFilter(hostNS ns.NetNS, hostVethName string) error {
+	return hostNS.Do(func(_ ns.NetNS) error {
+		hostVeth, err := netlink.LinkByName(hostVethName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+		}
+		return ip.DetachBPFFilter(hostVeth)
+	})
+}
+
+// lookupHostVethName returns the name of the host end of the veth pair
+// whose container end is ifName. Must be called in the container netns.
+func lookupHostVethName(ifName string, hostNS ns.NetNS) (string, error) {
+	contVeth, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	// for a veth, the parent index is the ifindex of its peer
+	peerIndex := contVeth.Attrs().ParentIndex
+
+	var hostVethName string
+	err = hostNS.Do(func(_ ns.NetNS) error {
+		hostVeth, err := netlink.LinkByIndex(peerIndex)
+		if err != nil {
+			return fmt.Errorf("failed to lookup host end of %q: %v", ifName, err)
+		}
+		hostVethName = hostVeth.Attrs().Name
+		return nil
+	})
+	return hostVethName, err
+}
+
+func markMask(mr MarkRoute) uint32 {
+	if mr.Mask == 0 {
+		return 0xffffffff
+	}
+	return mr.Mask
+}
+
+func markSpec(mr MarkRoute) string {
+	return fmt.Sprintf("%#x/%#x", mr.Mark, markMask(mr))
+}
+
+func markRule(mr MarkRoute) *ip.Rule {
+	return &ip.Rule{
+		Table: mr.TableID,
+		Mark:  mr.Mark,
+		Mask:  markMask(mr),
+	}
+}
+
+// ensureMarkRule adds the policy routing rule for mr. The rule is shared
+// by all containers using the same mark so it may already exist.
+func ensureMarkRule(mr MarkRoute) error {
+	rule := markRule(mr)
+	rules, err := ip.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("could not get list of rules: %v", err)
+	}
+
+	// the kernel happily adds duplicates of rules without a priority
+	for _, r := range rules {
+		if r.Mark == rule.Mark && r.Mask == rule.Mask && r.Table == rule.Table {
+			return nil
+		}
+	}
+
+	if err := ip.AddRule(rule); err != nil {
+		return fmt.Errorf("failed to add rule %v: %v", rule, err)
+	}
+	return nil
+}
+
+// setupMarkRoutes marks traffic arriving from hostVethName so that it is
+// routed using the table of each of the mark based routes
+func setupMarkRoutes(routes []MarkRoute, hostVethName string, comment string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	for _, mr := range routes {
+		if mr.TableID <= 0 {
+			return fmt.Errorf("invalid routing table %d for mark %s", mr.TableID, markSpec(mr))
+		}
+
+		if err := ipt.AppendUnique("mangle", "PREROUTING", "-i", hostVethName, "-j", "MARK", "--set-mark", markSpec(mr), "-m", "comment", "--comment", comment); err != nil {
+			return err
+		}
+
+		if err := ensureMarkRule(mr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// teardownMarkRoutes undoes the effects of setupMarkRoutes. A policy
+// routing rule is only removed once no container uses its mark anymore.
+func teardownMarkRoutes(routes []MarkRoute, hostVethName string, comment string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	for _, mr := range routes {
+		if err := deleteRule(ipt, "mangle", "PREROUTING", "-i", hostVethName, "-j", "MARK", "--set-mark", markSpec(mr), "-m", "comment", "--comment", comment); err != nil {
+			return err
+		}
+	}
+
+	return releaseMarkRules(ipt, routes)
+}
+
+// releaseMarkRules removes the policy routing rules of routes whose mark
+// is no longer set by any rule of mangle/PREROUTING
+func releaseMarkRules(ipt *iptables.IPTables, routes []MarkRoute) error {
+	rules, err := ipt.List("mangle", "PREROUTING")
+	if err != nil {
+		return err
+	}
+
+	for _, mr := range routes {
+		inUse := false
+		for _, r := range rules {
+			if strings.Contains(r, " "+markSpec(mr)) {
+				inUse = true
+				break
+			}
+		}
+		if inUse {
+			continue
+		}
+
+		if err := ip.DelRule(markRule(mr)); err != nil && err != syscall.ENOENT {
+			return fmt.Errorf("failed to delete rule %v: %v", markRule(mr), err)
+		}
+	}
+	return nil
+}
+
+// globalAddr returns the first address of the given family of ifName
+// that is not link-local, or nil if it has none
+func globalAddr(ifName string, family int) (*net.IPNet, error) {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	addrs, err := netlink.AddrList(link, family)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get IP addresses for %q: %v", ifName, err)
+	}
+	for _, a := range addrs {
+		if !a.IP.IsLinkLocalUnicast() {
+			return a.IPNet, nil
+		}
+	}
+	return nil, nil
+}
+
+func calcGatewayIP(ipn *net.IPNet) net.IP {
+	nid := ipn.IP.Mask(ipn.Mask)
+	return ip.NextIP(nid)
+}
+
+// routeGet is swapped out by tests
+var routeGet = netlink.RouteGet
+
+// detectGateway returns the gateway the host uses for the bridge subnet
+func detectGateway(n *NetConf) (net.IP, error) {
+	bridgeIPNet, err := calculateBridgeIP(n)
+	if err != nil {
+		return nil, err
+	}
+
+	routes, err := routeGet(bridgeIPNet.IP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get route to %v: %v", bridgeIPNet.IP, err)
+	}
+	for _, r := range routes {
+		if r.Gw != nil {
+			return r.Gw, nil
+		}
+	}
+	return nil, fmt.Errorf("no gateway found for bridge subnet %s", n.BrSubnet)
+}
+
+// addDefaultRoute adds a default route, defaultDst being "0.0.0.0/0" or
+// "::/0", via the gateway of ipc unless IPAM already set a different one
+func addDefaultRoute(ipc *types.IPConfig, defaultDst string) error {
+	_, defaultNet, err := net.ParseCIDR(defaultDst)
+	if err != nil {
+		return err
+	}
+
+	for _, route := range ipc.Routes {
+		if defaultNet.String() == route.Dst.String() {
+			if route.GW != nil && !route.GW.Equal(ipc.Gateway) {
+				return fmt.Errorf(
+					"isDefaultGateway ineffective because IPAM sets default route via %q",
+					route.GW,
+				)
+			}
+		}
+	}
+
+	ipc.Routes = append(ipc.Routes, types.Route{Dst: *defaultNet, GW: ipc.Gateway})
+	return nil
+}
+
+// injectDetectedGateway makes the detected gateway the default route of
+// an IPAM result that has no gateway
+func injectDetectedGateway(n *NetConf, ipc *types.IPConfig) error {
+	gw, err := detectGateway(n)
+	if err != nil {
+		return err
+	}
+	if !ipc.IP.Contains(gw) {
+		return fmt.Errorf("detected gateway %v is not in the container subnet %v", gw, ip.Network(&ipc.IP))
+	}
+
+	_, defaultNet, _ := net.ParseCIDR("0.0.0.0/0")
+	ipc.Gateway = gw
+	ipc.Routes = append(ipc.Routes, types.Route{Dst: *defaultNet, GW: gw})
+	return nil
+}
+
+func calculateBridgeIP(n *NetConf) (*net.IPNet, error) {
+	var (
+		ip          net.IP
+		bridgeIPNet *net.IPNet
+		err         error
+	)
+
+	if n.BrSubnet == "" {
+		return nil, fmt.Errorf("mandatory bridgeSubnet not specified in config")
+	}
+
+	_, brNetworkIPNet, err := net.ParseCIDR(n.BrSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid bridgeSubnet specified got error: %v", err)
+	}
+
+	if n.BrIP != "" {
+		ip = net.ParseIP(n.BrIP)
+		if ip == nil {
+			// Check if we can parse as a CIDR
+			ip, _, err = net.ParseCIDR(n.BrIP)
+			if err != nil {
+				return nil, fmt.Errorf("invalid bridgeIP specified in config")
+			}
+		}
+
+		if !brNetworkIPNet.Contains(ip) {
+			return nil, fmt.Errorf("bridgeIP is not in bridgeSubnet")
+		}
+		bridgeIPNet = &net.IPNet{IP: ip, Mask: brNetworkIPNet.Mask}
+	} else {
+		// Use the first IP of the subnet for the bridge
+		brNetworkIPTo4 := brNetworkIPNet.IP.To4()
+
+		ip = net.IPv4(
+			brNetworkIPTo4[0],
+			brNetworkIPTo4[1],
+			brNetworkIPTo4[2],
+			brNetworkIPTo4[3]+1,
+		)
+		bridgeIPNet = &net.IPNet{IP: ip, Mask: brNetworkIPNet.Mask}
+	}
+
+	return bridgeIPNet, nil
+}
+
+func setBridgeIP(n *NetConf) error {
+
+	if n.BrSubnet == "" {
+		return fmt.Errorf("mandatory bridgeSubnet not specified in config")
+	}
+
+	link, err := netlink.LinkByName(n.BrName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", n.BrName, err)
+	}
+
+	bridgeIPNet, err := calculateBridgeIP(n)
+	if err != nil {
+		return fmt.Errorf("failed to calculate bridge IP: %v", err)
+	}
+
+	addrs, err := netlink.AddrList(link, syscall.AF_INET)
+	if err != nil && err != syscall.ENOENT {
+		return fmt.Errorf("could not get list of IP addresses: %v", err)
+	}
+	if len(addrs) > 0 {
+		bridgeIPStr := bridgeIPNet.String()
+		for _, a := range addrs {
+			if a.IPNet.String() == bridgeIPStr {
+				// Bridge IP already set, only make sure it is recorded
+				// for bridges set up before the record existed
+				return saveBridgeIP(n.BrName, bridgeIPNet)
+			}
+		}
+	}
+
+	// replace the address of a previous configuration, e.g. after the
+	// bridgeSubnet changed. Other addresses, such as those moved from
+	// the uplink, are left alone.
+	if n.ForceBridgeIP {
+		old, err := loadBridgeIP(n.BrName)
+		if err != nil {
+			return err
+		}
+		for _, a := range addrs {
+			if old == nil || a.IPNet.String() != old.String() {
+				continue
+			}
+			logrus.Warnf("replacing IP addr %v of %q with %v", a.IPNet, n.BrName, bridgeIPNet)
+			if err = netlink.AddrDel(link, &a); err != nil {
+				return fmt.Errorf("failed to delete IP addr %v from %q: %v", a.IPNet, n.BrName, err)
+			}
+		}
+	}
+
+	addr := &netlink.Addr{IPNet: bridgeIPNet, Label: ""}
+	if err = netlink.AddrAdd(link, addr); err != nil {
+		return fmt.Errorf("failed to add IP addr to %q: %v", n.BrName, err)
+	}
+
+	return saveBridgeIP(n.BrName, bridgeIPNet)
+}
+
+// bridgeStateDir keeps, for every bridge, the address setBridgeIP gave
+// it, so that forceUpdateBridgeIP only replaces that one
+var bridgeStateDir = "/var/lib/cni/bridge"
+
+// saveBridgeIP records ipn as the address setBridgeIP gave the bridge
+func saveBridgeIP(brName string, ipn *net.IPNet) error {
+	if err := os.MkdirAll(bridgeStateDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", bridgeStateDir, err)
+	}
+	path := filepath.Join(bridgeStateDir, brName)
+	if err := ioutil.WriteFile(path, []byte(ipn.String()), 0644); err != nil {
+		return fmt.Errorf("failed to record the IP addr of %q: %v", brName, err)
+	}
+	return nil
+}
+
+// loadBridgeIP returns the address recorded by saveBridgeIP, or nil if
+// there is none
+func loadBridgeIP(brName string) (*net.IPNet, error) {
+	data, err := ioutil.ReadFile(filepath.Join(bridgeStateDir, brName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the recorded IP addr of %q: %v", brName, err)
+	}
+	ip, ipn, err := net.ParseCIDR(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid recorded IP addr of %q: %v", brName, err)
+	}
+	ipn.IP = ip
+	return ipn, nil
+}
+
+func setupBridge(n *NetConf) (*netlink.Bridge, error) {
+	// default to the MTU of the uplink, so that hosts with jumbo frames
+	// need no configuration; the veths get it less linkMTUOverhead
+	if n.MTU == 0 {
+		mtu, err := ip.DetectMTU()
+		if err != nil {
+			logrus.Warnf("failed to detect the MTU, using the kernel default: %v", err)
+		} else {
+			n.MTU = mtu
+		}
+	}
+
+	// create bridge if necessary
+	br, err := ensureBridge(n.BrName, n.MTU)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bridge %q: %v", n.BrName, err)
+	}
+
+	// Set the bridge IP address
+	err = setBridgeIP(n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set bridge IP: %v", err)
+	}
+
+	if n.ForwardDelay > 0 {
+		if err = ip.BridgeSetForwardDelay(br, n.ForwardDelay); err != nil {
+			return nil, fmt.Errorf("failed to set forward delay of %q: %v", n.BrName, err)
+		}
+	}
+
+	// set STP either way, as some distributions enable it by default
+	if err = ip.BridgeSetSTPState(br, n.STPEnabled); err != nil {
+		return nil, fmt.Errorf("failed to set STP state of %q: %v", n.BrName, err)
+	}
+
+	if n.AgeingTime > 0 {
+		if err = ip.BridgeSetAgeingTime(br, n.AgeingTime); err != nil {
+			return nil, fmt.Errorf("failed to set ageing time of %q: %v", n.BrName, err)
+		}
+	}
+
+	if n.MulticastSnooping != nil {
+		if err = ip.BridgeSetMulticastSnooping(br, *n.MulticastSnooping); err != nil {
+			return nil, fmt.Errorf("failed to set multicast snooping of %q: %v", n.BrName, err)
+		}
+	}
+
+	if n.BridgePromiscMode {
+		if err = ip.LinkSetPromisc(br, true); err != nil {
+			return nil, err
+		}
+	}
+
+	if n.TrunkPort || n.VLANFiltering {
+		if err = ip.BridgeSetVlanFiltering(br, true); err != nil {
+			return nil, fmt.Errorf("failed to enable VLAN filtering on %q: %v", n.BrName, err)
+		}
+	}
+
+	if n.MACTableMax > 0 {
+		if err = ip.BridgeSetFDBMaxLearned(br, uint32(n.MACTableMax)); err != nil {
+			return nil, fmt.Errorf("failed to limit the MAC table of %q: %v", n.BrName, err)
+		}
+	}
+
+	if n.BridgeUplink != "" {
+		if err = attachUplink(br, n.BridgeUplink); err != nil {
+			return nil, err
+		}
+	}
+
+	return br, nil
+}
+
+// enterNetNS switches the plugin's thread to the network namespace at
+// nspath. The bridge, host veths and iptables rules are then all created
+// in that namespace. The plugin exits when done, so the namespace is not
+// switched back.
+func enterNetNS(nspath string) error {
+	netns, err := ns.GetNS(nspath)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", nspath, err)
+	}
+	defer netns.Close()
+
+	return netns.Set()
+}
 
 func checkIfContainerInterfaceExists(args *skel.CmdArgs) bool {
 	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
 		_, err := netlink.LinkByName(args.IfName)
 		if err != nil {
-			return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+			return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+		}
+		return nil
+	})
+
+	if err == nil {
+		return true
+	}
+	return false
+}
+
+// teardownIPMasq removes the masquerading of the IPv4 network ipn and of
+// the IPv6 network ipn6, either of which may be nil. Both are torn down
+// even if the first fails, so that DEL leaves no half of a dual-stack
+// setup behind.
+func teardownIPMasq(n *NetConf, containerID string, ipn, ipn6 *net.IPNet) error {
+	chain := utils.FormatChainName(n.Name, containerID)
+	comment := utils.FormatComment(n.Name, containerID)
+
+	var errs []string
+	if ipn != nil {
+		if err := ip.TeardownMasq(ipn, chain, comment); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if ipn6 != nil {
+		if err := ip.TeardownMasq(ip.Network(ipn6), chain, comment); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to tear down IP masquerade: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// logFile is the file logrus writes to. It stays open for the life of
+// the process, as a daemon keeps logging to it between requests.
+var logFile *os.File
+
+// setupLogFile sends the debug log to path, opening it unless it is
+// already the log file
+func setupLogFile(path string) {
+	if logFile != nil && logFile.Name() == path {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return
+	}
+	logrus.SetLevel(logrus.DebugLevel)
+	logrus.SetOutput(f)
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = f
+}
+
+// requiredModules returns the kernel modules the configuration needs,
+// loaded up front where modprobe is available
+func requiredModules(n *NetConf) []string {
+	modules := []string{"bridge", "veth"}
+	if n.IPMasq {
+		modules = append(modules, "ip_tables", "nf_conntrack")
+	}
+	for _, name := range n.CTHelpers {
+		modules = append(modules, ctHelpers[name].module)
+	}
+	return modules
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return types.NewError(types.ErrInvalidNetworkConfig, err.Error(), "")
+	}
+
+	if n.LogToFile != "" {
+		setupLogFile(n.LogToFile)
+	}
+
+	if n.HostVethNS != "" {
+		if err = enterNetNS(n.HostVethNS); err != nil {
+			return err
+		}
+	}
+
+	if n.IsDefaultGW {
+		n.IsGW = true
+	}
+
+	// modprobe is often missing or not permitted on container hosts, the
+	// netlink and iptables calls below report a module that is really
+	// absent
+	for _, module := range requiredModules(n) {
+		if err = modprobe.EnsureModule(module); err != nil {
+			logrus.Warnf("%v", err)
+		}
+	}
+
+	br, err := setupBridge(n)
+	if err != nil {
+		return err
+	}
+
+	if n.RemoteSubnet != "" {
+		if err = setupRemoteRoute(n); err != nil {
+			return err
+		}
+	}
+
+	if n.GlobalRPFilter != nil {
+		if err = relaxRPFilter(rpFilterPath, *n.GlobalRPFilter); err != nil {
+			return fmt.Errorf("failed to set rp_filter: %v", err)
+		}
+	}
+
+	if n.ConntrackTCPLoose {
+		if err = enableSysctl(conntrackTCPLoosePath); err != nil {
+			return fmt.Errorf("failed to set nf_conntrack_tcp_loose: %v", err)
+		}
+	}
+
+	if n.EnableARPTables {
+		if err = enableSysctl(arptablesPath); err != nil {
+			return fmt.Errorf("failed to set bridge-nf-call-arptables: %v", err)
+		}
+	}
+
+	// needs Linux 6.11 or later
+	if n.ECMPFlowHashSeed != 0 {
+		if err = setSysctlValue(ecmpHashSeedPath, strconv.FormatUint(uint64(n.ECMPFlowHashSeed), 10)); err != nil {
+			return fmt.Errorf("failed to set the multipath hash seed: %v", err)
+		}
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	linkMTU := n.MTU - n.LinkMTUOverhead
+	// If user error, just use the bridge MTU
+	if linkMTU < 0 {
+		linkMTU = n.MTU
+	}
+
+	// Check if the container interface already exists
+	var hostVethName string
+	if !checkIfContainerInterfaceExists(args) {
+		if n.MaxPorts > 0 {
+			if err = checkMaxPorts(br, n.MaxPorts); err != nil {
+				return err
+			}
+		}
+
+		var trunkVLANs []int
+		if n.TrunkPort {
+			trunkVLANs = n.AllowedVLANs
+		}
+		// validated by loadNetConf
+		contMAC, _ := net.ParseMAC(n.ContainerMAC)
+		hostVeth, err := setupVeth(netns, br, args.IfName, linkMTU, contMAC, n.HairpinMode, trunkVLANs)
+		if err != nil {
+			return err
+		}
+		hostVethName = hostVeth.Attrs().Name
+
+		if n.VLANTag != 0 {
+			if err = setupAccessVLAN(hostVeth, n.VLANTag); err != nil {
+				return err
+			}
+		}
+
+		if len(n.VLANPriorityMap) > 0 {
+			if err = ip.SetupDSCPPriorityMap(hostVeth, vlanPriorityFilterPrio, n.VLANPriorityMap); err != nil {
+				return err
+			}
+		}
+
+		if n.EgressKbps > 0 || n.IngressKbps > 0 {
+			if err = ip.SetupQoS(hostVethName, n.EgressKbps, n.IngressKbps); err != nil {
+				return err
+			}
+		}
+
+		if n.BPDUGuard {
+			if err = setupBPDUGuard(hostVeth); err != nil {
+				return err
+			}
+		}
+
+		if n.ArpProxy {
+			if err = ip.SetArpProxy(hostVethName, true); err != nil {
+				return err
+			}
+		}
+
+		if n.PromiscMode {
+			if err = ip.LinkSetPromisc(hostVeth, true); err != nil {
+				return err
+			}
+		}
+
+		if n.ARPAnnounce != nil {
+			if err = setARPAnnounce(hostVethName, *n.ARPAnnounce); err != nil {
+				return err
+			}
+		}
+
+		if n.AFXDPEnabled {
+			if err = setupAFXDP(hostVeth, n.AFXDPQueueID); err != nil {
+				return err
+			}
+		}
+
+		if n.BPFFilterPath != "" {
+			if err = attachBPFFilter(hostVeth, n.BPFFilterPath); err != nil {
+				return err
+			}
+		}
+	} else {
+		logrus.Infof("container already has interface: %v, no worries", args.IfName)
+		err = netns.Do(func(hostNS ns.NetNS) error {
+			var err error
+			hostVethName, err = lookupHostVethName(args.IfName, hostNS)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// run the IPAM plugin and get back the config to apply
+	result, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if result.IP4 == nil && result.IP6 == nil {
+		return errors.New("IPAM plugin returned missing IP config")
+	}
+
+	if result.IP4 != nil && result.IP4.Gateway == nil && n.IsGW {
+		result.IP4.Gateway = calcGatewayIP(&result.IP4.IP)
+	}
+
+	if result.IP4 != nil && result.IP4.Gateway == nil && n.AutoDetectGW {
+		if err = injectDetectedGateway(n, result.IP4); err != nil {
+			return err
+		}
+	}
+
+	if result.IP6 != nil && result.IP6.Gateway == nil && n.IsGW {
+		result.IP6.Gateway = calcGatewayIP(&result.IP6.IP)
+	}
+
+	var contIface types.Interface
+	if err := netns.Do(func(_ ns.NetNS) error {
+		// set the default gateway if requested
+		if n.IsDefaultGW {
+			if result.IP4 != nil {
+				if err := addDefaultRoute(result.IP4, "0.0.0.0/0"); err != nil {
+					return err
+				}
+			}
+			if result.IP6 != nil {
+				if err := addDefaultRoute(result.IP6, "::/0"); err != nil {
+					return err
+				}
+			}
+		}
+
+		// before the addresses are configured, so that neighbours
+		// learn the final MAC
+		if n.StableMAC {
+			if err := setStableMAC(args.IfName, args.ContainerID); err != nil {
+				return err
+			}
+		}
+
+		if n.ACDEnabled && result.IP4 != nil {
+			if err := checkAddressConflict(args.IfName, result.IP4.IP.IP); err != nil {
+				return err
+			}
+		}
+
+		if err := ipam.ConfigureIfaceWithOptions(args.IfName, result, ipam.Options{SkipConflictCheck: n.IPAM.SkipConflictCheck, AddressScope: n.AddressScope}); err != nil {
+			return err
+		}
+
+		if n.ContainerQdisc != "" {
+			if err := setupContainerQdisc(args.IfName, n.ContainerQdisc); err != nil {
+				return err
+			}
+		}
+
+		if n.IPv6MaxExtHeaders != 0 {
+			for _, path := range ipv6ExtHeaderLimitPaths {
+				if err := setSysctlValue(path, strconv.Itoa(n.IPv6MaxExtHeaders)); err != nil {
+					return fmt.Errorf("failed to limit IPv6 extension header options: %v", err)
+				}
+			}
+		}
+
+		if n.ARPAnnounce != nil {
+			if err := setARPAnnounce(args.IfName, containerARPAnnounce); err != nil {
+				return err
+			}
+		}
+
+		if n.IPv6HopLimit != 0 {
+			if err := setHopLimit(args.IfName, n.IPv6HopLimit); err != nil {
+				return err
+			}
+		}
+
+		if n.TCPCongestionCtl != "" {
+			if err := setTCPCongestionControl(n.TCPCongestionCtl); err != nil {
+				return err
+			}
+		}
+
+		// the bridge is the gateway, no other host may redirect us
+		if n.IsGW {
+			if err := disableSysctl(acceptRedirectsPath); err != nil {
+				return fmt.Errorf("failed to disable accepting ICMP redirects: %v", err)
+			}
+		}
+
+		contVeth, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+		}
+		result.Annotations = map[string]string{
+			annotationInterfaceMAC: contVeth.Attrs().HardwareAddr.String(),
+		}
+		contIface = types.Interface{
+			Name:    args.IfName,
+			Mac:     contVeth.Attrs().HardwareAddr.String(),
+			Sandbox: args.Netns,
+		}
+
+		return addAdditionalIPs(args.IfName, n.AdditionalIPs)
+	}); err != nil {
+		return err
+	}
+
+	if n.IsGW && result.IP4 != nil {
+		gwn := &net.IPNet{
+			IP:   result.IP4.Gateway,
+			Mask: result.IP4.IP.Mask,
+		}
+
+		if err = ensureBridgeAddr(br, gwn); err != nil {
+			return err
+		}
+
+		if err := ip.EnableIP4Forward(); err != nil {
+			return fmt.Errorf("failed to enable forwarding: %v", err)
+		}
+
+		if err = disableSendRedirects(n.BrName); err != nil {
+			return err
+		}
+	}
+
+	if n.IsGW && result.IP6 != nil {
+		gwn := &net.IPNet{
+			IP:   result.IP6.Gateway,
+			Mask: result.IP6.IP.Mask,
+		}
+
+		if err = ensureBridgeAddr(br, gwn); err != nil {
+			return err
+		}
+
+		if err := ip.EnableIP6Forward(); err != nil {
+			return fmt.Errorf("failed to enable IPv6 forwarding: %v", err)
+		}
+	}
+
+	if n.IPv6HopLimit != 0 {
+		if err = setHopLimit(n.BrName, n.IPv6HopLimit); err != nil {
+			return err
+		}
+	}
+
+	if result.IP4 != nil && n.IPMasq {
+		chain := utils.FormatChainName(n.Name, args.ContainerID)
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		var exclude []*net.IPNet
+		for _, cidr := range n.IPMasqExcludeCIDRs {
+			_, ipn, _ := net.ParseCIDR(cidr)
+			exclude = append(exclude, ipn)
+		}
+		ipn := ip.Network(&result.IP4.IP)
+		masq := ip.NewMasqBackend()
+		if n.SNATToIP != "" {
+			err = masq.SetupSNATWithExclusions(ipn, net.ParseIP(n.SNATToIP), exclude, chain, comment)
+		} else {
+			err = masq.SetupIPMasqWithExclusions(ipn, exclude, chain, comment)
+		}
+		if err != nil {
+			return err
 		}
-		return nil
-	})
+	}
 
-	if err == nil {
-		return true
+	if result.IP6 != nil && n.IPMasq {
+		chain := utils.FormatChainName(n.Name, args.ContainerID)
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = ip.NewMasqBackend().SetupIPMasq(ip.Network(&result.IP6.IP), chain, comment); err != nil {
+			return err
+		}
 	}
-	return false
-}
 
-func cmdAdd(args *skel.CmdArgs) error {
-	n, err := loadNetConf(args.StdinData)
-	if err != nil {
-		return err
+	if result.IP4 != nil && n.IPVSVirtualService != "" {
+		if err = addIPVSRealServer(n, result.IP4.IP.IP); err != nil {
+			return err
+		}
 	}
 
-	if n.LogToFile != "" {
-		f, err := os.OpenFile(n.LogToFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-		if err == nil && f != nil {
-			logrus.SetLevel(logrus.DebugLevel)
-			logrus.SetOutput(f)
-			defer f.Close()
+	if result.IP4 != nil && n.NFTablesExpireTTL > 0 {
+		if err = addNFTExpireElement(n, result.IP4.IP.IP); err != nil {
+			return err
 		}
 	}
 
-	if n.IsDefaultGW {
-		n.IsGW = true
+	if result.IP4 != nil && n.HWOffloadHints {
+		if err = setupHWOffload(netns, args.IfName, hostVethName, result.IP4.IP.IP); err != nil {
+			return err
+		}
 	}
 
-	br, err := setupBridge(n)
+	if result.IP4 != nil && n.nflogEnabled() {
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = setupNFLOG(n, result.IP4.IP.IP, comment); err != nil {
+			return err
+		}
+	}
+
+	if result.IP4 != nil && n.dscpClearEnabled() {
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = setupDSCPClear(n.BrName, result.IP4.IP.IP, comment); err != nil {
+			return err
+		}
+	}
+
+	if result.IP4 != nil && (n.ByteQuota > 0 || n.ICMPv4RateLimitPPS > 0) {
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = setupForwardLimits(result.IP4.IP.IP, n.ByteQuota, n.ICMPv4RateLimitPPS, comment); err != nil {
+			return err
+		}
+	}
+
+	if result.IP4 != nil && n.WireGuardIface != "" {
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = setupWireGuardForward(n, result.IP4.IP.IP, comment); err != nil {
+			return err
+		}
+	}
+
+	if result.IP4 != nil && n.ConnmarkMark != 0 {
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = setupConnmark(n, result.IP4.IP.IP, comment); err != nil {
+			return err
+		}
+	}
+
+	if result.IP4 != nil && len(n.CTHelpers) > 0 {
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = setupCTHelpers(n.CTHelpers, result.IP4.IP.IP, comment); err != nil {
+			return err
+		}
+	}
+
+	if len(n.MarkBased) > 0 {
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = setupMarkRoutes(n.MarkBased, hostVethName, comment); err != nil {
+			return err
+		}
+	}
+
+	if n.RouteMark != 0 {
+		if err = setupRouteMark(n); err != nil {
+			return err
+		}
+	}
+
+	if len(n.DNS.Nameservers) > 0 {
+		if err = writeResolvConf(args.Netns, n.resolvConfPath(), n.DNS); err != nil {
+			// without an explicit resolvConfPath, a namespace we cannot
+			// find the root filesystem of is left to the runtime
+			if n.ResolvConfPath != "" || procNetNSPath.MatchString(args.Netns) {
+				return err
+			}
+			logrus.Warnf("not writing %s: %v", n.resolvConfPath(), err)
+		}
+	}
+
+	hostVeth, err := netlink.LinkByName(hostVethName)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+	result.Interfaces = []types.Interface{
+		{Name: hostVethName, Mac: hostVeth.Attrs().HardwareAddr.String()},
+		contIface,
 	}
 
-	netns, err := ns.GetNS(args.Netns)
+	result.DNS = n.DNS
+	return args.PrintResult(result)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, err := loadNetConf(args.StdinData)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return types.NewError(types.ErrInvalidNetworkConfig, err.Error(), "")
 	}
-	defer netns.Close()
 
-	linkMTU := n.MTU - n.LinkMTUOverhead
-	// If user error, just use the bridge MTU
-	if linkMTU < 0 {
-		linkMTU = n.MTU
+	if n.LogToFile != "" {
+		setupLogFile(n.LogToFile)
 	}
 
-	// Check if the container interface already exists
-	if !checkIfContainerInterfaceExists(args) {
-		if err = setupVeth(netns, br, args.IfName, linkMTU, n.HairpinMode); err != nil {
+	if n.HostVethNS != "" {
+		if err = enterNetNS(n.HostVethNS); err != nil {
 			return err
 		}
-	} else {
-		logrus.Infof("container already has interface: %v, no worries", args.IfName)
 	}
 
-	// run the IPAM plugin and get back the config to apply
-	result, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
-	if err != nil {
+	if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
 		return err
 	}
 
-	// TODO: make this optional when IPv6 is supported
-	if result.IP4 == nil {
-		return errors.New("IPAM plugin returned missing IPv4 config")
+	if args.Netns == "" {
+		return nil
 	}
 
-	if result.IP4.Gateway == nil && n.IsGW {
-		result.IP4.Gateway = calcGatewayIP(&result.IP4.IP)
+	if n.CleanupDNS && procNetNSPath.MatchString(args.Netns) {
+		if err := removeResolvConf(args.Netns, n.resolvConfPath()); err != nil {
+			return err
+		}
 	}
 
-	if err := netns.Do(func(_ ns.NetNS) error {
-		// set the default gateway if requested
-		if n.IsDefaultGW {
-			_, defaultNet, err := net.ParseCIDR("0.0.0.0/0")
+	var ipn, ipn6 *net.IPNet
+	var hostVethName string
+	err = ns.WithNetNSPath(args.Netns, func(hostNS ns.NetNS) error {
+		var err error
+		if len(n.MarkBased) > 0 || n.BPFFilterPath != "" || n.VLANTag != 0 || n.EgressKbps > 0 || n.ArpProxy || n.PromiscMode {
+			hostVethName, err = lookupHostVethName(args.IfName, hostNS)
+			if err != nil {
+				return err
+			}
+		}
+
+		if n.VLANTag != 0 {
+			if err = teardownAccessVLAN(hostNS, hostVethName, n.VLANTag); err != nil {
+				return err
+			}
+		}
+
+		if n.ArpProxy {
+			err = hostNS.Do(func(_ ns.NetNS) error {
+				return ip.SetArpProxy(hostVethName, false)
+			})
 			if err != nil {
 				return err
 			}
+		}
 
-			for _, route := range result.IP4.Routes {
-				if defaultNet.String() == route.Dst.String() {
-					if route.GW != nil && !route.GW.Equal(result.IP4.Gateway) {
-						return fmt.Errorf(
-							"isDefaultGateway ineffective because IPAM sets default route via %q",
-							route.GW,
-						)
-					}
+		if n.PromiscMode {
+			err = hostNS.Do(func(_ ns.NetNS) error {
+				hostVeth, err := netlink.LinkByName(hostVethName)
+				if err != nil {
+					return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
 				}
+				return ip.LinkSetPromisc(hostVeth, false)
+			})
+			if err != nil {
+				return err
 			}
+		}
 
-			result.IP4.Routes = append(
-				result.IP4.Routes,
-				types.Route{Dst: *defaultNet, GW: result.IP4.Gateway},
-			)
+		if n.BPFFilterPath != "" {
+			if err = detachBPFFilter(hostNS, hostVethName); err != nil {
+				return err
+			}
+		}
 
-			// TODO: IPV6
+		if n.ContainerQdisc != "" {
+			if err = teardownContainerQdisc(args.IfName, n.ContainerQdisc); err != nil {
+				return err
+			}
 		}
 
-		return ipam.ConfigureIface(args.IfName, result)
-	}); err != nil {
+		// remove the additional IPs so the primary ones are returned below
+		if err = delAdditionalIPs(args.IfName, n.AdditionalIPs); err != nil {
+			return err
+		}
+
+		if ipn6, err = globalAddr(args.IfName, netlink.FAMILY_V6); err != nil {
+			return err
+		}
+		if ipn6 != nil {
+			// an IPv6-only container has no IPv4 address to return
+			if ipn, err = globalAddr(args.IfName, netlink.FAMILY_V4); err != nil {
+				return err
+			}
+			return ip.DelLinkByName(args.IfName)
+		}
+
+		ipn, err = ip.DelLinkByNameAddr(args.IfName, netlink.FAMILY_V4)
+		return err
+	})
+	if err != nil {
 		return err
 	}
 
-	if n.IsGW {
-		gwn := &net.IPNet{
-			IP:   result.IP4.Gateway,
-			Mask: result.IP4.IP.Mask,
+	if n.IPMasq {
+		if err = teardownIPMasq(n, args.ContainerID, ipn, ipn6); err != nil {
+			return err
 		}
+	}
 
-		if err = ensureBridgeAddr(br, gwn); err != nil {
+	if ipn != nil && n.IPVSVirtualService != "" {
+		if err = delIPVSRealServer(n, ipn.IP); err != nil {
 			return err
 		}
+	}
 
-		if err := ip.EnableIP4Forward(); err != nil {
-			return fmt.Errorf("failed to enable forwarding: %v", err)
+	if ipn != nil && n.NFTablesExpireTTL > 0 {
+		if err = delNFTExpireElement(n, ipn.IP); err != nil {
+			return err
 		}
 	}
 
-	if n.IPMasq {
-		chain := utils.FormatChainName(n.Name, args.ContainerID)
+	if ipn != nil && n.nflogEnabled() {
 		comment := utils.FormatComment(n.Name, args.ContainerID)
-		if err = ip.SetupIPMasq(ip.Network(&result.IP4.IP), chain, comment); err != nil {
+		if err = teardownNFLOG(n, ipn.IP, comment); err != nil {
 			return err
 		}
 	}
 
-	result.DNS = n.DNS
-	return result.Print()
+	if ipn != nil && n.dscpClearEnabled() {
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = teardownDSCPClear(n.BrName, ipn.IP, comment); err != nil {
+			return err
+		}
+	}
+
+	if ipn != nil && (n.ByteQuota > 0 || n.ICMPv4RateLimitPPS > 0) {
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = teardownForwardLimits(ipn.IP, n.ByteQuota, n.ICMPv4RateLimitPPS, comment); err != nil {
+			return err
+		}
+	}
+
+	if ipn != nil && n.WireGuardIface != "" {
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = teardownWireGuardForward(n, ipn.IP, comment); err != nil {
+			return err
+		}
+	}
+
+	if ipn != nil && n.ConnmarkMark != 0 {
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = teardownConnmark(n, ipn.IP, comment); err != nil {
+			return err
+		}
+	}
+
+	if ipn != nil && len(n.CTHelpers) > 0 {
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = teardownCTHelpers(n.CTHelpers, ipn.IP, comment); err != nil {
+			return err
+		}
+	}
+
+	if n.RemoteSubnet != "" {
+		if err = teardownRemoteRoute(n); err != nil {
+			return err
+		}
+	}
+
+	if n.BridgeUplink != "" {
+		if err = detachUplink(n); err != nil {
+			return err
+		}
+	}
+
+	if len(n.MarkBased) > 0 {
+		comment := utils.FormatComment(n.Name, args.ContainerID)
+		if err = teardownMarkRoutes(n.MarkBased, hostVethName, comment); err != nil {
+			return err
+		}
+	}
+
+	// the htb qdisc of the ingress rate went away with the veth, but the
+	// ifb device of the egress rate has to be deleted
+	if n.EgressKbps > 0 {
+		if err = ip.TeardownQoS(hostVethName); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func cmdDel(args *skel.CmdArgs) error {
+// cmdCheck verifies that the bridge and the container interface set up
+// by cmdAdd are still in place
+func cmdCheck(args *skel.CmdArgs) error {
 	n, err := loadNetConf(args.StdinData)
 	if err != nil {
-		return err
+		return types.NewError(types.ErrInvalidNetworkConfig, err.Error(), "")
 	}
 
-	if n.LogToFile != "" {
-		f, err := os.OpenFile(n.LogToFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-		if err == nil && f != nil {
-			logrus.SetLevel(logrus.DebugLevel)
-			logrus.SetOutput(f)
-			defer f.Close()
+	if n.HostVethNS != "" {
+		if err = enterNetNS(n.HostVethNS); err != nil {
+			return err
 		}
 	}
 
-	if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+	br, err := bridgeByName(n.BrName)
+	if err != nil {
 		return err
 	}
-
-	if args.Netns == "" {
-		return nil
+	if br.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("bridge %q is down", n.BrName)
 	}
 
-	var ipn *net.IPNet
-	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		var err error
-		ipn, err = ip.DelLinkByNameAddr(args.IfName, netlink.FAMILY_V4)
+	var ipn, ipn6 *net.IPNet
+	var hostVethName string
+	err = ns.WithNetNSPath(args.Netns, func(hostNS ns.NetNS) error {
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
+		}
+		if _, ok := link.(*netlink.Veth); !ok {
+			return fmt.Errorf("%q is not a veth", args.IfName)
+		}
+
+		if hostVethName, err = lookupHostVethName(args.IfName, hostNS); err != nil {
+			return err
+		}
+		if ipn, err = globalAddr(args.IfName, netlink.FAMILY_V4); err != nil {
+			return err
+		}
+		ipn6, err = globalAddr(args.IfName, netlink.FAMILY_V6)
 		return err
 	})
 	if err != nil {
 		return err
 	}
 
-	if n.IPMasq {
-		chain := utils.FormatChainName(n.Name, args.ContainerID)
-		comment := utils.FormatComment(n.Name, args.ContainerID)
-		if err = ip.TeardownIPMasq(ipn, chain, comment); err != nil {
-			return err
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+	}
+	if hostVeth.Attrs().MasterIndex != br.Attrs().Index {
+		return fmt.Errorf("host veth %q is not attached to bridge %q", hostVethName, n.BrName)
+	}
+
+	var addrs []*net.IPNet
+	for _, a := range []*net.IPNet{ipn, ipn6} {
+		if a != nil {
+			addrs = append(addrs, a)
 		}
 	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("%q has no IP address", args.IfName)
+	}
 
+	for _, a := range addrs {
+		if n.IsGW {
+			if err = checkBridgeGateway(br, a); err != nil {
+				return err
+			}
+		}
+		if n.IPMasq {
+			chain := utils.FormatChainName(n.Name, args.ContainerID)
+			comment := utils.FormatComment(n.Name, args.ContainerID)
+			if err = ip.CheckMasq(ip.Network(a), chain, comment); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
+// checkBridgeGateway returns an error if the bridge has no address in the
+// subnet of the container address ipn
+func checkBridgeGateway(br *netlink.Bridge, ipn *net.IPNet) error {
+	family := netlink.FAMILY_V4
+	if ipn.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	addrs, err := netlink.AddrList(br, family)
+	if err != nil {
+		return fmt.Errorf("could not get list of IP addresses: %v", err)
+	}
+
+	for _, a := range addrs {
+		if a.IPNet.Contains(ipn.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("bridge %q has no gateway address in the subnet of %v", br.Name, ipn)
+}
+
+// serveDaemon handles CNI requests received on socketPath until the
+// listener fails
+func serveDaemon(socketPath string) error {
+	hostNS, err := ns.GetCurrentNS()
+	if err != nil {
+		return fmt.Errorf("failed to open host netns: %v", err)
+	}
+	defer hostNS.Close()
+
+	// a request may leave the thread in another netns, e.g. with
+	// hostVethNetns, so switch back before serving the next one
+	inHostNS := func(cmd func(*skel.CmdArgs) error) func(*skel.CmdArgs) error {
+		return func(args *skel.CmdArgs) error {
+			defer hostNS.Set()
+			return cmd(args)
+		}
+	}
+
+	return skel.PluginServe(socketPath, inHostNS(cmdAdd), inHostNS(cmdDel), inHostNS(cmdCheck))
+}
+
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel)
+	if len(os.Args) == 3 && os.Args[1] == "-daemon" {
+		if err := serveDaemon(os.Args[2]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	skel.PluginMainWithCheck(cmdAdd, cmdDel, cmdCheck)
 }
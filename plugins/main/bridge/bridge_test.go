@@ -16,9 +16,16 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"syscall"
+	"unsafe"
 
+	"github.com/containernetworking/cni/pkg/ip"
 	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/testutils"
@@ -31,86 +38,1399 @@ import (
 )
 
 var _ = Describe("bridge Operations", func() {
-	var originalNS ns.NetNS
+	var (
+		originalNS         ns.NetNS
+		origBridgeStateDir string
+	)
 
 	BeforeEach(func() {
 		// Create a new NetNS so we don't modify the host
 		var err error
 		originalNS, err = ns.NewNS()
 		Expect(err).NotTo(HaveOccurred())
+
+		origBridgeStateDir = bridgeStateDir
+		bridgeStateDir, err = ioutil.TempDir("", "bridge-state")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(os.RemoveAll(bridgeStateDir)).To(Succeed())
+		bridgeStateDir = origBridgeStateDir
+	})
+
+	It("creates a bridge", func() {
+		const IFNAME = "bridge0"
+
+		conf := &NetConf{
+			NetConf: types.NetConf{
+				Name: "testConfig",
+				Type: "bridge",
+			},
+			BrName: IFNAME,
+			IsGW:   false,
+			IPMasq: false,
+			MTU:    5000,
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			bridge, err := setupBridge(conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bridge.Attrs().Name).To(Equal(IFNAME))
+
+			// Double check that the link was added
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().Name).To(Equal(IFNAME))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("handles an existing bridge", func() {
+		const IFNAME = "bridge0"
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Bridge{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: IFNAME,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().Name).To(Equal(IFNAME))
+			ifindex := link.Attrs().Index
+
+			conf := &NetConf{
+				NetConf: types.NetConf{
+					Name: "testConfig",
+					Type: "bridge",
+				},
+				BrName: IFNAME,
+				IsGW:   false,
+				IPMasq: false,
+			}
+
+			bridge, err := setupBridge(conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bridge.Attrs().Name).To(Equal(IFNAME))
+			Expect(bridge.Attrs().Index).To(Equal(ifindex))
+
+			// Double check that the link has the same ifindex
+			link, err = netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().Name).To(Equal(IFNAME))
+			Expect(link.Attrs().Index).To(Equal(ifindex))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("adds a shared policy routing rule for a mark based route", func() {
+		mr := MarkRoute{Mark: 0x10, Mask: 0xff, TableID: 100}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			// the rule is shared between containers so adding it twice is fine
+			Expect(ensureMarkRule(mr)).To(Succeed())
+			Expect(ensureMarkRule(mr)).To(Succeed())
+
+			rules, err := ip.RuleList(netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+
+			found := 0
+			for _, r := range rules {
+				if r.Mark == mr.Mark && r.Mask == mr.Mask && r.Table == mr.TableID {
+					found++
+				}
+			}
+			Expect(found).To(Equal(1))
+
+			Expect(ip.DelRule(markRule(mr))).To(Succeed())
+
+			rules, err = ip.RuleList(netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			for _, r := range rules {
+				Expect(r.Table).NotTo(Equal(mr.TableID))
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("routes the marked connections using the connmark table", func() {
+		n := &NetConf{ConnmarkMark: 0x20, ConnmarkTable: 200}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(ensureMarkRule(connmarkRoute(n))).To(Succeed())
+
+			rules, err := ip.RuleList(netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			found := false
+			for _, r := range rules {
+				if r.Mark == 0x20 && r.Mask == 0xffffffff && r.Table == 200 {
+					found = true
+				}
+			}
+			Expect(found).To(BeTrue())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("routes the traffic from the bridge using the route mark table", func() {
+		n := &NetConf{BrName: "cni0", RouteMark: 0x30, RouteMarkMask: 0xf0, RouteMarkTable: 300}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(ensureMarkRule(routeMarkRoute(n))).To(Succeed())
+
+			rules, err := ip.RuleList(netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			found := false
+			for _, r := range rules {
+				if r.Mark == 0x30 && r.Mask == 0xf0 && r.Table == 300 {
+					found = true
+				}
+			}
+			Expect(found).To(BeTrue())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("refuses to forward to a missing WireGuard interface", func() {
+		n := &NetConf{BrName: "cni0", WireGuardIface: "wg0"}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			return setupWireGuardForward(n, net.ParseIP("10.1.2.3"), "test")
+		})
+		Expect(err).To(MatchError(HavePrefix(`failed to lookup WireGuard interface "wg0"`)))
+	})
+
+	It("disables ICMP redirects on the host and in the container", func() {
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		readSysctl := func(path string) string {
+			data, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			return strings.TrimSpace(string(data))
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := ensureBridge("bridge0", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(disableSendRedirects("bridge0")).To(Succeed())
+
+			Expect(readSysctl("/proc/sys/net/ipv4/conf/all/send_redirects")).To(Equal("0"))
+			Expect(readSysctl("/proc/sys/net/ipv4/conf/bridge0/send_redirects")).To(Equal("0"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(disableSysctl(acceptRedirectsPath)).To(Succeed())
+			Expect(readSysctl(acceptRedirectsPath)).To(Equal("0"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("sets the multipath hash seed", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			_, err := os.Stat(ecmpHashSeedPath)
+			return err
+		})
+		if os.IsNotExist(err) {
+			Skip("the kernel has no multipath hash seed")
+		}
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(setSysctlValue(ecmpHashSeedPath, "12345")).To(Succeed())
+			data, err := ioutil.ReadFile(ecmpHashSeedPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(strings.TrimSpace(string(data))).To(Equal("12345"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("limits the IPv6 extension header options in the container", func() {
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for _, path := range ipv6ExtHeaderLimitPaths {
+				Expect(setSysctlValue(path, "4")).To(Succeed())
+				data, err := ioutil.ReadFile(path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(strings.TrimSpace(string(data))).To(Equal("4"))
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// the host namespace keeps the kernel default
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			data, err := ioutil.ReadFile(ipv6ExtHeaderLimitPaths[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(strings.TrimSpace(string(data))).To(Equal("8"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("sets the TCP congestion control of the container only", func() {
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		readCongestionControl := func() string {
+			data, err := ioutil.ReadFile(tcpCongestionControlPath)
+			Expect(err).NotTo(HaveOccurred())
+			return strings.TrimSpace(string(data))
+		}
+
+		var hostAlgorithm string
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			hostAlgorithm = readCongestionControl()
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// reno is always built in
+		algorithm := "reno"
+		if hostAlgorithm == "reno" {
+			algorithm = "cubic"
+		}
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(setTCPCongestionControl(algorithm)).To(Succeed())
+			Expect(readCongestionControl()).To(Equal(algorithm))
+
+			err := setTCPCongestionControl("nonexistent")
+			Expect(err).To(MatchError(`TCP congestion control "nonexistent" is not available, is the tcp_nonexistent kernel module installed?`))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			Expect(readCongestionControl()).To(Equal(hostAlgorithm))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("adds the trunk VLANs to the host veth tagged", func() {
+		const BRNAME = "bridge0"
+
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := ensureBridge(BRNAME, 1500)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ip.BridgeSetVlanFiltering(br, true)).To(Succeed())
+
+			hostVeth, err := setupVeth(targetNs, br, "eth0", 1500, nil, false, []int{100, 200})
+			Expect(err).NotTo(HaveOccurred())
+
+			vlans, err := ip.BridgeVlanList()
+			Expect(err).NotTo(HaveOccurred())
+
+			tagged := []uint16{}
+			for _, v := range vlans[int32(hostVeth.Attrs().Index)] {
+				if !v.Untagged {
+					tagged = append(tagged, v.Vid)
+				}
+			}
+			Expect(tagged).To(Equal([]uint16{100, 200}))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("adds the access VLAN to the host veth as PVID and untagged, and removes it", func() {
+		const BRNAME = "bridge0"
+
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := ensureBridge(BRNAME, 1500)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ip.BridgeSetVlanFiltering(br, true)).To(Succeed())
+
+			hostVeth, err := setupVeth(targetNs, br, "eth0", 1500, nil, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(setupAccessVLAN(hostVeth, 300)).To(Succeed())
+
+			vlanInfo := func() *ip.BridgeVlanInfo {
+				vlans, err := ip.BridgeVlanList()
+				Expect(err).NotTo(HaveOccurred())
+				for _, v := range vlans[int32(hostVeth.Attrs().Index)] {
+					if v.Vid == 300 {
+						return &v
+					}
+				}
+				return nil
+			}
+			v := vlanInfo()
+			Expect(v).NotTo(BeNil())
+			Expect(v.Pvid).To(BeTrue())
+			Expect(v.Untagged).To(BeTrue())
+
+			Expect(teardownAccessVLAN(originalNS, hostVeth.Attrs().Name, 300)).To(Succeed())
+			Expect(vlanInfo()).To(BeNil())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("shapes the traffic of the container on the host veth", func() {
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := ensureBridge("bridge0", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			hostVeth, err := setupVeth(targetNs, br, "eth0", 1500, nil, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+			hostVethName := hostVeth.Attrs().Name
+
+			Expect(ip.SetupQoS(hostVethName, 2000, 1000)).To(Succeed())
+
+			rate := func(link netlink.Link) uint64 {
+				classes, err := netlink.ClassList(link, netlink.MakeHandle(1, 0))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(classes).To(HaveLen(1))
+				return classes[0].(*netlink.HtbClass).Rate
+			}
+			// htb rates are in bytes per second
+			Expect(rate(hostVeth)).To(Equal(uint64(1000 * 1000 / 8)))
+
+			ifb, err := netlink.LinkByName("ifb" + strings.TrimPrefix(hostVethName, "veth"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rate(ifb)).To(Equal(uint64(2000 * 1000 / 8)))
+
+			Expect(ip.TeardownQoS(hostVethName)).To(Succeed())
+			_, err = netlink.LinkByName(ifb.Attrs().Name)
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("adds a flower filter for the container to the host veth", func() {
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := ensureBridge("bridge0", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			hostVeth, err := setupVeth(targetNs, br, "eth0", 1500, nil, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			contIP := net.ParseIP("10.1.2.3")
+			Expect(setupHWOffload(targetNs, "eth0", hostVeth.Attrs().Name, contIP)).To(Succeed())
+
+			var contMAC net.HardwareAddr
+			err = targetNs.Do(func(ns.NetNS) error {
+				link, err := netlink.LinkByName("eth0")
+				contMAC = link.Attrs().HardwareAddr
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			filters, err := ip.FlowerFilterList(hostVeth)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filters).To(HaveLen(1))
+			Expect(filters[0].SrcMAC).To(Equal(contMAC))
+			Expect(filters[0].SrcIP.Equal(contIP)).To(BeTrue())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("creates the bridge and host veth in the host veth namespace", func() {
+		infraNS, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer infraNS.Close()
+
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		var hostVethName string
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(enterNetNS(infraNS.Path())).To(Succeed())
+
+			br, err := ensureBridge("bridge0", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			hostVeth, err := setupVeth(targetNs, br, "eth0", 1500, nil, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+			hostVethName = hostVeth.Attrs().Name
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = infraNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(hostVethName)
+			Expect(err).NotTo(HaveOccurred())
+			br, err := netlink.LinkByName("bridge0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().MasterIndex).To(Equal(br.Attrs().Index))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := netlink.LinkByName(hostVethName)
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("attaches and detaches a pinned eBPF filter on the host veth", func() {
+		if runtime.GOARCH != "amd64" {
+			Skip("the test program is only loaded on amd64")
+		}
+
+		bpffs, err := ioutil.TempDir("", "bpffs")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(bpffs)
+		Expect(syscall.Mount("bpf", bpffs, "bpf", 0, "")).To(Succeed())
+		defer syscall.Unmount(bpffs, 0)
+
+		progPath := filepath.Join(bpffs, "drop_all")
+		Expect(pinDropAllProgram(progPath)).To(Succeed())
+
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := ensureBridge("bridge0", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			hostVeth, err := setupVeth(targetNs, br, "eth0", 1500, nil, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(attachBPFFilter(hostVeth, progPath)).To(Succeed())
+			names, err := ip.BPFFilterList(hostVeth)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(names).To(Equal([]string{"drop_all"}))
+
+			Expect(ip.DetachBPFFilter(hostVeth)).To(Succeed())
+			names, err = ip.BPFFilterList(hostVeth)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(names).To(BeEmpty())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("adds and removes the additional IPs on the container interface", func() {
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		additionalIPs := []string{"10.1.2.10/24", "10.1.3.10/24"}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := ensureBridge("bridge0", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = setupVeth(targetNs, br, "eth0", 1500, nil, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(addAdditionalIPs("eth0", additionalIPs)).To(Succeed())
+
+			link, err := netlink.LinkByName("eth0")
+			Expect(err).NotTo(HaveOccurred())
+			addrs, err := netlink.AddrList(link, syscall.AF_INET)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(HaveLen(2))
+			for i, cidr := range additionalIPs {
+				Expect(addrs[i].IPNet.String()).To(Equal(cidr))
+				Expect(addrs[i].Label).To(Equal(fmt.Sprintf("eth0:%d", i)))
+			}
+
+			Expect(delAdditionalIPs("eth0", additionalIPs)).To(Succeed())
+			addrs, err = netlink.AddrList(link, syscall.AF_INET)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(BeEmpty())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("enables BPDU guard on the host veth", func() {
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := ensureBridge("bridge0", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			hostVeth, err := setupVeth(targetNs, br, "eth0", 1500, nil, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			protinfo, err := netlink.LinkGetProtinfo(hostVeth)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(protinfo.Guard).To(BeFalse())
+
+			Expect(setupBPDUGuard(hostVeth)).To(Succeed())
+			protinfo, err = netlink.LinkGetProtinfo(hostVeth)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(protinfo.Guard).To(BeTrue())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("attaches an XDP program in native mode to the host veth", func() {
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := ensureBridge("bridge0", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			hostVeth, err := setupVeth(targetNs, br, "eth0", 1500, nil, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = setupAFXDP(hostVeth, 1)
+			Expect(err).To(MatchError(fmt.Sprintf("afXDPQueueID 1 does not exist, %q has 1 receive queues", hostVeth.Attrs().Name)))
+
+			Expect(setupAFXDP(hostVeth, 0)).To(Succeed())
+			xdp, err := ip.LinkXDP(hostVeth)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(xdp.Attached).To(Equal(uint8(ip.XDPAttachedDrv)))
+			Expect(xdp.ProgID).NotTo(BeZero())
+
+			Expect(ip.LinkSetXDP(hostVeth, -1, ip.XDPFlagsDrvMode)).To(Succeed())
+			xdp, err = ip.LinkXDP(hostVeth)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(xdp.Attached).To(BeZero())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("sets arp_announce on both ends of the veth pair", func() {
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		readARPAnnounce := func(ifName string) string {
+			data, err := ioutil.ReadFile(fmt.Sprintf(arpAnnouncePath, ifName))
+			Expect(err).NotTo(HaveOccurred())
+			return strings.TrimSpace(string(data))
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := ensureBridge("bridge0", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			hostVeth, err := setupVeth(targetNs, br, "eth0", 1500, nil, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(setARPAnnounce(hostVeth.Attrs().Name, 1)).To(Succeed())
+			Expect(readARPAnnounce(hostVeth.Attrs().Name)).To(Equal("1"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(setARPAnnounce("eth0", containerARPAnnounce)).To(Succeed())
+			Expect(readARPAnnounce("eth0")).To(Equal("2"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("gives the container interface a MAC derived from the container ID", func() {
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := ensureBridge("bridge0", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = setupVeth(targetNs, br, "eth0", 1500, nil, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(setStableMAC("eth0", "dummy")).To(Succeed())
+			link, err := netlink.LinkByName("eth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().HardwareAddr).To(Equal(ip.DeriveStableMAC("dummy", "eth0")))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("gives the container interface the containerMAC with ADD", func() {
+		const IFNAME = "eth0"
+
+		conf := `{
+    "name": "mynet",
+    "type": "bridge",
+    "bridge": "cni0",
+    "containerMAC": "02:42:0a:01:02:03",
+    "ipam": {
+        "type": "host-local",
+        "subnet": "10.1.2.0/24"
+    }
+}`
+
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			result, err := testutils.CmdAddWithResult(targetNs.Path(), IFNAME, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces).To(HaveLen(2))
+			Expect(result.Interfaces[1].Mac).To(Equal("02:42:0a:01:02:03"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().HardwareAddr.String()).To(Equal("02:42:0a:01:02:03"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("maps the DSCP of the container's packets to priorities on the host veth", func() {
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := ensureBridge("bridge0", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			hostVeth, err := setupVeth(targetNs, br, "eth0", 1500, nil, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			prioMap := map[int]int{46: 5, 26: 3, 0: 0}
+			Expect(ip.SetupDSCPPriorityMap(hostVeth, vlanPriorityFilterPrio, prioMap)).To(Succeed())
+			Expect(ip.SetupQoS(hostVeth.Attrs().Name, 2000, 0)).To(Succeed())
+
+			Expect(ip.DSCPPriorityMap(hostVeth, vlanPriorityFilterPrio)).To(Equal(prioMap))
+			Expect(ip.TeardownQoS(hostVeth.Attrs().Name)).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("defaults the MTU to the one of the default route interface", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := ip.DetectMTU()
+			Expect(err).To(MatchError("no default route"))
+
+			err = netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "uplink0", MTU: 9000},
+				PeerName:  "uplink1",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			uplink, err := netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(uplink)).To(Succeed())
+			Expect(netlink.AddrAdd(uplink, &netlink.Addr{IPNet: &net.IPNet{
+				IP:   net.ParseIP("10.9.9.1"),
+				Mask: net.CIDRMask(24, 32),
+			}})).To(Succeed())
+			Expect(ip.AddDefaultRoute(net.ParseIP("10.9.9.254"), uplink)).To(Succeed())
+
+			Expect(ip.DetectMTU()).To(Equal(9000))
+
+			conf := &NetConf{BrName: "bridge0", BrSubnet: "10.1.2.0/24"}
+			br, err := setupBridge(conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conf.MTU).To(Equal(9000))
+			Expect(br.Attrs().MTU).To(Equal(9000))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("turns on promiscuous mode of the bridge and the host veth", func() {
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := setupBridge(&NetConf{BrName: "bridge0", BrSubnet: "10.1.2.0/24", BridgePromiscMode: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ip.LinkPromisc(br)).To(BeTrue())
+
+			hostVeth, err := setupVeth(targetNs, br, "eth0", 1500, nil, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ip.LinkPromisc(hostVeth)).To(BeFalse())
+
+			Expect(ip.LinkSetPromisc(hostVeth, true)).To(Succeed())
+			Expect(ip.LinkPromisc(hostVeth)).To(BeTrue())
+			Expect(ip.LinkSetPromisc(hostVeth, false)).To(Succeed())
+			Expect(ip.LinkPromisc(hostVeth)).To(BeFalse())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("sets the IPv6 hop limit of the bridge and of the container", func() {
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		readHopLimit := func(ifName string) string {
+			data, err := ioutil.ReadFile(fmt.Sprintf(hopLimitPath, ifName))
+			Expect(err).NotTo(HaveOccurred())
+			return strings.TrimSpace(string(data))
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := ensureBridge("bridge0", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = setupVeth(targetNs, br, "eth0", 1500, nil, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(setHopLimit("bridge0", 32)).To(Succeed())
+			Expect(readHopLimit("bridge0")).To(Equal("32"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(setHopLimit("eth0", 32)).To(Succeed())
+			Expect(readHopLimit("eth0")).To(Equal("32"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("adds the IPv6 gateway address next to the link-local one", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := ensureBridge("bridge0", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			linkLocal, err := netlink.ParseAddr("fe80::1/64")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(br, linkLocal)).To(Succeed())
+
+			gw, err := types.ParseCIDR("2001:db8::1/64")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ensureBridgeAddr(br, gw)).To(Succeed())
+			Expect(ensureBridgeAddr(br, gw)).To(Succeed())
+
+			other, err := types.ParseCIDR("2001:db8::2/64")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ensureBridgeAddr(br, other)).NotTo(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("finds the global IPv6 address of the container interface", func() {
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := ensureBridge("bridge0", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = setupVeth(targetNs, br, "eth0", 1500, nil, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName("eth0")
+			Expect(err).NotTo(HaveOccurred())
+			ipn, err := globalAddr("eth0", netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ipn).To(BeNil())
+
+			for _, a := range []string{"fe80::5/64", "2001:db8::5/64"} {
+				addr, err := netlink.ParseAddr(a)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.AddrAdd(link, addr)).To(Succeed())
+			}
+			ipn, err = globalAddr("eth0", netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ipn.String()).To(Equal("2001:db8::5/64"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("checks the bridge and the container interface with CHECK", func() {
+		const IFNAME = "eth0"
+
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		conf := `{
+	"name": "testConfig",
+	"type": "bridge",
+	"bridge": "bridge0",
+	"isGateway": true,
+	"ipam": {
+		"type": "host-local",
+		"subnet": "10.1.2.0/24"
+	}
+}`
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNs.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		var br *netlink.Bridge
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err = ensureBridge("bridge0", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = setupVeth(targetNs, br, IFNAME, 1500, nil, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+			gw, err := types.ParseCIDR("10.1.2.1/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ensureBridgeAddr(br, gw)).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			addr, err := netlink.ParseAddr("10.1.2.2/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(link, addr)).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(cmdCheck(args)).To(Succeed())
+
+			Expect(netlink.LinkSetDown(br)).To(Succeed())
+			Expect(cmdCheck(args)).To(MatchError(`bridge "bridge0" is down`))
+			Expect(netlink.LinkSetUp(br)).To(Succeed())
+
+			gw, err := netlink.ParseAddr("10.1.2.1/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrDel(br, gw)).To(Succeed())
+			Expect(cmdCheck(args)).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			return ip.DelLinkByName(IFNAME)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(cmdCheck(args)).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
 	})
 
-	AfterEach(func() {
-		Expect(originalNS.Close()).To(Succeed())
+	It("detects an IP address conflict with ARP probing", func() {
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		var brMAC net.HardwareAddr
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := ensureBridge("bridge0", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = setupVeth(targetNs, br, "eth0", 1500, nil, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			// the host side of the veth pair already uses 10.1.2.1
+			ipn, err := types.ParseCIDR("10.1.2.1/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(br, &netlink.Addr{IPNet: ipn})).To(Succeed())
+
+			// the bridge takes its MAC address from its first port
+			link, err := netlink.LinkByName("bridge0")
+			Expect(err).NotTo(HaveOccurred())
+			brMAC = link.Attrs().HardwareAddr
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := checkAddressConflict("eth0", net.ParseIP("10.1.2.1"))
+			Expect(err).To(MatchError(fmt.Sprintf("IP address 10.1.2.1 is already in use by %v", brMAC)))
+
+			Expect(checkAddressConflict("eth0", net.ParseIP("10.1.2.2"))).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
 	})
 
-	It("creates a bridge", func() {
-		const IFNAME = "bridge0"
+	It("sets and removes the root qdisc of the container interface", func() {
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
 
-		conf := &NetConf{
-			NetConf: types.NetConf{
-				Name: "testConfig",
-				Type: "bridge",
-			},
-			BrName: IFNAME,
-			IsGW:   false,
-			IPMasq: false,
-			MTU:    5000,
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := ensureBridge("bridge0", 1500)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = setupVeth(targetNs, br, "eth0", 1500, nil, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		rootQdiscs := func() []string {
+			link, err := netlink.LinkByName("eth0")
+			Expect(err).NotTo(HaveOccurred())
+			qdiscs, err := netlink.QdiscList(link)
+			Expect(err).NotTo(HaveOccurred())
+
+			var kinds []string
+			for _, q := range qdiscs {
+				if q.Attrs().Parent == netlink.HANDLE_ROOT {
+					kinds = append(kinds, q.Type())
+				}
+			}
+			return kinds
 		}
 
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(setupContainerQdisc("eth0", "pfifo_fast")).To(Succeed())
+			Expect(rootQdiscs()).To(Equal([]string{"pfifo_fast"}))
+
+			Expect(teardownContainerQdisc("eth0", "pfifo_fast")).To(Succeed())
+			Expect(rootQdiscs()).NotTo(ContainElement("pfifo_fast"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("refuses to add more ports than maxPorts to the bridge", func() {
 		err := originalNS.Do(func(ns.NetNS) error {
 			defer GinkgoRecover()
 
-			bridge, err := setupBridge(conf)
+			br, err := ensureBridge("bridge0", 1500)
 			Expect(err).NotTo(HaveOccurred())
-			Expect(bridge.Attrs().Name).To(Equal(IFNAME))
 
-			// Double check that the link was added
-			link, err := netlink.LinkByName(IFNAME)
+			for i := 0; i < 2; i++ {
+				Expect(checkMaxPorts(br, 2)).To(Succeed())
+
+				targetNs, err := ns.NewNS()
+				Expect(err).NotTo(HaveOccurred())
+				defer targetNs.Close()
+				_, err = setupVeth(targetNs, br, "eth0", 1500, nil, false, nil)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			err = checkMaxPorts(br, 2)
+			Expect(err).To(MatchError(`bridge "bridge0" already has 2 ports, the maximum allowed by maxPorts`))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("limits the number of MAC addresses learned by the bridge", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := setupBridge(&NetConf{
+				BrName:      "bridge0",
+				BrSubnet:    "10.1.2.0/24",
+				MTU:         1500,
+				MACTableMax: 100,
+			})
 			Expect(err).NotTo(HaveOccurred())
-			Expect(link.Attrs().Name).To(Equal(IFNAME))
+
+			max, err := ip.BridgeFDBMaxLearned(br)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(max).To(Equal(uint32(100)))
 			return nil
 		})
 		Expect(err).NotTo(HaveOccurred())
 	})
 
-	It("handles an existing bridge", func() {
-		const IFNAME = "bridge0"
+	It("replaces the bridge IP of a previous configuration", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := setupBridge(&NetConf{
+				BrName:   "bridge0",
+				BrSubnet: "10.1.2.0/24",
+				BrIP:     "10.1.2.1",
+				MTU:      1500,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = setupBridge(&NetConf{
+				BrName:        "bridge0",
+				BrSubnet:      "10.1.3.0/24",
+				BrIP:          "10.1.3.1",
+				MTU:           1500,
+				ForceBridgeIP: true,
+			})
+			Expect(err).NotTo(HaveOccurred())
 
+			addrs, err := netlink.AddrList(br, syscall.AF_INET)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(HaveLen(1))
+			Expect(addrs[0].IPNet.String()).To(Equal("10.1.3.1/24"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("keeps the addresses it did not set when replacing the bridge IP", func() {
 		err := originalNS.Do(func(ns.NetNS) error {
 			defer GinkgoRecover()
 
-			err := netlink.LinkAdd(&netlink.Bridge{
-				LinkAttrs: netlink.LinkAttrs{
-					Name: IFNAME,
-				},
+			br, err := setupBridge(&NetConf{
+				BrName:   "bridge0",
+				BrSubnet: "10.1.2.0/24",
+				MTU:      1500,
 			})
 			Expect(err).NotTo(HaveOccurred())
-			link, err := netlink.LinkByName(IFNAME)
+
+			// e.g. moved from the uplink
+			uplinkAddr, err := netlink.ParseAddr("192.168.1.5/24")
 			Expect(err).NotTo(HaveOccurred())
-			Expect(link.Attrs().Name).To(Equal(IFNAME))
-			ifindex := link.Attrs().Index
+			Expect(netlink.AddrAdd(br, uplinkAddr)).To(Succeed())
 
-			conf := &NetConf{
-				NetConf: types.NetConf{
-					Name: "testConfig",
-					Type: "bridge",
-				},
-				BrName: IFNAME,
-				IsGW:   false,
-				IPMasq: false,
+			_, err = setupBridge(&NetConf{
+				BrName:        "bridge0",
+				BrSubnet:      "10.1.3.0/24",
+				MTU:           1500,
+				ForceBridgeIP: true,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			addrs, err := netlink.AddrList(br, syscall.AF_INET)
+			Expect(err).NotTo(HaveOccurred())
+			var got []string
+			for _, a := range addrs {
+				got = append(got, a.IPNet.String())
 			}
+			Expect(got).To(ConsistOf("10.1.3.1/24", "192.168.1.5/24"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
 
-			bridge, err := setupBridge(conf)
+	It("sets the forward delay and ageing time of the bridge", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			br, err := setupBridge(&NetConf{
+				BrName:       "bridge0",
+				BrSubnet:     "10.1.2.0/24",
+				MTU:          1500,
+				ForwardDelay: 4,
+				AgeingTime:   30,
+			})
 			Expect(err).NotTo(HaveOccurred())
-			Expect(bridge.Attrs().Name).To(Equal(IFNAME))
-			Expect(bridge.Attrs().Index).To(Equal(ifindex))
 
-			// Double check that the link has the same ifindex
-			link, err = netlink.LinkByName(IFNAME)
+			delay, err := ip.BridgeForwardDelay(br)
 			Expect(err).NotTo(HaveOccurred())
-			Expect(link.Attrs().Name).To(Equal(IFNAME))
-			Expect(link.Attrs().Index).To(Equal(ifindex))
+			Expect(delay).To(Equal(4))
+
+			ageing, err := ip.BridgeAgeingTime(br)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ageing).To(Equal(30))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("sets multicast snooping only when configured", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			snooping := func() bool {
+				link, err := netlink.LinkByName("bridge0")
+				Expect(err).NotTo(HaveOccurred())
+				on, err := ip.BridgeMulticastSnooping(link)
+				Expect(err).NotTo(HaveOccurred())
+				return on
+			}
+
+			off := false
+			_, err := setupBridge(&NetConf{
+				BrName:            "bridge0",
+				BrSubnet:          "10.1.2.0/24",
+				MTU:               1500,
+				MulticastSnooping: &off,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snooping()).To(BeFalse())
+
+			// the setting is left alone when omitted
+			_, err = setupBridge(&NetConf{
+				BrName:   "bridge0",
+				BrSubnet: "10.1.2.0/24",
+				MTU:      1500,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snooping()).To(BeFalse())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("enables or disables STP on the bridge", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for _, enabled := range []bool{true, false} {
+				br, err := setupBridge(&NetConf{
+					BrName:     "bridge0",
+					BrSubnet:   "10.1.2.0/24",
+					MTU:        1500,
+					STPEnabled: enabled,
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				state, err := ip.BridgeSTPState(br)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(state).To(Equal(enabled))
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("adds and removes an IP in IP encapsulated route", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "encap0"},
+				PeerName:  "encap1",
+			})).To(Succeed())
+			dev, err := netlink.LinkByName("encap0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(dev)).To(Succeed())
+
+			_, dst, _ := net.ParseCIDR("10.9.0.0/16")
+			gw := net.ParseIP("192.168.1.2")
+			Expect(ip.AddEncapRoute(dst, gw, dev)).To(Succeed())
+
+			routes, err := ip.EncapRouteList()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(HaveLen(1))
+			Expect(routes[0].Dst.String()).To(Equal("10.9.0.0/16"))
+			Expect(routes[0].LinkIndex).To(Equal(dev.Attrs().Index))
+			Expect(routes[0].EncapDst.Equal(gw)).To(BeTrue())
+
+			Expect(ip.DelEncapRoute(dst, gw, dev)).To(Succeed())
+			routes, err = ip.EncapRouteList()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(BeEmpty())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("routes the remote subnet through the ipip device", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			return ip.AddIPIPDevice(ipipDevName)
+		})
+		if err == syscall.EOPNOTSUPP {
+			Skip("the kernel does not support ipip devices")
+		}
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			n := &NetConf{BrName: "bridge0", RemoteSubnet: "10.9.0.0/16", RemoteEncapGW: "192.168.1.2"}
+			_, err := ensureBridge(n.BrName, 1500)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(setupRemoteRoute(n)).To(Succeed())
+
+			dev, err := netlink.LinkByName(ipipDevName)
+			Expect(err).NotTo(HaveOccurred())
+			routes, err := ip.EncapRouteList()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(HaveLen(1))
+			Expect(routes[0].LinkIndex).To(Equal(dev.Attrs().Index))
+
+			Expect(teardownRemoteRoute(n)).To(Succeed())
+			routes, err = ip.EncapRouteList()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(BeEmpty())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("attaches the uplink to the bridge and moves its address", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "uplink0"},
+				PeerName:  "uplink1",
+			})).To(Succeed())
+			uplink, err := netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+			ipn, err := types.ParseCIDR("192.168.1.10/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(uplink, &netlink.Addr{IPNet: ipn})).To(Succeed())
+
+			n := &NetConf{
+				BrName:       "bridge0",
+				BrSubnet:     "10.1.2.0/24",
+				MTU:          1500,
+				BridgeUplink: "uplink0",
+			}
+			br, err := setupBridge(n)
+			Expect(err).NotTo(HaveOccurred())
+
+			uplink, err = netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(uplink.Attrs().MasterIndex).To(Equal(br.Attrs().Index))
+			addrs, err := netlink.AddrList(uplink, syscall.AF_INET)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(BeEmpty())
+
+			addrs, err = netlink.AddrList(br, syscall.AF_INET)
+			Expect(err).NotTo(HaveOccurred())
+			var brAddrs []string
+			for _, a := range addrs {
+				brAddrs = append(brAddrs, a.IPNet.String())
+			}
+			Expect(brAddrs).To(ContainElement("192.168.1.10/24"))
+
+			Expect(detachUplink(n)).To(Succeed())
+			uplink, err = netlink.LinkByName("uplink0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(uplink.Attrs().MasterIndex).To(Equal(0))
 			return nil
 		})
 		Expect(err).NotTo(HaveOccurred())
@@ -149,11 +1469,19 @@ var _ = Describe("bridge Operations", func() {
 		err = originalNS.Do(func(ns.NetNS) error {
 			defer GinkgoRecover()
 
-			_, err := testutils.CmdAddWithResult(targetNs.Path(), IFNAME, func() error {
+			result, err := testutils.CmdAddWithResult(targetNs.Path(), IFNAME, func() error {
 				return cmdAdd(args)
 			})
 			Expect(err).NotTo(HaveOccurred())
 
+			// The result lists the host veth, then the container veth
+			Expect(result.Interfaces).To(HaveLen(2))
+			Expect(result.Interfaces[0].Sandbox).To(BeEmpty())
+			Expect(result.Interfaces[0].Mac).NotTo(BeEmpty())
+			Expect(result.Interfaces[1].Name).To(Equal(IFNAME))
+			Expect(result.Interfaces[1].Sandbox).To(Equal(targetNs.Path()))
+			Expect(result.Interfaces[1].Mac).NotTo(BeEmpty())
+
 			// Make sure bridge link exists
 			link, err := netlink.LinkByName(BRNAME)
 			Expect(err).NotTo(HaveOccurred())
@@ -237,3 +1565,49 @@ var _ = Describe("bridge Operations", func() {
 		Expect(err).NotTo(HaveOccurred())
 	})
 })
+
+// pinDropAllProgram loads a sched_cls eBPF program returning TC_ACT_SHOT
+// for every packet and pins it at path
+func pinDropAllProgram(path string) error {
+	const (
+		bpfProgLoad        = 5
+		bpfObjPin          = 6
+		bpfProgTypeSchedCl = 3
+		sysBPF             = 321 // amd64
+	)
+
+	// mov r0, 2 (TC_ACT_SHOT); exit
+	insns := []uint64{0x00000002000000b7, 0x0000000000000095}
+	license := []byte("GPL\x00")
+	load := struct {
+		progType uint32
+		insnCnt  uint32
+		insns    uint64
+		license  uint64
+		pad      [64]byte
+	}{
+		progType: bpfProgTypeSchedCl,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	fd, _, errno := syscall.Syscall(sysBPF, bpfProgLoad, uintptr(unsafe.Pointer(&load)), unsafe.Sizeof(load))
+	if errno != 0 {
+		return fmt.Errorf("failed to load program: %v", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	pathname := append([]byte(path), 0)
+	pin := struct {
+		pathname uint64
+		bpfFD    uint32
+		flags    uint32
+	}{
+		pathname: uint64(uintptr(unsafe.Pointer(&pathname[0]))),
+		bpfFD:    uint32(fd),
+	}
+	if _, _, errno := syscall.Syscall(sysBPF, bpfObjPin, uintptr(unsafe.Pointer(&pin)), unsafe.Sizeof(pin)); errno != 0 {
+		return fmt.Errorf("failed to pin program: %v", errno)
+	}
+	return nil
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
 )
 
 func TestErrorNetworkConfigMissingSubnet(t *testing.T) {
@@ -194,3 +201,704 @@ func TestNetworkConfigWithInValidBrIPWithNoMask(t *testing.T) {
 		t.Fatalf("Expecting error, didn't get any")
 	}
 }
+
+func TestErrorNetworkConfigInvalidRPFilter(t *testing.T) {
+	_, err := loadNetConf([]byte(`{"name": "mynet", "type": "bridge", "globalRPFilter": 3}`))
+	if err == nil {
+		t.Fatalf("Expecting error, didn't get any")
+	}
+}
+
+func TestRelaxRPFilter(t *testing.T) {
+	tests := []struct {
+		current  string
+		mode     int
+		expected string
+	}{
+		{"1\n", 2, "2"},
+		{"1\n", 0, "0"},
+		{"2\n", 0, "0"},
+		{"2\n", 1, "2\n"},
+		{"0\n", 2, "0\n"},
+		{"0\n", 1, "0\n"},
+	}
+
+	for _, tt := range tests {
+		f, err := ioutil.TempFile("", "rp_filter")
+		if err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+		defer os.Remove(f.Name())
+		f.WriteString(tt.current)
+		f.Close()
+
+		if err := relaxRPFilter(f.Name(), tt.mode); err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+
+		data, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+		if string(data) != tt.expected {
+			t.Fatalf("current %q, mode %d: expected: %q, got: %q", tt.current, tt.mode, tt.expected, string(data))
+		}
+	}
+}
+
+func TestErrorNetworkConfigNFLOGPrefixTooLong(t *testing.T) {
+	conf := fmt.Sprintf(`{
+	"name": "test",
+	"type": "bridge",
+	"nflogGroup": 5,
+	"nflogPrefix": "%s"
+}`, strings.Repeat("x", 65))
+	if _, err := loadNetConf([]byte(conf)); err == nil {
+		t.Fatalf("expected error for an nflogPrefix longer than 64 characters")
+	}
+}
+
+func TestWriteResolvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridge-dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dns := types.DNS{
+		Nameservers: []string{"10.1.0.1", "10.1.0.2"},
+		Domain:      "example.com",
+		Search:      []string{"a.example.com", "example.com"},
+		Options:     []string{"ndots:2"},
+	}
+	netns := fmt.Sprintf("/proc/%d/ns/net", os.Getpid())
+	path := filepath.Join(dir, "resolv.conf")
+	if err := writeResolvConf(netns, path, dns); err != nil {
+		t.Fatalf("failed to write resolv.conf: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "nameserver 10.1.0.1\nnameserver 10.1.0.2\nsearch a.example.com example.com\noptions ndots:2\n"
+	if string(data) != expected {
+		t.Fatalf("expected %q, got %q", expected, string(data))
+	}
+
+	if err := removeResolvConf(netns, path); err != nil {
+		t.Fatalf("failed to remove resolv.conf: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected resolv.conf to be removed, got %v", err)
+	}
+}
+
+func TestErrorResolvConfNetNSNotInProc(t *testing.T) {
+	if err := writeResolvConf("/var/run/netns/test", "/etc/resolv.conf", types.DNS{}); err == nil {
+		t.Fatalf("expected error for a netns path outside of /proc")
+	}
+}
+
+func TestErrorWriteResolvConfThroughSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridge-dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "shadow")
+	if err := ioutil.WriteFile(target, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "resolv.conf")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, filepath.Join(dir, "etc")); err != nil {
+		t.Fatal(err)
+	}
+
+	netns := fmt.Sprintf("/proc/%d/ns/net", os.Getpid())
+	dns := types.DNS{Nameservers: []string{"10.1.0.1"}}
+	if err := writeResolvConf(netns, link, dns); err == nil {
+		t.Fatalf("expected error writing through a symlink")
+	}
+	if err := writeResolvConf(netns, filepath.Join(dir, "etc", "resolv.conf"), dns); err == nil {
+		t.Fatalf("expected error writing below a symlinked directory")
+	}
+
+	if err := removeResolvConf(netns, link); err != nil {
+		t.Fatalf("failed to remove resolv.conf: %v", err)
+	}
+	if _, err := os.Lstat(link); !os.IsNotExist(err) {
+		t.Fatalf("expected the symlink to be removed, got %v", err)
+	}
+	data, err := ioutil.ReadFile(target)
+	if err != nil || string(data) != "secret\n" {
+		t.Fatalf("expected the symlink target to be untouched, got %q, %v", data, err)
+	}
+}
+
+func TestRemoveResolvConfMissing(t *testing.T) {
+	netns := fmt.Sprintf("/proc/%d/ns/net", os.Getpid())
+	if err := removeResolvConf(netns, "/nonexistent/dir/resolv.conf"); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+}
+
+func TestResolvConfPathDefault(t *testing.T) {
+	n, err := loadNetConf([]byte(`{"name": "test", "type": "bridge"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := n.resolvConfPath(); path != "/etc/resolv.conf" {
+		t.Fatalf("expected /etc/resolv.conf, got %q", path)
+	}
+}
+
+func TestInjectDetectedGateway(t *testing.T) {
+	defer func(f func(net.IP) ([]netlink.Route, error)) { routeGet = f }(routeGet)
+	var queried net.IP
+	routeGet = func(dst net.IP) ([]netlink.Route, error) {
+		queried = dst
+		return []netlink.Route{{Gw: net.ParseIP("10.10.0.254")}}, nil
+	}
+
+	c := &NetConf{BrSubnet: "10.10.0.0/16", BrIP: "10.10.0.1"}
+	ipc := &types.IPConfig{IP: net.IPNet{IP: net.ParseIP("10.10.0.5"), Mask: net.CIDRMask(16, 32)}}
+	if err := injectDetectedGateway(c, ipc); err != nil {
+		t.Fatalf("failed to inject gateway: %v", err)
+	}
+
+	if !queried.Equal(net.ParseIP("10.10.0.1")) {
+		t.Fatalf("expected route lookup of the bridge IP, got %v", queried)
+	}
+	if !ipc.Gateway.Equal(net.ParseIP("10.10.0.254")) {
+		t.Fatalf("expected gateway 10.10.0.254, got %v", ipc.Gateway)
+	}
+	if len(ipc.Routes) != 1 || ipc.Routes[0].Dst.String() != "0.0.0.0/0" || !ipc.Routes[0].GW.Equal(ipc.Gateway) {
+		t.Fatalf("expected default route via the gateway, got %+v", ipc.Routes)
+	}
+}
+
+func TestErrorInjectDetectedGatewayOutsideSubnet(t *testing.T) {
+	defer func(f func(net.IP) ([]netlink.Route, error)) { routeGet = f }(routeGet)
+	routeGet = func(dst net.IP) ([]netlink.Route, error) {
+		return []netlink.Route{{Gw: net.ParseIP("192.168.0.1")}}, nil
+	}
+
+	c := &NetConf{BrSubnet: "10.10.0.0/16", BrIP: "10.10.0.1"}
+	ipc := &types.IPConfig{IP: net.IPNet{IP: net.ParseIP("10.10.0.5"), Mask: net.CIDRMask(16, 32)}}
+	if err := injectDetectedGateway(c, ipc); err == nil {
+		t.Fatalf("expected error for a gateway outside the container subnet")
+	}
+}
+
+func TestEnableSysctl(t *testing.T) {
+	tests := []struct {
+		current  string
+		expected string
+	}{
+		{"0\n", "1"},
+		// already enabled: not rewritten
+		{"1\n", "1\n"},
+	}
+
+	for _, tt := range tests {
+		f, err := ioutil.TempFile("", "sysctl")
+		if err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+		defer os.Remove(f.Name())
+		f.WriteString(tt.current)
+		f.Close()
+
+		if err := enableSysctl(f.Name()); err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+
+		data, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+		if string(data) != tt.expected {
+			t.Fatalf("current %q: expected: %q, got: %q", tt.current, tt.expected, string(data))
+		}
+	}
+}
+
+func TestDSCPClearRule(t *testing.T) {
+	rule := dscpClearRule("cni0", net.ParseIP("10.1.2.3"), "name: \"test\" id: \"abc\"")
+	expected := []string{
+		"-i", "cni0",
+		"-s", "10.1.2.3/32",
+		"-j", "DSCP", "--set-dscp", "0",
+		"-m", "comment", "--comment", "name: \"test\" id: \"abc\"",
+	}
+	if strings.Join(rule, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expected: %q, got: %q", expected, rule)
+	}
+}
+
+func TestDSCPClearOptIn(t *testing.T) {
+	for _, tt := range []struct {
+		conf     string
+		expected bool
+	}{
+		{`{"name": "test", "type": "bridge"}`, false},
+		{`{"name": "test", "type": "bridge", "dscpRewrite": true}`, false},
+		{`{"name": "test", "type": "bridge", "dscpRewrite": false}`, true},
+	} {
+		n, err := loadNetConf([]byte(tt.conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.dscpClearEnabled() != tt.expected {
+			t.Fatalf("%s: expected DSCP clearing %v", tt.conf, tt.expected)
+		}
+	}
+}
+
+func TestErrorNetworkConfigInvalidContainerQdisc(t *testing.T) {
+	conf := `{
+	"name": "test",
+	"type": "bridge",
+	"containerQdisc": "netem"
+}`
+	if _, err := loadNetConf([]byte(conf)); err == nil {
+		t.Fatalf("expected error for an unsupported containerQdisc")
+	}
+}
+
+func TestErrorNetworkConfigRemoteSubnetWithoutGateway(t *testing.T) {
+	conf := `{
+	"name": "test",
+	"type": "bridge",
+	"remoteSubnet": "10.9.0.0/16"
+}`
+	if _, err := loadNetConf([]byte(conf)); err == nil {
+		t.Fatalf("expected error for remoteSubnet without remoteEncapGateway")
+	}
+}
+
+func TestErrorNetworkConfigInvalidSNATToIP(t *testing.T) {
+	conf := `{
+	"name": "test",
+	"type": "bridge",
+	"ipMasq": true,
+	"snatToIP": "2001:db8::1"
+}`
+	if _, err := loadNetConf([]byte(conf)); err == nil {
+		t.Fatalf("expected error for a snatToIP that is not an IPv4 address")
+	}
+}
+
+func TestConnmarkRules(t *testing.T) {
+	comment := "name: \"test\" id: \"abc\""
+	preRouting, output := connmarkRules(net.ParseIP("10.1.2.3"), 0x10, comment)
+
+	expected := []string{
+		"-s 10.1.2.3/32 -j MARK --set-mark 0x10/0xffffffff -m comment --comment " + comment,
+		"-s 10.1.2.3/32 -j CONNMARK --save-mark -m comment --comment " + comment,
+		"-d 10.1.2.3/32 -j CONNMARK --restore-mark -m comment --comment " + comment,
+	}
+	var rules []string
+	for _, rule := range append(preRouting, output...) {
+		rules = append(rules, strings.Join(rule, " "))
+	}
+	if strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected: %q, got: %q", expected, rules)
+	}
+	if len(output) != 1 {
+		t.Fatalf("expected the restore rule in OUTPUT, got: %q", output)
+	}
+}
+
+func TestErrorNetworkConfigConnmarkWithoutTable(t *testing.T) {
+	conf := `{
+	"name": "test",
+	"type": "bridge",
+	"connmarkMark": 16
+}`
+	if _, err := loadNetConf([]byte(conf)); err == nil {
+		t.Fatalf("expected error for connmarkMark without connmarkTable")
+	}
+}
+
+func TestWireGuardForwardRules(t *testing.T) {
+	n := &NetConf{BrName: "cni0", WireGuardIface: "wg0", WireGuardMasq: true}
+	comment := "name: \"test\" id: \"abc\""
+	ip := net.ParseIP("10.1.2.3")
+
+	expected := []string{
+		"-i cni0 -o wg0 -s 10.1.2.3/32 -j ACCEPT -m comment --comment " + comment,
+		"-i wg0 -o cni0 -d 10.1.2.3/32 -j ACCEPT -m comment --comment " + comment,
+		"-s 10.1.2.3/32 -o wg0 -j MASQUERADE -m comment --comment " + comment,
+	}
+	var rules []string
+	for _, rule := range append(wireGuardForwardRules(n, ip, comment), wireGuardMasqRule(n, ip, comment)) {
+		rules = append(rules, strings.Join(rule, " "))
+	}
+	if strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected: %q, got: %q", expected, rules)
+	}
+}
+
+func TestByteQuotaRules(t *testing.T) {
+	comment := "name: \"test\" id: \"abc\""
+	rules := forwardLimitRules(net.ParseIP("10.1.2.3"), 1<<30, 0, comment)
+
+	expected := []string{
+		"-s 10.1.2.3/32 -m quota ! --quota 1073741824 -j DROP -m comment --comment " + comment,
+		"-s 10.1.2.3/32 -j ACCEPT -m comment --comment " + comment,
+	}
+	var got []string
+	for _, rule := range rules {
+		got = append(got, strings.Join(rule, " "))
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected: %q, got: %q", expected, got)
+	}
+}
+
+func TestICMPRateLimitRules(t *testing.T) {
+	comment := "name: \"test\" id: \"abc\""
+	rules := forwardLimitRules(net.ParseIP("10.1.2.3"), 0, 10, comment)
+
+	expected := []string{
+		"-s 10.1.2.3/32 -p icmp --icmp-type echo-request -m limit --limit 10/sec -j ACCEPT -m comment --comment " + comment,
+		"-s 10.1.2.3/32 -p icmp --icmp-type echo-request -j DROP -m comment --comment " + comment,
+	}
+	var got []string
+	for _, rule := range rules {
+		got = append(got, strings.Join(rule, " "))
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected: %q, got: %q", expected, got)
+	}
+}
+
+func TestForwardLimitRulesOrder(t *testing.T) {
+	comment := "name: \"test\" id: \"abc\""
+	rules := forwardLimitRules(net.ParseIP("10.1.2.3"), 1<<30, 10, comment)
+
+	// pings count against the quota and are accepted within it only up
+	// to the rate limit
+	expected := []string{
+		"-s 10.1.2.3/32 -m quota ! --quota 1073741824 -j DROP -m comment --comment " + comment,
+		"-s 10.1.2.3/32 -p icmp --icmp-type echo-request -m limit --limit 10/sec -j ACCEPT -m comment --comment " + comment,
+		"-s 10.1.2.3/32 -p icmp --icmp-type echo-request -j DROP -m comment --comment " + comment,
+		"-s 10.1.2.3/32 -j ACCEPT -m comment --comment " + comment,
+	}
+	var got []string
+	for _, rule := range rules {
+		got = append(got, strings.Join(rule, " "))
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected: %q, got: %q", expected, got)
+	}
+}
+
+func TestDisableSysctl(t *testing.T) {
+	tests := []struct {
+		current  string
+		expected string
+	}{
+		{"1\n", "0"},
+		// already disabled: not rewritten
+		{"0\n", "0\n"},
+	}
+
+	for _, tt := range tests {
+		f, err := ioutil.TempFile("", "sysctl")
+		if err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+		defer os.Remove(f.Name())
+		f.WriteString(tt.current)
+		f.Close()
+
+		if err := disableSysctl(f.Name()); err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+
+		data, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+		if string(data) != tt.expected {
+			t.Fatalf("expected %q, got %q", tt.expected, string(data))
+		}
+	}
+}
+
+func TestSetSysctlValue(t *testing.T) {
+	tests := []struct {
+		current  string
+		expected string
+	}{
+		{"0\n", "12345"},
+		// already set: not rewritten
+		{"12345\n", "12345\n"},
+	}
+
+	for _, tt := range tests {
+		f, err := ioutil.TempFile("", "sysctl")
+		if err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+		defer os.Remove(f.Name())
+		f.WriteString(tt.current)
+		f.Close()
+
+		if err := setSysctlValue(f.Name(), "12345"); err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+
+		data, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+		if string(data) != tt.expected {
+			t.Fatalf("expected %q, got %q", tt.expected, string(data))
+		}
+	}
+}
+
+func TestErrorNetworkConfigInvalidARPAnnounce(t *testing.T) {
+	conf := `{
+	"name": "test",
+	"type": "bridge",
+	"arpAnnounce": 3
+}`
+	if _, err := loadNetConf([]byte(conf)); err == nil {
+		t.Fatalf("expected error for an arpAnnounce mode out of range")
+	}
+}
+
+func TestIPVSRealServer(t *testing.T) {
+	var calls []string
+	orig := ipvsadm
+	ipvsadm = func(args ...string) error {
+		calls = append(calls, strings.Join(args, " "))
+		return nil
+	}
+	defer func() { ipvsadm = orig }()
+
+	n := &NetConf{IPVSVirtualService: "10.0.0.1:80", IPVSWeight: 5}
+	ip := net.ParseIP("10.1.2.3")
+	if err := addIPVSRealServer(n, ip); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if err := delIPVSRealServer(n, ip); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	expected := []string{
+		"-a -t 10.0.0.1:80 -r 10.1.2.3:80 -m -w 5",
+		"-d -t 10.0.0.1:80 -r 10.1.2.3:80",
+	}
+	if strings.Join(calls, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected: %q, got: %q", expected, calls)
+	}
+}
+
+func TestErrorNetworkConfigInvalidIPVSVirtualService(t *testing.T) {
+	for _, vs := range []string{"10.0.0.1", "example.com:80", "10.0.0.1:0"} {
+		conf := fmt.Sprintf(`{
+	"name": "test",
+	"type": "bridge",
+	"ipvsVirtualService": %q
+}`, vs)
+		if _, err := loadNetConf([]byte(conf)); err == nil {
+			t.Fatalf("expected error for ipvsVirtualService %q", vs)
+		}
+	}
+}
+
+func TestNFTExpireElement(t *testing.T) {
+	var calls []string
+	orig := nft
+	nft = func(args ...string) error {
+		calls = append(calls, strings.Join(args, " "))
+		return nil
+	}
+	defer func() { nft = orig }()
+
+	n := &NetConf{BrName: "cni0", NFTablesExpireTTL: 3600}
+	if err := addNFTExpireElement(n, net.ParseIP("10.1.2.3")); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	expected := []string{
+		"add table ip cni",
+		"add set ip cni expire-cni0 { type ipv4_addr; flags timeout; timeout 3600s; }",
+		"add element ip cni expire-cni0 { 10.1.2.3 timeout 3600s }",
+	}
+	if strings.Join(calls, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected: %q, got: %q", expected, calls)
+	}
+}
+
+func TestNFTExpireElementAlreadyExpired(t *testing.T) {
+	orig := nft
+	nft = func(args ...string) error {
+		return fmt.Errorf("nft %s failed: exit status 1: Error: Could not process rule: No such file or directory", strings.Join(args, " "))
+	}
+	defer func() { nft = orig }()
+
+	n := &NetConf{BrName: "cni0", NFTablesExpireTTL: 3600}
+	if err := delNFTExpireElement(n, net.ParseIP("10.1.2.3")); err != nil {
+		t.Fatalf("not expecting error for an expired element: %v", err)
+	}
+}
+
+func TestErrorNetworkConfigInvalidVLANTag(t *testing.T) {
+	for _, vid := range []int{-1, 4095} {
+		conf := fmt.Sprintf(`{
+	"name": "test",
+	"type": "bridge",
+	"vlan": %d
+}`, vid)
+		if _, err := loadNetConf([]byte(conf)); err == nil {
+			t.Fatalf("expected error for vlan %d", vid)
+		}
+	}
+}
+
+func TestRouteMarkRule(t *testing.T) {
+	n := &NetConf{BrName: "cni0", RouteMark: 0x30, RouteMarkMask: 0xf0, RouteMarkTable: 300}
+
+	expected := "-i cni0 -j MARK --set-mark 0x30/0xf0"
+	if rule := strings.Join(routeMarkRule(n), " "); rule != expected {
+		t.Fatalf("expected: %q, got: %q", expected, rule)
+	}
+
+	n.RouteMarkMask = 0
+	expected = "-i cni0 -j MARK --set-mark 0x30/0xffffffff"
+	if rule := strings.Join(routeMarkRule(n), " "); rule != expected {
+		t.Fatalf("expected: %q, got: %q", expected, rule)
+	}
+}
+
+func TestErrorNetworkConfigRouteMarkWithoutTable(t *testing.T) {
+	conf := `{
+	"name": "test",
+	"type": "bridge",
+	"routeMark": 48
+}`
+	if _, err := loadNetConf([]byte(conf)); err == nil {
+		t.Fatalf("expected error for routeMark without routeMarkTable")
+	}
+}
+
+func TestErrorNetworkConfigNegativeBridgeTimers(t *testing.T) {
+	for _, key := range []string{"forwardDelay", "ageingTime"} {
+		conf := fmt.Sprintf(`{
+	"name": "test",
+	"type": "bridge",
+	%q: -1
+}`, key)
+		if _, err := loadNetConf([]byte(conf)); err == nil {
+			t.Fatalf("expected error for a negative %s", key)
+		}
+	}
+}
+
+func TestCTHelperRules(t *testing.T) {
+	rules := ctHelperRules([]string{"ftp", "sip"}, net.ParseIP("10.1.2.3"), "test")
+
+	expected := []string{
+		"-s 10.1.2.3/32 -p tcp -j CT --helper ftp -m comment --comment test",
+		"-d 10.1.2.3/32 -p tcp -j CT --helper ftp -m comment --comment test",
+		"-s 10.1.2.3/32 -p udp -j CT --helper sip -m comment --comment test",
+		"-d 10.1.2.3/32 -p udp -j CT --helper sip -m comment --comment test",
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("expected %d rules, got %d", len(expected), len(rules))
+	}
+	for i, rule := range rules {
+		if r := strings.Join(rule, " "); r != expected[i] {
+			t.Fatalf("expected: %q, got: %q", expected[i], r)
+		}
+	}
+
+	modules := strings.Join(requiredModules(&NetConf{CTHelpers: []string{"ftp", "sip"}}), " ")
+	if modules != "bridge veth nf_conntrack_ftp nf_conntrack_sip" {
+		t.Fatalf("unexpected required modules %q", modules)
+	}
+}
+
+func TestErrorNetworkConfigUnknownCTHelper(t *testing.T) {
+	conf := `{
+	"name": "test",
+	"type": "bridge",
+	"ctHelpers": ["ftp", "gopher"]
+}`
+	if _, err := loadNetConf([]byte(conf)); err == nil {
+		t.Fatalf("expected error for an unknown conntrack helper")
+	}
+}
+
+func TestErrorNetworkConfigInvalidIPv6HopLimit(t *testing.T) {
+	conf := `{
+	"name": "test",
+	"type": "bridge",
+	"ipv6HopLimit": 256
+}`
+	if _, err := loadNetConf([]byte(conf)); err == nil {
+		t.Fatalf("expected error for an ipv6HopLimit out of range")
+	}
+}
+
+func TestErrorNetworkConfigInvalidVLANPriorityMap(t *testing.T) {
+	for _, m := range []string{`{"64": 1}`, `{"46": 8}`} {
+		conf := `{
+	"name": "test",
+	"type": "bridge",
+	"vlanPriorityMap": ` + m + `
+}`
+		if _, err := loadNetConf([]byte(conf)); err == nil {
+			t.Fatalf("expected error for vlanPriorityMap %s", m)
+		}
+	}
+}
+
+func TestErrorNetworkConfigMulticastContainerMAC(t *testing.T) {
+	conf := `{
+	"name": "test",
+	"type": "bridge",
+	"containerMAC": "03:00:00:00:00:01"
+}`
+	if _, err := loadNetConf([]byte(conf)); err == nil {
+		t.Fatalf("expected error for a multicast containerMAC")
+	}
+}
+
+func TestErrorNetworkConfigContainerMACWithStableMAC(t *testing.T) {
+	conf := `{
+	"name": "test",
+	"type": "bridge",
+	"containerMAC": "02:00:00:00:00:01",
+	"stableMAC": true
+}`
+	if _, err := loadNetConf([]byte(conf)); err == nil {
+		t.Fatalf("expected error for containerMAC combined with stableMAC")
+	}
+}
+
+func TestNetworkConfigContainerMAC(t *testing.T) {
+	conf := `{
+	"name": "test",
+	"type": "bridge",
+	"containerMAC": "02:00:00:00:00:01"
+}`
+	n, err := loadNetConf([]byte(conf))
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if n.ContainerMAC != "02:00:00:00:00:01" {
+		t.Fatalf("expected containerMAC 02:00:00:00:00:01, got %q", n.ContainerMAC)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+const defaultResolvConfPath = "/etc/resolv.conf"
+
+var procNetNSPath = regexp.MustCompile(`^/proc/(\d+)(/task/\d+)?/ns/net$`)
+
+// containerRoot returns the procfs view of the root filesystem of the
+// process whose network namespace is netnsPath. A namespace bind mounted
+// elsewhere, e.g. under /var/run/netns, has no process to go through.
+func containerRoot(netnsPath string) (string, error) {
+	m := procNetNSPath.FindStringSubmatch(netnsPath)
+	if m == nil {
+		return "", fmt.Errorf("cannot find the root filesystem of netns %q, it is not a /proc/<pid>/ns/net path", netnsPath)
+	}
+	return fmt.Sprintf("/proc/%s/root", m[1]), nil
+}
+
+func formatResolvConf(dns types.DNS) []byte {
+	var buf bytes.Buffer
+	for _, ns := range dns.Nameservers {
+		fmt.Fprintf(&buf, "nameserver %s\n", ns)
+	}
+	if len(dns.Search) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(dns.Search, " "))
+	} else if dns.Domain != "" {
+		fmt.Fprintf(&buf, "domain %s\n", dns.Domain)
+	}
+	if len(dns.Options) > 0 {
+		fmt.Fprintf(&buf, "options %s\n", strings.Join(dns.Options, " "))
+	}
+	return buf.Bytes()
+}
+
+// openParentInRoot opens the directory holding path below root and
+// returns it along with the last element of path. No symlink is followed
+// on the way: the plugin runs on the host, so an absolute link in the
+// container image would resolve against the host's root filesystem.
+func openParentInRoot(root, path string) (int, string, error) {
+	elems := strings.Split(strings.TrimPrefix(filepath.Clean("/"+path), "/"), "/")
+	name := elems[len(elems)-1]
+	if name == "" {
+		return -1, "", fmt.Errorf("invalid path %q", path)
+	}
+
+	dirfd, err := syscall.Open(root, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, "", fmt.Errorf("failed to open %s: %v", root, err)
+	}
+	for _, elem := range elems[:len(elems)-1] {
+		fd, err := syscall.Openat(dirfd, elem, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		syscall.Close(dirfd)
+		if err != nil {
+			return -1, "", &os.PathError{Op: "open", Path: path, Err: err}
+		}
+		dirfd = fd
+	}
+	return dirfd, name, nil
+}
+
+// writeResolvConf writes the DNS settings to path inside the container.
+// path must not be or go through a symlink.
+func writeResolvConf(netnsPath, path string, dns types.DNS) error {
+	root, err := containerRoot(netnsPath)
+	if err != nil {
+		return err
+	}
+
+	dirfd, name, err := openParentInRoot(root, path)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	defer syscall.Close(dirfd)
+
+	// O_NONBLOCK keeps a FIFO from blocking the plugin, anything but a
+	// regular file is refused below
+	fd, err := syscall.Openat(dirfd, name, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_NOFOLLOW|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	f := os.NewFile(uintptr(fd), path)
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("failed to write %s: not a regular file", path)
+	}
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if _, err := f.Write(formatResolvConf(dns)); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// removeResolvConf undoes the effects of writeResolvConf. A symlink at
+// path is removed itself, never its target.
+func removeResolvConf(netnsPath, path string) error {
+	root, err := containerRoot(netnsPath)
+	if err != nil {
+		return err
+	}
+
+	dirfd, name, err := openParentInRoot(root, path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove %s: %v", path, err)
+	}
+	defer syscall.Close(dirfd)
+
+	if err := syscall.Unlinkat(dirfd, name); err != nil && err != syscall.ENOENT {
+		return fmt.Errorf("failed to remove %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,415 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+)
+
+// maxNFLOGPrefixLen is the longest prefix accepted by the NFLOG target
+const maxNFLOGPrefixLen = 64
+
+// deleteRule deletes rule from chain if it is there, so that a repeated
+// DEL, or the DEL of a container added before the rule existed, succeeds
+func deleteRule(ipt *iptables.IPTables, table, chain string, rule ...string) error {
+	exists, err := ipt.Exists(table, chain, rule...)
+	if err != nil || !exists {
+		return err
+	}
+	return ipt.Delete(table, chain, rule...)
+}
+
+func nflogRules(n *NetConf, ip net.IP, comment string) [][]string {
+	target := []string{"-j", "NFLOG", "--nflog-group", strconv.Itoa(int(n.NFLOGGroup))}
+	if n.NFLOGPrefix != "" {
+		target = append(target, "--nflog-prefix", n.NFLOGPrefix)
+	}
+	target = append(target, "-m", "comment", "--comment", comment)
+
+	host := ip.String() + "/32"
+	return [][]string{
+		append([]string{"-s", host}, target...),
+		append([]string{"-d", host}, target...),
+	}
+}
+
+// setupNFLOG sends a copy of all traffic forwarded to and from the
+// container to the configured netfilter log group
+func setupNFLOG(n *NetConf, ip net.IP, comment string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	for _, rule := range nflogRules(n, ip, comment) {
+		if err := ipt.AppendUnique("filter", "FORWARD", rule...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// teardownNFLOG undoes the effects of setupNFLOG
+func teardownNFLOG(n *NetConf, ip net.IP, comment string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	for _, rule := range nflogRules(n, ip, comment) {
+		if err := deleteRule(ipt, "filter", "FORWARD", rule...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ctHelper is a connection tracking helper: the protocol of the
+// connections it follows and the kernel module providing it
+type ctHelper struct {
+	proto  string
+	module string
+}
+
+// ctHelpers are the connection tracking helpers of the kernel, by name
+var ctHelpers = map[string]ctHelper{
+	"amanda":     {"udp", "nf_conntrack_amanda"},
+	"ftp":        {"tcp", "nf_conntrack_ftp"},
+	"irc":        {"tcp", "nf_conntrack_irc"},
+	"netbios-ns": {"udp", "nf_conntrack_netbios_ns"},
+	"pptp":       {"tcp", "nf_conntrack_pptp"},
+	"Q.931":      {"tcp", "nf_conntrack_h323"},
+	"RAS":        {"udp", "nf_conntrack_h323"},
+	"sane":       {"tcp", "nf_conntrack_sane"},
+	"sip":        {"udp", "nf_conntrack_sip"},
+	"snmp":       {"udp", "nf_conntrack_snmp"},
+	"tftp":       {"udp", "nf_conntrack_tftp"},
+}
+
+// ctHelperRules returns the raw/PREROUTING rules assigning the helpers to
+// the connections of the container, whichever side opens them. The CT
+// target requires the protocol of the helper to be matched.
+func ctHelperRules(helpers []string, ip net.IP, comment string) [][]string {
+	host := ip.String() + "/32"
+	var rules [][]string
+	for _, name := range helpers {
+		target := []string{"-p", ctHelpers[name].proto, "-j", "CT", "--helper", name, "-m", "comment", "--comment", comment}
+		rules = append(rules,
+			append([]string{"-s", host}, target...),
+			append([]string{"-d", host}, target...),
+		)
+	}
+	return rules
+}
+
+// setupCTHelpers lets the connection tracking helpers follow the
+// connections of the container, so that protocols opening related
+// connections, like FTP, work through NAT
+func setupCTHelpers(helpers []string, ip net.IP, comment string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	for _, rule := range ctHelperRules(helpers, ip, comment) {
+		if err := ipt.AppendUnique("raw", "PREROUTING", rule...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// teardownCTHelpers undoes the effects of setupCTHelpers
+func teardownCTHelpers(helpers []string, ip net.IP, comment string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	for _, rule := range ctHelperRules(helpers, ip, comment) {
+		if err := deleteRule(ipt, "raw", "PREROUTING", rule...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dscpClearRule matches traffic sent by the container into the bridge
+// and zeroes its DSCP bits
+func dscpClearRule(brName string, ip net.IP, comment string) []string {
+	return []string{
+		"-i", brName,
+		"-s", ip.String() + "/32",
+		"-j", "DSCP", "--set-dscp", "0",
+		"-m", "comment", "--comment", comment,
+	}
+}
+
+// setupDSCPClear stops the container from raising the priority of its
+// traffic by marking it with a DSCP codepoint
+func setupDSCPClear(brName string, ip net.IP, comment string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	return ipt.AppendUnique("mangle", "PREROUTING", dscpClearRule(brName, ip, comment)...)
+}
+
+// teardownDSCPClear undoes the effects of setupDSCPClear
+func teardownDSCPClear(brName string, ip net.IP, comment string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	return deleteRule(ipt, "mangle", "PREROUTING", dscpClearRule(brName, ip, comment)...)
+}
+
+// connmarkRules returns the mangle rules marking the connections of the
+// container: PREROUTING marks its packets and saves the mark on the
+// connection, OUTPUT restores it on the packets the host sends back
+func connmarkRules(ip net.IP, mark uint32, comment string) (preRouting [][]string, output [][]string) {
+	host := ip.String() + "/32"
+	spec := markSpec(MarkRoute{Mark: mark})
+	preRouting = [][]string{
+		{"-s", host, "-j", "MARK", "--set-mark", spec, "-m", "comment", "--comment", comment},
+		{"-s", host, "-j", "CONNMARK", "--save-mark", "-m", "comment", "--comment", comment},
+	}
+	output = [][]string{
+		{"-d", host, "-j", "CONNMARK", "--restore-mark", "-m", "comment", "--comment", comment},
+	}
+	return preRouting, output
+}
+
+// connmarkRoute is the policy routing rule sending the marked traffic to
+// the connmark table
+func connmarkRoute(n *NetConf) MarkRoute {
+	return MarkRoute{Mark: n.ConnmarkMark, TableID: n.ConnmarkTable}
+}
+
+// setupConnmark routes the connections of the container, in both
+// directions, using the connmark table
+func setupConnmark(n *NetConf, ip net.IP, comment string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	preRouting, output := connmarkRules(ip, n.ConnmarkMark, comment)
+	for _, rule := range preRouting {
+		if err := ipt.AppendUnique("mangle", "PREROUTING", rule...); err != nil {
+			return err
+		}
+	}
+	for _, rule := range output {
+		if err := ipt.AppendUnique("mangle", "OUTPUT", rule...); err != nil {
+			return err
+		}
+	}
+
+	return ensureMarkRule(connmarkRoute(n))
+}
+
+// teardownConnmark undoes the effects of setupConnmark. The policy
+// routing rule is only removed once no container uses the mark anymore.
+func teardownConnmark(n *NetConf, ip net.IP, comment string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	preRouting, output := connmarkRules(ip, n.ConnmarkMark, comment)
+	for _, rule := range preRouting {
+		if err := deleteRule(ipt, "mangle", "PREROUTING", rule...); err != nil {
+			return err
+		}
+	}
+	for _, rule := range output {
+		if err := deleteRule(ipt, "mangle", "OUTPUT", rule...); err != nil {
+			return err
+		}
+	}
+
+	return releaseMarkRules(ipt, []MarkRoute{connmarkRoute(n)})
+}
+
+// routeMarkRoute is the policy routing rule sending the traffic marked
+// by routeMarkRule to the routeMarkTable
+func routeMarkRoute(n *NetConf) MarkRoute {
+	return MarkRoute{Mark: n.RouteMark, Mask: n.RouteMarkMask, TableID: n.RouteMarkTable}
+}
+
+// routeMarkRule returns the mangle/PREROUTING rule marking all traffic
+// the host routes from the bridge
+func routeMarkRule(n *NetConf) []string {
+	return []string{"-i", n.BrName, "-j", "MARK", "--set-mark", markSpec(routeMarkRoute(n))}
+}
+
+// setupRouteMark policy routes the traffic of all the containers on the
+// bridge. Like the bridge itself, the rules are shared by the containers
+// and are left in place when they are deleted.
+func setupRouteMark(n *NetConf) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	if err := ipt.AppendUnique("mangle", "PREROUTING", routeMarkRule(n)...); err != nil {
+		return err
+	}
+	return ensureMarkRule(routeMarkRoute(n))
+}
+
+// wireGuardForwardRules returns the filter/FORWARD rules letting the
+// container traffic through between the bridge and the WireGuard interface
+func wireGuardForwardRules(n *NetConf, ip net.IP, comment string) [][]string {
+	host := ip.String() + "/32"
+	return [][]string{
+		{"-i", n.BrName, "-o", n.WireGuardIface, "-s", host, "-j", "ACCEPT", "-m", "comment", "--comment", comment},
+		{"-i", n.WireGuardIface, "-o", n.BrName, "-d", host, "-j", "ACCEPT", "-m", "comment", "--comment", comment},
+	}
+}
+
+// wireGuardMasqRule masquerades the container traffic leaving through the
+// WireGuard interface to the address of that interface
+func wireGuardMasqRule(n *NetConf, ip net.IP, comment string) []string {
+	return []string{"-s", ip.String() + "/32", "-o", n.WireGuardIface, "-j", "MASQUERADE", "-m", "comment", "--comment", comment}
+}
+
+// setupWireGuardForward lets the container reach the VPN behind the
+// WireGuard interface
+func setupWireGuardForward(n *NetConf, ip net.IP, comment string) error {
+	if _, err := netlink.LinkByName(n.WireGuardIface); err != nil {
+		return fmt.Errorf("failed to lookup WireGuard interface %q: %v", n.WireGuardIface, err)
+	}
+
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	for _, rule := range wireGuardForwardRules(n, ip, comment) {
+		if err := ipt.AppendUnique("filter", "FORWARD", rule...); err != nil {
+			return err
+		}
+	}
+	if n.WireGuardMasq {
+		return ipt.AppendUnique("nat", "POSTROUTING", wireGuardMasqRule(n, ip, comment)...)
+	}
+	return nil
+}
+
+// teardownWireGuardForward undoes the effects of setupWireGuardForward
+func teardownWireGuardForward(n *NetConf, ip net.IP, comment string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	for _, rule := range wireGuardForwardRules(n, ip, comment) {
+		if err := deleteRule(ipt, "filter", "FORWARD", rule...); err != nil {
+			return err
+		}
+	}
+	if n.WireGuardMasq {
+		return deleteRule(ipt, "nat", "POSTROUTING", wireGuardMasqRule(n, ip, comment)...)
+	}
+	return nil
+}
+
+// forwardLimitRules returns the filter/FORWARD rules, in order, enforcing
+// the byte quota and the ICMP echo request rate limit of the container.
+// The quota is checked first, so that every packet counts against it,
+// pings included. Traffic within the quota is accepted last, after the
+// rate limit had its say.
+func forwardLimitRules(ip net.IP, quota uint64, pps int, comment string) [][]string {
+	host := ip.String() + "/32"
+	withComment := func(rule ...string) []string {
+		return append(rule, "-m", "comment", "--comment", comment)
+	}
+
+	var rules [][]string
+	if quota > 0 {
+		// counts the bytes while the quota lasts, matches once it is used up
+		rules = append(rules, withComment("-s", host, "-m", "quota", "!", "--quota", strconv.FormatUint(quota, 10), "-j", "DROP"))
+	}
+	if pps > 0 {
+		rules = append(rules,
+			withComment("-s", host, "-p", "icmp", "--icmp-type", "echo-request", "-m", "limit", "--limit", strconv.Itoa(pps)+"/sec", "-j", "ACCEPT"),
+			withComment("-s", host, "-p", "icmp", "--icmp-type", "echo-request", "-j", "DROP"),
+		)
+	}
+	if quota > 0 {
+		rules = append(rules, withComment("-s", host, "-j", "ACCEPT"))
+	}
+	return rules
+}
+
+// setupForwardLimits caps the traffic the container can send through the
+// host and the pings among it. The rules go at the top of FORWARD so that
+// no other rule accepts the traffic first. The byte counter of the quota
+// lives in the kernel, so usage is tracked until the rules are deleted.
+func setupForwardLimits(ip net.IP, quota uint64, pps int, comment string) error {
+	return insertForwardRules(forwardLimitRules(ip, quota, pps, comment))
+}
+
+// insertForwardRules inserts the missing rules at the top of FORWARD,
+// keeping their order
+func insertForwardRules(rules [][]string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	for i := len(rules) - 1; i >= 0; i-- {
+		exists, err := ipt.Exists("filter", "FORWARD", rules[i]...)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if err := ipt.Insert("filter", "FORWARD", 1, rules[i]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteForwardRules deletes rules from FORWARD
+func deleteForwardRules(rules [][]string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	for _, rule := range rules {
+		if err := deleteRule(ipt, "filter", "FORWARD", rule...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// teardownForwardLimits undoes the effects of setupForwardLimits
+func teardownForwardLimits(ip net.IP, quota uint64, pps int, comment string) error {
+	return deleteForwardRules(forwardLimitRules(ip, quota, pps, comment))
+}
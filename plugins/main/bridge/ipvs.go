@@ -0,0 +1,66 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ipvsadm runs the ipvsadm command; tests replace it to check the
+// arguments without touching the host IPVS tables
+var ipvsadm = func(args ...string) error {
+	out, err := exec.Command("ipvsadm", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ipvsadm %s failed: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+// ipvsRealServer returns the real server address of the container: its
+// IP and the port of the virtual service
+func ipvsRealServer(n *NetConf, ip net.IP) string {
+	_, port, _ := net.SplitHostPort(n.IPVSVirtualService)
+	return net.JoinHostPort(ip.String(), port)
+}
+
+// ipvsWeight returns the configured weight, defaulting to ipvsadm's 1
+func ipvsWeight(n *NetConf) int {
+	if n.IPVSWeight == 0 {
+		return 1
+	}
+	return n.IPVSWeight
+}
+
+// addIPVSRealServer adds the container as a masqueraded real server of
+// the virtual service
+func addIPVSRealServer(n *NetConf, ip net.IP) error {
+	err := ipvsadm("-a", "-t", n.IPVSVirtualService, "-r", ipvsRealServer(n, ip), "-m", "-w", strconv.Itoa(ipvsWeight(n)))
+	if err != nil {
+		return fmt.Errorf("failed to add IPVS real server: %v", err)
+	}
+	return nil
+}
+
+// delIPVSRealServer removes the container from the virtual service
+func delIPVSRealServer(n *NetConf, ip net.IP) error {
+	if err := ipvsadm("-d", "-t", n.IPVSVirtualService, "-r", ipvsRealServer(n, ip)); err != nil {
+		return fmt.Errorf("failed to delete IPVS real server: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// nftTable is the nftables table holding the sets of the bridge plugin
+const nftTable = "cni"
+
+// nft runs the nft command; tests replace it to check the arguments
+// without touching the host nftables ruleset
+var nft = func(args ...string) error {
+	out, err := exec.Command("nft", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nft %s failed: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+// nftExpireSet returns the name of the set of container addresses of the
+// bridge, whose entries expire after nftablesAutoExpireTTL
+func nftExpireSet(n *NetConf) string {
+	return "expire-" + n.BrName
+}
+
+// nftExpireCommands returns the nft commands adding ip to the expiring
+// set, creating the table and set if needed
+func nftExpireCommands(n *NetConf, ip net.IP) [][]string {
+	timeout := fmt.Sprintf("%ds", n.NFTablesExpireTTL)
+	set := nftExpireSet(n)
+	return [][]string{
+		{"add", "table", "ip", nftTable},
+		{"add", "set", "ip", nftTable, set, "{ type ipv4_addr; flags timeout; timeout " + timeout + "; }"},
+		{"add", "element", "ip", nftTable, set, "{ " + ip.String() + " timeout " + timeout + " }"},
+	}
+}
+
+// addNFTExpireElement adds the container address to the expiring set, so
+// that it goes away after the TTL even if DEL is never called
+func addNFTExpireElement(n *NetConf, ip net.IP) error {
+	for _, args := range nftExpireCommands(n, ip) {
+		if err := nft(args...); err != nil {
+			return fmt.Errorf("failed to add %v to nftables set %q: %v", ip, nftExpireSet(n), err)
+		}
+	}
+	return nil
+}
+
+// delNFTExpireElement removes the container address from the expiring
+// set, unless it already expired
+func delNFTExpireElement(n *NetConf, ip net.IP) error {
+	err := nft("delete", "element", "ip", nftTable, nftExpireSet(n), "{ "+ip.String()+" }")
+	if err != nil && !strings.Contains(err.Error(), "No such file or directory") {
+		return fmt.Errorf("failed to delete %v from nftables set %q: %v", ip, nftExpireSet(n), err)
+	}
+	return nil
+}
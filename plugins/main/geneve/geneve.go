@@ -0,0 +1,442 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/ipam"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// GENEVE attributes from linux/if_link.h; the vendored netlink
+// package does not know about geneve links.
+const (
+	iflaGeneveID              = 1
+	iflaGeneveRemote          = 2
+	iflaGeneveTTL             = 3
+	iflaGeneveTOS             = 4
+	iflaGeneveCollectMetadata = 6
+	iflaGeneveRemote6         = 7
+
+	maxVNI = 1<<24 - 1
+)
+
+// tc attributes from linux/pkt_sched.h, linux/pkt_cls.h and
+// linux/tc_act/tc_tunnel_key.h; the vendored netlink package has no
+// support for clsact qdiscs or tunnel_key actions.
+const (
+	tcHClsact     = 0xfffffff1
+	tcHMinEgress  = 0xfff3
+	tcaActKind    = 1
+	tcaActOptions = 2
+
+	tcaTunnelKeyParms       = 2
+	tcaTunnelKeyEncIPv4Dst  = 4
+	tcaTunnelKeyEncIPv6Dst  = 6
+	tcaTunnelKeyEncKeyID    = 7
+	tcaTunnelKeyEncOpts     = 11
+	tcaTunnelKeyEncTOS      = 14
+	tcaTunnelKeyEncTTL      = 15
+	tcaTunnelKeyEncOptsGnv  = 1
+	tcaTunnelKeyEncOptClass = 1
+	tcaTunnelKeyEncOptType  = 2
+	tcaTunnelKeyEncOptData  = 3
+
+	tcaTunnelKeyActSet = 1
+	// struct tc_tunnel_key is a struct tc_gen and the tunnel key action
+	sizeofTcTunnelKey = 24
+
+	// the GENEVE header has a 6 bit length of the options in 4 byte words
+	maxGeneveOptsLen = 63 * 4
+	geneveOptHdrLen  = 4
+)
+
+// GeneveOpt is a GENEVE option (TLV) added to every packet sent through
+// the tunnel. Data is base64 encoded in JSON, and its length must be a
+// multiple of 4 bytes.
+type GeneveOpt struct {
+	Class uint16 `json:"class"`
+	Type  uint8  `json:"type"`
+	Data  []byte `json:"data"`
+}
+
+type NetConf struct {
+	types.NetConf
+	VNI         int    `json:"vni"`
+	RemoteIP    string `json:"remote"`
+	TTL         int    `json:"ttl"`
+	TOS         int    `json:"tos"`
+	OptionsType string `json:"optionsType"`
+	MTU         int    `json:"mtu"`
+
+	GeneveOptions []GeneveOpt `json:"geneveOptions"`
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadConf(bytes []byte) (*NetConf, error) {
+	n := &NetConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	switch n.OptionsType {
+	case "":
+		if n.VNI < 0 || n.VNI > maxVNI {
+			return nil, fmt.Errorf("invalid vni %d, must be between 0 and %d", n.VNI, maxVNI)
+		}
+		if net.ParseIP(n.RemoteIP) == nil {
+			return nil, fmt.Errorf(`"remote" field is required. It specifies the IP address of the remote tunnel endpoint`)
+		}
+	case "external":
+		// the tunnel metadata is supplied per packet
+		if n.VNI != 0 || n.RemoteIP != "" {
+			return nil, fmt.Errorf(`"vni" and "remote" can not be used with optionsType "external"`)
+		}
+	default:
+		return nil, fmt.Errorf("unknown geneve optionsType: %q", n.OptionsType)
+	}
+
+	if len(n.GeneveOptions) > 0 && n.OptionsType == "external" {
+		return nil, fmt.Errorf(`"geneveOptions" can not be used with optionsType "external"`)
+	}
+	optsLen := 0
+	for _, opt := range n.GeneveOptions {
+		if len(opt.Data)%4 != 0 {
+			return nil, fmt.Errorf("invalid data of geneve option %#x/%#x: length must be a multiple of 4", opt.Class, opt.Type)
+		}
+		optsLen += geneveOptHdrLen + len(opt.Data)
+	}
+	if optsLen > maxGeneveOptsLen {
+		return nil, fmt.Errorf("geneve options too long: %d bytes, at most %d", optsLen, maxGeneveOptsLen)
+	}
+
+	if n.TTL < 0 || n.TTL > 255 {
+		return nil, fmt.Errorf("invalid ttl %d", n.TTL)
+	}
+	if n.TOS < 0 || n.TOS > 255 {
+		return nil, fmt.Errorf("invalid tos %d", n.TOS)
+	}
+	return n, nil
+}
+
+// addGeneve creates a geneve link named name in the netns referred to by nsFd.
+// The tunnel socket stays in the current netns.
+func addGeneve(conf *NetConf, name string, nsFd int) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	req.AddData(nl.NewIfInfomsg(syscall.AF_UNSPEC))
+	req.AddData(nl.NewRtAttr(syscall.IFLA_IFNAME, nl.ZeroTerminated(name)))
+	if conf.MTU > 0 {
+		req.AddData(nl.NewRtAttr(syscall.IFLA_MTU, nl.Uint32Attr(uint32(conf.MTU))))
+	}
+	req.AddData(nl.NewRtAttr(nl.IFLA_NET_NS_FD, nl.Uint32Attr(uint32(nsFd))))
+
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.NonZeroTerminated("geneve"))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+
+	// the options can only be set per packet, see setupGeneveOptions
+	if conf.OptionsType == "external" || len(conf.GeneveOptions) > 0 {
+		nl.NewRtAttrChild(data, iflaGeneveCollectMetadata, []byte{})
+	} else {
+		nl.NewRtAttrChild(data, iflaGeneveID, nl.Uint32Attr(uint32(conf.VNI)))
+
+		remote := net.ParseIP(conf.RemoteIP)
+		if remote4 := remote.To4(); remote4 != nil {
+			nl.NewRtAttrChild(data, iflaGeneveRemote, []byte(remote4))
+		} else {
+			nl.NewRtAttrChild(data, iflaGeneveRemote6, []byte(remote.To16()))
+		}
+	}
+	if conf.TTL > 0 {
+		nl.NewRtAttrChild(data, iflaGeneveTTL, nl.Uint8Attr(uint8(conf.TTL)))
+	}
+	if conf.TOS > 0 {
+		nl.NewRtAttrChild(data, iflaGeneveTOS, nl.Uint8Attr(uint8(conf.TOS)))
+	}
+	req.AddData(linkInfo)
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// setupGeneveOptions makes every packet sent through the geneve link carry
+// the GENEVE options of conf. Linux only takes options from the metadata
+// of packets, so the link is in external mode and an egress filter sets
+// the VNI, remote, TTL, TOS and options of packets.
+// Equivalent to: `tc qdisc add dev $link clsact; tc filter add dev $link
+// egress prio 1 protocol all u32 match u32 0 0 action tunnel_key set id
+// $vni dst_ip $remote ttl $ttl tos $tos geneve_opts $class:$type:$data`
+func setupGeneveOptions(conf *NetConf, link netlink.Link) error {
+	clsact := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    tcHClsact,
+		},
+		QdiscType: "clsact",
+	}
+	if err := netlink.QdiscAdd(clsact); err != nil {
+		return fmt.Errorf("failed to add clsact qdisc to %q: %v", link.Attrs().Name, err)
+	}
+
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWTFILTER, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(link.Attrs().Index),
+		Parent:  netlink.MakeHandle(0xffff, tcHMinEgress),
+		Info:    netlink.MakeHandle(1, nl.Swap16(syscall.ETH_P_ALL)),
+	})
+	req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("u32")))
+
+	options := nl.NewRtAttr(nl.TCA_OPTIONS, nil)
+	// match all
+	sel := nl.TcU32Sel{
+		Nkeys: 1,
+		Flags: nl.TC_U32_TERMINAL,
+		Keys:  []nl.TcU32Key{{}},
+	}
+	nl.NewRtAttrChild(options, nl.TCA_U32_SEL, sel.Serialize())
+
+	acts := nl.NewRtAttrChild(options, nl.TCA_U32_ACT, nil)
+	act := nl.NewRtAttrChild(acts, 1, nil)
+	nl.NewRtAttrChild(act, tcaActKind, nl.ZeroTerminated("tunnel_key"))
+	actOpts := nl.NewRtAttrChild(act, tcaActOptions, nil)
+	parms := make([]byte, sizeofTcTunnelKey)
+	nl.NativeEndian().PutUint32(parms[8:], nl.TC_ACT_PIPE)
+	nl.NativeEndian().PutUint32(parms[20:], tcaTunnelKeyActSet)
+	nl.NewRtAttrChild(actOpts, tcaTunnelKeyParms, parms)
+
+	vni := make([]byte, 4)
+	binary.BigEndian.PutUint32(vni, uint32(conf.VNI))
+	nl.NewRtAttrChild(actOpts, tcaTunnelKeyEncKeyID, vni)
+	remote := net.ParseIP(conf.RemoteIP)
+	if remote4 := remote.To4(); remote4 != nil {
+		nl.NewRtAttrChild(actOpts, tcaTunnelKeyEncIPv4Dst, []byte(remote4))
+	} else {
+		nl.NewRtAttrChild(actOpts, tcaTunnelKeyEncIPv6Dst, []byte(remote.To16()))
+	}
+	if conf.TTL > 0 {
+		nl.NewRtAttrChild(actOpts, tcaTunnelKeyEncTTL, nl.Uint8Attr(uint8(conf.TTL)))
+	}
+	if conf.TOS > 0 {
+		nl.NewRtAttrChild(actOpts, tcaTunnelKeyEncTOS, nl.Uint8Attr(uint8(conf.TOS)))
+	}
+
+	encOpts := nl.NewRtAttrChild(actOpts, tcaTunnelKeyEncOpts|syscall.NLA_F_NESTED, nil)
+	for _, opt := range conf.GeneveOptions {
+		gnv := nl.NewRtAttrChild(encOpts, tcaTunnelKeyEncOptsGnv|syscall.NLA_F_NESTED, nil)
+		class := make([]byte, 2)
+		binary.BigEndian.PutUint16(class, opt.Class)
+		nl.NewRtAttrChild(gnv, tcaTunnelKeyEncOptClass, class)
+		nl.NewRtAttrChild(gnv, tcaTunnelKeyEncOptType, nl.Uint8Attr(opt.Type))
+		nl.NewRtAttrChild(gnv, tcaTunnelKeyEncOptData, opt.Data)
+	}
+	req.AddData(options)
+
+	if _, err := req.Execute(syscall.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("failed to add geneve options filter to %q: %v", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// geneveOptions returns the GENEVE options set by the egress filter of
+// the link
+func geneveOptions(link netlink.Link) ([]GeneveOpt, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETTFILTER, syscall.NLM_F_DUMP)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(link.Attrs().Index),
+		Parent:  netlink.MakeHandle(0xffff, tcHMinEgress),
+	})
+
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWTFILTER)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []GeneveOpt
+	for _, m := range msgs {
+		msg := nl.DeserializeTcMsg(m)
+		// each level of attributes down to the options of the action
+		path := []uint16{nl.TCA_OPTIONS, nl.TCA_U32_ACT, 1, tcaActOptions, tcaTunnelKeyEncOpts}
+		encOpts, err := nestedAttr(m[msg.Len():], path)
+		if err != nil {
+			return nil, err
+		}
+		if encOpts == nil {
+			continue
+		}
+
+		gnvs, err := nl.ParseRouteAttr(encOpts)
+		if err != nil {
+			return nil, err
+		}
+		for _, gnv := range gnvs {
+			attrs, err := nl.ParseRouteAttr(gnv.Value)
+			if err != nil {
+				return nil, err
+			}
+			opt := GeneveOpt{}
+			for _, attr := range attrs {
+				switch attr.Attr.Type {
+				case tcaTunnelKeyEncOptClass:
+					opt.Class = binary.BigEndian.Uint16(attr.Value)
+				case tcaTunnelKeyEncOptType:
+					opt.Type = attr.Value[0]
+				case tcaTunnelKeyEncOptData:
+					opt.Data = attr.Value
+				}
+			}
+			opts = append(opts, opt)
+		}
+	}
+	return opts, nil
+}
+
+// nestedAttr returns the value of the attribute at path in the attributes
+// b, or nil if there is none
+func nestedAttr(b []byte, path []uint16) ([]byte, error) {
+	for _, typ := range path {
+		attrs, err := nl.ParseRouteAttr(b)
+		if err != nil {
+			return nil, err
+		}
+		b = nil
+		for _, attr := range attrs {
+			if attr.Attr.Type&^syscall.NLA_F_NESTED == typ {
+				b = attr.Value
+				break
+			}
+		}
+		if b == nil {
+			return nil, nil
+		}
+	}
+	return b, nil
+}
+
+func createGeneve(conf *NetConf, ifName string, netns ns.NetNS) error {
+	// create with a temporary name so that it does not collide
+	// with an interface of the same name on the host
+	tmpName, err := ip.RandomVethName()
+	if err != nil {
+		return err
+	}
+
+	if err := addGeneve(conf, tmpName, int(netns.Fd())); err != nil {
+		return fmt.Errorf("failed to create geneve: %v", err)
+	}
+
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(tmpName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", tmpName, err)
+		}
+
+		if err := netlink.LinkSetName(link, ifName); err != nil {
+			_ = netlink.LinkDel(link)
+			return fmt.Errorf("failed to rename geneve to %q: %v", ifName, err)
+		}
+
+		if len(conf.GeneveOptions) > 0 {
+			if link, err = netlink.LinkByName(ifName); err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+			}
+			if err := setupGeneveOptions(conf, link); err != nil {
+				_ = netlink.LinkDel(link)
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	if err = createGeneve(n, args.IfName, netns); err != nil {
+		return err
+	}
+
+	// run the IPAM plugin and get back the config to apply
+	result, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+	if err != nil {
+		return err
+	}
+	if result.IP4 == nil {
+		return errors.New("IPAM plugin returned missing IPv4 config")
+	}
+
+	err = netns.Do(func(_ ns.NetNS) error {
+		return ipam.ConfigureIfaceWithOptions(args.IfName, result, ipam.Options{SkipConflictCheck: n.IPAM.SkipConflictCheck, AddressScope: n.AddressScope})
+	})
+	if err != nil {
+		return err
+	}
+
+	result.DNS = n.DNS
+	return args.PrintResult(result)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	err = ipam.ExecDel(n.IPAM.Type, args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return ip.DelLinkByName(args.IfName)
+	})
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdDel)
+}
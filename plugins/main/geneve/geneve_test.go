@@ -0,0 +1,133 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("geneve Operations", func() {
+	var originalNS ns.NetNS
+
+	BeforeEach(func() {
+		// Create a new NetNS so we don't modify the host
+		var err error
+		originalNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+	})
+
+	It("requires a remote endpoint", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "geneve", "vni": 42}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects an out of range vni", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "geneve", "vni": 16777216, "remote": "10.0.0.2"}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects an unknown optionsType", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "geneve", "remote": "10.0.0.2", "optionsType": "foo"}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects geneve options whose data is not a multiple of 4 bytes", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "geneve", "remote": "10.0.0.2",
+			"geneveOptions": [{"class": 258, "type": 1, "data": "AQID"}]}`))
+		Expect(err).To(MatchError("invalid data of geneve option 0x102/0x1: length must be a multiple of 4"))
+	})
+
+	It("rejects geneve options with optionsType external", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "geneve", "optionsType": "external",
+			"geneveOptions": [{"class": 258, "type": 1, "data": "AQIDBA=="}]}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("sets the geneve options of packets sent through the link", func() {
+		conf, err := loadConf([]byte(`{"name": "mynet", "type": "geneve", "vni": 42, "remote": "10.0.0.2",
+			"geneveOptions": [{"class": 258, "type": 1, "data": "AQIDBA=="}, {"class": 259, "type": 2, "data": "AAAAAAAAAAE="}]}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			return createGeneve(conf, "foobar0", targetNs)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName("foobar0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(geneveOptions(link)).To(Equal([]GeneveOpt{
+				{Class: 258, Type: 1, Data: []byte{1, 2, 3, 4}},
+				{Class: 259, Type: 2, Data: []byte{0, 0, 0, 0, 0, 0, 0, 1}},
+			}))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("creates a geneve link in a non-default namespace", func() {
+		conf := &NetConf{
+			NetConf: types.NetConf{
+				Name: "testConfig",
+				Type: "geneve",
+			},
+			VNI:      42,
+			RemoteIP: "10.0.0.2",
+			TTL:      64,
+			MTU:      1400,
+		}
+
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			return createGeneve(conf, "foobar0", targetNs)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Make sure geneve link exists in the target namespace
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName("foobar0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Type()).To(Equal("geneve"))
+			Expect(link.Attrs().MTU).To(Equal(1400))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,273 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/ipam"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// GRE attributes from linux/if_tunnel.h; the vendored netlink package
+// does not know about gre and gretap links.
+const (
+	iflaGreIFlags     = 2
+	iflaGreOFlags     = 3
+	iflaGreIKey       = 4
+	iflaGreOKey       = 5
+	iflaGreLocal      = 6
+	iflaGreRemote     = 7
+	iflaGreTTL        = 8
+	iflaGreEncapType  = 14
+	iflaGreEncapSport = 16
+	iflaGreEncapDport = 17
+
+	greKey = 0x2000
+
+	tunnelEncapFOU = 1
+	tunnelEncapGUE = 2
+)
+
+// Encap is the UDP encapsulation of the GRE packets, for networks that
+// only pass UDP. The host needs a fou or gue receive port on DPort.
+type Encap struct {
+	Type  string `json:"type"`
+	SPort int    `json:"sport"`
+	DPort int    `json:"dport"`
+}
+
+type NetConf struct {
+	types.NetConf
+	// TunnelType is "gre" for an L3 tunnel or "gretap" for an L2 one
+	TunnelType string  `json:"tunnelType"`
+	Local      string  `json:"local"`
+	Remote     string  `json:"remote"`
+	TTL        int     `json:"ttl"`
+	Key        *uint32 `json:"key"`
+	Encap      *Encap  `json:"encap"`
+	MTU        int     `json:"mtu"`
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadConf(bytes []byte) (*NetConf, error) {
+	n := &NetConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	switch n.TunnelType {
+	case "":
+		n.TunnelType = "gre"
+	case "gre", "gretap":
+	default:
+		return nil, fmt.Errorf("unknown tunnelType %q, must be gre or gretap", n.TunnelType)
+	}
+	if err := checkEndpoint("local", n.Local); err != nil {
+		return nil, err
+	}
+	if err := checkEndpoint("remote", n.Remote); err != nil {
+		return nil, err
+	}
+	if n.TTL < 0 || n.TTL > 255 {
+		return nil, fmt.Errorf("invalid ttl %d", n.TTL)
+	}
+	if n.Encap != nil {
+		if _, err := encapType(n.Encap.Type); err != nil {
+			return nil, err
+		}
+		if n.Encap.SPort < 0 || n.Encap.SPort > 65535 {
+			return nil, fmt.Errorf("invalid encap sport %d", n.Encap.SPort)
+		}
+		if n.Encap.DPort < 1 || n.Encap.DPort > 65535 {
+			return nil, fmt.Errorf("invalid encap dport %d", n.Encap.DPort)
+		}
+	}
+	return n, nil
+}
+
+// checkEndpoint returns an error if addr is not a routable IPv4 address:
+// not loopback, link-local, multicast, broadcast or unspecified
+func checkEndpoint(field, addr string) error {
+	ipAddr := net.ParseIP(addr).To4()
+	if ipAddr == nil || !ipAddr.IsGlobalUnicast() || ipAddr.Equal(net.IPv4bcast) {
+		return fmt.Errorf("invalid %s %q, must be a routable IPv4 address", field, addr)
+	}
+	return nil
+}
+
+func encapType(s string) (uint16, error) {
+	switch s {
+	case "fou":
+		return tunnelEncapFOU, nil
+	case "gue":
+		return tunnelEncapGUE, nil
+	default:
+		return 0, fmt.Errorf("unknown encap type %q, must be fou or gue", s)
+	}
+}
+
+func be16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// addGre creates a gre or gretap link named name in the netns referred to
+// by nsFd. The tunnel stays in the current netns.
+func addGre(conf *NetConf, name string, nsFd int) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	req.AddData(nl.NewIfInfomsg(syscall.AF_UNSPEC))
+	req.AddData(nl.NewRtAttr(syscall.IFLA_IFNAME, nl.ZeroTerminated(name)))
+	if conf.MTU > 0 {
+		req.AddData(nl.NewRtAttr(syscall.IFLA_MTU, nl.Uint32Attr(uint32(conf.MTU))))
+	}
+	req.AddData(nl.NewRtAttr(nl.IFLA_NET_NS_FD, nl.Uint32Attr(uint32(nsFd))))
+
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.NonZeroTerminated(conf.TunnelType))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+
+	nl.NewRtAttrChild(data, iflaGreLocal, []byte(net.ParseIP(conf.Local).To4()))
+	nl.NewRtAttrChild(data, iflaGreRemote, []byte(net.ParseIP(conf.Remote).To4()))
+	if conf.TTL > 0 {
+		nl.NewRtAttrChild(data, iflaGreTTL, nl.Uint8Attr(uint8(conf.TTL)))
+	}
+	if conf.Key != nil {
+		nl.NewRtAttrChild(data, iflaGreIFlags, be16(greKey))
+		nl.NewRtAttrChild(data, iflaGreOFlags, be16(greKey))
+		nl.NewRtAttrChild(data, iflaGreIKey, be32(*conf.Key))
+		nl.NewRtAttrChild(data, iflaGreOKey, be32(*conf.Key))
+	}
+	if conf.Encap != nil {
+		t, _ := encapType(conf.Encap.Type)
+		nl.NewRtAttrChild(data, iflaGreEncapType, nl.Uint16Attr(t))
+		nl.NewRtAttrChild(data, iflaGreEncapSport, be16(uint16(conf.Encap.SPort)))
+		nl.NewRtAttrChild(data, iflaGreEncapDport, be16(uint16(conf.Encap.DPort)))
+	}
+	req.AddData(linkInfo)
+
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+func createGre(conf *NetConf, ifName string, netns ns.NetNS) error {
+	// create with a temporary name so that it does not collide
+	// with an interface of the same name on the host
+	tmpName, err := ip.RandomVethName()
+	if err != nil {
+		return err
+	}
+
+	if err := addGre(conf, tmpName, int(netns.Fd())); err != nil {
+		return fmt.Errorf("failed to create %s: %v", conf.TunnelType, err)
+	}
+
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(tmpName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", tmpName, err)
+		}
+
+		if err := netlink.LinkSetName(link, ifName); err != nil {
+			_ = netlink.LinkDel(link)
+			return fmt.Errorf("failed to rename %s to %q: %v", conf.TunnelType, ifName, err)
+		}
+		return nil
+	})
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	if err = createGre(n, args.IfName, netns); err != nil {
+		return err
+	}
+
+	// run the IPAM plugin and get back the config to apply
+	result, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+	if err != nil {
+		return err
+	}
+	if result.IP4 == nil {
+		return errors.New("IPAM plugin returned missing IPv4 config")
+	}
+
+	err = netns.Do(func(_ ns.NetNS) error {
+		return ipam.ConfigureIfaceWithOptions(args.IfName, result, ipam.Options{SkipConflictCheck: n.IPAM.SkipConflictCheck, AddressScope: n.AddressScope})
+	})
+	if err != nil {
+		return err
+	}
+
+	result.DNS = n.DNS
+	return args.PrintResult(result)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	err = ipam.ExecDel(n.IPAM.Type, args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return ip.DelLinkByName(args.IfName)
+	})
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdDel)
+}
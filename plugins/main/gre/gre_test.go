@@ -0,0 +1,223 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/ns"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// addAddr assigns addr to the link ifName and sets it up
+func addAddr(ifName, addr string) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return err
+	}
+	ipn, err := netlink.ParseIPNet(addr)
+	if err != nil {
+		return err
+	}
+	if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: ipn}); err != nil {
+		return err
+	}
+	return netlink.LinkSetUp(link)
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// ping sends an ICMP echo request to dst and waits for the reply
+func ping(dst string) error {
+	conn, err := net.Dial("ip4:icmp", dst)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	id := os.Getpid() & 0xffff
+	msg := []byte{8, 0, 0, 0, byte(id >> 8), byte(id), 0, 1, 'c', 'n', 'i'}
+	cs := checksum(msg)
+	msg[2], msg[3] = byte(cs>>8), byte(cs)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return err
+	}
+	reply := make([]byte, 1500)
+	for {
+		n, err := conn.Read(reply)
+		if err != nil {
+			return err
+		}
+		// the reply may or may not start with the IPv4 header
+		if n >= 20 && reply[0]>>4 == 4 {
+			hlen := int(reply[0]&0x0f) * 4
+			reply, n = reply[hlen:], n-hlen
+		}
+		if n >= 8 && reply[0] == 0 && int(reply[4])<<8|int(reply[5]) == id {
+			return nil
+		}
+		if n >= 1 && reply[0] != 8 {
+			return fmt.Errorf("unexpected ICMP type %d", reply[0])
+		}
+	}
+}
+
+var _ = Describe("gre Operations", func() {
+	var originalNS ns.NetNS
+
+	BeforeEach(func() {
+		// Create a new NetNS so we don't modify the host
+		var err error
+		originalNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+	})
+
+	It("defaults to an L3 gre tunnel", func() {
+		conf, err := loadConf([]byte(`{"name": "mynet", "type": "gre", "local": "10.0.0.1", "remote": "10.0.0.2"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.TunnelType).To(Equal("gre"))
+	})
+
+	It("rejects an unknown tunnelType", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "gre", "tunnelType": "ipip", "local": "10.0.0.1", "remote": "10.0.0.2"}`))
+		Expect(err).To(MatchError(`unknown tunnelType "ipip", must be gre or gretap`))
+	})
+
+	It("requires routable IPv4 endpoints", func() {
+		for _, endpoints := range [][2]string{
+			{"", "10.0.0.2"},
+			{"10.0.0.1", ""},
+			{"127.0.0.1", "10.0.0.2"},
+			{"10.0.0.1", "169.254.0.2"},
+			{"10.0.0.1", "224.0.0.1"},
+			{"0.0.0.0", "10.0.0.2"},
+			{"10.0.0.1", "255.255.255.255"},
+			{"10.0.0.1", "fd00::2"},
+		} {
+			_, err := loadConf([]byte(fmt.Sprintf(`{"name": "mynet", "type": "gre", "local": %q, "remote": %q}`, endpoints[0], endpoints[1])))
+			Expect(err).To(HaveOccurred(), "local %q remote %q", endpoints[0], endpoints[1])
+		}
+	})
+
+	It("rejects an out of range ttl", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "gre", "local": "10.0.0.1", "remote": "10.0.0.2", "ttl": 256}`))
+		Expect(err).To(MatchError("invalid ttl 256"))
+	})
+
+	It("validates the encapsulation", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "gre", "local": "10.0.0.1", "remote": "10.0.0.2", "encap": {"type": "vxlan", "dport": 5555}}`))
+		Expect(err).To(MatchError(`unknown encap type "vxlan", must be fou or gue`))
+
+		_, err = loadConf([]byte(`{"name": "mynet", "type": "gre", "local": "10.0.0.1", "remote": "10.0.0.2", "encap": {"type": "fou"}}`))
+		Expect(err).To(MatchError("invalid encap dport 0"))
+
+		_, err = loadConf([]byte(`{"name": "mynet", "type": "gre", "local": "10.0.0.1", "remote": "10.0.0.2", "encap": {"type": "gue", "dport": 5555}}`))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	for _, tunnelType := range []string{"gre", "gretap"} {
+		tunnelType := tunnelType
+		It(fmt.Sprintf("passes traffic through a %s tunnel between two namespaces", tunnelType), func() {
+			hostA := originalNS
+			hostB, err := ns.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+			defer hostB.Close()
+
+			contA, err := ns.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+			defer contA.Close()
+			contB, err := ns.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+			defer contB.Close()
+
+			// the underlay: a veth between hostA (10.0.0.1) and hostB (10.0.0.2)
+			err = hostA.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				hostVeth, _, err := ip.SetupVeth("eth0", 1500, hostB)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(addAddr("eth0", "10.0.0.1/24")).To(Succeed())
+
+				return hostB.Do(func(ns.NetNS) error {
+					return addAddr(hostVeth.Attrs().Name, "10.0.0.2/24")
+				})
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			key := uint32(42)
+			for _, side := range []struct {
+				host, cont    ns.NetNS
+				local, remote string
+				addr          string
+			}{
+				{hostA, contA, "10.0.0.1", "10.0.0.2", "10.1.0.1/24"},
+				{hostB, contB, "10.0.0.2", "10.0.0.1", "10.1.0.2/24"},
+			} {
+				conf := &NetConf{TunnelType: tunnelType, Local: side.local, Remote: side.remote, Key: &key}
+				cont := side.cont
+				err = side.host.Do(func(ns.NetNS) error {
+					return createGre(conf, "gre0", cont)
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				addr := side.addr
+				err = cont.Do(func(ns.NetNS) error {
+					return addAddr("gre0", addr)
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			// the tunnel itself stays in the host namespace
+			err = hostA.Do(func(ns.NetNS) error {
+				_, err := netlink.LinkByName("gre0")
+				return err
+			})
+			Expect(err).To(HaveOccurred())
+
+			err = contA.Do(func(ns.NetNS) error {
+				return ping("10.1.0.2")
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	}
+})
@@ -0,0 +1,356 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"runtime"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/ipam"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+)
+
+// pciDevicesDir is where sysfs lists the PCI devices; a var for the tests
+var pciDevicesDir = "/sys/bus/pci/devices"
+
+var pciAddrRe = regexp.MustCompile(`^[0-9a-fA-F]{4}:[0-9a-fA-F]{2}:[0-9a-fA-F]{2}\.[0-7]$`)
+
+type NetConf struct {
+	types.NetConf
+	// Device is the name or the PCI address of the host interface
+	Device string `json:"device"`
+	HWAddr string `json:"hwaddr"`
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadConf(bytes []byte) (*NetConf, error) {
+	n := &NetConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	if n.Device == "" && n.HWAddr == "" {
+		return nil, errors.New(`one of "device" or "hwaddr" must be set`)
+	}
+	if n.HWAddr != "" {
+		if _, err := net.ParseMAC(n.HWAddr); err != nil {
+			return nil, fmt.Errorf("invalid hwaddr %q: %v", n.HWAddr, err)
+		}
+	}
+	return n, nil
+}
+
+// pciDeviceName returns the name of the interface of the PCI device
+func pciDeviceName(pciAddr string) (string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(pciDevicesDir, pciAddr, "net"))
+	if err != nil {
+		return "", fmt.Errorf("failed to list the interfaces of PCI device %s: %v", pciAddr, err)
+	}
+	if len(infos) != 1 {
+		return "", fmt.Errorf("PCI device %s has %d interfaces, expected 1", pciAddr, len(infos))
+	}
+	return infos[0].Name(), nil
+}
+
+// findLink returns the host interface selected by device and hwaddr in
+// the current netns
+func findLink(n *NetConf) (netlink.Link, error) {
+	var hwAddr net.HardwareAddr
+	if n.HWAddr != "" {
+		hwAddr, _ = net.ParseMAC(n.HWAddr)
+	}
+
+	if n.Device == "" {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list links: %v", err)
+		}
+		for _, link := range links {
+			if link.Attrs().HardwareAddr.String() == hwAddr.String() {
+				return link, nil
+			}
+		}
+		return nil, fmt.Errorf("no interface with hwaddr %s", hwAddr)
+	}
+
+	name := n.Device
+	if pciAddrRe.MatchString(n.Device) {
+		var err error
+		if name, err = pciDeviceName(n.Device); err != nil {
+			return nil, err
+		}
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", name, err)
+	}
+	if hwAddr != nil && link.Attrs().HardwareAddr.String() != hwAddr.String() {
+		return nil, fmt.Errorf("interface %q has hwaddr %s, not %s", name, link.Attrs().HardwareAddr, hwAddr)
+	}
+	return link, nil
+}
+
+// moveLinkIn moves the host interface into netns as ifName. Its original
+// name is kept in the alias of the link, for moveLinkOut.
+func moveLinkIn(link netlink.Link, netns ns.NetNS, ifName string) (netlink.Link, error) {
+	name := link.Attrs().Name
+	if err := ip.LinkSetAlias(link, name); err != nil {
+		return nil, err
+	}
+	if err := netlink.LinkSetNsFd(link, int(netns.Fd())); err != nil {
+		return nil, fmt.Errorf("failed to move %q to netns: %v", name, err)
+	}
+
+	var contLink netlink.Link
+	err := netns.Do(func(hostNS ns.NetNS) error {
+		var err error
+		contLink, err = netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", name, err)
+		}
+
+		if err = netlink.LinkSetName(contLink, ifName); err != nil {
+			// give the interface back rather than strand it in the container
+			_ = netlink.LinkSetNsFd(contLink, int(hostNS.Fd()))
+			return fmt.Errorf("failed to rename %q to %q: %v", name, ifName, err)
+		}
+
+		if err = netlink.LinkSetUp(contLink); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", ifName, err)
+		}
+
+		// refresh the attributes after the rename
+		contLink, err = netlink.LinkByName(ifName)
+		return err
+	})
+	return contLink, err
+}
+
+// lookupLink returns the link called name in the current netns, or nil
+// if there is none
+func lookupLink(name string) (netlink.Link, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	for _, link := range links {
+		if link.Attrs().Name == name {
+			return link, nil
+		}
+	}
+	return nil, nil
+}
+
+// moveLinkOut moves the interface ifName of the current netns back to
+// hostNS, restoring the name it had there. An interface that is already
+// gone, moved out by an earlier DEL, is left alone.
+func moveLinkOut(ifName string, hostNS ns.NetNS) error {
+	link, err := lookupLink(ifName)
+	if err != nil || link == nil {
+		return err
+	}
+	name, err := ip.LinkAlias(link)
+	if err != nil {
+		return fmt.Errorf("failed to get the alias of %q: %v", ifName, err)
+	}
+	if name == "" {
+		return fmt.Errorf("interface %q has no alias with its original name", ifName)
+	}
+
+	if err = netlink.LinkSetDown(link); err != nil {
+		return fmt.Errorf("failed to set %q down: %v", ifName, err)
+	}
+
+	// move it under a temporary name, as ifName may be taken on the host
+	// and name may be taken in the container
+	tmpName, err := ip.RandomVethName()
+	if err != nil {
+		return err
+	}
+	if err = netlink.LinkSetName(link, tmpName); err != nil {
+		return fmt.Errorf("failed to rename %q to %q: %v", ifName, tmpName, err)
+	}
+	if err = netlink.LinkSetNsFd(link, int(hostNS.Fd())); err != nil {
+		return fmt.Errorf("failed to move %q to the host netns: %v", ifName, err)
+	}
+
+	return hostNS.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(tmpName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", tmpName, err)
+		}
+		return restoreName(link, name)
+	})
+}
+
+// restoreName renames link to name, its name on the host, and clears the
+// alias moveLinkIn set
+func restoreName(link netlink.Link, name string) error {
+	if link.Attrs().Name != name {
+		if err := netlink.LinkSetName(link, name); err != nil {
+			return fmt.Errorf("failed to rename %q to %q: %v", link.Attrs().Name, name, err)
+		}
+	}
+	return ip.LinkSetAlias(link, "")
+}
+
+// restoreReturnedLink gives back its original name to the interface of n
+// that the kernel returned to the current netns, the host one, when the
+// container netns went away. The kernel keeps the container name of the
+// interface, or picks a devN one if that is taken, but leaves the alias
+// moveLinkIn set; an interface without it was already restored.
+func restoreReturnedLink(n *NetConf) error {
+	var link netlink.Link
+	if n.Device != "" && !pciAddrRe.MatchString(n.Device) {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return fmt.Errorf("failed to list links: %v", err)
+		}
+		for _, l := range links {
+			if alias, err := ip.LinkAlias(l); err == nil && alias == n.Device {
+				link = l
+				break
+			}
+		}
+		if link == nil {
+			return nil
+		}
+	} else {
+		var err error
+		if link, err = findLink(n); err != nil {
+			return err
+		}
+	}
+
+	name, err := ip.LinkAlias(link)
+	if err != nil {
+		return fmt.Errorf("failed to get the alias of %q: %v", link.Attrs().Name, err)
+	}
+	if name == "" {
+		return nil
+	}
+	if err = netlink.LinkSetDown(link); err != nil {
+		return fmt.Errorf("failed to set %q down: %v", link.Attrs().Name, err)
+	}
+	return restoreName(link, name)
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	hostLink, err := findLink(n)
+	if err != nil {
+		return err
+	}
+
+	contLink, err := moveLinkIn(hostLink, netns, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	result := &types.Result{}
+	if n.IPAM.Type != "" {
+		// run the IPAM plugin and get back the config to apply
+		result, err = ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+		if result.IP4 == nil {
+			return errors.New("IPAM plugin returned missing IPv4 config")
+		}
+
+		err = netns.Do(func(_ ns.NetNS) error {
+			return ipam.ConfigureIfaceWithOptions(args.IfName, result, ipam.Options{SkipConflictCheck: n.IPAM.SkipConflictCheck, AddressScope: n.AddressScope})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	result.Interfaces = []types.Interface{{
+		Name:    args.IfName,
+		Mac:     contLink.Attrs().HardwareAddr.String(),
+		Sandbox: args.Netns,
+	}}
+	result.DNS = n.DNS
+	return args.PrintResult(result)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	// the device must go back to the host regardless, or it is lost
+	// along with the container netns
+	if n.IPAM.Type != "" {
+		if err = ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+			logrus.Warnf("failed to release the IPAM config of %q: %v", args.IfName, err)
+		}
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	hostNS, err := ns.GetCurrentNS()
+	if err != nil {
+		return fmt.Errorf("failed to open the host netns: %v", err)
+	}
+	defer hostNS.Close()
+
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return moveLinkOut(args.IfName, hostNS)
+	})
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		// the kernel already moved the device back along with the
+		// netns; only its name is left to restore
+		if err = restoreReturnedLink(n); err != nil {
+			logrus.Warnf("failed to restore the name of the device of %q: %v", args.IfName, err)
+		}
+		return nil
+	}
+	return err
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdDel)
+}
@@ -0,0 +1,240 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const HOST_DEV = "dev0"
+
+var _ = Describe("host-device Operations", func() {
+	var originalNS, targetNS ns.NetNS
+	var hostDev netlink.Link
+
+	BeforeEach(func() {
+		// Create a new NetNS so we don't modify the host
+		var err error
+		originalNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		targetNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: HOST_DEV},
+				PeerName:  "peer0",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			hostDev, err = netlink.LinkByName(HOST_DEV)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(targetNS.Close()).To(Succeed())
+	})
+
+	// addDel runs ADD then DEL of conf in originalNS, checking that the
+	// device is in targetNS as eth1 in between and back afterwards
+	addDel := func(conf string) {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "eth1",
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			result, err := testutils.CmdAddWithResult(targetNS.Path(), "eth1", func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces).To(HaveLen(1))
+			Expect(result.Interfaces[0].Name).To(Equal("eth1"))
+			Expect(result.Interfaces[0].Mac).To(Equal(hostDev.Attrs().HardwareAddr.String()))
+
+			_, err = netlink.LinkByName(HOST_DEV)
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName("eth1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().HardwareAddr).To(Equal(hostDev.Attrs().HardwareAddr))
+			Expect(link.Attrs().Flags & net.FlagUp).To(Equal(net.FlagUp))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := testutils.CmdDelWithResult(targetNS.Path(), "eth1", func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			link, err := netlink.LinkByName(HOST_DEV)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().HardwareAddr).To(Equal(hostDev.Attrs().HardwareAddr))
+			Expect(ip.LinkAlias(link)).To(Equal(""))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			_, err := netlink.LinkByName("eth1")
+			return err
+		})
+		Expect(err).To(HaveOccurred())
+	}
+
+	It("requires a device or hwaddr", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "host-device"}`))
+		Expect(err).To(MatchError(`one of "device" or "hwaddr" must be set`))
+
+		_, err = loadConf([]byte(`{"name": "mynet", "type": "host-device", "hwaddr": "foo"}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("moves a device selected by name in and out of the container", func() {
+		addDel(fmt.Sprintf(`{"name": "mynet", "type": "host-device", "device": %q}`, HOST_DEV))
+	})
+
+	It("moves a device selected by hwaddr in and out of the container", func() {
+		addDel(fmt.Sprintf(`{"name": "mynet", "type": "host-device", "hwaddr": %q}`, hostDev.Attrs().HardwareAddr))
+	})
+
+	It("moves a device selected by PCI address in and out of the container", func() {
+		dir, err := ioutil.TempDir("", "host-device")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		Expect(os.MkdirAll(filepath.Join(dir, "0000:03:00.1", "net", HOST_DEV), 0755)).To(Succeed())
+
+		defer func(old string) { pciDevicesDir = old }(pciDevicesDir)
+		pciDevicesDir = dir
+
+		addDel(`{"name": "mynet", "type": "host-device", "device": "0000:03:00.1"}`)
+	})
+
+	It("refuses a device whose hwaddr does not match", func() {
+		conf, err := loadConf([]byte(fmt.Sprintf(`{"name": "mynet", "type": "host-device", "device": %q, "hwaddr": "02:00:00:00:00:01"}`, HOST_DEV)))
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			_, err := findLink(conf)
+			return err
+		})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("moves the device back even if IPAM DEL fails", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "eth1",
+			StdinData:   []byte(`{"name": "mynet", "type": "host-device", "device": "dev0", "ipam": {"type": "does-not-exist"}}`),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := moveLinkIn(hostDev, targetNS, "eth1")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = testutils.CmdDelWithResult(targetNS.Path(), "eth1", func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = netlink.LinkByName(HOST_DEV)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("succeeds on a repeated DEL", func() {
+		conf := fmt.Sprintf(`{"name": "mynet", "type": "host-device", "device": %q}`, HOST_DEV)
+		addDel(conf)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "eth1",
+			StdinData:   []byte(conf),
+		}
+		err := originalNS.Do(func(ns.NetNS) error {
+			return testutils.CmdDelWithResult(targetNS.Path(), "eth1", func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("restores the device name when the netns is already gone", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/var/run/netns/does-not-exist",
+			IfName:      "eth1",
+			StdinData:   []byte(fmt.Sprintf(`{"name": "mynet", "type": "host-device", "device": %q}`, HOST_DEV)),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			// leave the device as the kernel returns it with the netns
+			Expect(ip.LinkSetAlias(hostDev, HOST_DEV)).To(Succeed())
+			Expect(netlink.LinkSetName(hostDev, "eth1")).To(Succeed())
+
+			err := testutils.CmdDelWithResult(args.Netns, "eth1", func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			link, err := netlink.LinkByName(HOST_DEV)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ip.LinkAlias(link)).To(Equal(""))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
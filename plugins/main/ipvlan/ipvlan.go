@@ -28,6 +28,10 @@ import (
 	"github.com/vishvananda/netlink"
 )
 
+// ipvlanModeL3S is IPVLAN_MODE_L3S from linux/if_link.h, which the
+// vendored netlink package does not define
+const ipvlanModeL3S netlink.IPVlanMode = 2
+
 type NetConf struct {
 	types.NetConf
 	Master string `json:"master"`
@@ -50,6 +54,9 @@ func loadConf(bytes []byte) (*NetConf, error) {
 	if n.Master == "" {
 		return nil, fmt.Errorf(`"master" field is required. It specifies the host interface name to virtualize`)
 	}
+	if _, err := modeFromString(n.Mode); err != nil {
+		return nil, err
+	}
 	return n, nil
 }
 
@@ -59,8 +66,25 @@ func modeFromString(s string) (netlink.IPVlanMode, error) {
 		return netlink.IPVLAN_MODE_L2, nil
 	case "l3":
 		return netlink.IPVLAN_MODE_L3, nil
+	case "l3s":
+		return ipvlanModeL3S, nil
 	default:
-		return 0, fmt.Errorf("unknown ipvlan mode: %q", s)
+		return 0, fmt.Errorf("unknown ipvlan mode %q, must be one of l2, l3 or l3s", s)
+	}
+}
+
+// removeGateways turns the routes of result into device routes. In the
+// L3 modes the master routes the packets of the container and neighbour
+// discovery does not work, so a gateway could never be resolved.
+func removeGateways(result *types.Result) {
+	for _, ipc := range []*types.IPConfig{result.IP4, result.IP6} {
+		if ipc == nil {
+			continue
+		}
+		ipc.Gateway = nil
+		for i := range ipc.Routes {
+			ipc.Routes[i].GW = nil
+		}
 	}
 }
 
@@ -129,16 +153,19 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if result.IP4 == nil {
 		return errors.New("IPAM plugin returned missing IPv4 config")
 	}
+	if n.Mode == "l3" || n.Mode == "l3s" {
+		removeGateways(result)
+	}
 
 	err = netns.Do(func(_ ns.NetNS) error {
-		return ipam.ConfigureIface(args.IfName, result)
+		return ipam.ConfigureIfaceWithOptions(args.IfName, result, ipam.Options{SkipConflictCheck: n.IPAM.SkipConflictCheck, AddressScope: n.AddressScope})
 	})
 	if err != nil {
 		return err
 	}
 
 	result.DNS = n.DNS
-	return result.Print()
+	return args.PrintResult(result)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
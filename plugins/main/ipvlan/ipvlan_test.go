@@ -16,6 +16,7 @@ package main
 
 import (
 	"fmt"
+	"net"
 
 	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/containernetworking/cni/pkg/skel"
@@ -61,40 +62,71 @@ var _ = Describe("ipvlan Operations", func() {
 	})
 
 	It("creates an ipvlan link in a non-default namespace", func() {
-		conf := &NetConf{
-			NetConf: types.NetConf{
-				Name: "testConfig",
-				Type: "ipvlan",
-			},
-			Master: MASTER_NAME,
-			Mode:   "l2",
-			MTU:    1500,
-		}
+		for mode, expected := range map[string]netlink.IPVlanMode{
+			"l2":  netlink.IPVLAN_MODE_L2,
+			"l3":  netlink.IPVLAN_MODE_L3,
+			"l3s": ipvlanModeL3S,
+		} {
+			conf := &NetConf{
+				NetConf: types.NetConf{
+					Name: "testConfig",
+					Type: "ipvlan",
+				},
+				Master: MASTER_NAME,
+				Mode:   mode,
+				MTU:    1500,
+			}
 
-		// Create ipvlan in other namespace
-		targetNs, err := ns.NewNS()
-		Expect(err).NotTo(HaveOccurred())
-		defer targetNs.Close()
+			// Create ipvlan in other namespace
+			targetNs, err := ns.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+			defer targetNs.Close()
 
-		err = originalNS.Do(func(ns.NetNS) error {
-			defer GinkgoRecover()
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
 
-			err := createIpvlan(conf, "foobar0", targetNs)
+				err := createIpvlan(conf, "foobar0", targetNs)
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
 			Expect(err).NotTo(HaveOccurred())
-			return nil
-		})
-		Expect(err).NotTo(HaveOccurred())
-
-		// Make sure ipvlan link exists in the target namespace
-		err = targetNs.Do(func(ns.NetNS) error {
-			defer GinkgoRecover()
 
-			link, err := netlink.LinkByName("foobar0")
+			// Make sure ipvlan link exists in the target namespace
+			err = targetNs.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName("foobar0")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().Name).To(Equal("foobar0"))
+				ipv, ok := link.(*netlink.IPVlan)
+				Expect(ok).To(BeTrue(), mode)
+				Expect(ipv.Mode).To(Equal(expected), mode)
+				return nil
+			})
 			Expect(err).NotTo(HaveOccurred())
-			Expect(link.Attrs().Name).To(Equal("foobar0"))
-			return nil
-		})
+		}
+	})
+
+	It("rejects an unknown mode", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "ipvlan", "master": "eth0", "mode": "l4"}`))
+		Expect(err).To(MatchError(`unknown ipvlan mode "l4", must be one of l2, l3 or l3s`))
+	})
+
+	It("turns the routes into device routes", func() {
+		ipn, err := types.ParseCIDR("10.1.2.3/24")
 		Expect(err).NotTo(HaveOccurred())
+		_, defaultNet, _ := net.ParseCIDR("0.0.0.0/0")
+		result := &types.Result{
+			IP4: &types.IPConfig{
+				IP:      *ipn,
+				Gateway: net.ParseIP("10.1.2.1"),
+				Routes:  []types.Route{{Dst: *defaultNet, GW: net.ParseIP("10.1.2.1")}},
+			},
+		}
+
+		removeGateways(result)
+		Expect(result.IP4.Gateway).To(BeNil())
+		Expect(result.IP4.Routes).To(Equal([]types.Route{{Dst: *defaultNet}}))
 	})
 
 	It("configures and deconfigures an iplvan link with ADD/DEL", func() {
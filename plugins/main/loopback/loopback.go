@@ -15,15 +15,39 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+
 	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/vishvananda/netlink"
 )
 
+type NetConf struct {
+	types.NetConf
+	MTU int `json:"mtu"`
+}
+
+func loadNetConf(bytes []byte) (*NetConf, error) {
+	n := &NetConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	if n.MTU < 0 {
+		return nil, fmt.Errorf("invalid mtu %d", n.MTU)
+	}
+	return n, nil
+}
+
 func cmdAdd(args *skel.CmdArgs) error {
+	n, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
 	args.IfName = "lo" // ignore config, this only works for loopback
-	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
 		link, err := netlink.LinkByName(args.IfName)
 		if err != nil {
 			return err // not tested
@@ -34,6 +58,12 @@ func cmdAdd(args *skel.CmdArgs) error {
 			return err // not tested
 		}
 
+		if n.MTU != 0 {
+			if err = netlink.LinkSetMTU(link, n.MTU); err != nil {
+				return fmt.Errorf("failed to set the MTU of lo to %d: %v", n.MTU, err)
+			}
+		}
+
 		return nil
 	})
 	if err != nil {
@@ -41,7 +71,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 
 	result := types.Result{}
-	return result.Print()
+	return args.PrintResult(&result)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -49,7 +49,7 @@ var _ = Describe("Loopback", func() {
 			fmt.Sprintf("CNI_ARGS=%s", "none"),
 			fmt.Sprintf("CNI_PATH=%s", "/some/test/path"),
 		}
-		command.Stdin = strings.NewReader("this doesn't matter")
+		command.Stdin = strings.NewReader(`{"name": "lo", "type": "loopback"}`)
 	})
 
 	AfterEach(func() {
@@ -77,6 +77,39 @@ var _ = Describe("Loopback", func() {
 			Expect(lo.Flags & net.FlagUp).To(Equal(net.FlagUp))
 		})
 
+		It("sets the MTU of the lo device", func() {
+			command.Env = append(environ, fmt.Sprintf("CNI_COMMAND=%s", "ADD"))
+			command.Stdin = strings.NewReader(`{"name": "lo", "type": "loopback", "mtu": 16384}`)
+
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(session).Should(gbytes.Say(`{.*}`))
+			Eventually(session).Should(gexec.Exit(0))
+
+			var lo *net.Interface
+			err = networkNS.Do(func(ns.NetNS) error {
+				var err error
+				lo, err = net.InterfaceByName("lo")
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(lo.Flags & net.FlagUp).To(Equal(net.FlagUp))
+			Expect(lo.MTU).To(Equal(16384))
+		})
+
+		It("rejects a malformed config", func() {
+			command.Env = append(environ, fmt.Sprintf("CNI_COMMAND=%s", "ADD"))
+			command.Stdin = strings.NewReader(`{"name": "lo", "type": "loopback", "mtu": "abc"}`)
+
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(session).Should(gbytes.Say(`failed to load netconf`))
+			Eventually(session).Should(gexec.Exit(1))
+		})
+
 		It("sets the lo device to DOWN", func() {
 			command.Env = append(environ, fmt.Sprintf("CNI_COMMAND=%s", "DEL"))
 
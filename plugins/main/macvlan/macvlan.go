@@ -55,6 +55,9 @@ func loadConf(bytes []byte) (*NetConf, error) {
 	if n.Master == "" {
 		return nil, fmt.Errorf(`"master" field is required. It specifies the host interface name to virtualize`)
 	}
+	if _, err := modeFromString(n.Mode); err != nil {
+		return nil, err
+	}
 	return n, nil
 }
 
@@ -69,7 +72,7 @@ func modeFromString(s string) (netlink.MacvlanMode, error) {
 	case "passthru":
 		return netlink.MACVLAN_MODE_PASSTHRU, nil
 	default:
-		return 0, fmt.Errorf("unknown macvlan mode: %q", s)
+		return 0, fmt.Errorf("unknown macvlan mode %q, must be one of bridge, private, vepa or passthru", s)
 	}
 }
 
@@ -149,14 +152,14 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 
 	err = netns.Do(func(_ ns.NetNS) error {
-		return ipam.ConfigureIface(args.IfName, result)
+		return ipam.ConfigureIfaceWithOptions(args.IfName, result, ipam.Options{SkipConflictCheck: n.IPAM.SkipConflictCheck, AddressScope: n.AddressScope})
 	})
 	if err != nil {
 		return err
 	}
 
 	result.DNS = n.DNS
-	return result.Print()
+	return args.PrintResult(result)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -60,6 +60,11 @@ var _ = Describe("macvlan Operations", func() {
 		Expect(originalNS.Close()).To(Succeed())
 	})
 
+	It("rejects an unknown mode", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "macvlan", "master": "eth0", "mode": "passthrough"}`))
+		Expect(err).To(MatchError(`unknown macvlan mode "passthrough", must be one of bridge, private, vepa or passthru`))
+	})
+
 	It("creates an macvlan link in a non-default namespace", func() {
 		conf := &NetConf{
 			NetConf: types.NetConf{
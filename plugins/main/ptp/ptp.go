@@ -21,6 +21,7 @@ import (
 	"net"
 	"os"
 	"runtime"
+	"syscall"
 
 	"github.com/vishvananda/netlink"
 
@@ -45,7 +46,7 @@ type NetConf struct {
 	MTU    int  `json:"mtu"`
 }
 
-func setupContainerVeth(netns, ifName string, mtu int, pr *types.Result) (string, error) {
+func setupContainerVeth(netns, ifName string, mtu int, pr *types.Result, opts ipam.Options) (string, error) {
 	// The IPAM result will be something like IP=192.168.3.5/24, GW=192.168.3.1.
 	// What we want is really a point-to-point link but veth does not support IFF_POINTOPONT.
 	// Next best thing would be to let it ARP but set interface to 192.168.3.5/32 and
@@ -64,7 +65,7 @@ func setupContainerVeth(netns, ifName string, mtu int, pr *types.Result) (string
 			return err
 		}
 
-		if err = ipam.ConfigureIface(ifName, pr); err != nil {
+		if err = ipam.ConfigureIfaceWithOptions(ifName, pr, opts); err != nil {
 			return err
 		}
 
@@ -149,6 +150,24 @@ func setupHostVeth(vethName string, ipConf *types.IPConfig) error {
 	return nil
 }
 
+// teardownHostVeth removes the host route to the container address.
+// The kernel normally flushes it along with the host veth, but a route
+// left behind would shadow the route of the next container to get the
+// same address, as setupHostVeth tolerates an existing one.
+func teardownHostVeth(ipn *net.IPNet) error {
+	route := &netlink.Route{
+		Scope: netlink.SCOPE_HOST,
+		Dst: &net.IPNet{
+			IP:   ipn.IP,
+			Mask: net.CIDRMask(32, 32),
+		},
+	}
+	if err := netlink.RouteDel(route); err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("failed to delete route to %v on host: %v", route.Dst, err)
+	}
+	return nil
+}
+
 func cmdAdd(args *skel.CmdArgs) error {
 	conf := NetConf{}
 	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
@@ -168,7 +187,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return errors.New("IPAM plugin returned missing IPv4 config")
 	}
 
-	hostVethName, err := setupContainerVeth(args.Netns, args.IfName, conf.MTU, result)
+	hostVethName, err := setupContainerVeth(args.Netns, args.IfName, conf.MTU, result, ipam.Options{SkipConflictCheck: conf.IPAM.SkipConflictCheck, AddressScope: conf.AddressScope})
 	if err != nil {
 		return err
 	}
@@ -180,13 +199,13 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if conf.IPMasq {
 		chain := utils.FormatChainName(conf.Name, args.ContainerID)
 		comment := utils.FormatComment(conf.Name, args.ContainerID)
-		if err = ip.SetupIPMasq(&result.IP4.IP, chain, comment); err != nil {
+		if err = ip.NewMasqBackend().SetupIPMasq(&result.IP4.IP, chain, comment); err != nil {
 			return err
 		}
 	}
 
 	result.DNS = conf.DNS
-	return result.Print()
+	return args.PrintResult(result)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -213,10 +232,14 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
+	if err = teardownHostVeth(ipn); err != nil {
+		return err
+	}
+
 	if conf.IPMasq {
 		chain := utils.FormatChainName(conf.Name, args.ContainerID)
 		comment := utils.FormatComment(conf.Name, args.ContainerID)
-		if err = ip.TeardownIPMasq(ipn, chain, comment); err != nil {
+		if err = ip.TeardownMasq(ipn, chain, comment); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,250 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/ipam"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	maxVNI = 1<<24 - 1
+
+	// defaultPort is the IANA assigned VXLAN port; Linux defaults to
+	// the port that predates it
+	defaultPort = 4789
+)
+
+type NetConf struct {
+	types.NetConf
+	VxlanID  int    `json:"vxlanID"`
+	VtepIP   string `json:"vtepIP"`
+	VtepDev  string `json:"vtepDev"`
+	Port     int    `json:"port"`
+	Learning bool   `json:"learning"`
+	MTU      int    `json:"mtu"`
+	// MulticastGroup replaces VtepIP: the traffic to unknown and
+	// broadcast MACs is sent to the group, on MulticastInterface if set
+	MulticastGroup     string `json:"multicastGroup"`
+	MulticastInterface string `json:"multicastInterface"`
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadConf(bytes []byte) (*NetConf, error) {
+	n := &NetConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	if n.VxlanID < 0 || n.VxlanID > maxVNI {
+		return nil, fmt.Errorf("invalid vxlanID %d, must be between 0 and %d", n.VxlanID, maxVNI)
+	}
+	if n.MulticastGroup != "" {
+		if n.VtepIP != "" {
+			return nil, errors.New("vtepIP and multicastGroup are mutually exclusive")
+		}
+		if group := net.ParseIP(n.MulticastGroup); group == nil || !group.IsMulticast() {
+			return nil, fmt.Errorf("invalid multicastGroup %q, must be a multicast IP address", n.MulticastGroup)
+		}
+		if n.MulticastInterface != "" && n.VtepDev != "" {
+			return nil, errors.New("vtepDev and multicastInterface are mutually exclusive")
+		}
+	} else {
+		if n.MulticastInterface != "" {
+			return nil, errors.New("multicastInterface requires multicastGroup")
+		}
+		if net.ParseIP(n.VtepIP) == nil {
+			return nil, fmt.Errorf(`"vtepIP" field is required. It specifies the IP address of the remote VTEP`)
+		}
+	}
+	if n.Port < 0 || n.Port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", n.Port)
+	}
+	if n.Port == 0 {
+		n.Port = defaultPort
+	}
+	return n, nil
+}
+
+// createVxlan creates a vxlan link named ifName in netns. Its socket stays
+// in the current netns, sending through vtepDev if set. With learning the
+// remote VTEP is the default destination and the link learns where MACs
+// are; without it the default destination is a static FDB entry. With a
+// multicast group the link always learns, and it joins the group on
+// multicastInterface once up.
+func createVxlan(conf *NetConf, ifName string, netns ns.NetNS) error {
+	vtepIP := net.ParseIP(conf.VtepIP)
+	multicast := conf.MulticastGroup != ""
+	vxlan := &netlink.Vxlan{
+		VxlanId:  conf.VxlanID,
+		Port:     conf.Port,
+		Learning: conf.Learning || multicast,
+	}
+	switch {
+	case multicast:
+		vxlan.Group = net.ParseIP(conf.MulticastGroup)
+	case conf.Learning:
+		// a unicast group is the remote VTEP, as in `ip link add ... remote`
+		vxlan.Group = vtepIP
+	}
+
+	devName, devField := conf.VtepDev, "vtepDev"
+	if conf.MulticastInterface != "" {
+		devName, devField = conf.MulticastInterface, "multicastInterface"
+	}
+	if devName != "" {
+		dev, err := netlink.LinkByName(devName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %s %q: %v", devField, devName, err)
+		}
+		vxlan.VtepDevIndex = dev.Attrs().Index
+	}
+
+	// create with a temporary name so that it does not collide
+	// with an interface of the same name on the host
+	tmpName, err := ip.RandomVethName()
+	if err != nil {
+		return err
+	}
+	vxlan.LinkAttrs = netlink.LinkAttrs{
+		MTU:       conf.MTU,
+		Name:      tmpName,
+		Namespace: netlink.NsFd(int(netns.Fd())),
+	}
+
+	if err := netlink.LinkAdd(vxlan); err != nil {
+		return fmt.Errorf("failed to create vxlan: %v", err)
+	}
+
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(tmpName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", tmpName, err)
+		}
+
+		if err := netlink.LinkSetName(link, ifName); err != nil {
+			_ = netlink.LinkDel(link)
+			return fmt.Errorf("failed to rename vxlan to %q: %v", ifName, err)
+		}
+
+		if multicast {
+			// the kernel joins the group when the link comes up
+			if err := netlink.LinkSetUp(link); err != nil {
+				_ = netlink.LinkDel(link)
+				return fmt.Errorf("failed to set %q up to join multicast group %s: %v", ifName, conf.MulticastGroup, err)
+			}
+		} else if !conf.Learning {
+			if err := addDefaultFDB(link, vtepIP); err != nil {
+				_ = netlink.LinkDel(link)
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// addDefaultFDB sends the traffic of link to unknown and broadcast MACs to
+// the VTEP at dst.
+// Equivalent to: `bridge fdb append 00:00:00:00:00:00 dev $link dst $dst`
+func addDefaultFDB(link netlink.Link, dst net.IP) error {
+	err := netlink.NeighAppend(&netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       syscall.AF_BRIDGE,
+		State:        netlink.NUD_PERMANENT,
+		Flags:        netlink.NTF_SELF,
+		IP:           dst,
+		HardwareAddr: make(net.HardwareAddr, 6),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add the FDB entry of %v to %q: %v", dst, link.Attrs().Name, err)
+	}
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	if err = createVxlan(n, args.IfName, netns); err != nil {
+		return err
+	}
+
+	// run the IPAM plugin and get back the config to apply
+	result, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+	if err != nil {
+		return err
+	}
+	if result.IP4 == nil {
+		return errors.New("IPAM plugin returned missing IPv4 config")
+	}
+
+	err = netns.Do(func(_ ns.NetNS) error {
+		return ipam.ConfigureIfaceWithOptions(args.IfName, result, ipam.Options{SkipConflictCheck: n.IPAM.SkipConflictCheck, AddressScope: n.AddressScope})
+	})
+	if err != nil {
+		return err
+	}
+
+	result.DNS = n.DNS
+	return args.PrintResult(result)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	err = ipam.ExecDel(n.IPAM.Type, args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	return ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return ip.DelLinkByName(args.IfName)
+	})
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdDel)
+}
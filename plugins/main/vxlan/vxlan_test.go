@@ -0,0 +1,214 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/ns"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("vxlan Operations", func() {
+	var originalNS ns.NetNS
+
+	BeforeEach(func() {
+		// Create a new NetNS so we don't modify the host
+		var err error
+		originalNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+	})
+
+	It("requires a remote VTEP", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "vxlan", "vxlanID": 42}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects an out of range vxlanID", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "vxlan", "vxlanID": 16777216, "vtepIP": "10.0.0.2"}`))
+		Expect(err).To(MatchError("invalid vxlanID 16777216, must be between 0 and 16777215"))
+	})
+
+	It("defaults to the IANA port", func() {
+		conf, err := loadConf([]byte(`{"name": "mynet", "type": "vxlan", "vxlanID": 42, "vtepIP": "10.0.0.2"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Port).To(Equal(4789))
+	})
+
+	It("creates a vxlan link with a static FDB entry without learning", func() {
+		conf, err := loadConf([]byte(`{"name": "mynet", "type": "vxlan", "vxlanID": 42, "vtepIP": "10.0.0.2", "mtu": 1400}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			return createVxlan(conf, "foobar0", targetNs)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName("foobar0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Type()).To(Equal("vxlan"))
+			Expect(link.Attrs().MTU).To(Equal(1400))
+			vxlan := link.(*netlink.Vxlan)
+			Expect(vxlan.VxlanId).To(Equal(42))
+			Expect(vxlan.Port).To(Equal(4789))
+			Expect(vxlan.Learning).To(BeFalse())
+
+			fdb, err := netlink.NeighList(link.Attrs().Index, syscall.AF_BRIDGE)
+			Expect(err).NotTo(HaveOccurred())
+			var dsts []string
+			for _, n := range fdb {
+				if n.HardwareAddr.String() == "00:00:00:00:00:00" {
+					dsts = append(dsts, n.IP.String())
+				}
+			}
+			Expect(dsts).To(ConsistOf("10.0.0.2"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("sends to the remote VTEP with learning", func() {
+		conf, err := loadConf([]byte(`{"name": "mynet", "type": "vxlan", "vxlanID": 42, "vtepIP": "10.0.0.2", "port": 8472, "learning": true}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			return createVxlan(conf, "foobar0", targetNs)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName("foobar0")
+			Expect(err).NotTo(HaveOccurred())
+			vxlan := link.(*netlink.Vxlan)
+			Expect(vxlan.Learning).To(BeTrue())
+			Expect(vxlan.Port).To(Equal(8472))
+			Expect(vxlan.Group.Equal(net.ParseIP("10.0.0.2"))).To(BeTrue())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("validates the multicast options", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "vxlan", "multicastGroup": "239.1.1.1"}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = loadConf([]byte(`{"name": "mynet", "type": "vxlan", "multicastGroup": "10.0.0.2"}`))
+		Expect(err).To(MatchError(`invalid multicastGroup "10.0.0.2", must be a multicast IP address`))
+
+		_, err = loadConf([]byte(`{"name": "mynet", "type": "vxlan", "multicastGroup": "239.1.1.1", "vtepIP": "10.0.0.2"}`))
+		Expect(err).To(MatchError("vtepIP and multicastGroup are mutually exclusive"))
+
+		_, err = loadConf([]byte(`{"name": "mynet", "type": "vxlan", "multicastGroup": "239.1.1.1", "multicastInterface": "eth0", "vtepDev": "eth1"}`))
+		Expect(err).To(MatchError("vtepDev and multicastInterface are mutually exclusive"))
+
+		_, err = loadConf([]byte(`{"name": "mynet", "type": "vxlan", "vtepIP": "10.0.0.2", "multicastInterface": "eth0"}`))
+		Expect(err).To(MatchError("multicastInterface requires multicastGroup"))
+	})
+
+	It("joins the multicast group on the multicast interface", func() {
+		conf, err := loadConf([]byte(`{"name": "mynet", "type": "vxlan", "vxlanID": 42, "multicastGroup": "239.1.1.1", "multicastInterface": "mcast0"}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		targetNs, err := ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNs.Close()
+
+		var devIndex int
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "mcast0"},
+				PeerName:  "mcast1",
+			})).To(Succeed())
+			for _, name := range []string{"mcast0", "mcast1"} {
+				link, err := netlink.LinkByName(name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetUp(link)).To(Succeed())
+				if name == "mcast0" {
+					devIndex = link.Attrs().Index
+				}
+			}
+
+			return createVxlan(conf, "foobar0", targetNs)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName("foobar0")
+			Expect(err).NotTo(HaveOccurred())
+			vxlan := link.(*netlink.Vxlan)
+			Expect(vxlan.Group.Equal(net.ParseIP("239.1.1.1"))).To(BeTrue())
+			Expect(vxlan.VtepDevIndex).To(Equal(devIndex))
+			Expect(vxlan.Learning).To(BeTrue())
+			Expect(link.Attrs().Flags & net.FlagUp).To(Equal(net.FlagUp))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// the socket of the link joined the group in the original netns
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			data, err := ioutil.ReadFile("/proc/thread-self/net/igmp")
+			Expect(err).NotTo(HaveOccurred())
+			// the IGMP table lists the groups joined on each device after
+			// its line, in hex of the host byte order
+			dev := ""
+			joined := false
+			for _, line := range strings.Split(string(data), "\n") {
+				fields := strings.Fields(line)
+				if len(fields) >= 2 && !strings.HasPrefix(line, "\t") {
+					dev = fields[1]
+				} else if len(fields) > 0 && dev == "mcast0" && (fields[0] == "010101EF" || fields[0] == "EF010101") {
+					joined = true
+				}
+			}
+			Expect(joined).To(BeTrue(), string(data))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -144,14 +144,14 @@ func consumeScratchNetConf(containerID string) ([]byte, error) {
 	return ioutil.ReadFile(path)
 }
 
-func delegateAdd(cid string, netconf map[string]interface{}) error {
+func delegateAdd(args *skel.CmdArgs, netconf map[string]interface{}) error {
 	netconfBytes, err := json.Marshal(netconf)
 	if err != nil {
 		return fmt.Errorf("error serializing delegate netconf: %v", err)
 	}
 
 	// save the rendered netconf for cmdDel
-	if err = saveScratchNetConf(cid, netconfBytes); err != nil {
+	if err = saveScratchNetConf(args.ContainerID, netconfBytes); err != nil {
 		return err
 	}
 
@@ -160,7 +160,7 @@ func delegateAdd(cid string, netconf map[string]interface{}) error {
 		return err
 	}
 
-	return result.Print()
+	return args.PrintResult(result)
 }
 
 func hasKey(m map[string]interface{}, k string) bool {
@@ -231,7 +231,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 		},
 	}
 
-	return delegateAdd(args.ContainerID, n.Delegate)
+	return delegateAdd(args, n.Delegate)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
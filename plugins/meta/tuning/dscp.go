@@ -0,0 +1,112 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// netClsRoot is where relative cgroup paths are looked up
+const netClsRoot = "/sys/fs/cgroup/net_cls"
+
+// DSCPRule marks the traffic of a net_cls cgroup with a DSCP value
+type DSCPRule struct {
+	CgroupPath string `json:"cgroupPath"`
+	DSCP       int    `json:"dscp"`
+}
+
+func validateDSCPRules(rules []DSCPRule) error {
+	for _, r := range rules {
+		if r.CgroupPath == "" {
+			return fmt.Errorf("dscpMarkings entries require a cgroupPath")
+		}
+		if r.DSCP < 0 || r.DSCP > 63 {
+			return fmt.Errorf("invalid DSCP value %d for %q, must be between 0 and 63", r.DSCP, r.CgroupPath)
+		}
+	}
+	return nil
+}
+
+// cgroupClassID reads the net_cls class ID of the cgroup, which the
+// iptables cgroup match compares with that of the sending socket
+func cgroupClassID(cgroupPath string) (uint32, error) {
+	if !filepath.IsAbs(cgroupPath) {
+		cgroupPath = filepath.Join(netClsRoot, cgroupPath)
+	}
+
+	path := filepath.Join(cgroupPath, "net_cls.classid")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	id, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if id == 0 {
+		return 0, fmt.Errorf("cgroup %q has no net_cls class ID", cgroupPath)
+	}
+	return uint32(id), nil
+}
+
+func dscpRuleArgs(classID uint32, dscp int, comment string) []string {
+	return []string{
+		"-m", "cgroup", "--cgroup", strconv.FormatUint(uint64(classID), 10),
+		"-j", "DSCP", "--set-dscp", strconv.Itoa(dscp),
+		"-m", "comment", "--comment", comment,
+	}
+}
+
+// checkTOS makes sure the kernel accepts the DSCP value by setting
+// it on a probe socket
+func checkTOS(dscp int) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open probe socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2); err != nil {
+		return fmt.Errorf("failed to set DSCP %d on probe socket: %v", dscp, err)
+	}
+	return nil
+}
+
+// setupDSCPMarkings adds a mangle rule per workload class. It must be
+// called in the container netns, whose rules go away with it.
+func setupDSCPMarkings(rules []DSCPRule, classIDs []uint32, comment string) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	for i, r := range rules {
+		if err := checkTOS(r.DSCP); err != nil {
+			return err
+		}
+		if err := ipt.AppendUnique("mangle", "OUTPUT", dscpRuleArgs(classIDs[i], r.DSCP, comment)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -21,30 +21,252 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 
+	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ip"
 	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/utils"
+	"github.com/vishvananda/netlink"
 )
 
 // TuningConf represents the network tuning configuration.
 type TuningConf struct {
 	types.NetConf
-	SysCtl map[string]string `json:"sysctl"`
+	SysCtl       map[string]string `json:"sysctl"`
+	Netem        *NetemConf        `json:"netem"`
+	DSCPMarkings []DSCPRule        `json:"dscpMarkings"`
+	HugePages    bool              `json:"enableHugePages"`
+	PortRangeMin int               `json:"localPortRangeMin"`
+	PortRangeMax int               `json:"localPortRangeMax"`
+	AddrLabels   []AddrLabel       `json:"addrLabels"`
+	UDPGSO       bool              `json:"udpGSO"`
+
+	TCPSynRetries    *int `json:"tcpSynRetries"`
+	TCPSynAckRetries *int `json:"tcpSynackRetries"`
+	TCPFinTimeout    *int `json:"tcpFinTimeout"`
+	TCPTimewaitReuse *int `json:"tcpTimewaitReuse"`
+}
+
+// tcpSysctl is a TCP sysctl of the container, its configuration key and
+// its allowed values
+type tcpSysctl struct {
+	key      string
+	path     string
+	value    *int
+	min, max int
+}
+
+// tcpSysctls returns the TCP sysctls of the configuration, set or not
+func (c *TuningConf) tcpSysctls() []tcpSysctl {
+	return []tcpSysctl{
+		{"tcpSynRetries", "/proc/sys/net/ipv4/tcp_syn_retries", c.TCPSynRetries, 1, 127},
+		{"tcpSynackRetries", "/proc/sys/net/ipv4/tcp_synack_retries", c.TCPSynAckRetries, 1, 255},
+		{"tcpFinTimeout", "/proc/sys/net/ipv4/tcp_fin_timeout", c.TCPFinTimeout, 1, math.MaxInt32},
+		{"tcpTimewaitReuse", "/proc/sys/net/ipv4/tcp_tw_reuse", c.TCPTimewaitReuse, 0, 2},
+	}
+}
+
+// localPortRangePath holds the range of the ephemeral ports of the
+// network namespace, shared by all the containers using it
+const localPortRangePath = "/proc/sys/net/ipv4/ip_local_port_range"
+
+// Kernel defaults of the ephemeral port range, used for the bound that
+// is not configured
+const (
+	defaultLocalPortRangeMin = 32768
+	defaultLocalPortRangeMax = 60999
+)
+
+// udpGSOFeature is the offload feature segmenting UDP packets sent with
+// UDP_SEGMENT, NETIF_F_GSO_UDP_L4
+const udpGSOFeature = "tx-udp-segmentation"
+
+// hugePageSize is the size of the hugepages socket buffers are aligned to
+const hugePageSize = 2 << 20
+
+// tcpBufferSysctls hold the "min default max" buffer sizes of the TCP
+// sockets of the network namespace
+var tcpBufferSysctls = []string{
+	"/proc/sys/net/ipv4/tcp_rmem",
+	"/proc/sys/net/ipv4/tcp_wmem",
+}
+
+// NetemConf represents the network emulation applied to the container
+// interface. Delays are in milliseconds, loss and duplicate are
+// probabilities between 0.0 and 1.0.
+type NetemConf struct {
+	Delay       int     `json:"delay"`
+	DelayJitter int     `json:"delayJitter"`
+	Loss        float64 `json:"loss"`
+	Duplicate   float64 `json:"duplicate"`
+}
+
+// AddrLabel labels a prefix for the source address selection of the
+// container, see ip-addrlabel(8)
+type AddrLabel struct {
+	Prefix string `json:"prefix"`
+	Label  int    `json:"label"`
+}
+
+// maxAddrLabel is the largest label, 0xffffffff being reserved by the kernel
+const maxAddrLabel = 0xfffffffe
+
+// addrLabels parses the address labels of the configuration
+func (c *TuningConf) addrLabels() ([]*ip.AddrLabel, error) {
+	labels := make([]*ip.AddrLabel, 0, len(c.AddrLabels))
+	for _, l := range c.AddrLabels {
+		_, prefix, err := net.ParseCIDR(l.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid addrLabels prefix %q: %v", l.Prefix, err)
+		}
+		if prefix.IP.To4() != nil {
+			return nil, fmt.Errorf("invalid addrLabels prefix %q: the kernel only labels IPv6 prefixes", l.Prefix)
+		}
+		if l.Label < 0 || l.Label > maxAddrLabel {
+			return nil, fmt.Errorf("invalid label %d for %q, must be between 0 and %d", l.Label, l.Prefix, maxAddrLabel)
+		}
+		labels = append(labels, &ip.AddrLabel{Prefix: prefix, Label: uint32(l.Label)})
+	}
+	return labels, nil
+}
+
+func loadConf(bytes []byte) (*TuningConf, error) {
+	tuningConf := &TuningConf{}
+	if err := json.Unmarshal(bytes, tuningConf); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	if n := tuningConf.Netem; n != nil {
+		if n.Delay < 0 || n.DelayJitter < 0 {
+			return nil, fmt.Errorf("netem delays can not be negative")
+		}
+		if n.Loss < 0 || n.Loss > 1 || n.Duplicate < 0 || n.Duplicate > 1 {
+			return nil, fmt.Errorf("netem loss and duplicate must be between 0.0 and 1.0")
+		}
+	}
+	if err := validateDSCPRules(tuningConf.DSCPMarkings); err != nil {
+		return nil, err
+	}
+	if tuningConf.PortRangeMin != 0 || tuningConf.PortRangeMax != 0 {
+		if tuningConf.PortRangeMin == 0 {
+			tuningConf.PortRangeMin = defaultLocalPortRangeMin
+		}
+		if tuningConf.PortRangeMax == 0 {
+			tuningConf.PortRangeMax = defaultLocalPortRangeMax
+		}
+		if tuningConf.PortRangeMin < 1 || tuningConf.PortRangeMax > 65535 || tuningConf.PortRangeMin > tuningConf.PortRangeMax {
+			return nil, fmt.Errorf("invalid local port range %d-%d", tuningConf.PortRangeMin, tuningConf.PortRangeMax)
+		}
+	}
+	for _, t := range tuningConf.tcpSysctls() {
+		if t.value != nil && (*t.value < t.min || *t.value > t.max) {
+			return nil, fmt.Errorf("invalid %s %d, must be between %d and %d", t.key, *t.value, t.min, t.max)
+		}
+	}
+	if _, err := tuningConf.addrLabels(); err != nil {
+		return nil, err
+	}
+	return tuningConf, nil
+}
+
+func setupNetem(ifName string, n *NetemConf) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	return ip.SetupNetem(link, &ip.Netem{
+		Delay:     uint32(n.Delay * 1000),
+		Jitter:    uint32(n.DelayJitter * 1000),
+		Loss:      n.Loss,
+		Duplicate: n.Duplicate,
+	})
+}
+
+// alignToHugePage rounds size up to a multiple of hugePageSize
+func alignToHugePage(size int) int {
+	return (size + hugePageSize - 1) / hugePageSize * hugePageSize
+}
+
+// alignTCPBuffers rounds the default and maximum sizes of the TCP buffer
+// sysctl at path up to hugepage boundaries, so that socket buffers can be
+// backed by whole hugepages. The socket buffer sizes of the container are
+// only set per namespace, through these sysctls: SO_SNDBUF and SO_RCVBUF
+// are chosen by the application. vm.hugetlb_shm_group is not namespaced
+// and is left alone.
+func alignTCPBuffers(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return fmt.Errorf("unexpected content %q in %s", string(data), path)
+	}
+	sizes := make([]int, 3)
+	for i, f := range fields {
+		if sizes[i], err = strconv.Atoi(f); err != nil {
+			return fmt.Errorf("unexpected content %q in %s", string(data), path)
+		}
+	}
+
+	value := fmt.Sprintf("%d %d %d", sizes[0], alignToHugePage(sizes[1]), alignToHugePage(sizes[2]))
+	return ioutil.WriteFile(path, []byte(value), 0644)
+}
+
+// enableUDPGSO lets QUIC and other UDP applications of the container hand
+// large batches of datagrams to ifName for segmentation. UDP GSO has no
+// sysctl: it is an offload feature of the interface, turned on here if
+// needed. A kernel without UDP GSO only gets a warning, as applications
+// fall back to sending single datagrams.
+func enableUDPGSO(ifName string) error {
+	features, err := ip.LinkFeatures(ifName)
+	if err != nil {
+		return err
+	}
+
+	active, ok := features[udpGSOFeature]
+	if !ok {
+		logrus.Warnf("%q does not support UDP GSO, it needs Linux 4.18 or later", ifName)
+		return nil
+	}
+	if active {
+		return nil
+	}
+	return ip.SetLinkFeature(ifName, udpGSOFeature, true)
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
-	tuningConf := TuningConf{}
-	if err := json.Unmarshal(args.StdinData, &tuningConf); err != nil {
-		return fmt.Errorf("failed to load netconf: %v", err)
+	tuningConf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	labels, err := tuningConf.addrLabels()
+	if err != nil {
+		return err
+	}
+
+	classIDs := make([]uint32, len(tuningConf.DSCPMarkings))
+	for i, r := range tuningConf.DSCPMarkings {
+		if classIDs[i], err = cgroupClassID(r.CgroupPath); err != nil {
+			return err
+		}
 	}
 
 	// The directory /proc/sys/net is per network namespace. Enter in the
 	// network namespace before writing on it.
 
-	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
 		for key, value := range tuningConf.SysCtl {
 			fileName := filepath.Join("/proc/sys", strings.Replace(key, ".", "/", -1))
 			fileName = filepath.Clean(fileName)
@@ -60,21 +282,102 @@ func cmdAdd(args *skel.CmdArgs) error {
 				return err
 			}
 		}
+
+		if tuningConf.HugePages {
+			for _, path := range tcpBufferSysctls {
+				if err := alignTCPBuffers(path); err != nil {
+					return err
+				}
+			}
+		}
+
+		if tuningConf.PortRangeMin != 0 {
+			value := fmt.Sprintf("%d %d", tuningConf.PortRangeMin, tuningConf.PortRangeMax)
+			if err := ioutil.WriteFile(localPortRangePath, []byte(value), 0644); err != nil {
+				return fmt.Errorf("failed to set the local port range: %v", err)
+			}
+		}
+
+		for _, t := range tuningConf.tcpSysctls() {
+			if t.value == nil {
+				continue
+			}
+			if err := ioutil.WriteFile(t.path, []byte(strconv.Itoa(*t.value)), 0644); err != nil {
+				return fmt.Errorf("failed to set %s: %v", t.key, err)
+			}
+		}
+
+		if tuningConf.Netem != nil {
+			if err := setupNetem(args.IfName, tuningConf.Netem); err != nil {
+				return err
+			}
+		}
+
+		if tuningConf.UDPGSO {
+			if err := enableUDPGSO(args.IfName); err != nil {
+				return err
+			}
+		}
+
+		for _, l := range labels {
+			if err := ip.AddAddrLabel(l); err != nil {
+				return fmt.Errorf("failed to add address label %v: %v", l, err)
+			}
+		}
+
+		if len(tuningConf.DSCPMarkings) > 0 {
+			comment := utils.FormatComment(tuningConf.Name, args.ContainerID)
+			return setupDSCPMarkings(tuningConf.DSCPMarkings, classIDs, comment)
+		}
 		return nil
 	})
 	if err != nil {
 		return err
 	}
 
-	result := types.Result{}
-	return result.Print()
+	return args.PrintResult(&types.Result{})
 }
 
 func cmdDel(args *skel.CmdArgs) error {
-	// TODO: the settings are not reverted to the previous values. Reverting the
+	// TODO: the sysctls are not reverted to the previous values. Reverting the
 	// settings is not useful when the whole container goes away but it could be
 	// useful in scenarios where plugins are added and removed at runtime.
-	return nil
+	tuningConf, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if (tuningConf.Netem == nil && len(tuningConf.AddrLabels) == 0) || args.Netns == "" {
+		return nil
+	}
+
+	labels, err := tuningConf.addrLabels()
+	if err != nil {
+		return err
+	}
+
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		for _, l := range labels {
+			if err := ip.DelAddrLabel(l); err != nil && err != syscall.ENOENT && err != syscall.ESRCH {
+				return fmt.Errorf("failed to delete address label %v: %v", l, err)
+			}
+		}
+
+		if tuningConf.Netem == nil {
+			return nil
+		}
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			// the interface is already gone, and the qdisc with it
+			return nil
+		}
+		return ip.TeardownNetem(link)
+	})
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		// the labels and the qdisc went away with the netns
+		return nil
+	}
+	return err
 }
 
 func main() {
@@ -0,0 +1,456 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/ip"
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const IFNAME = "eth0"
+
+var _ = Describe("tuning plugin", func() {
+	var originalNS, targetNS ns.NetNS
+
+	BeforeEach(func() {
+		// Create a new NetNS so we don't modify the host
+		var err error
+		originalNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		targetNS, err = ns.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: IFNAME,
+				},
+				PeerName: "peer0",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(targetNS.Close()).To(Succeed())
+		Expect(originalNS.Close()).To(Succeed())
+	})
+
+	It("rejects an invalid loss probability", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "tuning", "netem": {"loss": 1.5}}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects an out of range DSCP value", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "tuning", "dscpMarkings": [{"cgroupPath": "bulk", "dscp": 64}]}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("builds a DSCP rule for each workload class", func() {
+		cgroupRoot, err := ioutil.TempDir("", "net_cls")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(cgroupRoot)
+
+		classes := []struct {
+			name     string
+			classID  string
+			dscp     int
+			expected []string
+		}{
+			{"latency", "1048577\n", 46, []string{"-m", "cgroup", "--cgroup", "1048577", "-j", "DSCP", "--set-dscp", "46", "-m", "comment", "--comment", "c"}},
+			{"bulk", "1048578\n", 10, []string{"-m", "cgroup", "--cgroup", "1048578", "-j", "DSCP", "--set-dscp", "10", "-m", "comment", "--comment", "c"}},
+			{"scavenger", "1048579\n", 8, []string{"-m", "cgroup", "--cgroup", "1048579", "-j", "DSCP", "--set-dscp", "8", "-m", "comment", "--comment", "c"}},
+		}
+		for _, c := range classes {
+			dir := filepath.Join(cgroupRoot, c.name)
+			Expect(os.Mkdir(dir, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "net_cls.classid"), []byte(c.classID), 0644)).To(Succeed())
+
+			classID, err := cgroupClassID(dir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dscpRuleArgs(classID, c.dscp, "c")).To(Equal(c.expected))
+		}
+	})
+
+	It("aligns the TCP buffer sizes to hugepages", func() {
+		conf := `{
+    "name": "mynet",
+    "type": "tuning",
+    "enableHugePages": true
+}`
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := targetNS.Do(func(ns.NetNS) error {
+			return ioutil.WriteFile("/proc/sys/net/ipv4/tcp_rmem", []byte("4096 131072 6291457"), 0644)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := testutils.CmdAddWithResult(targetNS.Path(), IFNAME, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			rmem, err := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_rmem")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(strings.Fields(string(rmem))).To(Equal([]string{"4096", "2097152", "8388608"}))
+
+			wmem, err := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_wmem")
+			Expect(err).NotTo(HaveOccurred())
+			for _, size := range strings.Fields(string(wmem))[1:] {
+				n, err := strconv.Atoi(size)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(n % hugePageSize).To(Equal(0))
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects an inverted local port range", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "tuning", "localPortRangeMin": 40000, "localPortRangeMax": 30000}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("sets the local port range", func() {
+		conf := `{
+    "name": "mynet",
+    "type": "tuning",
+    "localPortRangeMin": 40000
+}`
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := testutils.CmdAddWithResult(targetNS.Path(), IFNAME, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			portRange, err := ioutil.ReadFile(localPortRangePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(strings.Fields(string(portRange))).To(Equal([]string{"40000", "60999"}))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects an out of range tcpTimewaitReuse", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "tuning", "tcpTimewaitReuse": 3}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("sets the TCP sysctls", func() {
+		conf := `{
+    "name": "mynet",
+    "type": "tuning",
+    "tcpSynRetries": 3,
+    "tcpSynackRetries": 2,
+    "tcpFinTimeout": 15,
+    "tcpTimewaitReuse": 1
+}`
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := testutils.CmdAddWithResult(targetNS.Path(), IFNAME, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for path, expected := range map[string]string{
+				"/proc/sys/net/ipv4/tcp_syn_retries":    "3",
+				"/proc/sys/net/ipv4/tcp_synack_retries": "2",
+				"/proc/sys/net/ipv4/tcp_fin_timeout":    "15",
+				"/proc/sys/net/ipv4/tcp_tw_reuse":       "1",
+			} {
+				value, err := ioutil.ReadFile(path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(strings.TrimSpace(string(value))).To(Equal(expected), path)
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects an IPv4 address label prefix", func() {
+		_, err := loadConf([]byte(`{"name": "mynet", "type": "tuning", "addrLabels": [{"prefix": "10.0.0.0/8", "label": 10}]}`))
+		Expect(err).To(MatchError(`invalid addrLabels prefix "10.0.0.0/8": the kernel only labels IPv6 prefixes`))
+	})
+
+	It("adds and removes the address labels with ADD/DEL", func() {
+		conf := `{
+    "name": "mynet",
+    "type": "tuning",
+    "addrLabels": [
+        {"prefix": "2001:db8:1::/48", "label": 100},
+        {"prefix": "2001:db8:2::/48", "label": 101}
+    ]
+}`
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		labels := func() map[string]uint32 {
+			res := map[string]uint32{}
+			err := targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				labels, err := ip.AddrLabelList()
+				Expect(err).NotTo(HaveOccurred())
+				for _, l := range labels {
+					res[l.Prefix.String()] = l.Label
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return res
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := testutils.CmdAddWithResult(targetNS.Path(), IFNAME, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(labels()).To(HaveKeyWithValue("2001:db8:1::/48", uint32(100)))
+		Expect(labels()).To(HaveKeyWithValue("2001:db8:2::/48", uint32(101)))
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(testutils.CmdDelWithResult(targetNS.Path(), IFNAME, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(labels()).NotTo(HaveKey("2001:db8:1::/48"))
+		Expect(labels()).NotTo(HaveKey("2001:db8:2::/48"))
+	})
+
+	It("enables UDP GSO on the container interface", func() {
+		conf := `{
+    "name": "mynet",
+    "type": "tuning",
+    "udpGSO": true
+}`
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(ip.SetLinkFeature(IFNAME, udpGSOFeature, false)).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := testutils.CmdAddWithResult(targetNS.Path(), IFNAME, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			features, err := ip.LinkFeatures(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(features).To(HaveKeyWithValue(udpGSOFeature, true))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("adds and removes a netem qdisc with ADD/DEL", func() {
+		conf := `{
+    "name": "mynet",
+    "type": "tuning",
+    "netem": {
+        "delay": 100,
+        "delayJitter": 10,
+        "loss": 0.25,
+        "duplicate": 0.5
+    }
+}`
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := targetNS.Do(func(ns.NetNS) error {
+			link, err := netlink.LinkByName(IFNAME)
+			if err != nil {
+				return err
+			}
+			if err = ip.SetupNetem(link, &ip.Netem{}); err != nil {
+				return err
+			}
+			return ip.TeardownNetem(link)
+		})
+		if err != nil {
+			Skip(fmt.Sprintf("the kernel has no netem qdisc: %v", err))
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := testutils.CmdAddWithResult(targetNS.Path(), IFNAME, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+
+			netem, err := ip.GetNetem(link)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netem).NotTo(BeNil())
+			Expect(netem.Delay).To(BeNumerically("~", 100000, 10))
+			Expect(netem.Jitter).To(BeNumerically("~", 10000, 10))
+			Expect(netem.Loss).To(BeNumerically("~", 0.25, 0.001))
+			Expect(netem.Duplicate).To(BeNumerically("~", 0.5, 0.001))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := testutils.CmdDelWithResult(targetNS.Path(), IFNAME, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+
+			netem, err := ip.GetNetem(link)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netem).To(BeNil())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("succeeds on DEL when the netns is already gone", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/var/run/netns/does-not-exist",
+			IfName:      IFNAME,
+			StdinData:   []byte(`{"name": "mynet", "type": "tuning", "netem": {"delay": 100}}`),
+		}
+
+		err := testutils.CmdDelWithResult(args.Netns, IFNAME, func() error {
+			return cmdDel(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})